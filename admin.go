@@ -0,0 +1,231 @@
+package guerrilla
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phires/go-guerrilla/backends"
+)
+
+// ServerInfo describes a server, as listed by the admin API
+type ServerInfo struct {
+	ListenInterface string `json:"listen_interface"`
+	State           string `json:"state"`
+	IsEnabled       bool   `json:"is_enabled"`
+	ActiveClients   int    `json:"active_clients"`
+	MaxClients      int    `json:"max_clients"`
+}
+
+var (
+	errServerNotFound = errors.New("server not found")
+	errClientNotFound = errors.New("client not found")
+	errNoReloader     = errors.New("the config cannot be reloaded, Daemon.ConfigReloader is not set")
+)
+
+// serverInfos returns the servers, sorted by listen interface
+func (g *guerrilla) serverInfos() []ServerInfo {
+	servers := make([]ServerInfo, 0)
+	g.mapServers(func(s *server) {
+		sc := s.configStore.Load().(ServerConfig)
+		servers = append(servers, ServerInfo{
+			ListenInterface: s.listenInterface,
+			State:           serverStateName(s.getState()),
+			IsEnabled:       sc.IsEnabled,
+			ActiveClients:   s.GetActiveClientsCount(),
+			MaxClients:      sc.MaxClients,
+		})
+	})
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ListenInterface < servers[j].ListenInterface })
+	return servers
+}
+
+// startServer starts a server that is stopped, and waits until it listens
+func (g *guerrilla) startServer(s *server) error {
+	switch {
+	case !s.isEnabled():
+		return fmt.Errorf("server [%s] is not enabled", s.listenInterface)
+	case s.getState() != ServerStateNew && s.getState() != ServerStateStopped && s.getState() != ServerStateStartError:
+		return fmt.Errorf("server [%s] is %s", s.listenInterface, serverStateName(s.getState()))
+	}
+	var startWG sync.WaitGroup
+	startWG.Add(1)
+	errs := make(chan error, 1)
+	go func() {
+		g.mainlog().Infof("Starting: %s", s.listenInterface)
+		if err := s.Start(&startWG); err != nil {
+			errs <- err
+		}
+	}()
+	startWG.Wait()
+	if s.getState() == ServerStateStartError {
+		return <-errs
+	}
+	return nil
+}
+
+// startAdmin serves the admin API on http://iface/, if iface is not empty
+func (d *Daemon) startAdmin(iface, token string) error {
+	if iface == "" {
+		return nil
+	}
+	if token == "" {
+		return errors.New("admin_token must be set to serve the admin API")
+	}
+	g, ok := d.g.(*guerrilla)
+	if !ok {
+		return errors.New("the admin API needs the daemon to be started")
+	}
+	listener, err := net.Listen("tcp", iface)
+	if err != nil {
+		return fmt.Errorf("cannot listen on the admin interface: %s", err)
+	}
+	srv := &http.Server{Handler: d.adminHandler(g, token), ReadHeaderTimeout: 10 * time.Second}
+	d.adminGuard.Lock()
+	d.adminServer = srv
+	d.adminGuard.Unlock()
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			d.Log().WithError(err).Error("admin listener failed")
+		}
+	}()
+	d.Log().Infof("Serving the admin API on http://%s/", iface)
+	return nil
+}
+
+// stopAdmin stops serving the admin API
+func (d *Daemon) stopAdmin() {
+	d.adminGuard.Lock()
+	defer d.adminGuard.Unlock()
+	if d.adminServer != nil {
+		_ = d.adminServer.Close()
+		d.adminServer = nil
+	}
+}
+
+// adminHandler returns the handler of the admin API, the requests are authenticated with the token
+func (d *Daemon) adminHandler(g *guerrilla, token string) http.Handler {
+	mux := http.NewServeMux()
+	// server returns the server of the request, or writes an error
+	server := func(w http.ResponseWriter, r *http.Request) *server {
+		s, err := g.findServer(r.PathValue("iface"))
+		if err != nil {
+			writeAdminError(w, http.StatusNotFound, errServerNotFound)
+			return nil
+		}
+		return s
+	}
+
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, g.serverInfos())
+	})
+	mux.HandleFunc("GET /servers/{iface}/clients", func(w http.ResponseWriter, r *http.Request) {
+		if s := server(w, r); s != nil {
+			writeAdminJSON(w, http.StatusOK, s.clients())
+		}
+	})
+	mux.HandleFunc("DELETE /servers/{iface}/clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s := server(w, r)
+		if s == nil {
+			return
+		}
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil || !s.killClient(id) {
+			writeAdminError(w, http.StatusNotFound, errClientNotFound)
+			return
+		}
+		d.Log().Infof("admin API: disconnected client %d of [%s]", id, s.listenInterface)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /servers/{iface}/start", func(w http.ResponseWriter, r *http.Request) {
+		s := server(w, r)
+		if s == nil {
+			return
+		}
+		if err := g.startServer(s); err != nil {
+			writeAdminError(w, http.StatusConflict, err)
+			return
+		}
+		d.Log().Infof("admin API: started [%s]", s.listenInterface)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /servers/{iface}/stop", func(w http.ResponseWriter, r *http.Request) {
+		s := server(w, r)
+		if s == nil {
+			return
+		}
+		if s.getState() != ServerStateRunning && s.getState() != ServerStateDraining {
+			writeAdminError(w, http.StatusConflict, fmt.Errorf("server [%s] is %s", s.listenInterface, serverStateName(s.getState())))
+			return
+		}
+		s.Shutdown()
+		d.Log().Infof("admin API: stopped [%s]", s.listenInterface)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /servers/{iface}/drain", func(w http.ResponseWriter, r *http.Request) {
+		s := server(w, r)
+		if s == nil {
+			return
+		}
+		if s.getState() != ServerStateRunning {
+			writeAdminError(w, http.StatusConflict, fmt.Errorf("server [%s] is %s", s.listenInterface, serverStateName(s.getState())))
+			return
+		}
+		s.Drain()
+		d.Log().Infof("admin API: draining [%s]", s.listenInterface)
+		// the server stops when its clients have left
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("POST /config/reload", func(w http.ResponseWriter, r *http.Request) {
+		if d.ConfigReloader == nil {
+			writeAdminError(w, http.StatusNotImplemented, errNoReloader)
+			return
+		}
+		if err := d.ConfigReloader(); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /logs/reopen", func(w http.ResponseWriter, r *http.Request) {
+		if err := d.ReopenLogs(); err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /backend", func(w http.ResponseWriter, r *http.Request) {
+		status := backends.BackendStatus{State: "unknown"}
+		if b, ok := g.backend().(interface{ Status() backends.BackendStatus }); ok {
+			status = b.Status()
+		}
+		writeAdminJSON(w, http.StatusOK, status)
+	})
+
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-guerrilla"`)
+			writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/phires/go-guerrilla/backends"
@@ -19,9 +21,17 @@ type Daemon struct {
 	Logger  log.Logger
 	Backend backends.Backend
 
+	// ConfigReloader is called by the admin API to reload the config, eg. it reads the config
+	// file and calls ReloadConfig. The admin API cannot reload the config if it is nil
+	ConfigReloader func() error
+
 	// Guerrilla will be managed through the API
 	g Guerrilla
 
+	// adminServer serves the admin API, nil if admin_interface is not set
+	adminServer *http.Server
+	adminGuard  sync.Mutex
+
 	configLoadTime time.Time
 	subs           []deferredSub
 }
@@ -37,6 +47,26 @@ func (d *Daemon) AddProcessor(name string, pc backends.ProcessorConstructor) {
 	backends.Svc.AddProcessor(name, pc)
 }
 
+// AddCommand adds an SMTP command to the servers, or replaces a built-in one. See AddCommand
+func (d *Daemon) AddCommand(verb string, handler CommandHandler) {
+	AddCommand(verb, handler)
+}
+
+// WrapCommand wraps an SMTP command of the servers. See WrapCommand
+func (d *Daemon) WrapCommand(verb string, wrapper CommandWrapper) {
+	WrapCommand(verb, wrapper)
+}
+
+// AddExtension adds a keyword to the EHLO reply of the servers, eg. "ETRN"
+func (d *Daemon) AddExtension(keyword string) {
+	AddExtension(keyword)
+}
+
+// AddHooks adds hooks called by the servers at each stage of an SMTP session. See AddHooks
+func (d *Daemon) AddHooks(h backends.SessionHooks) {
+	AddHooks(h)
+}
+
 // Starts the daemon, initializing d.Config, d.Logger and d.Backend with defaults
 // can only be called once through the lifetime of the program
 func (d *Daemon) Start() (err error) {
@@ -68,13 +98,20 @@ func (d *Daemon) Start() (err error) {
 
 		}
 		d.subs = make([]deferredSub, 0)
+		// the admin listener changed, restart it
+		_ = d.g.Subscribe(EventConfigAdminInterface, func(c *AppConfig) {
+			d.stopAdmin()
+			if err := d.startAdmin(c.AdminInterface, c.AdminToken); err != nil {
+				d.Log().WithError(err).Error("admin listener failed to restart")
+			}
+		})
 	}
 	err = d.g.Start()
 	if err == nil {
 		if err := d.resetLogger(); err == nil {
 			d.Log().Infof("main log configured to %s", d.Config.LogFile)
 		}
-
+		err = d.startAdmin(d.Config.AdminInterface, d.Config.AdminToken)
 	}
 	return err
 }
@@ -82,6 +119,7 @@ func (d *Daemon) Start() (err error) {
 // Shuts down the daemon, including servers and backend.
 // Do not call Start on it again, use a new server.
 func (d *Daemon) Shutdown() {
+	d.stopAdmin()
 	if d.g != nil {
 		d.g.Shutdown()
 	}
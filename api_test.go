@@ -2,11 +2,15 @@ package guerrilla
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,6 +18,7 @@ import (
 	"github.com/phires/go-guerrilla/log"
 	"github.com/phires/go-guerrilla/mail"
 	"github.com/phires/go-guerrilla/response"
+	"github.com/phires/go-guerrilla/tracing"
 )
 
 // Test Starting smtp without setting up logger / backend
@@ -774,3 +779,435 @@ func TestCustomBackendResult(t *testing.T) {
 	}
 
 }
+
+// tantrum panics when the subject is "tantrum"
+var tantrum = func() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskSaveMail && e.Subject == "tantrum" {
+					panic("tantrum")
+				}
+				return p.Process(e, task)
+			})
+	}
+}
+
+// Test the events of the clients, their transactions and the backend
+func TestLifecycleEvents(t *testing.T) {
+	d := Daemon{Config: &AppConfig{
+		LogFile:      "off",
+		AllowedHosts: []string{"grr.la"},
+		BackendConfig: backends.BackendConfig{
+			"save_process": "HeadersParser|Tantrum",
+		},
+	}}
+	d.AddProcessor("Tantrum", tantrum)
+
+	var mu sync.Mutex
+	var got []string
+	record := func(topic Event, detail string) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, topic.String()+" "+detail)
+	}
+	disconnected := make(chan struct{})
+	for _, topic := range []Event{EventClientConnect, EventClientDisconnect} {
+		topic := topic
+		if err := d.Subscribe(topic, func(ev *ConnectionEvent) {
+			record(topic, ev.Server)
+			if topic == EventClientDisconnect {
+				close(disconnected)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, topic := range []Event{EventTransactionStart, EventRcptAccepted, EventRcptRejected, EventMessageAccepted, EventMessageRejected} {
+		topic := topic
+		if err := d.Subscribe(topic, func(ev *TransactionEvent) {
+			record(topic, fmt.Sprintf("%s %s %d %d", ev.MailFrom.String(), ev.Rcpt.String(), ev.Size, ev.Code))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Subscribe(EventWorkerPanic, func(ev *BackendEvent) {
+		record(EventWorkerPanic, fmt.Sprint(ev.Panic, " ", ev.QueuedID != ""))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	conn, err := net.Dial("tcp", d.Config.Servers[0].ListenInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	in := bufio.NewReader(conn)
+	_, _ = in.ReadString('\n')
+	for _, cmd := range []string{
+		"HELO test",
+		"MAIL FROM:<alice@example.com>",
+		"RCPT TO:<bob@funkyhost.com>",
+		"RCPT TO:<bob@grr.la>",
+		"DATA",
+		"Subject: hi\r\n\r\nhi\r\n.",
+		"MAIL FROM:<alice@example.com>",
+		"RCPT TO:<bob@grr.la>",
+		"DATA",
+		"Subject: tantrum\r\n\r\nno\r\n.",
+		"QUIT",
+	} {
+		if _, err := fmt.Fprint(conn, cmd+"\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := in.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting the disconnect event")
+	}
+
+	server := d.Config.Servers[0].ListenInterface
+	want := []string{
+		"client:connect " + server,
+		"transaction:start alice@example.com  0 0",
+		"transaction:rcpt_rejected alice@example.com bob@funkyhost.com 0 454",
+		"transaction:rcpt_accepted alice@example.com bob@grr.la 0 250",
+		"transaction:message_accepted alice@example.com  16 250",
+		"transaction:start alice@example.com  0 0",
+		"transaction:rcpt_accepted alice@example.com bob@grr.la 0 250",
+		"backend:worker_panic tantrum true",
+		"transaction:message_rejected alice@example.com  21 554",
+		"client:disconnect " + server,
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expecting the events\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// TestLifecycleEventsWhileStopping checks that a config change can stop a server that has clients,
+// the clients publish their disconnect events while the config change waits for them to leave
+func TestLifecycleEventsWhileStopping(t *testing.T) {
+	d := Daemon{Config: &AppConfig{LogFile: "off", AllowedHosts: []string{"grr.la"}}}
+	disconnected := make(chan struct{})
+	if err := d.Subscribe(EventClientDisconnect, func(ev *ConnectionEvent) {
+		close(disconnected)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	conn, err := net.Dial("tcp", d.Config.Servers[0].ListenInterface)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := *d.Config
+	cfg.Servers = append([]ServerConfig{}, d.Config.Servers...)
+	cfg.Servers[0].IsEnabled = false
+	reloaded := make(chan error, 1)
+	go func() {
+		reloaded <- d.ReloadConfig(cfg)
+	}()
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the config change did not stop the server")
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting the disconnect event")
+	}
+}
+
+// Test the metrics served on metrics_interface
+func TestMetrics(t *testing.T) {
+	d := Daemon{Config: &AppConfig{
+		LogFile:          "off",
+		AllowedHosts:     []string{"grr.la"},
+		MetricsInterface: "127.0.0.1:9931",
+		BackendConfig: backends.BackendConfig{
+			"save_process": "HeadersParser|Debugger",
+		},
+	}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+	if err := talkToServer("127.0.0.1:2525"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://127.0.0.1:9931/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`guerrilla_connections_total{server="127.0.0.1:2525",result="accepted"} `,
+		`guerrilla_commands_total{server="127.0.0.1:2525",verb="MAIL"} `,
+		`guerrilla_responses_total{server="127.0.0.1:2525",code="250"} `,
+		`guerrilla_message_size_bytes_count{server="127.0.0.1:2525"} `,
+		`guerrilla_processor_duration_seconds_count{processor="headersparser"} `,
+		`guerrilla_server_active_clients{server="127.0.0.1:2525"} 1`,
+		"guerrilla_backend_queue_depth 0",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("expecting the metrics to contain %s, got\n%s", want, b)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := &tracing.MemoryExporter{}
+	tracing.SetExporter(exporter)
+	defer tracing.SetExporter(nil)
+	d := Daemon{Config: &AppConfig{
+		LogFile:      "off",
+		AllowedHosts: []string{"grr.la"},
+		BackendConfig: backends.BackendConfig{
+			"save_process": "HeadersParser|Debugger",
+		},
+	}}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := talkToServer("127.0.0.1:2525"); err != nil {
+		t.Fatal(err)
+	}
+	// the session ends when the server shuts down
+	d.Shutdown()
+
+	spans := make(map[string]*tracing.SpanData)
+	for _, s := range exporter.Spans() {
+		spans[s.Name] = s
+	}
+	session, tx := spans["smtp.session"], spans["smtp.transaction"]
+	if session == nil || tx == nil {
+		t.Fatalf("expecting a session and a transaction span, got %v", spans)
+	}
+	attrs := func(s *tracing.SpanData) map[string]interface{} {
+		m := make(map[string]interface{})
+		for _, a := range s.Attributes {
+			m[a.Key] = a.Value
+		}
+		return m
+	}
+	if attrs(session)["remote_ip"] != "127.0.0.1" {
+		t.Error("expecting the session to have the remote ip, got", attrs(session))
+	}
+	if a := attrs(tx); a["smtp.code"] != int64(250) || a["queued_id"] == "" {
+		t.Error("expecting the transaction to have the code and the queued id, got", a)
+	}
+	parents := map[string]*tracing.SpanData{
+		"smtp.transaction":        session,
+		"SMTP HELO":               session,
+		"SMTP MAIL":               tx,
+		"SMTP RCPT":               tx,
+		"SMTP DATA":               tx,
+		"processor headersparser": nil,
+		"processor debugger":      nil,
+	}
+	for name, parent := range parents {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("expecting a %s span", name)
+			continue
+		}
+		if s.TraceID != session.TraceID {
+			t.Errorf("expecting %s to be in the trace of the session", name)
+		}
+		if parent != nil && s.ParentSpanID != parent.SpanID {
+			t.Errorf("expecting %s to be a child of %s", name, parent.Name)
+		}
+	}
+	// the processors are called in the transaction, the first one is its child
+	if p := spans["processor headersparser"]; p != nil && p.ParentSpanID != tx.SpanID &&
+		spans["processor debugger"].ParentSpanID != tx.SpanID {
+		t.Error("expecting a processor span to be a child of the transaction")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	reloaded := 0
+	d := Daemon{
+		Config: &AppConfig{
+			LogFile:        "off",
+			AllowedHosts:   []string{"grr.la"},
+			AdminInterface: "127.0.0.1:9932",
+			AdminToken:     "secret",
+		},
+		ConfigReloader: func() error {
+			reloaded++
+			return nil
+		},
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Shutdown()
+
+	call := func(method, path, token string, out interface{}) int {
+		req, err := http.NewRequest(method, "http://127.0.0.1:9932"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if out != nil {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	if code := call("GET", "/servers", "", nil); code != http.StatusUnauthorized {
+		t.Error("expecting 401 without the token, got", code)
+	}
+	if code := call("GET", "/servers", "wrong", nil); code != http.StatusUnauthorized {
+		t.Error("expecting 401 with a wrong token, got", code)
+	}
+
+	var servers []ServerInfo
+	if code := call("GET", "/servers", "secret", &servers); code != http.StatusOK {
+		t.Fatal("expecting 200, got", code)
+	}
+	if len(servers) != 1 || servers[0].ListenInterface != "127.0.0.1:2525" || servers[0].State != "running" {
+		t.Error("expecting the server to be running, got", servers)
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	in := bufio.NewReader(conn)
+	if _, err := in.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fmt.Fprint(conn, "HELO admin.test\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	var clients []ClientInfo
+	if code := call("GET", "/servers/127.0.0.1:2525/clients", "secret", &clients); code != http.StatusOK {
+		t.Fatal("expecting 200, got", code)
+	}
+	if len(clients) != 1 || clients[0].Helo != "admin.test" || clients[0].State != "command" ||
+		clients[0].RemoteIP != "127.0.0.1" || clients[0].ConnectedAt.IsZero() {
+		t.Fatal("expecting the client waiting for a command, got", clients)
+	}
+	path := fmt.Sprintf("/servers/127.0.0.1:2525/clients/%d", clients[0].ID)
+	if code := call("DELETE", path, "secret", nil); code != http.StatusNoContent {
+		t.Error("expecting 204 when killing the client, got", code)
+	}
+	if _, err := in.ReadString('\n'); err == nil {
+		t.Error("expecting the client to be disconnected")
+	}
+	if code := call("DELETE", path, "secret", nil); code != http.StatusNotFound {
+		t.Error("expecting 404 for a client that left, got", code)
+	}
+	if code := call("GET", "/servers/127.0.0.1:1/clients", "secret", nil); code != http.StatusNotFound {
+		t.Error("expecting 404 for an unknown server, got", code)
+	}
+
+	var status backends.BackendStatus
+	if code := call("GET", "/backend", "secret", &status); code != http.StatusOK {
+		t.Fatal("expecting 200, got", code)
+	}
+	if status.State != "RunningState" || status.Workers < 1 {
+		t.Error("expecting the backend to be running with workers, got", status)
+	}
+
+	if code := call("POST", "/config/reload", "secret", nil); code != http.StatusNoContent || reloaded != 1 {
+		t.Error("expecting the config to be reloaded, got", code)
+	}
+	if code := call("POST", "/logs/reopen", "secret", nil); code != http.StatusNoContent {
+		t.Error("expecting the logs to be reopened, got", code)
+	}
+
+	// drain with a client connected, the server stops when it leaves
+	conn2, err := net.Dial("tcp", "127.0.0.1:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in2 := bufio.NewReader(conn2)
+	if _, err := in2.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if code := call("POST", "/servers/127.0.0.1:2525/drain", "secret", nil); code != http.StatusAccepted {
+		t.Fatal("expecting 202 when draining, got", code)
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:2525"); err == nil {
+		t.Error("expecting a draining server to refuse new clients")
+	}
+	if _, err := fmt.Fprint(conn2, "NOOP\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := in2.ReadString('\n'); err != nil || !strings.HasPrefix(line, "200") {
+		t.Error("expecting a draining server to serve its clients, got", line, err)
+	}
+	call("GET", "/servers", "secret", &servers)
+	if servers[0].State != "draining" {
+		t.Error("expecting the server to be draining, got", servers[0].State)
+	}
+	_ = conn2.Close()
+	for i := 0; i < 50; i++ {
+		call("GET", "/servers", "secret", &servers)
+		if servers[0].State == "stopped" {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if servers[0].State != "stopped" {
+		t.Fatal("expecting the server to stop when its client left, got", servers[0].State)
+	}
+
+	if code := call("POST", "/servers/127.0.0.1:2525/start", "secret", nil); code != http.StatusNoContent {
+		t.Fatal("expecting 204 when starting, got", code)
+	}
+	if err := talkToServer("127.0.0.1:2525"); err != nil {
+		t.Error("expecting the server to be started,", err)
+	}
+	if code := call("POST", "/servers/127.0.0.1:2525/start", "secret", nil); code != http.StatusConflict {
+		t.Error("expecting 409 when starting a running server, got", code)
+	}
+	if code := call("POST", "/servers/127.0.0.1:2525/stop", "secret", nil); code != http.StatusNoContent {
+		t.Error("expecting 204 when stopping, got", code)
+	}
+	call("GET", "/servers", "secret", &servers)
+	if servers[0].State != "stopped" {
+		t.Error("expecting the server to be stopped, got", servers[0].State)
+	}
+}
@@ -0,0 +1,240 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AttachmentStore saves the contents of attachments, keyed by their hash.
+// Since the key is derived from the content, saving the same content again does nothing
+type AttachmentStore interface {
+	// Put saves the content, if there is nothing saved for the key yet
+	Put(key string, content []byte) error
+	// Get returns the content saved for the key
+	Get(key string) ([]byte, error)
+}
+
+var errAttachmentKey = errors.New("invalid attachment key")
+
+// validAttachmentKey checks that the key is a hex hash, so it is safe for paths and URLs
+func validAttachmentKey(key string) error {
+	if len(key) < 4 {
+		return errAttachmentKey
+	}
+	if _, err := hex.DecodeString(key); err != nil {
+		return errAttachmentKey
+	}
+	return nil
+}
+
+// fileAttachmentStore saves each attachment to a file, in sub-directories named after
+// the first bytes of the key, eg. dir/ab/cd/abcdef...
+type fileAttachmentStore struct {
+	dir string
+}
+
+func newFileAttachmentStore(dir string) (*fileAttachmentStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &fileAttachmentStore{dir: dir}, nil
+}
+
+func (s *fileAttachmentStore) path(key string) string {
+	return filepath.Join(s.dir, key[:2], key[2:4], key)
+}
+
+func (s *fileAttachmentStore) Put(key string, content []byte) error {
+	if err := validAttachmentKey(key); err != nil {
+		return err
+	}
+	path := s.path(key)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a partial file is never seen under the key
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+key)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *fileAttachmentStore) Get(key string) ([]byte, error) {
+	if err := validAttachmentKey(key); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(s.path(key))
+}
+
+// s3AttachmentStore saves each attachment as an object of an S3-compatible bucket,
+// using path-style URLs, eg. https://s3.example.com/bucket/abcdef...
+type s3AttachmentStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	// now is replaced for testing
+	now func() time.Time
+}
+
+func newS3AttachmentStore(endpoint, bucket, region, accessKey, secretKey string, timeout time.Duration) (*s3AttachmentStore, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint [%s]", endpoint)
+	}
+	if bucket == "" {
+		return nil, errors.New("the S3 bucket is missing")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3AttachmentStore{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: timeout},
+		now:       time.Now,
+	}, nil
+}
+
+func (s *s3AttachmentStore) request(method, key string, content []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if content != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	s.sign(req, content)
+	return s.client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 Authorization header
+func (s *s3AttachmentStore) sign(req *http.Request, content []byte) {
+	now := s.now().UTC()
+	date, datetime := now.Format("20060102"), now.Format("20060102T150405Z")
+	payloadHash := sha256.Sum256(content)
+	payload := hex.EncodeToString(payloadHash[:])
+	req.Header.Set("X-Amz-Date", datetime)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if s.accessKey == "" {
+		// anonymous access
+		return
+	}
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Content-Type") != "" {
+		names = []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + datetime + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *s3AttachmentStore) Put(key string, content []byte) error {
+	if err := validAttachmentKey(key); err != nil {
+		return err
+	}
+	// the same attachment is received many times, avoid uploading it again
+	resp, err := s.request(http.MethodHead, key, nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	resp, err = s.request(http.MethodPut, key, content)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("S3 PUT of %s failed with status %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (s *s3AttachmentStore) Get(key string) ([]byte, error) {
+	if err := validAttachmentKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.request(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("S3 GET of %s failed with status %s", key, resp.Status)
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(resp.Body)
+	return buf.Bytes(), err
+}
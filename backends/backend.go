@@ -2,6 +2,7 @@ package backends
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"reflect"
 	"strconv"
@@ -48,6 +49,23 @@ type Backend interface {
 	Start() error
 }
 
+// ContextBackend is implemented by backends that take the context of the transaction,
+// so that the processors can stop when it is cancelled, eg. when the client disconnects
+type ContextBackend interface {
+	Backend
+	// ProcessContext is like Process, with the context of the transaction
+	ProcessContext(ctx context.Context, e *mail.Envelope, task SelectTask) Result
+	// ValidateRcptContext is like ValidateRcpt, with the context of the transaction
+	ValidateRcptContext(ctx context.Context, e *mail.Envelope) RcptError
+}
+
+// Reloader is implemented by backends that can refresh the resources of their processors,
+// such as keys loaded from files, without being restarted
+type Reloader interface {
+	// Reload is called when the config was reloaded, but the backend config did not change
+	Reload() error
+}
+
 type BackendConfig map[string]interface{}
 
 // All config structs extend from this
@@ -115,8 +133,13 @@ type processorShutdowner interface {
 	Shutdown() error
 }
 
+type processorReloader interface {
+	Reload(backendConfig BackendConfig) error
+}
+
 type InitializeWith func(backendConfig BackendConfig) error
 type ShutdownWith func() error
+type ReloadWith func(backendConfig BackendConfig) error
 
 // Satisfy ProcessorInitializer interface
 // So we can now pass an anonymous function that implements ProcessorInitializer
@@ -131,6 +154,12 @@ func (s ShutdownWith) Shutdown() error {
 	return s()
 }
 
+// satisfy ProcessorReloader interface, same concept as InitializeWith type
+func (r ReloadWith) Reload(backendConfig BackendConfig) error {
+	// delegate
+	return r(backendConfig)
+}
+
 type Errors []error
 
 // implement the Error interface
@@ -153,8 +182,11 @@ func convertError(name string) error {
 type service struct {
 	initializers []processorInitializer
 	shutdowners  []processorShutdowner
+	reloaders    []processorReloader
+	hooks        []SessionHooks
 	sync.Mutex
-	mainlog atomic.Value
+	mainlog  atomic.Value
+	notifier atomic.Value
 }
 
 // Get loads the log.logger in an atomic operation. Returns a stderr logger if not able to load
@@ -184,28 +216,63 @@ func (s *service) AddShutdowner(sh processorShutdowner) {
 	s.shutdowners = append(s.shutdowners, sh)
 }
 
-// reset clears the initializers and Shutdowners
+// AddReloader adds a function that implements ProcessorReloader to be called when the config
+// was reloaded but the backend config did not change, eg. to re-read keys from files
+func (s *service) AddReloader(r processorReloader) {
+	s.Lock()
+	defer s.Unlock()
+	s.reloaders = append(s.reloaders, r)
+}
+
+// reset clears the initializers, Shutdowners, Reloaders and session hooks
 func (s *service) reset() {
 	s.shutdowners = make([]processorShutdowner, 0)
 	s.initializers = make([]processorInitializer, 0)
+	s.reloaders = make([]processorReloader, 0)
+	s.hooks = nil
 }
 
 // Initialize initializes all the processors one-by-one and returns any errors.
 // Subsequent calls to Initialize will not call the initializer again unless it failed on the previous call
-// so Initialize may be called again to retry after getting errors
+// so Initialize may be called again to retry after getting errors.
+// An initializer may build processors of its own, their initializers are called in the same call.
 func (s *service) initialize(backend BackendConfig) Errors {
-	s.Lock()
-	defer s.Unlock()
 	var errors Errors
 	failed := make([]processorInitializer, 0)
-	for i := range s.initializers {
-		if err := s.initializers[i].Initialize(backend); err != nil {
-			errors = append(errors, err)
-			failed = append(failed, s.initializers[i])
+	for {
+		s.Lock()
+		pending := s.initializers
+		s.initializers = make([]processorInitializer, 0)
+		s.Unlock()
+		if len(pending) == 0 {
+			break
+		}
+		for i := range pending {
+			if err := pending[i].Initialize(backend); err != nil {
+				errors = append(errors, err)
+				failed = append(failed, pending[i])
+			}
 		}
 	}
 	// keep only the failed initializers
-	s.initializers = failed
+	s.Lock()
+	s.initializers = append(failed, s.initializers...)
+	s.Unlock()
+	return errors
+}
+
+// reload calls all the reloaders and returns any errors.
+// A reloader may build processors of its own, and initialize them with initialize
+func (s *service) reload(backend BackendConfig) Errors {
+	s.Lock()
+	reloaders := s.reloaders
+	s.Unlock()
+	var errors Errors
+	for i := range reloaders {
+		if err := reloaders[i].Reload(backend); err != nil {
+			errors = append(errors, err)
+		}
+	}
 	return errors
 }
 
@@ -224,6 +291,9 @@ func (s *service) shutdown() Errors {
 		}
 	}
 	s.shutdowners = failed
+	// the processors are gone, there is nothing to reload and no hooks to call
+	s.reloaders = make([]processorReloader, 0)
+	s.hooks = nil
 	return errors
 }
 
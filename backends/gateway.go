@@ -1,10 +1,12 @@
 package backends
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"runtime/debug"
@@ -30,12 +32,19 @@ type BackendGateway struct {
 	workStoppers []chan bool
 	processors   []Processor
 	validators   []Processor
+	// ctx is cancelled on shutdown, to abandon the messages being processed
+	ctx    context.Context
+	cancel context.CancelFunc
+	// busy is the number of workers processing a task
+	busy int32
 
 	// controls access to state
 	sync.Mutex
 	State    backendState
 	config   BackendConfig
 	gwConfig *GatewayConfig
+	// stacks are the named stacks of the config, see stack.go
+	stacks map[string]string
 }
 
 type GatewayConfig struct {
@@ -59,6 +68,8 @@ type workerMsg struct {
 	notifyMe chan *notifyMsg
 	// select the task type
 	task SelectTask
+	// ctx is the context of the transaction
+	ctx context.Context
 }
 
 type backendState int
@@ -118,24 +129,56 @@ var workerMsgPool = sync.Pool{
 }
 
 // reset resets a workerMsg that has been borrowed from the pool
-func (w *workerMsg) reset(e *mail.Envelope, task SelectTask) {
+func (w *workerMsg) reset(ctx context.Context, e *mail.Envelope, task SelectTask) {
 	if w.notifyMe == nil {
 		w.notifyMe = make(chan *notifyMsg)
 	}
 	w.e = e
 	w.task = task
+	w.ctx = ctx
+}
+
+// transactionContext returns the context of a transaction with the timeout,
+// it is also cancelled when the backend shuts down
+func (gw *BackendGateway) transactionContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	if gw.ctx != nil {
+		stop := context.AfterFunc(gw.ctx, cancel)
+		return ctx, func() {
+			stop()
+			cancel()
+		}
+	}
+	return ctx, cancel
 }
 
 // Process distributes an envelope to one of the backend workers with a TaskSaveMail task
 func (gw *BackendGateway) Process(e *mail.Envelope, task SelectTask) Result {
+	return gw.ProcessContext(e.Context(), e, task)
+}
+
+// ProcessContext is like Process, the processors get a context derived from ctx,
+// with the gw_save_timeout deadline
+func (gw *BackendGateway) ProcessContext(ctx context.Context, e *mail.Envelope, task SelectTask) Result {
 	if gw.State != BackendStateRunning {
 		return NewResult(response.Canned.FailBackendNotRunning, response.SP, gw.State)
 	}
+	ctx, cancel := gw.transactionContext(ctx, gw.saveTimeout())
+	defer cancel()
 	// borrow a workerMsg from the pool
 	workerMsg := workerMsgPool.Get().(*workerMsg)
-	workerMsg.reset(e, task)
+	workerMsg.reset(ctx, e, task)
 	// place on the channel so that one of the save mail workers can pick it up
-	gw.conveyor <- workerMsg
+	select {
+	case gw.conveyor <- workerMsg:
+	case <-ctx.Done():
+		workerMsgPool.Put(workerMsg)
+		Log().Errorf("Backend has no worker available to save email %s: %s", e.QueuedId, context.Cause(ctx))
+		if ctx.Err() == context.DeadlineExceeded {
+			Svc.notify(NotifyTimeout, e.QueuedId, task)
+		}
+		return NewResult(response.Canned.FailBackendTimeout)
+	}
 	// wait for the save to complete
 	// or timeout
 	select {
@@ -166,8 +209,13 @@ func (gw *BackendGateway) Process(e *mail.Envelope, task SelectTask) Result {
 		Log().Error(err)
 		return NewResult(response.Canned.FailBackendTransaction, response.SP, err)
 
-	case <-time.After(gw.saveTimeout()):
-		Log().Error("Backend has timed out while saving email")
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			Log().Error("Backend has timed out while saving email")
+			Svc.notify(NotifyTimeout, e.QueuedId, task)
+		} else {
+			Log().Warnf("Abandoned saving email %s: %s", e.QueuedId, context.Cause(ctx))
+		}
 		e.Lock() // lock the envelope - it's still processing here, we don't want the server to recycle it
 		go func() {
 			// keep waiting for the backend to finish processing
@@ -182,6 +230,12 @@ func (gw *BackendGateway) Process(e *mail.Envelope, task SelectTask) Result {
 // ValidateRcpt asks one of the workers to validate the recipient
 // Only the last recipient appended to e.RcptTo will be validated.
 func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
+	return gw.ValidateRcptContext(e.Context(), e)
+}
+
+// ValidateRcptContext is like ValidateRcpt, the processors get a context derived from ctx,
+// with the gw_val_rcpt_timeout deadline
+func (gw *BackendGateway) ValidateRcptContext(ctx context.Context, e *mail.Envelope) RcptError {
 	if gw.State != BackendStateRunning {
 		return StorageNotAvailable
 	}
@@ -189,10 +243,20 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 		// no validator processors configured
 		return nil
 	}
+	ctx, cancel := gw.transactionContext(ctx, gw.validateRcptTimeout())
+	defer cancel()
 	// place on the channel so that one of the save mail workers can pick it up
 	workerMsg := workerMsgPool.Get().(*workerMsg)
-	workerMsg.reset(e, TaskValidateRcpt)
-	gw.conveyor <- workerMsg
+	workerMsg.reset(ctx, e, TaskValidateRcpt)
+	select {
+	case gw.conveyor <- workerMsg:
+	case <-ctx.Done():
+		workerMsgPool.Put(workerMsg)
+		if ctx.Err() == context.DeadlineExceeded {
+			Svc.notify(NotifyTimeout, e.QueuedId, TaskValidateRcpt)
+		}
+		return StorageTimeout
+	}
 	// wait for the validation to complete
 	// or timeout
 	select {
@@ -203,7 +267,10 @@ func (gw *BackendGateway) ValidateRcpt(e *mail.Envelope) RcptError {
 		}
 		return nil
 
-	case <-time.After(gw.validateRcptTimeout()):
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			Svc.notify(NotifyTimeout, e.QueuedId, TaskValidateRcpt)
+		}
 		e.Lock()
 		go func() {
 			<-workerMsg.notifyMe
@@ -220,6 +287,10 @@ func (gw *BackendGateway) Shutdown() error {
 	gw.Lock()
 	defer gw.Unlock()
 	if gw.State != BackendStateShuttered {
+		// abandon the messages being processed
+		if gw.cancel != nil {
+			gw.cancel()
+		}
 		// send a signal to all workers
 		gw.stopWorkers()
 		// wait for workers to stop
@@ -250,29 +321,56 @@ func (gw *BackendGateway) Reinitialize() error {
 	return err
 }
 
+// Reload asks the processors to refresh their resources, keeping the existing config
+func (gw *BackendGateway) Reload() error {
+	gw.Lock()
+	defer gw.Unlock()
+	if gw.State != BackendStateRunning {
+		return fmt.Errorf("cannot reload because backend is in %s state", gw.State)
+	}
+	if err := Svc.reload(gw.config); err != nil {
+		return err
+	}
+	return nil
+}
+
 // newStack creates a new Processor by chaining multiple Processors in a call stack
 // Decorators are functions of Decorator type, source files prefixed with p_*
 // Each decorator does a specific task during the processing stage.
 // This function uses the config value save_process or validate_process to figure out which Decorator to use
 func (gw *BackendGateway) newStack(stackConfig string) (Processor, error) {
-	var decorators []Decorator
+	return newStack(stackConfig, gw.stacks)
+}
+
+// newConfigStack builds the stack of a processor's config option, with the named stacks of
+// the backend config. Processors which deliver to a stack of their own (such as Queue) use it
+// in their initializer, the initializers of their stack are then called from within it.
+func newConfigStack(stackConfig string, backendConfig BackendConfig) (Processor, error) {
+	stacks, err := namedStacks(backendConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newStack(stackConfig, stacks)
+}
+
+// newStack builds a processor stack from a config string, eg. "HeadersParser|Header|Debugger".
+// The config may also have branches and the named stacks of stacks, see stack.go.
+func newStack(stackConfig string, stacks map[string]string) (Processor, error) {
 	cfg := strings.ToLower(strings.TrimSpace(stackConfig))
 	if len(cfg) == 0 {
 		//cfg = strings.ToLower(defaultProcessor)
 		return NoopProcessor{}, nil
 	}
-	items := strings.Split(cfg, "|")
-	for i := range items {
-		name := items[len(items)-1-i] // reverse order, since decorators are stacked
-		if makeFunc, ok := processors[name]; ok {
-			decorators = append(decorators, makeFunc())
-		} else {
-			ErrProcessorNotFound = fmt.Errorf("processor [%s] not found", name)
-			return nil, ErrProcessorNotFound
-		}
+	sp := &stackParser{s: cfg, stacks: stacks}
+	decorators, err := sp.chain()
+	if err != nil {
+		return nil, err
+	}
+	if sp.pos != len(cfg) {
+		return nil, sp.errorf("unexpected %q at position %d", cfg[sp.pos], sp.pos)
 	}
-	// build the call-stack of decorators
-	p := Decorate(DefaultProcessor{}, decorators...)
+	// build the call-stack of decorators, in reverse order since decorators are stacked
+	p := Decorate(DefaultProcessor{}, reverseDecorators(decorators)...)
 	return p, nil
 }
 
@@ -287,7 +385,8 @@ func (gw *BackendGateway) loadConfig(cfg BackendConfig) error {
 		return err
 	}
 	gw.gwConfig = bcfg.(*GatewayConfig)
-	return nil
+	gw.stacks, err = namedStacks(cfg)
+	return err
 }
 
 // Initialize builds the workers and initializes each one
@@ -348,6 +447,7 @@ func (gw *BackendGateway) Start() error {
 		gw.workStoppers = make([]chan bool, 0)
 		// set the wait group
 		gw.wg.Add(workersSize)
+		gw.ctx, gw.cancel = context.WithCancel(context.Background())
 
 		for i := 0; i < workersSize; i++ {
 			stop := make(chan bool)
@@ -376,6 +476,37 @@ func (gw *BackendGateway) Start() error {
 	}
 }
 
+// QueueDepth returns the number of tasks waiting for a worker
+func (gw *BackendGateway) QueueDepth() int {
+	gw.Lock()
+	defer gw.Unlock()
+	return len(gw.conveyor)
+}
+
+// BackendStatus is the state of the backend and of its workers
+type BackendStatus struct {
+	State string `json:"state"`
+	// Workers is the number of workers running, Busy the number of them processing a task
+	Workers    int `json:"workers"`
+	Busy       int `json:"busy"`
+	QueueDepth int `json:"queue_depth"`
+}
+
+// Status returns the state of the backend and of its workers
+func (gw *BackendGateway) Status() BackendStatus {
+	gw.Lock()
+	defer gw.Unlock()
+	status := BackendStatus{
+		State:      gw.State.String(),
+		Busy:       int(atomic.LoadInt32(&gw.busy)),
+		QueueDepth: len(gw.conveyor),
+	}
+	if gw.State == BackendStateRunning {
+		status.Workers = gw.workersSize()
+	}
+	return status
+}
+
 // workersSize gets the number of workers to use for saving email by reading the save_workers_size config value
 // Returns 1 if no config value was set
 func (gw *BackendGateway) workersSize() int {
@@ -436,9 +567,15 @@ func (gw *BackendGateway) workDispatcher(
 		if r := recover(); r != nil {
 			Log().Error("worker recovered from panic:", r, string(debug.Stack()))
 
+			queuedID := ""
+			if state == dispatcherStateWorking || state == dispatcherStateNotify {
+				atomic.AddInt32(&gw.busy, -1)
+			}
 			if state == dispatcherStateWorking {
+				queuedID = msg.e.QueuedId
 				msg.notifyMe <- &notifyMsg{err: errors.New("storage failed")}
 			}
+			Svc.notify(NotifyPanic, queuedID, r)
 			state = dispatcherStatePanic
 			return
 		}
@@ -454,17 +591,19 @@ func (gw *BackendGateway) workDispatcher(
 			Log().Infof("stop signal for worker (#%d)", workerId)
 			return
 		case msg = <-workIn:
+			atomic.AddInt32(&gw.busy, 1)
 			state = dispatcherStateWorking // recovers from panic if in this state
 			if msg.task == TaskSaveMail || msg.task == TaskTest {
-				result, err := save.Process(msg.e, msg.task)
+				result, err := ProcessContext(msg.ctx, save, msg.e, msg.task)
 				state = dispatcherStateNotify
 				msg.notifyMe <- &notifyMsg{err: err, result: result, queuedID: msg.e.QueuedId}
 			} else {
-				result, err := validate.Process(msg.e, msg.task)
+				result, err := ProcessContext(msg.ctx, validate, msg.e, msg.task)
 				state = dispatcherStateNotify
 				msg.notifyMe <- &notifyMsg{err: err, result: result}
 			}
 		}
+		atomic.AddInt32(&gw.busy, -1)
 		state = dispatcherStateIdle
 	}
 }
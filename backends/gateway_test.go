@@ -1,12 +1,14 @@
 package backends
 
 import (
+	"context"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/phires/go-guerrilla/log"
 	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/response"
 )
 
 func TestStates(t *testing.T) {
@@ -86,7 +88,7 @@ func TestStartProcessStop(t *testing.T) {
 	e.Data.WriteString("Subject:Test\n\nThis is a test.")
 	notify := make(chan *notifyMsg)
 
-	gateway.conveyor <- &workerMsg{e, notify, TaskSaveMail}
+	gateway.conveyor <- &workerMsg{e, notify, TaskSaveMail, context.Background()}
 
 	// it should not produce any errors
 	// headers (subject) should be parsed.
@@ -111,3 +113,149 @@ func TestStartProcessStop(t *testing.T) {
 		t.Error("Gateway did not shutdown")
 	}
 }
+
+// waitCtxProcessor waits for the context of the transaction to be done
+func waitCtxProcessor() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWithContext(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+			select {
+			case <-ctx.Done():
+				e.Values["waitctx"] = ctx.Err()
+				return NewResult("451 4.3.0 Error: cancelled"), ctx.Err()
+			case <-time.After(time.Second):
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+func TestProcessContext(t *testing.T) {
+	registerProcessors(t, traceProcessors())
+	registerProcessors(t, map[string]ProcessorConstructor{"waitctx": waitCtxProcessor})
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":      "TraceA|WaitCtx",
+		"save_workers_size": 1,
+		"gw_save_timeout":   "100ms",
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gw.Shutdown() }()
+	cb, ok := gw.(ContextBackend)
+	if !ok {
+		t.Fatal("expecting the gateway to take a context")
+	}
+
+	for _, test := range []struct {
+		name   string
+		cancel bool
+		err    error
+	}{
+		{"deadline", false, context.DeadlineExceeded},
+		{"cancelled", true, context.Canceled},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := mail.NewEnvelope("127.0.0.1", 1)
+			e.Data.WriteString("Subject: hi\n\nhi\n")
+			ctx, cancel := context.WithCancel(context.Background())
+			if test.cancel {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			} else {
+				defer cancel()
+			}
+			start := time.Now()
+			if r := cb.ProcessContext(ctx, e, TaskSaveMail); r.Code() < 400 {
+				t.Error("expecting a failure, got", r)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Error("the processing was not abandoned, took", elapsed)
+			}
+			// wait for the worker to let go of the envelope
+			e.Lock()
+			defer e.Unlock()
+			if e.Values["waitctx"] != test.err {
+				t.Errorf("expecting the processor to get %v, got %v", test.err, e.Values["waitctx"])
+			}
+		})
+	}
+}
+
+func TestProcessContextAdapters(t *testing.T) {
+	type key struct{}
+	var got []interface{}
+	last := ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+		got = append(got, e.Context().Value(key{}))
+		return BackendResultOK, nil
+	})
+	withCtx := ProcessWithContext(func(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+		got = append(got, ctx.Value(key{}))
+		return last.Process(e, task)
+	})
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	ctx := context.WithValue(context.Background(), key{}, "tx")
+	if _, err := ProcessContext(ctx, withCtx, e, TaskTest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProcessContext(ctx, last, e, TaskTest); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0] != "tx" || got[1] != "tx" || got[2] != "tx" {
+		t.Error("expecting the context to be passed on, got", got)
+	}
+	if e.Context().Value(key{}) != nil {
+		t.Error("expecting the context of the envelope to be restored")
+	}
+}
+
+// blockHooks refuses the recipients named "blocked"
+type blockHooks struct {
+	BaseHooks
+}
+
+func (blockHooks) OnRcptTo(_ context.Context, e *mail.Envelope) *response.Response {
+	if e.RcptTo[len(e.RcptTo)-1].User == "blocked" {
+		return &response.Response{
+			EnhancedCode: response.BadDestinationMailboxAddress,
+			Class:        response.ClassPermanentFailure,
+		}
+	}
+	return nil
+}
+
+// blockHooksProcessor adds the blockHooks
+func blockHooksProcessor() Decorator {
+	Svc.AddHooks(blockHooks{})
+	return func(p Processor) Processor {
+		return p
+	}
+}
+
+func TestProcessorHooks(t *testing.T) {
+	registerProcessors(t, map[string]ProcessorConstructor{"blockhooks": blockHooksProcessor})
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":      "BlockHooks",
+		"save_workers_size": 1,
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(Svc.Hooks()) != 1 {
+		t.Fatal("expecting the processor to add its hooks, got", Svc.Hooks())
+	}
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.PushRcpt(mail.Address{User: "blocked", Host: "example.com"})
+	if res := Svc.Hooks()[0].OnRcptTo(context.Background(), e); res == nil || res.String()[0] != '5' {
+		t.Error("expecting the recipient to be rejected, got", res)
+	}
+	if err = gw.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if len(Svc.Hooks()) != 0 {
+		t.Error("expecting the hooks to be removed with the processors")
+	}
+}
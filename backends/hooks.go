@@ -0,0 +1,75 @@
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/response"
+)
+
+// SessionHooks are called by the servers at each stage of an SMTP session, so that policy checks
+// such as DNSBL lookups, sender blocklists or quotas can reject a client before the body is read.
+// A hook returns nil to accept the stage, or a response to refuse it: a 4xx reply to tempfail
+// or a 5xx reply to reject. Embed BaseHooks to implement only some of them
+type SessionHooks interface {
+	// OnConnect is called before the greeting. state is nil if the connection is not TLS.
+	// The connection is closed if it is refused
+	OnConnect(ctx context.Context, remoteIP string, state *tls.ConnectionState) *response.Response
+	// OnHelo is called after HELO or EHLO, e.Helo is the name given by the client
+	OnHelo(ctx context.Context, e *mail.Envelope) *response.Response
+	// OnMailFrom is called after MAIL, e.MailFrom is the sender
+	OnMailFrom(ctx context.Context, e *mail.Envelope) *response.Response
+	// OnRcptTo is called after RCPT, before ValidateRcpt. The recipient is the last one in e.RcptTo
+	OnRcptTo(ctx context.Context, e *mail.Envelope) *response.Response
+	// OnDataStart is called after DATA, before the client sends the body
+	OnDataStart(ctx context.Context, e *mail.Envelope) *response.Response
+	// OnDataEnd is called after the body was read, before the message is processed
+	OnDataEnd(ctx context.Context, e *mail.Envelope) *response.Response
+	// OnDisconnect is called when the client is gone
+	OnDisconnect(ctx context.Context, e *mail.Envelope)
+}
+
+// BaseHooks accepts every stage, embed it in a SessionHooks to implement only some of the hooks
+type BaseHooks struct{}
+
+func (BaseHooks) OnConnect(context.Context, string, *tls.ConnectionState) *response.Response {
+	return nil
+}
+
+func (BaseHooks) OnHelo(context.Context, *mail.Envelope) *response.Response {
+	return nil
+}
+
+func (BaseHooks) OnMailFrom(context.Context, *mail.Envelope) *response.Response {
+	return nil
+}
+
+func (BaseHooks) OnRcptTo(context.Context, *mail.Envelope) *response.Response {
+	return nil
+}
+
+func (BaseHooks) OnDataStart(context.Context, *mail.Envelope) *response.Response {
+	return nil
+}
+
+func (BaseHooks) OnDataEnd(context.Context, *mail.Envelope) *response.Response {
+	return nil
+}
+
+func (BaseHooks) OnDisconnect(context.Context, *mail.Envelope) {}
+
+// AddHooks adds session hooks, typically from the constructor of a processor.
+// They are removed with the processors when the backend is rebuilt, eg. after its config changed
+func (s *service) AddHooks(h SessionHooks) {
+	s.Lock()
+	defer s.Unlock()
+	s.hooks = append(s.hooks, h)
+}
+
+// Hooks returns the session hooks added by the processors
+func (s *service) Hooks() []SessionHooks {
+	s.Lock()
+	defer s.Unlock()
+	return s.hooks
+}
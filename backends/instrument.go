@@ -0,0 +1,105 @@
+package backends
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/metrics"
+	"github.com/phires/go-guerrilla/tracing"
+)
+
+var (
+	processorDuration = metrics.Default.Histogram("guerrilla_processor_duration_seconds",
+		"Time spent in each processor, without the processors after it.",
+		metrics.ExponentialBuckets(0.0005, 2, 16), "processor")
+	processorErrors = metrics.Default.Counter("guerrilla_processor_errors_total",
+		"Errors returned by each processor.", "processor")
+	workerPanics = metrics.Default.Counter("guerrilla_worker_panics_total",
+		"Panics recovered by the backend workers.")
+	backendTimeouts = metrics.Default.Counter("guerrilla_backend_timeouts_total",
+		"Tasks of the backend that timed out.", "task")
+)
+
+// instrumentKey is the key of the instrumentCall of a processor in the context
+type instrumentKey struct {
+	name string
+}
+
+// instrumentCall is what the processors after an instrumented one did in a call
+type instrumentCall struct {
+	// spent is the time spent in the processors after it
+	spent int64
+	sync.Mutex
+	// passed is true if the envelope was passed on, nextResult and nextErr came back
+	passed     bool
+	nextResult Result
+	nextErr    error
+}
+
+// failed returns true if the processor itself failed, rather than the next processors
+// whose failure it returned
+func (c *instrumentCall) failed(result Result, err error) bool {
+	if err == nil && (result == nil || result.Code() < 300) {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if !c.passed {
+		return true
+	}
+	if err != nil {
+		return err != c.nextErr
+	}
+	// a result is only compared if its type can be
+	t := reflect.TypeOf(result)
+	return c.nextErr != nil || t != reflect.TypeOf(c.nextResult) || !t.Comparable() || result != c.nextResult
+}
+
+// instrumentDecorator wraps the decorator of a processor to measure its latency and errors,
+// and to trace it in a span, child of the span of the transaction.
+// The time spent in the processors after it is subtracted, it is added up in a value of the context.
+// Only its own errors are counted, not those it returned from the processors after it.
+// When the processor fails, its name is set in e.Values["failed_processor"]
+func instrumentDecorator(name string, d Decorator) Decorator {
+	key := &instrumentKey{name}
+	duration := processorDuration.With(name)
+	failures := processorErrors.With(name)
+	return func(p Processor) Processor {
+		next := ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			start := time.Now()
+			result, err := p.Process(e, task)
+			if call, ok := e.Context().Value(key).(*instrumentCall); ok {
+				atomic.AddInt64(&call.spent, int64(time.Since(start)))
+				call.Lock()
+				call.passed, call.nextResult, call.nextErr = true, result, err
+				call.Unlock()
+			}
+			return result, err
+		})
+		inner := d(next)
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			call := &instrumentCall{}
+			ctx, span := tracing.Start(e.Context(), "processor "+name,
+				tracing.String("task", task.String()), tracing.String("queued_id", e.QueuedId))
+			start := time.Now()
+			result, err := ProcessContext(context.WithValue(ctx, key, call), inner, e, task)
+			duration.Observe((time.Since(start) - time.Duration(atomic.LoadInt64(&call.spent))).Seconds())
+			if result != nil {
+				span.SetAttributes(tracing.Int("smtp.code", result.Code()))
+			}
+			if call.failed(result, err) {
+				e.Values["failed_processor"] = name
+				if err != nil {
+					failures.Inc()
+					span.SetStatus(tracing.StatusError, err.Error())
+				}
+			}
+			span.End()
+			return result, err
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// A processor of a stack config may have options in brackets, eg. "Hasher|SQL[timeout=5s, retries=2, breaker=5]"
+//
+//	timeout=5s   - the processor fails with a temporary error if it takes longer. Its
+//	               context is cancelled, and it is left to finish on a copy of the envelope
+//	retries=2    - the processor is run again when it fails with a temporary error
+//	backoff=1s   - the wait before the first retry, doubled for each retry. Defaults to 100ms
+//	breaker=5    - after this many temporary errors in a row, the circuit breaker opens:
+//	               the processor is not run, and fails fast with a temporary error
+//	cooldown=1m  - how long the breaker stays open, then one message is let through to
+//	               test the processor. Defaults to 30s
+//
+// The timeout only covers the work of the processor before it passes the envelope on to
+// the next processors, and only failures of the processor itself are retried or counted
+// by the breaker. The breakers are shared by the processors with the same name, so that
+// all the workers stop using a backend that is down.
+// When the processor fails, its name is in e.Values["failed_processor"], as for any
+// processor, see instrument.go.
+//
+// Temporary errors are 4xx replies, and the storage errors, except for the replies of
+// checks such as spam or SPF, which are decisions about the message.
+
+var (
+	ErrProcessorTimeout = errors.New("processor timed out")
+	ErrCircuitOpen      = errors.New("circuit breaker open")
+)
+
+const (
+	defaultBackoff  = 100 * time.Millisecond
+	defaultCooldown = 30 * time.Second
+)
+
+type middlewareOptions struct {
+	timeout  time.Duration
+	retries  int
+	backoff  time.Duration
+	breaker  int
+	cooldown time.Duration
+}
+
+func parseMiddlewareOptions(s string) (*middlewareOptions, error) {
+	o := &middlewareOptions{backoff: defaultBackoff, cooldown: defaultCooldown}
+	for _, option := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(option), "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid option [%s]", option)
+		}
+		var err error
+		switch key {
+		case "timeout":
+			o.timeout, err = time.ParseDuration(value)
+		case "backoff":
+			o.backoff, err = time.ParseDuration(value)
+		case "cooldown":
+			o.cooldown, err = time.ParseDuration(value)
+		case "retries":
+			o.retries, err = strconv.Atoi(value)
+		case "breaker":
+			o.breaker, err = strconv.Atoi(value)
+		default:
+			return nil, fmt.Errorf("unknown option [%s]", key)
+		}
+		if err != nil || strings.HasPrefix(value, "-") {
+			return nil, fmt.Errorf("invalid value of option [%s]", key)
+		}
+	}
+	return o, nil
+}
+
+// circuitBreaker counts the temporary errors of a processor
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+	// testing is set while a message tests the processor, after the cooldown
+	testing bool
+	sync.Mutex
+}
+
+var breakers = struct {
+	m map[string]*circuitBreaker
+	sync.Mutex
+}{m: make(map[string]*circuitBreaker)}
+
+// breakerFor returns the circuit breaker of the processors with a name
+func breakerFor(name string) *circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b, ok := breakers.m[name]
+	if !ok {
+		b = &circuitBreaker{}
+		breakers.m[name] = b
+	}
+	return b
+}
+
+// allow returns true if the processor can be run
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.testing {
+		return false
+	}
+	b.testing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures, b.openUntil, b.testing = 0, time.Time{}, false
+}
+
+// failure counts a temporary error, and returns true if the breaker opened
+func (b *circuitBreaker) failure(threshold int, cooldown time.Duration, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+	if b.testing || b.openUntil.IsZero() && b.failures >= threshold {
+		b.openUntil, b.testing = now.Add(cooldown), false
+		return true
+	}
+	return false
+}
+
+// temporaryFailure is true for the failures that are worth a retry
+func temporaryFailure(result Result, err error) bool {
+	switch err {
+	case SpfError, DKIMError, DMARCError, SpamError, VirusError, PolicyError, RuleError, SieveError:
+		return false
+	case StorageNotAvailable, StorageTooBusy, StorageTimeout, StorageError, ErrProcessorTimeout:
+		return true
+	}
+	if result == nil {
+		return err != nil
+	}
+	return result.Code() >= 400 && result.Code() < 500
+}
+
+// middlewareDecorator wraps the decorator of a processor with the options
+func middlewareDecorator(name string, o *middlewareOptions, d Decorator) Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			var b *circuitBreaker
+			if o.breaker > 0 {
+				b = breakerFor(name)
+				if !b.allow(time.Now()) {
+					return NewResult("451 4.3.0 Error: " + name + " is not available, try again later"), ErrCircuitOpen
+				}
+			}
+			for attempt := 0; ; attempt++ {
+				result, err, passed := runProcessor(name, o.timeout, d, p, e, task)
+				if passed {
+					// the failure is not the processor's
+					if b != nil {
+						b.success()
+					}
+					return result, err
+				}
+				temporary := temporaryFailure(result, err)
+				if b != nil {
+					if !temporary {
+						b.success()
+					} else if b.failure(o.breaker, o.cooldown, time.Now()) {
+						Log().Errorf("processor [%s] failed %d times, circuit breaker open for %s", name, o.breaker, o.cooldown)
+						return result, err
+					}
+				}
+				if err == nil && (result == nil || result.Code() < 300) {
+					return result, err
+				}
+				if !temporary || attempt >= o.retries || e.Context().Err() != nil {
+					Log().WithError(err).Warnf("processor [%s] failed for %s: %v", name, e.QueuedId, result)
+					return result, err
+				}
+				wait := o.backoff << attempt
+				Log().WithError(err).Infof("processor [%s] failed for %s, retrying in %s", name, e.QueuedId, wait)
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-e.Context().Done():
+					timer.Stop()
+					return result, err
+				}
+			}
+		})
+	}
+}
+
+// runProcessor runs the processor of the decorator once, on a copy of the envelope.
+// passed is true if it passed the envelope on to the next processors
+func runProcessor(name string, timeout time.Duration, d Decorator, p Processor, e *mail.Envelope, task SelectTask) (
+	result Result, err error, passed bool) {
+	const (
+		running int32 = iota
+		next
+		timedOut
+	)
+	var state int32
+	parent := e.Context()
+	// the next processors run on the copy too, unless the processor timed out,
+	// with the context of the transaction rather than the one with the timeout
+	last := ProcessWith(func(c *mail.Envelope, task SelectTask) (Result, error) {
+		if !atomic.CompareAndSwapInt32(&state, running, next) {
+			return NewResult("451 4.3.0 Error: " + name + " timed out"), ErrProcessorTimeout
+		}
+		return ProcessContext(parent, p, c, task)
+	})
+	// the changes of a failed attempt are dropped
+	c := copyEnvelope(e)
+	if timeout == 0 {
+		result, err = d(last).Process(c, task)
+		if state == next {
+			restoreEnvelope(e, c)
+		} else {
+			c.Data.Reset()
+		}
+		return result, err, state == next
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	type outcome struct {
+		result Result
+		err    error
+	}
+	// buffered, so that a processor that timed out can still finish
+	done := make(chan outcome, 1)
+	go func() {
+		var o outcome
+		defer func() {
+			if r := recover(); r != nil {
+				o.result, o.err = nil, fmt.Errorf("panic: %v", r)
+			}
+			done <- o
+		}()
+		o.result, o.err = ProcessContext(ctx, d(last), c, task)
+	}()
+	select {
+	case o := <-done:
+		passed := atomic.LoadInt32(&state) == next
+		if passed {
+			restoreEnvelope(e, c)
+		} else {
+			c.Data.Reset()
+		}
+		return o.result, o.err, passed
+	case <-ctx.Done():
+		if atomic.CompareAndSwapInt32(&state, running, timedOut) {
+			// the copy is released when the processor finishes
+			go func() {
+				<-done
+				c.Data.Reset()
+			}()
+			if parent.Err() != nil {
+				// the transaction was abandoned
+				return NewResult("451 4.3.0 Error: " + name + " cancelled"), context.Cause(parent), false
+			}
+			Log().Warnf("processor [%s] timed out after %s for %s", name, timeout, e.QueuedId)
+			return NewResult("451 4.3.0 Error: " + name + " timed out"), ErrProcessorTimeout, false
+		}
+		// the next processors are running, they are not timed
+		o := <-done
+		restoreEnvelope(e, c)
+		return o.result, o.err, true
+	}
+}
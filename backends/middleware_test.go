@@ -0,0 +1,215 @@
+package backends
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// flakyFailures is the number of times the flaky processor fails before it works again
+var flakyFailures, flakyCalls int32
+
+// flakyProcessor fails flakyFailures times, then passes the message on
+func flakyProcessor() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			atomic.AddInt32(&flakyCalls, 1)
+			if atomic.AddInt32(&flakyFailures, -1) >= 0 {
+				e.Values["flaky"] = "partial"
+				return NewResult("451 4.3.0 Error: storage not available"), StorageNotAvailable
+			}
+			e.Values["flaky"] = "done"
+			return p.Process(e, task)
+		})
+	}
+}
+
+func newMiddlewareTestGateway(t *testing.T, stack string) Backend {
+	registerProcessors(t, traceProcessors())
+	registerProcessors(t, sleepProcessors())
+	registerProcessors(t, map[string]ProcessorConstructor{"flaky": flakyProcessor})
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":      stack,
+		"save_workers_size": 1,
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	breakers.Lock()
+	breakers.m = make(map[string]*circuitBreaker)
+	breakers.Unlock()
+	atomic.StoreInt32(&flakyCalls, 0)
+	return gw
+}
+
+func newMiddlewareTestEnvelope() *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: hi\n\nhi\n")
+	return e
+}
+
+func TestMiddlewareTimeout(t *testing.T) {
+	gw := newMiddlewareTestGateway(t, "HeadersParser|SleepC[timeout=100ms]|TraceA")
+	defer func() { _ = gw.Shutdown() }()
+
+	e := newMiddlewareTestEnvelope()
+	start := time.Now()
+	r := gw.Process(e, TaskTest)
+	if r.Code() != 451 || !strings.Contains(r.String(), "sleepc timed out") {
+		t.Fatal("expecting a timeout, got", r)
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Error("the timeout was not applied, took", elapsed)
+	}
+	if e.Values["failed_processor"] != "sleepc" || e.Values["trace"] != nil {
+		t.Error("unexpected values", e.Values)
+	}
+
+	// the next processors are not timed
+	gw2 := newMiddlewareTestGateway(t, "HeadersParser|TraceA[timeout=50ms]|SleepA")
+	defer func() { _ = gw2.Shutdown() }()
+	e = newMiddlewareTestEnvelope()
+	if r := gw2.Process(e, TaskTest); r.Code() != 250 {
+		t.Fatal("expecting 250, got", r)
+	}
+	if e.Values["sleepa"] != true || e.Values["trace"] == nil {
+		t.Error("expecting the changes of the processors, got", e.Values)
+	}
+}
+
+func TestMiddlewareRetries(t *testing.T) {
+	gw := newMiddlewareTestGateway(t, "Flaky[retries=2, backoff=10ms]|TraceA")
+	defer func() { _ = gw.Shutdown() }()
+
+	atomic.StoreInt32(&flakyFailures, 2)
+	e := newMiddlewareTestEnvelope()
+	if r := gw.Process(e, TaskTest); r.Code() != 250 {
+		t.Fatal("expecting 250 after the retries, got", r)
+	}
+	if calls := atomic.LoadInt32(&flakyCalls); calls != 3 {
+		t.Error("expecting 3 calls, got", calls)
+	}
+	if e.Values["flaky"] != "done" || e.Values["failed_processor"] != nil {
+		t.Error("unexpected values", e.Values)
+	}
+
+	atomic.StoreInt32(&flakyFailures, 3)
+	e = newMiddlewareTestEnvelope()
+	if r := gw.Process(e, TaskTest); r.Code() != 451 {
+		t.Fatal("expecting 451 when the retries run out, got", r)
+	}
+	if e.Values["failed_processor"] != "flaky" || e.Values["flaky"] != nil {
+		t.Error("unexpected values", e.Values)
+	}
+}
+
+func TestMiddlewareBreaker(t *testing.T) {
+	gw := newMiddlewareTestGateway(t, "Flaky[breaker=2, cooldown=200ms]|TraceA")
+	defer func() { _ = gw.Shutdown() }()
+
+	atomic.StoreInt32(&flakyFailures, 3)
+	for i := 0; i < 3; i++ {
+		if r := gw.Process(newMiddlewareTestEnvelope(), TaskTest); r.Code() != 451 {
+			t.Fatal("expecting 451, got", r)
+		}
+	}
+	if calls := atomic.LoadInt32(&flakyCalls); calls != 2 {
+		t.Error("expecting the breaker to open after 2 calls, got", calls)
+	}
+	time.Sleep(250 * time.Millisecond)
+	// the trial after the cooldown fails, so the breaker opens again
+	if r := gw.Process(newMiddlewareTestEnvelope(), TaskTest); r.Code() != 451 {
+		t.Fatal("expecting 451, got", r)
+	}
+	if r := gw.Process(newMiddlewareTestEnvelope(), TaskTest); !strings.Contains(r.String(), "not available") {
+		t.Fatal("expecting the breaker to be open, got", r)
+	}
+	time.Sleep(250 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if r := gw.Process(newMiddlewareTestEnvelope(), TaskTest); r.Code() != 250 {
+			t.Fatal("expecting the breaker to close, got", r)
+		}
+	}
+	if calls := atomic.LoadInt32(&flakyCalls); calls != 5 {
+		t.Error("expecting 5 calls, got", calls)
+	}
+}
+
+// openSpillFiles returns the number of temporary files of bodies that are open
+func openSpillFiles(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, entry := range entries {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name())); err == nil &&
+			strings.Contains(target, "guerrilla-body-") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSpilledCopiesReleased(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the open files are listed in /proc")
+	}
+	dir := t.TempDir()
+	for _, stack := range []string{
+		// the copies of the branches and of the failed attempt are dropped
+		"{TraceA, TraceB}|Flaky[retries=1, backoff=10ms]|TraceC",
+		// the copies are still used after the timeouts
+		"{TraceA, 10ms: SleepB}",
+		"SleepA[timeout=10ms]",
+	} {
+		gw := newMiddlewareTestGateway(t, stack)
+		atomic.StoreInt32(&flakyFailures, 1)
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.SetSpill(8, dir)
+		e.Data.WriteString("Subject: hi\n\nhi\n")
+		if !e.Data.Spilled() {
+			t.Fatal("expecting the body to be spilled")
+		}
+		gw.Process(e, TaskTest)
+		_ = gw.Shutdown()
+		e.Data.Reset()
+		deadline := time.Now().Add(time.Second)
+		for openSpillFiles(t) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := openSpillFiles(t); n > 0 {
+			t.Errorf("%s: expecting the temporary file to be released, %d open", stack, n)
+		}
+	}
+}
+
+func TestMiddlewareParse(t *testing.T) {
+	registerProcessors(t, traceProcessors())
+	for _, cfg := range []string{
+		"TraceA[timeout=5s",
+		"TraceA[timeout=soon]",
+		"TraceA[retries=-1]",
+		"TraceA[color=red]",
+		"TraceA[timeout]",
+		"@x[timeout=1s]",
+	} {
+		if _, err := newStack(cfg, nil); err == nil {
+			t.Error("expecting an error for", cfg)
+		}
+	}
+	if _, err := newStack("TraceA[timeout=1s, retries=1]|(tls=true => TraceB[breaker=3]; TraceC)|{TraceD[timeout=1s]}", nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,44 @@
+package backends
+
+// Notification is something that happened in the backend, outside the reply to a client
+type Notification int
+
+const (
+	// NotifyTimeout is when a task timed out, the value is the SelectTask
+	NotifyTimeout Notification = iota
+	// NotifyPanic is when a worker recovered from a panic, the value is the value of the panic
+	NotifyPanic
+)
+
+func (n Notification) String() string {
+	switch n {
+	case NotifyTimeout:
+		return "timeout"
+	case NotifyPanic:
+		return "panic"
+	}
+	return "unknown"
+}
+
+// Notifier is called with the notifications of the backend. queuedID is the id of the email,
+// if there was one. It is called by the workers, so it should not block
+type Notifier func(n Notification, queuedID string, value interface{})
+
+// SetNotifier sets the function called with the notifications of the backend
+func (s *service) SetNotifier(fn Notifier) {
+	s.notifier.Store(fn)
+}
+
+// notify counts the notification in the metrics, and calls the notifier if one was set
+func (s *service) notify(n Notification, queuedID string, value interface{}) {
+	switch n {
+	case NotifyTimeout:
+		task, _ := value.(SelectTask)
+		backendTimeouts.With(task.String()).Inc()
+	case NotifyPanic:
+		workerPanics.With().Inc()
+	}
+	if fn, ok := s.notifier.Load().(Notifier); ok && fn != nil {
+		fn(n, queuedID, value)
+	}
+}
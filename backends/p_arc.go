@@ -0,0 +1,62 @@
+package backends
+
+import (
+	"net"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/arc"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: arc
+// ----------------------------------------------------------------------------------
+// Description   : Validates the Authenticated Received Chain (RFC 8617) of the message.
+//
+//	: The result is added to the Authentication-Results header by DMARC, which can
+//	: trust the chain of the sealers listed in dmarc_arc_trusted.
+//	: Place it before DMARC, eg. "HeadersParser|SPF|DKIM|ARC|DMARC"
+//
+// ----------------------------------------------------------------------------------
+// Config Options: none
+// --------------:-------------------------------------------------------------------
+// Input         : e.NewReader()
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["arc"] is set to the *arc.Result
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["arc"] = func() Decorator {
+		return ARC()
+	}
+}
+
+// ARCLookupTXT is used for finding the keys of the ARC signatures. It can be replaced for testing.
+var ARCLookupTXT = net.LookupTXT
+
+// arcVerify validates the chain of the envelope, and saves the result to e.Values["arc"]
+func arcVerify(e *mail.Envelope) *arc.Result {
+	result, err := arc.Verify(e.NewReader(), &arc.VerifyOptions{LookupTXT: ARCLookupTXT})
+	if err != nil {
+		result = &arc.Result{Validation: arc.ChainFail, Reason: err.Error()}
+	}
+	e.Values["arc"] = result
+	return result
+}
+
+func ARC() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			switch task {
+			case TaskSaveMail, TaskTest:
+				result := arcVerify(e)
+				if result.Validation == arc.ChainFail {
+					Log().Infof("ARC chain of %s failed: %s", e.QueuedId, result.Reason)
+				} else {
+					Log().Debugf("ARC chain of %s: %s, instance %d sealed by %s",
+						e.QueuedId, result.Validation, result.Instance, result.Domain)
+				}
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package backends
+
+import (
+	"crypto"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-msgauth/authres"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/arc"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: arcseal
+// ----------------------------------------------------------------------------------
+// Description   : Adds an ARC set (RFC 8617) when forwarding the message, recording the
+//
+//	: authentication results found by the SPF, DKIM, ARC and DMARC processors.
+//	: Place it after them, before the processor that delivers,
+//	: eg. "HeadersParser|SPF|DKIM|ARC|DMARC|ARCSeal|Relay"
+//
+// ----------------------------------------------------------------------------------
+// Config Options: arc_seal_domain string - domain of the key, eg. "example.com"
+//
+//	: arc_seal_selector string - selector of the key, published at
+//	: selector._domainkey.domain
+//	: arc_seal_key string - path to a PEM encoded RSA or Ed25519 private key.
+//	: The key is loaded again when the config is reloaded
+//	: arc_seal_headers string - comma separated headers to sign
+//	: arc_authserv_id string - the authserv-id of the recorded results,
+//	: defaults to primary_mail_host
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Values["spf"], e.Values["dkim"], e.Values["arc"], e.Values["dmarc"]
+// ----------------------------------------------------------------------------------
+// Output        : the ARC set is prepended to e.DeliveryHeader
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["arcseal"] = func() Decorator {
+		return ARCSeal()
+	}
+}
+
+type ARCSealProcessorConfig struct {
+	Domain      string `json:"arc_seal_domain"`
+	Selector    string `json:"arc_seal_selector"`
+	Key         string `json:"arc_seal_key"`
+	Headers     string `json:"arc_seal_headers,omitempty"`
+	AuthServID  string `json:"arc_authserv_id,omitempty"`
+	PrimaryHost string `json:"primary_mail_host,omitempty"`
+}
+
+func ARCSeal() Decorator {
+	var (
+		config  *ARCSealProcessorConfig
+		headers []string
+		signer  crypto.Signer
+		mu      sync.RWMutex
+	)
+	loadKey := func() error {
+		key, err := loadDKIMKey(config.Key)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		signer = key
+		mu.Unlock()
+		return nil
+	}
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ARCSealProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*ARCSealProcessorConfig)
+		if config.AuthServID == "" {
+			config.AuthServID = reportingMTA("", config.PrimaryHost)
+		}
+		for _, h := range strings.Split(config.Headers, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				headers = append(headers, h)
+			}
+		}
+		return loadKey()
+	}))
+
+	Svc.AddReloader(ReloadWith(func(backendConfig BackendConfig) error {
+		if err := loadKey(); err != nil {
+			// keep sealing with the old key
+			return fmt.Errorf("could not reload ARC seal key: %s", err)
+		}
+		Log().Info("reloaded ARC seal key")
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			switch task {
+			case TaskSaveMail, TaskTest:
+				result, ok := e.Values["arc"].(*arc.Result)
+				if !ok {
+					result = arcVerify(e)
+				}
+				mu.RLock()
+				key := signer
+				mu.RUnlock()
+				set, err := arc.Seal(e.NewReader(), &arc.SealOptions{
+					Domain:      config.Domain,
+					Selector:    config.Selector,
+					Signer:      key,
+					HeaderKeys:  headers,
+					AuthResults: authres.Format(config.AuthServID, authResults(e)),
+					Validation:  result.Validation,
+				})
+				if err != nil {
+					Log().WithError(err).Errorf("could not ARC seal %s", e.QueuedId)
+					break
+				}
+				e.DeliveryHeader = set + e.DeliveryHeader
+				Log().Debugf("ARC sealed %s with d=%s s=%s", e.QueuedId, config.Domain, config.Selector)
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package backends
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/arc"
+)
+
+func TestARC(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "arc.pem")
+	records := map[string]string{"arc._domainkey.lists.example.com": writeDKIMTestKey(t, keyPath, false)}
+	lookup := ARCLookupTXT
+	ARCLookupTXT = func(domain string) ([]string, error) {
+		if r, ok := records[domain]; ok {
+			return []string{r}, nil
+		}
+		return nil, errors.New("no such domain")
+	}
+	defer func() { ARCLookupTXT = lookup }()
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+
+	// the mailing list checks the DKIM signature, tags the subject and seals the message
+	registerProcessors(t, map[string]ProcessorConstructor{"arctestsubject": func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				data := strings.Replace(e.Data.String(), "Subject: Is dkim ready?", "Subject: [list] Is dkim ready?", 1)
+				e.Data.Reset()
+				_, _ = e.Data.WriteString(data)
+				return p.Process(e, task)
+			})
+		}
+	}})
+	seal := func(process string) string {
+		gw, err := New(BackendConfig{
+			"save_process":      process,
+			"save_workers_size": 1,
+			"dkim_defer":        true,
+			"arc_seal_domain":   "lists.example.com",
+			"arc_seal_selector": "arc",
+			"arc_seal_key":      keyPath,
+			"primary_mail_host": "lists.example.com",
+		}, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = gw.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = gw.Shutdown() }()
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString(verifiedMailString)
+		if r := gw.Process(e, TaskTest); r.Code() != 250 {
+			t.Error("expecting the message to be sealed, got", r)
+		}
+		if !strings.HasPrefix(e.DeliveryHeader, "ARC-Seal: i=1; a=ed25519-sha256;") ||
+			!strings.Contains(e.DeliveryHeader, "ARC-Authentication-Results: i=1; lists.example.com; dkim=") ||
+			!strings.Contains(e.DeliveryHeader, "arc=none") {
+			t.Fatal("unexpected ARC set", e.DeliveryHeader)
+		}
+		return e.String()
+	}
+	authenticated := seal("HeadersParser|DKIM|ARC|ArcTestSubject|ARCSeal")
+	if !strings.Contains(authenticated, "; dkim=pass header.d=example.com") {
+		t.Fatal("expecting the list to record dkim=pass, got", authenticated)
+	}
+	// the subject was changed before the list checked the signature
+	unauthenticated := seal("HeadersParser|ArcTestSubject|DKIM|ARC|ARCSeal")
+
+	// the receiver trusts the chain of the list when the message fails DMARC, if the list
+	// recorded that the sender was authenticated
+	tests := []struct {
+		name      string
+		forwarded string
+		trusted   string
+		code      int
+	}{
+		{"trusted", authenticated, "other.example.net, lists.example.com", 250},
+		{"not trusted", authenticated, "", 550},
+		{"trusted, not authenticated", unauthenticated, "lists.example.com", 550},
+	}
+	for _, tt := range tests {
+		gw := newDMARCTestGateway(t, BackendConfig{
+			"save_process":      "HeadersParser|DKIM|ARC|DMARC",
+			"save_workers_size": 1,
+			"dkim_defer":        true,
+			"dmarc_arc_trusted": tt.trusted,
+			"primary_mail_host": "mx.grr.la",
+		})
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString(tt.forwarded)
+		r := gw.Process(e, TaskTest)
+		_ = gw.Shutdown()
+		if chain, ok := e.Values["arc"].(*arc.Result); !ok || chain.Validation != arc.ChainPass {
+			t.Fatal(tt.name, "expecting the chain to pass, got", e.Values["arc"])
+		}
+		if !strings.Contains(e.DeliveryHeader, "dkim=fail") || !strings.Contains(e.DeliveryHeader, "arc=pass") {
+			t.Error(tt.name, "unexpected Authentication-Results", e.DeliveryHeader)
+		}
+		if r.Code() != tt.code {
+			t.Errorf("%s: expecting %d, got %s", tt.name, tt.code, r)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package backends
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/mime"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: attachpolicy
+// ----------------------------------------------------------------------------------
+// Description   : Rejects or quarantines messages with attachments that match a rule:
+//
+//	: a blocked extension, a double extension (eg. invoice.pdf.exe), a content
+//	: type that does not match the content, an encrypted archive, archives
+//	: nested too deep, or a file that is too big. The files in zip, tar and
+//	: gzip archives are checked too, and archives that expand too much are
+//	: rejected (zip bombs). Uses the tree of the mimeparser processor, or
+//	: parses the message. The reply names the rule and the file
+//
+// ----------------------------------------------------------------------------------
+// Config Options: policy_action string - "reject" (default) or "quarantine"
+//
+//	: policy_blocked_ext string - comma separated extensions, defaults to
+//	: executables and scripts, eg. "exe,scr,js"
+//	: policy_max_size int - limit of the size of a file in bytes, 0 for none
+//	: policy_max_nesting int - limit of nested archives, defaults to 3
+//	: policy_max_ratio int - limit of the expansion of an archive, defaults to 100
+//	: policy_max_unpacked int - limit of the bytes unpacked from the archives
+//	: of a message, defaults to 100MB
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.Values["mime"]
+// ----------------------------------------------------------------------------------
+// Output        : with quarantine, e.Values["quarantine"] is set to the reason and an
+//
+//	: X-Quarantine header is prepended to e.DeliveryHeader
+//
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["attachpolicy"] = func() Decorator {
+		return AttachPolicy()
+	}
+}
+
+type AttachPolicyProcessorConfig struct {
+	Action      string `json:"policy_action,omitempty"`
+	BlockedExt  string `json:"policy_blocked_ext,omitempty"`
+	MaxSize     int    `json:"policy_max_size,omitempty"`
+	MaxNesting  int    `json:"policy_max_nesting,omitempty"`
+	MaxRatio    int    `json:"policy_max_ratio,omitempty"`
+	MaxUnpacked int    `json:"policy_max_unpacked,omitempty"`
+}
+
+const (
+	policyDefaultBlockedExt = "exe,com,scr,pif,bat,cmd,vbs,vbe,js,jse,wsf,wsh,msi,msp,cpl,hta,jar,lnk,ps1,reg,dll,iso,img"
+	policyDefaultMaxNesting = 3
+	policyDefaultMaxRatio   = 100
+	policyDefaultMaxUnpack  = 100 << 20 // 100MB
+)
+
+// policyDocumentExt are the extensions used to disguise executables, eg. invoice.pdf.exe
+var policyDocumentExt = map[string]bool{
+	"pdf": true, "doc": true, "docx": true, "xls": true, "xlsx": true, "ppt": true, "pptx": true,
+	"txt": true, "rtf": true, "odt": true, "jpg": true, "jpeg": true, "png": true, "gif": true,
+	"mp3": true, "mp4": true, "avi": true, "zip": true, "htm": true, "html": true,
+}
+
+// policyViolation is a rule that matched
+type policyViolation struct {
+	rule string
+	file string
+}
+
+func (v *policyViolation) Error() string {
+	// the name is from the message, keep it on one line
+	file := strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return '?'
+		}
+		return r
+	}, v.file)
+	return v.rule + " (" + file + ")"
+}
+
+// attachPolicy holds the rules
+type attachPolicy struct {
+	blocked     map[string]bool
+	maxSize     int64
+	maxNesting  int
+	maxRatio    int64
+	maxUnpacked int64
+}
+
+// policyCheck is the state of checking a message, the bytes unpacked so far
+type policyCheck struct {
+	*attachPolicy
+	unpacked int64
+}
+
+func newAttachPolicy(config *AttachPolicyProcessorConfig) *attachPolicy {
+	p := &attachPolicy{
+		blocked:     make(map[string]bool),
+		maxSize:     int64(config.MaxSize),
+		maxNesting:  config.MaxNesting,
+		maxRatio:    int64(config.MaxRatio),
+		maxUnpacked: int64(config.MaxUnpacked),
+	}
+	blocked := config.BlockedExt
+	if blocked == "" {
+		blocked = policyDefaultBlockedExt
+	}
+	for _, ext := range strings.Split(blocked, ",") {
+		if ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), ".")); ext != "" {
+			p.blocked[ext] = true
+		}
+	}
+	if p.maxNesting <= 0 {
+		p.maxNesting = policyDefaultMaxNesting
+	}
+	if p.maxRatio <= 0 {
+		p.maxRatio = policyDefaultMaxRatio
+	}
+	if p.maxUnpacked <= 0 {
+		p.maxUnpacked = policyDefaultMaxUnpack
+	}
+	return p
+}
+
+// extensions returns the extensions of the name, lower-cased, the last one first
+func extensions(name string) []string {
+	name = strings.ToLower(path.Base(strings.ReplaceAll(name, "\\", "/")))
+	parts := strings.Split(name, ".")
+	var exts []string
+	for i := len(parts) - 1; i > 0; i-- {
+		// spaces are used to hide the last extension, eg. "invoice.pdf     .exe"
+		exts = append(exts, strings.TrimSpace(parts[i]))
+	}
+	return exts
+}
+
+// checkName checks the extensions of a file name
+func (p *attachPolicy) checkName(name string) error {
+	exts := extensions(name)
+	if len(exts) == 0 {
+		return nil
+	}
+	if len(exts) >= 2 && policyDocumentExt[exts[1]] && p.blocked[exts[0]] {
+		return &policyViolation{"double extension", name}
+	}
+	if p.blocked[exts[0]] {
+		return &policyViolation{"blocked extension ." + exts[0], name}
+	}
+	return nil
+}
+
+// magicType returns the kind of content from its first bytes, or "" if unknown
+func magicType(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte("%PDF-")):
+		return "pdf"
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")), bytes.HasPrefix(content, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(content, []byte("\x1f\x8b")):
+		return "gzip"
+	case bytes.HasPrefix(content, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(content, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(content, []byte("GIF87a")), bytes.HasPrefix(content, []byte("GIF89a")):
+		return "gif"
+	case isPE(content):
+		return "exe"
+	case bytes.HasPrefix(content, []byte("\x7fELF")):
+		return "elf"
+	case bytes.HasPrefix(content, []byte("Rar!\x1a\x07")):
+		return "rar"
+	case bytes.HasPrefix(content, []byte("7z\xbc\xaf\x27\x1c")):
+		return "7z"
+	case len(content) > 262 && bytes.Equal(content[257:262], []byte("ustar")):
+		return "tar"
+	}
+	return ""
+}
+
+// isPE checks for a Windows executable, the MZ header points to the PE header
+func isPE(content []byte) bool {
+	if len(content) < 64 || !bytes.HasPrefix(content, []byte("MZ")) {
+		return false
+	}
+	offset := int(binary.LittleEndian.Uint32(content[0x3c:]))
+	return offset >= 64 && offset+4 <= len(content) && bytes.Equal(content[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// declaredType returns the kind of content of a MIME type, or "" if it is not known
+func declaredType(contentType string) string {
+	switch contentType {
+	case "application/pdf":
+		return "pdf"
+	case "application/zip", "application/x-zip-compressed", "application/java-archive", "application/epub+zip":
+		return "zip"
+	case "application/gzip", "application/x-gzip":
+		return "gzip"
+	case "image/png":
+		return "png"
+	case "image/jpeg", "image/jpg", "image/pjpeg":
+		return "jpeg"
+	case "image/gif":
+		return "gif"
+	case "application/x-msdownload", "application/x-dosexec", "application/vnd.microsoft.portable-executable":
+		return "exe"
+	case "application/x-executable", "application/x-elf":
+		return "elf"
+	case "application/x-rar-compressed", "application/vnd.rar":
+		return "rar"
+	case "application/x-7z-compressed":
+		return "7z"
+	case "application/x-tar":
+		return "tar"
+	}
+	// office documents are zip files
+	if strings.HasPrefix(contentType, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(contentType, "application/vnd.oasis.opendocument.") {
+		return "zip"
+	}
+	return ""
+}
+
+// checkType checks that the content is what the content type says
+func checkType(name, contentType string, content []byte) error {
+	magic, declared := magicType(content), declaredType(contentType)
+	if magic == "" {
+		return nil
+	}
+	if (magic == "exe" || magic == "elf") && declared != magic {
+		// executables must not be disguised as anything
+		return &policyViolation{"content type mismatch, " + contentType + " is an executable", name}
+	}
+	if declared != "" && declared != magic {
+		return &policyViolation{"content type mismatch, " + contentType + " is " + magic, name}
+	}
+	return nil
+}
+
+// checkFile checks a file, and the files inside it if it is an archive
+func (c *policyCheck) checkFile(name string, content []byte, depth int) error {
+	if err := c.checkName(name); err != nil {
+		return err
+	}
+	if c.maxSize > 0 && int64(len(content)) > c.maxSize {
+		return &policyViolation{fmt.Sprintf("file larger than %d bytes", c.maxSize), name}
+	}
+	switch magicType(content) {
+	case "zip":
+		return c.checkZip(name, content, depth+1)
+	case "gzip":
+		return c.checkGzip(name, content, depth+1)
+	case "tar":
+		return c.checkTar(name, bytes.NewReader(content), int64(len(content)), depth+1)
+	case "rar", "7z":
+		if depth+1 > c.maxNesting {
+			return &policyViolation{"archives nested too deep", name}
+		}
+	}
+	return nil
+}
+
+// unpack reads a file of an archive, within the limits of the expansion ratio and the total
+func (c *policyCheck) unpack(archive, name string, r io.Reader, packed int64) ([]byte, error) {
+	limit := c.maxUnpacked - c.unpacked
+	if ratioLimit := packed * c.maxRatio; packed > 0 && ratioLimit < limit {
+		limit = ratioLimit
+	}
+	content, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, &policyViolation{"damaged archive", archive}
+	}
+	if int64(len(content)) > limit {
+		return nil, &policyViolation{"archive expands too much", archive + "/" + name}
+	}
+	c.unpacked += int64(len(content))
+	return content, nil
+}
+
+func (c *policyCheck) checkZip(name string, content []byte, depth int) error {
+	if depth > c.maxNesting {
+		return &policyViolation{"archives nested too deep", name}
+	}
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return &policyViolation{"damaged archive", name}
+	}
+	for _, f := range zr.File {
+		if f.Flags&0x1 != 0 {
+			return &policyViolation{"encrypted archive", name}
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if err = c.checkName(f.Name); err != nil {
+			return err
+		}
+		// the sizes in the headers are not trusted, the ratio is checked while unpacking
+		rc, err := f.Open()
+		if err != nil {
+			return &policyViolation{"damaged archive", name}
+		}
+		packed := int64(f.CompressedSize64)
+		if packed == 0 {
+			packed = 1
+		}
+		inner, err := c.unpack(name, f.Name, rc, packed)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+		if err = c.checkFile(f.Name, inner, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *policyCheck) checkGzip(name string, content []byte, depth int) error {
+	if depth > c.maxNesting {
+		return &policyViolation{"archives nested too deep", name}
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return &policyViolation{"damaged archive", name}
+	}
+	inner, err := c.unpack(name, zr.Name, zr, int64(len(content)))
+	if err != nil {
+		return err
+	}
+	innerName := zr.Name
+	if innerName == "" {
+		innerName = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".tgz")
+	}
+	if magicType(inner) == "tar" {
+		// a .tar.gz is one archive
+		return c.checkTar(name, bytes.NewReader(inner), int64(len(content)), depth)
+	}
+	return c.checkFile(innerName, inner, depth)
+}
+
+func (c *policyCheck) checkTar(name string, r io.Reader, packed int64, depth int) error {
+	if depth > c.maxNesting {
+		return &policyViolation{"archives nested too deep", name}
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return &policyViolation{"damaged archive", name}
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		inner, err := c.unpack(name, h.Name, tr, packed)
+		if err != nil {
+			return err
+		}
+		if err = c.checkFile(h.Name, inner, depth); err != nil {
+			return err
+		}
+	}
+}
+
+// checkMessage runs the rules on the attachments of a message
+func (p *attachPolicy) checkMessage(root *mime.Part) error {
+	c := &policyCheck{attachPolicy: p}
+	return root.Walk(func(part *mime.Part) error {
+		if !part.IsAttachment() || part.ContentType == "message/rfc822" {
+			return nil
+		}
+		name := part.Filename
+		if name == "" {
+			name = "part " + part.Path
+		}
+		if part.Truncated {
+			return &policyViolation{"file too big to be checked", name}
+		}
+		if err := checkType(name, part.ContentType, part.Raw); err != nil {
+			return err
+		}
+		return c.checkFile(name, part.Raw, 0)
+	})
+}
+
+func AttachPolicy() Decorator {
+	var (
+		config *AttachPolicyProcessorConfig
+		policy *attachPolicy
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&AttachPolicyProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*AttachPolicyProcessorConfig)
+		switch config.Action {
+		case "":
+			config.Action = "reject"
+		case "reject", "quarantine":
+		default:
+			return fmt.Errorf("invalid policy_action [%s], expecting reject or quarantine", config.Action)
+		}
+		policy = newAttachPolicy(config)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail && task != TaskTest {
+				return p.Process(e, task)
+			}
+			root := mimeTree(e)
+			if root == nil {
+				var err error
+				if root, err = mime.Parse(e.Data.NewReader(), nil); err != nil {
+					Log().WithError(err).Error("attachpolicy: mime parse error")
+					return p.Process(e, task)
+				}
+				e.Values["mime"] = root
+			}
+			err := policy.checkMessage(root)
+			var violation *policyViolation
+			if !errors.As(err, &violation) {
+				return p.Process(e, task)
+			}
+			if config.Action == "quarantine" {
+				Log().Infof("attachment policy quarantined %s: %s", e.QueuedId, violation)
+				e.Values["quarantine"] = violation.Error()
+				e.DeliveryHeader = "X-Quarantine: " + violation.Error() + "\n" + e.DeliveryHeader
+				return p.Process(e, task)
+			}
+			Log().Infof("attachment policy rejected %s: %s", e.QueuedId, violation)
+			return NewResult("554 5.7.1 Attachment rejected: " + violation.Error()), PolicyError
+		})
+	}
+}
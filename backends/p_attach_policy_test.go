@@ -0,0 +1,137 @@
+package backends
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// testPE returns a minimal Windows executable header
+func testPE() []byte {
+	pe := make([]byte, 128)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3c:], 64)
+	copy(pe[64:], "PE\x00\x00")
+	return pe
+}
+
+func testZip(t *testing.T, files map[string][]byte, encrypted bool) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		h := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		if encrypted {
+			h.Flags |= 0x1
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testTarGz(t *testing.T, name string, content []byte) []byte {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	_, _ = tw.Write(content)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, _ = gw.Write(tarBuf.Bytes())
+	_ = gw.Close()
+	return buf.Bytes()
+}
+
+func policyTestMail(name, contentType string, content []byte) string {
+	return "Subject: files\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+		"--b\r\nContent-Type: " + contentType + "\r\n" +
+		"Content-Disposition: attachment; filename=\"" + name + "\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(content) + "\r\n--b--\r\n"
+}
+
+func TestAttachPolicy(t *testing.T) {
+	pdf := []byte("%PDF-1.4\n")
+	nested := testZip(t, map[string][]byte{"a.txt": []byte("a")}, false)
+	for i := 0; i < 3; i++ {
+		nested = testZip(t, map[string][]byte{"inner.zip": nested}, false)
+	}
+	tests := []struct {
+		name        string
+		config      BackendConfig
+		file        string
+		contentType string
+		content     []byte
+		rule        string
+	}{
+		{"clean", BackendConfig{}, "report.pdf", "application/pdf", pdf, ""},
+		{"blocked extension", BackendConfig{}, "setup.EXE", "application/octet-stream", []byte("x"), "blocked extension .exe"},
+		{"custom blocked extension", BackendConfig{"policy_blocked_ext": "docm"}, "a.docm", "application/octet-stream", []byte("x"), "blocked extension .docm"},
+		{"double extension", BackendConfig{}, "invoice.pdf   .scr", "application/octet-stream", []byte("x"), "double extension"},
+		{"type mismatch", BackendConfig{}, "photo.png", "image/png", pdf, "content type mismatch, image/png is pdf"},
+		{"disguised executable", BackendConfig{}, "report", "application/octet-stream", testPE(), "is an executable"},
+		{"executable in zip", BackendConfig{}, "files.zip", "application/zip",
+			testZip(t, map[string][]byte{"docs/run.bat": []byte("x")}, false), "blocked extension .bat (docs/run.bat)"},
+		{"executable in tar.gz", BackendConfig{}, "files.tar.gz", "application/gzip", testTarGz(t, "run.js", []byte("x")), "blocked extension .js"},
+		{"encrypted zip", BackendConfig{}, "secret.zip", "application/zip",
+			testZip(t, map[string][]byte{"a.txt": []byte("a")}, true), "encrypted archive"},
+		{"nested too deep", BackendConfig{}, "nested.zip", "application/zip", nested, "archives nested too deep"},
+		{"nesting allowed", BackendConfig{"policy_max_nesting": 4}, "nested.zip", "application/zip", nested, ""},
+		{"zip bomb", BackendConfig{}, "bomb.zip", "application/zip",
+			testZip(t, map[string][]byte{"zeros.txt": make([]byte, 1<<20)}, false), "archive expands too much"},
+		{"too big", BackendConfig{"policy_max_size": 4}, "report.pdf", "application/pdf", pdf, "file larger than 4 bytes"},
+		{"quarantine", BackendConfig{"policy_action": "quarantine"}, "setup.exe", "application/octet-stream", []byte("x"), "blocked extension .exe"},
+	}
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := BackendConfig{"save_process": "AttachPolicy", "save_workers_size": 1}
+			for k, v := range test.config {
+				config[k] = v
+			}
+			gw, err := New(config, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = gw.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = gw.Shutdown() }()
+			e := mail.NewEnvelope("127.0.0.1", 1)
+			e.Data.WriteString(policyTestMail(test.file, test.contentType, test.content))
+			r := gw.Process(e, TaskTest)
+			switch {
+			case test.rule == "":
+				if r.Code() != 250 {
+					t.Error("expecting the message to be accepted, got", r)
+				}
+			case config["policy_action"] == "quarantine":
+				if r.Code() != 250 || !strings.Contains(e.DeliveryHeader, "X-Quarantine: "+test.rule) {
+					t.Error("expecting the message to be quarantined, got", r, e.DeliveryHeader)
+				}
+			default:
+				if r.Code() != 554 || !strings.Contains(r.String(), test.rule) {
+					t.Errorf("expecting a rejection with %q, got %s", test.rule, r)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	stdmime "mime"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/mime"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: attachments
+// ----------------------------------------------------------------------------------
+// Description   : Saves the attachments to a content-addressed store, keyed by their
+//
+//	: BLAKE2b-256 hash, so that an attachment received many times is only
+//	: stored once. The attachments are then replaced in the message by a
+//	: message/external-body part with the hash, or annotated with an
+//	: X-Attachment-Hash header. Place it after the DKIM and ARC checks,
+//	: since the message is modified. If an attachment cannot be saved, it is
+//	: left in the message.
+//	: Uses the tree of the mimeparser processor, or parses the message
+//
+// ----------------------------------------------------------------------------------
+// Config Options: attach_store string - "file" (default) or "s3"
+//
+//	: attach_mode string - "replace" (default) or "annotate"
+//	: attach_min_size int - smaller attachments are left alone, in bytes
+//	: attach_dir string - directory of the file store
+//	: attach_s3_endpoint string - eg. https://s3.example.com
+//	: attach_s3_bucket string - the bucket
+//	: attach_s3_region string - defaults to us-east-1
+//	: attach_s3_access_key, attach_s3_secret_key string - the credentials
+//	: attach_s3_timeout string - defaults to "30s"
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.Values["mime"]
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["attachments"] is set to the []*Attachment that were saved,
+//
+//	: which the sql processor stores in sql_attach_table. e.Data is rewritten,
+//	: while e.Values["mime"] still describes the original message
+//
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["attachments"] = func() Decorator {
+		return Attachments()
+	}
+}
+
+type AttachmentsProcessorConfig struct {
+	Store       string `json:"attach_store,omitempty"`
+	Mode        string `json:"attach_mode,omitempty"`
+	MinSize     int    `json:"attach_min_size,omitempty"`
+	Dir         string `json:"attach_dir,omitempty"`
+	S3Endpoint  string `json:"attach_s3_endpoint,omitempty"`
+	S3Bucket    string `json:"attach_s3_bucket,omitempty"`
+	S3Region    string `json:"attach_s3_region,omitempty"`
+	S3AccessKey string `json:"attach_s3_access_key,omitempty"`
+	S3SecretKey string `json:"attach_s3_secret_key,omitempty"`
+	S3Timeout   string `json:"attach_s3_timeout,omitempty"`
+}
+
+// Attachment is the metadata of an attachment that was saved to the store
+type Attachment struct {
+	Name        string
+	ContentType string
+	Size        int64
+	// Hash is the hex BLAKE2b-256 of the decoded content, and the key in the store
+	Hash string
+}
+
+// attachmentHashPrefix names the algorithm in the headers
+const attachmentHashPrefix = "blake2b-256:"
+
+func newAttachmentStore(config *AttachmentsProcessorConfig) (AttachmentStore, error) {
+	switch config.Store {
+	case "", "file":
+		if config.Dir == "" {
+			return nil, convertError("missing/invalid: 'attach_dir' of type: string")
+		}
+		return newFileAttachmentStore(config.Dir)
+	case "s3":
+		timeout := 30 * time.Second
+		if config.S3Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(config.S3Timeout); err != nil {
+				return nil, fmt.Errorf("invalid attach_s3_timeout [%s]: %s", config.S3Timeout, err)
+			}
+		}
+		return newS3AttachmentStore(config.S3Endpoint, config.S3Bucket, config.S3Region,
+			config.S3AccessKey, config.S3SecretKey, timeout)
+	}
+	return nil, fmt.Errorf("invalid attach_store [%s], expecting file or s3", config.Store)
+}
+
+// attachmentParts returns the attachments to extract. The parts of an extracted
+// message/rfc822 are not extracted again
+func attachmentParts(part *mime.Part, minSize int64) []*mime.Part {
+	if part.IsAttachment() && !part.Truncated && int64(len(part.Raw)) >= minSize {
+		return []*mime.Part{part}
+	}
+	var parts []*mime.Part
+	for _, sub := range part.Parts {
+		parts = append(parts, attachmentParts(sub, minSize)...)
+	}
+	return parts
+}
+
+// attachmentEdit replaces data[start:end] of the message
+type attachmentEdit struct {
+	start, end  int
+	replacement string
+}
+
+// externalBody returns the part replacing an attachment that was saved (RFC 2046 section 5.2.3)
+func externalBody(part *mime.Part, a *Attachment, nl string) string {
+	params := map[string]string{
+		"access-type": "x-content-addressed",
+		"hash":        attachmentHashPrefix + a.Hash,
+		"size":        fmt.Sprint(a.Size),
+	}
+	if a.Name != "" {
+		params["name"] = a.Name
+	}
+	s := "Content-Type: " + stdmime.FormatMediaType("message/external-body", params) + nl
+	if cd := part.Header.Get("Content-Disposition"); cd != "" {
+		s += "Content-Disposition: " + cd + nl
+	}
+	s += nl
+	// the header of the attachment, the content can be found with the hash
+	s += "Content-Type: " + stdmime.FormatMediaType(a.ContentType, part.Params) + nl
+	s += "Content-ID: <" + a.Hash + "@blake2b>" + nl + nl
+	return s
+}
+
+// rewrite applies the edits to the message, they must not overlap
+func rewrite(data []byte, edits []attachmentEdit) []byte {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var out bytes.Buffer
+	pos := 0
+	for _, edit := range edits {
+		out.Write(data[pos:edit.start])
+		out.WriteString(edit.replacement)
+		pos = edit.end
+	}
+	out.Write(data[pos:])
+	return out.Bytes()
+}
+
+func Attachments() Decorator {
+	var (
+		config *AttachmentsProcessorConfig
+		store  AttachmentStore
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&AttachmentsProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*AttachmentsProcessorConfig)
+		switch config.Mode {
+		case "":
+			config.Mode = "replace"
+		case "replace", "annotate":
+		default:
+			return fmt.Errorf("invalid attach_mode [%s], expecting replace or annotate", config.Mode)
+		}
+		store, err = newAttachmentStore(config)
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail && task != TaskTest {
+				return p.Process(e, task)
+			}
+			root := mimeTree(e)
+			if root == nil {
+				var err error
+				if root, err = mime.Parse(e.Data.NewReader(), nil); err != nil {
+					Log().WithError(err).Error("attachments: mime parse error")
+					return p.Process(e, task)
+				}
+				e.Values["mime"] = root
+			}
+			data := e.Data.Bytes()
+			located := root.Locate(data) == nil
+			nl := "\n"
+			if bytes.Contains(data, []byte("\r\n")) {
+				nl = "\r\n"
+			}
+			var (
+				attachments []*Attachment
+				edits       []attachmentEdit
+			)
+			for _, part := range attachmentParts(root, int64(config.MinSize)) {
+				// the content is saved as it was sent, text keeps its charset
+				sum := blake2b.Sum256(part.Raw)
+				a := &Attachment{
+					Name:        part.Filename,
+					ContentType: part.ContentType,
+					Size:        int64(len(part.Raw)),
+					Hash:        hex.EncodeToString(sum[:]),
+				}
+				if err := store.Put(a.Hash, part.Raw); err != nil {
+					Log().WithError(err).Errorf("could not save attachment %s of %s", a.Name, e.QueuedId)
+					continue
+				}
+				attachments = append(attachments, a)
+				if !located || part.End == 0 || part == root {
+					continue
+				}
+				switch config.Mode {
+				case "replace":
+					edits = append(edits, attachmentEdit{part.Offset, part.End, strings.TrimSuffix(externalBody(part, a, nl), nl)})
+				case "annotate":
+					edits = append(edits, attachmentEdit{part.Offset, part.Offset, "X-Attachment-Hash: " + attachmentHashPrefix + a.Hash + nl})
+				}
+			}
+			if len(attachments) > 0 {
+				e.Values["attachments"] = attachments
+			}
+			if len(edits) > 0 {
+				rewritten := rewrite(data, edits)
+				e.Data.Reset()
+				e.Data.Write(rewritten)
+				Log().Debugf("%d attachments of %s saved", len(edits), e.QueuedId)
+			}
+			return p.Process(e, task)
+		})
+	}
+}
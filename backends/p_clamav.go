@@ -0,0 +1,163 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: clamav
+// ----------------------------------------------------------------------------------
+// Description   : Scans the message for viruses with clamd, streaming it with the INSTREAM
+//
+//	: command. Infected messages are rejected with the name of the signature
+//
+// ----------------------------------------------------------------------------------
+// Config Options: clamav_addr string - address of clamd, host:port or unix:/path/to/socket
+//
+//	: clamav_timeout string - timeout of the scan. Defaults to 3/4 of
+//	: gw_save_timeout, and cannot be longer than that, so that the scan is
+//	: given up before the save times out
+//	: clamav_fail_open bool - accept the message if it could not be scanned.
+//	: By default, it is rejected with a 4xx reply so that it is tried again
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["clamav"] is set to the name of the signature if infected
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["clamav"] = func() Decorator {
+		return ClamAV()
+	}
+}
+
+type ClamAVProcessorConfig struct {
+	Addr        string `json:"clamav_addr"`
+	Timeout     string `json:"clamav_timeout,omitempty"`
+	FailOpen    bool   `json:"clamav_fail_open,omitempty"`
+	SaveTimeout string `json:"gw_save_timeout,omitempty"`
+}
+
+// clamavChunkSize is the size of the chunks of the stream, clamd limits it with StreamMaxLength
+const clamavChunkSize = 64 * 1024
+
+// clamavTimeout returns the timeout of the scan, which is kept below gw_save_timeout
+func clamavTimeout(config *ClamAVProcessorConfig) (time.Duration, error) {
+	limit := saveTimeout
+	if config.SaveTimeout != "" {
+		if t, err := time.ParseDuration(config.SaveTimeout); err == nil {
+			limit = t
+		}
+	}
+	limit = limit * 3 / 4
+	if config.Timeout == "" {
+		return limit, nil
+	}
+	t, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clamav_timeout [%s]: %s", config.Timeout, err)
+	}
+	if t > limit {
+		Log().Warnf("clamav_timeout %s is too close to gw_save_timeout, using %s", t, limit)
+		return limit, nil
+	}
+	return t, nil
+}
+
+// clamavScan streams the message to clamd, and returns the name of the signature if infected
+func clamavScan(ctx context.Context, addr string, timeout time.Duration, msg io.Reader) (virus string, err error) {
+	// spamd addresses have the same form
+	conn, err := spamdDial(ctx, addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamavChunkSize)
+	for {
+		n, readErr := io.ReadFull(msg, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection when the size limit is exceeded, the reply tells why
+				break
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			// a zero length chunk ends the stream
+			_, err = conn.Write([]byte{0, 0, 0, 0})
+			break
+		} else if readErr != nil {
+			return "", readErr
+		}
+	}
+	reply, readErr := io.ReadAll(conn)
+	if len(reply) == 0 {
+		if readErr != nil {
+			return "", readErr
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errors.New("no reply from clamd")
+	}
+	// eg. "stream: OK", "stream: Eicar-Signature FOUND" or "INSTREAM size limit exceeded. ERROR"
+	line := strings.TrimSpace(string(bytes.TrimRight(reply, "\x00")))
+	switch {
+	case strings.HasSuffix(line, " FOUND"):
+		virus = strings.TrimSuffix(strings.TrimPrefix(line, "stream: "), " FOUND")
+		return virus, nil
+	case strings.HasSuffix(line, " OK"):
+		return "", nil
+	}
+	return "", fmt.Errorf("clamd error [%s]", line)
+}
+
+func ClamAV() Decorator {
+	var (
+		config  *ClamAVProcessorConfig
+		timeout time.Duration
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ClamAVProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*ClamAVProcessorConfig)
+		timeout, err = clamavTimeout(config)
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail || task == TaskTest {
+				virus, err := clamavScan(e.Context(), config.Addr, timeout, e.NewReader())
+				if err != nil {
+					if !config.FailOpen {
+						Log().WithError(err).Error("clamav scan failed, rejecting ", e.QueuedId)
+						return NewResult("451 4.3.0 Message could not be scanned for viruses, try again later"), VirusError
+					}
+					Log().WithError(err).Error("clamav scan failed, accepting ", e.QueuedId)
+				} else if virus != "" {
+					e.Values["clamav"] = virus
+					Log().Infof("clamav found %s in %s", virus, e.QueuedId)
+					return NewResult("554 5.7.1 Message rejected, virus found: " + virus), VirusError
+				}
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd reads the INSTREAM chunks and finds the EICAR test string.
+// If stall is true, it never replies
+func fakeClamd(t *testing.T, stall bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer func() { _ = conn.Close() }()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+						return
+					}
+				}
+				if stall {
+					time.Sleep(time.Second * 2)
+					return
+				}
+				if strings.Contains(data.String(), eicar) {
+					_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+				_, _ = conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestClamAV(t *testing.T) {
+	addr, stalled := fakeClamd(t, false), fakeClamd(t, true)
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	// bigger than a chunk
+	clean := "Subject: hi\r\n\r\n" + strings.Repeat("hello world\r\n", 10000)
+	tests := []struct {
+		name   string
+		config BackendConfig
+		data   string
+		code   int
+	}{
+		{"clean", BackendConfig{}, clean, 250},
+		{"infected", BackendConfig{}, clean + eicar + "\r\n", 554},
+		{"unreachable", BackendConfig{"clamav_addr": "127.0.0.1:1"}, clean, 451},
+		{"unreachable fail open", BackendConfig{"clamav_addr": "127.0.0.1:1", "clamav_fail_open": true}, clean, 250},
+		{"timeout", BackendConfig{"clamav_addr": stalled, "gw_save_timeout": "1s"}, clean, 451},
+		{"timeout fail open", BackendConfig{"clamav_addr": stalled, "clamav_timeout": "100ms", "clamav_fail_open": true}, clean, 250},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := BackendConfig{
+				"save_process":      "clamav",
+				"save_workers_size": 1,
+				"clamav_addr":       addr,
+			}
+			for k, v := range test.config {
+				config[k] = v
+			}
+			gw, err := New(config, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = gw.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = gw.Shutdown() }()
+			e := mail.NewEnvelope("127.0.0.1", 1)
+			e.Data.WriteString(test.data)
+			r := gw.Process(e, TaskSaveMail)
+			if r.Code() != test.code {
+				t.Fatalf("expecting %d, got %s", test.code, r)
+			}
+			if test.code == 554 && !strings.Contains(r.String(), "Eicar-Test-Signature") {
+				t.Error("expecting the signature in the reply, got", r)
+			}
+		})
+	}
+}
+
+func TestClamAVTimeout(t *testing.T) {
+	tests := []struct {
+		timeout, save string
+		expect        time.Duration
+	}{
+		{"", "", saveTimeout * 3 / 4},
+		{"", "4s", time.Second * 3},
+		{"1s", "4s", time.Second},
+		{"1m", "4s", time.Second * 3},
+	}
+	for _, test := range tests {
+		timeout, err := clamavTimeout(&ClamAVProcessorConfig{Timeout: test.timeout, SaveTimeout: test.save})
+		if err != nil || timeout != test.expect {
+			t.Errorf("clamav_timeout %q gw_save_timeout %q: expecting %s, got %s %v",
+				test.timeout, test.save, test.expect, timeout, err)
+		}
+	}
+}
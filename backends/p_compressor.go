@@ -36,7 +36,7 @@ func init() {
 // compressedData struct will be compressed using zlib when printed via fmt
 type DataCompressor struct {
 	ExtraHeaders []byte
-	Data         *bytes.Buffer
+	Data         *mail.Body
 	// the pool is used to recycle buffers to ease up on the garbage collector
 	Pool *sync.Pool
 }
@@ -57,7 +57,7 @@ func newCompressor() *DataCompressor {
 }
 
 // Set the extraheaders and buffer of data to compress
-func (c *DataCompressor) set(b []byte, d *bytes.Buffer) {
+func (c *DataCompressor) set(b []byte, d *mail.Body) {
 	c.ExtraHeaders = b
 	c.Data = d
 }
@@ -76,14 +76,30 @@ func (c *DataCompressor) String() string {
 		b.Reset()
 		c.Pool.Put(b)
 	}()
+	c.compress(b)
+	return b.String()
+}
+
+// Bytes returns the compressed data. The body is read as a stream, but the compressed
+// data is all in memory. The buffer is not put back in the pool, the slice is the caller's
+func (c *DataCompressor) Bytes() []byte {
+	if c.Data == nil {
+		return nil
+	}
+	b := c.Pool.Get().(*bytes.Buffer)
+	b.Reset()
+	c.compress(b)
+	return b.Bytes()
+}
 
+// compress writes the extra headers and the data to b, compressed
+func (c *DataCompressor) compress(b *bytes.Buffer) {
 	var r *bytes.Reader
 	w, _ := zlib.NewWriterLevel(b, zlib.BestSpeed)
 	r = bytes.NewReader(c.ExtraHeaders)
 	_, _ = io.Copy(w, r)
-	_, _ = io.Copy(w, c.Data)
+	_, _ = io.Copy(w, c.Data.NewReader())
 	_ = w.Close()
-	return b.String()
 }
 
 // clear it, without clearing the pool
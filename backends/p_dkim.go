@@ -3,11 +3,26 @@ package backends
 import (
 	"errors"
 
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-msgauth/dkim"
 
 	"github.com/phires/go-guerrilla/mail"
 )
 
+// ----------------------------------------------------------------------------------
+// Processor Name: dkim
+// ----------------------------------------------------------------------------------
+// Description   : Verifies the DKIM signatures of the message
+// ----------------------------------------------------------------------------------
+// Config Options: dkim_defer bool - do not reject unsigned messages or invalid signatures,
+//
+//	: and leave the decision to a later processor, eg. DMARC
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header (set by HeadersParser), e.NewReader()
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["dkim"] is set to a []*authres.DKIMResult, one for each signature
+// ----------------------------------------------------------------------------------
 const DKIMSignatureHeaderFieldName = "DKIM-Signature"
 
 func init() {
@@ -16,53 +31,90 @@ func init() {
 	}
 }
 
+type DKIMProcessorConfig struct {
+	Defer bool `json:"dkim_defer,omitempty"`
+}
+
+// dkimTestVerifyOptions only knows the test key of example.com, they are used for TaskTest
+var dkimTestVerifyOptions = dkim.VerifyOptions{
+	LookupTXT: func(domain string) ([]string, error) {
+		Log().Debugf("DKIM TXT lookup for %s", domain)
+		if domain == "grrla._domainkey.example.com" {
+			return []string{"v=DKIM1; k=ed25519; p=xSvJUKTEe5zW0XuekE6pkPyd/mhSfpVqSZ2yGtvbt/I="}, nil
+		}
+		return nil, errors.New("no such domain")
+	},
+}
+
+// dkimVerify verifies the signatures and saves the results to e.Values["dkim"].
+// A Result is returned if the message should be rejected
+func dkimVerify(e *mail.Envelope, options *dkim.VerifyOptions, deferred bool) (Result, error) {
+	results := make([]*authres.DKIMResult, 0)
+	e.Values["dkim"] = results
+	if dkimSignature := e.Header.Get(DKIMSignatureHeaderFieldName); dkimSignature == "" {
+		if deferred {
+			return nil, nil
+		}
+		return NewResult("556 5.7.20 No DKIM signature."), DKIMError
+	}
+	verifications, err := dkim.VerifyWithOptions(e.NewReader(), options)
+	if err != nil {
+		Log().Errorf("DKIM error=%s", err)
+		e.Values["dkim"] = append(results, &authres.DKIMResult{Value: authres.ResultPermError, Reason: err.Error()})
+		if deferred {
+			return nil, nil
+		}
+		return NewResult("556 5.7.20 DKIM verification error."), DKIMError
+	}
+	valid := true
+	for _, v := range verifications {
+		result := &authres.DKIMResult{Value: authres.ResultPass, Domain: v.Domain, Identifier: v.Identifier}
+		if v.Err == nil {
+			Log().Infoln("DKIM Valid signature for:", v.Domain)
+		} else {
+			Log().Infoln("DKIM Invalid signature for:", v.Domain, v.Err)
+			valid = false
+			result.Reason = v.Err.Error()
+			switch {
+			case dkim.IsTempFail(v.Err):
+				result.Value = authres.ResultTempError
+			case dkim.IsPermFail(v.Err):
+				result.Value = authres.ResultPermError
+			default:
+				result.Value = authres.ResultFail
+			}
+		}
+		results = append(results, result)
+	}
+	e.Values["dkim"] = results
+	if !valid && !deferred {
+		return NewResult("556 5.7.0 Unauthorized sender. Email blocked due to policy reasons."), DKIMError
+	}
+	return nil, nil
+}
+
 func DKIM() Decorator {
+	var config *DKIMProcessorConfig
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&DKIMProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*DKIMProcessorConfig)
+		return nil
+	}))
+
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
-
 			switch task {
-			case TaskSaveMail:
-				if dkimSignature := e.Header.Get(DKIMSignatureHeaderFieldName); dkimSignature == "" {
-					return NewResult("556 5.7.20 No DKIM signature."), DKIMError
-				}
-				verifications, err := dkim.Verify(e.NewReader())
-				if err != nil {
-					Log().Errorf("DKIM error=%s", err)
-					return NewResult("556 5.7.20 DKIM verification error."), DKIMError
-				}
-				for _, v := range verifications {
-					if v.Err == nil {
-						Log().Infoln("DKIM Valid signature for:", v.Domain)
-					} else {
-						Log().Infoln("DKIM Invalid signature for:", v.Domain, v.Err)
-						return NewResult("556 5.7.0 Unauthorized sender. Email blocked due to policy reasons."), DKIMError
-					}
-				}
-			case TaskTest:
-				if dkimSignature := e.Header.Get(DKIMSignatureHeaderFieldName); dkimSignature == "" {
-					return NewResult("556 5.7.20 No DKIM signature."), DKIMError
-				}
-				verifyOptions := dkim.VerifyOptions{
-					LookupTXT: func(domain string) ([]string, error) {
-						Log().Debugf("DKIM TXT lookup for %s", domain)
-						if domain == "grrla._domainkey.example.com" {
-							return []string{"v=DKIM1; k=ed25519; p=xSvJUKTEe5zW0XuekE6pkPyd/mhSfpVqSZ2yGtvbt/I="}, nil
-						}
-						return nil, errors.New("no such domain")
-					},
-				}
-				verifications, err := dkim.VerifyWithOptions(e.NewReader(), &verifyOptions)
-				if err != nil {
-					Log().Errorf("DKIM error=%s", err)
-					return NewResult("556 5.7.20 DKIM verification error."), DKIMError
+			case TaskSaveMail, TaskTest:
+				var options *dkim.VerifyOptions
+				if task == TaskTest {
+					options = &dkimTestVerifyOptions
 				}
-				for _, v := range verifications {
-					if v.Err == nil {
-						Log().Infoln("DKIM Valid signature for:", v.Domain)
-					} else {
-						Log().Infoln("DKIM Invalid signature for:", v.Domain, v.Err)
-						return NewResult("556 5.7.0 Unauthorized sender. Email blocked due to policy reasons."), DKIMError
-					}
+				if result, err := dkimVerify(e, options, config.Defer); result != nil {
+					return result, err
 				}
 			}
 			// next processor
@@ -0,0 +1,270 @@
+package backends
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-msgauth/dkim"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dkimsign
+// ----------------------------------------------------------------------------------
+// Description   : Adds a DKIM-Signature for the domain of the From header
+//
+// ----------------------------------------------------------------------------------
+// Config Options: dkim_sign_keys string - keys for each domain, as a comma separated list of
+//
+//	: domain:selector:/path/to/key.pem
+//	: Keys are PEM encoded RSA (PKCS #1 or #8) or Ed25519 (PKCS #8) private keys.
+//	: A key also signs for the sub-domains of its domain.
+//	: Keys are loaded again when the config is reloaded
+//	: dkim_sign_headers string - comma separated headers to sign, From is always signed
+//	: dkim_sign_canonicalization string - header/body canonicalization, eg "relaxed/simple".
+//	: Defaults to "relaxed/relaxed"
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header (optional, set by HeadersParser), e.MailFrom, e.NewReader()
+// ----------------------------------------------------------------------------------
+// Output        : the DKIM-Signature header is prepended to e.DeliveryHeader
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dkimsign"] = func() Decorator {
+		return DKIMSign()
+	}
+}
+
+type DKIMSignProcessorConfig struct {
+	Keys             string `json:"dkim_sign_keys"`
+	Headers          string `json:"dkim_sign_headers,omitempty"`
+	Canonicalization string `json:"dkim_sign_canonicalization,omitempty"`
+}
+
+// dkimDefaultHeaders are signed if dkim_sign_headers is not set, see RFC 6376 section 5.4.1
+var dkimDefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Resent-Date", "Resent-From", "Resent-To", "Resent-Cc",
+	"In-Reply-To", "References", "List-Id", "List-Help", "List-Unsubscribe",
+	"List-Subscribe", "List-Post", "List-Owner", "List-Archive",
+	"Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// dkimKey is a signing key for a domain
+type dkimKey struct {
+	domain   string
+	selector string
+	signer   crypto.Signer
+}
+
+// dkimKeyring holds the keys of each domain, so that they can be swapped when reloaded
+type dkimKeyring struct {
+	keys        map[string]*dkimKey
+	headers     []string
+	headerCanon dkim.Canonicalization
+	bodyCanon   dkim.Canonicalization
+	sync.RWMutex
+}
+
+// loadDKIMKey reads a PEM encoded private key from a file
+func loadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported key type [%s] in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse key in %s: %s", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key in %s", path)
+	}
+	return signer, nil
+}
+
+// parseDKIMCanonicalization parses a value such as "relaxed/simple"
+func parseDKIMCanonicalization(s string) (header dkim.Canonicalization, body dkim.Canonicalization, err error) {
+	if s == "" {
+		return dkim.CanonicalizationRelaxed, dkim.CanonicalizationRelaxed, nil
+	}
+	parts := strings.SplitN(strings.ToLower(s), "/", 2)
+	if len(parts) == 1 {
+		// as per RFC 6376, the body defaults to simple
+		parts = append(parts, string(dkim.CanonicalizationSimple))
+	}
+	for _, c := range parts {
+		if c != string(dkim.CanonicalizationSimple) && c != string(dkim.CanonicalizationRelaxed) {
+			return "", "", fmt.Errorf("invalid dkim_sign_canonicalization [%s]", s)
+		}
+	}
+	return dkim.Canonicalization(parts[0]), dkim.Canonicalization(parts[1]), nil
+}
+
+// load (re)loads the keys from the config
+func (k *dkimKeyring) load(config *DKIMSignProcessorConfig) error {
+	keys := make(map[string]*dkimKey)
+	for _, item := range strings.Split(config.Keys, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return fmt.Errorf("invalid dkim_sign_keys entry [%s], expecting domain:selector:/path/to/key.pem", item)
+		}
+		signer, err := loadDKIMKey(parts[2])
+		if err != nil {
+			return err
+		}
+		domain := strings.ToLower(strings.TrimSuffix(parts[0], "."))
+		keys[domain] = &dkimKey{domain: domain, selector: parts[1], signer: signer}
+	}
+	if len(keys) == 0 {
+		return errors.New("dkim_sign_keys has no keys")
+	}
+	var headers []string
+	if config.Headers == "" {
+		headers = dkimDefaultHeaders
+	} else {
+		hasFrom := false
+		for _, h := range strings.Split(config.Headers, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				headers = append(headers, h)
+				hasFrom = hasFrom || strings.EqualFold(h, "From")
+			}
+		}
+		if !hasFrom {
+			headers = append([]string{"From"}, headers...)
+		}
+	}
+	headerCanon, bodyCanon, err := parseDKIMCanonicalization(config.Canonicalization)
+	if err != nil {
+		return err
+	}
+	k.Lock()
+	defer k.Unlock()
+	k.keys = keys
+	k.headers = headers
+	k.headerCanon, k.bodyCanon = headerCanon, bodyCanon
+	return nil
+}
+
+// options returns the signing options for the domain, or its closest parent domain
+func (k *dkimKeyring) options(domain string) *dkim.SignOptions {
+	k.RLock()
+	defer k.RUnlock()
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for domain != "" {
+		if key, ok := k.keys[domain]; ok {
+			return &dkim.SignOptions{
+				Domain:                 key.domain,
+				Selector:               key.selector,
+				Signer:                 key.signer,
+				HeaderKeys:             k.headers,
+				HeaderCanonicalization: k.headerCanon,
+				BodyCanonicalization:   k.bodyCanon,
+			}
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return nil
+}
+
+// dkimSignerDomain returns the domain of the From header, or of the envelope sender
+// if there is no From header
+func dkimSignerDomain(e *mail.Envelope) string {
+	if domain, err := headerFromDomain(e); err == nil {
+		return domain
+	}
+	return e.MailFrom.Host
+}
+
+// sign returns the DKIM-Signature header for the message
+func dkimSign(r io.Reader, options *dkim.SignOptions) (string, error) {
+	signer, err := dkim.NewSigner(options)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(signer, r); err != nil {
+		_ = signer.Close()
+		return "", err
+	}
+	if err = signer.Close(); err != nil {
+		return "", err
+	}
+	return signer.Signature(), nil
+}
+
+func DKIMSign() Decorator {
+	var (
+		config  *DKIMSignProcessorConfig
+		keyring = &dkimKeyring{}
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&DKIMSignProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*DKIMSignProcessorConfig)
+		return keyring.load(config)
+	}))
+
+	Svc.AddReloader(ReloadWith(func(backendConfig BackendConfig) error {
+		if err := keyring.load(config); err != nil {
+			// keep signing with the old keys
+			return fmt.Errorf("could not reload DKIM keys: %s", err)
+		}
+		Log().Info("reloaded DKIM signing keys")
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			switch task {
+			case TaskSaveMail, TaskTest:
+				domain := dkimSignerDomain(e)
+				options := keyring.options(domain)
+				if options == nil {
+					Log().Debugf("no DKIM signing key for domain [%s]", domain)
+					break
+				}
+				signature, err := dkimSign(e.NewReader(), options)
+				if err != nil {
+					Log().WithError(err).Errorf("could not DKIM sign %s for %s", e.QueuedId, options.Domain)
+					break
+				}
+				e.DeliveryHeader = signature + e.DeliveryHeader
+				Log().Debugf("DKIM signed %s with d=%s s=%s", e.QueuedId, options.Domain, options.Selector)
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
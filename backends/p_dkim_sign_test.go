@@ -0,0 +1,154 @@
+package backends
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const dkimSignTestMessage = "From: Sender <sender@mail.example.com>\r\n" +
+	"To: rcpt@grr.la\r\n" +
+	"Subject: sign me\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+// writeDKIMTestKey writes a new key to path, returning its public key record
+func writeDKIMTestKey(t *testing.T, path string, rsaKey bool) string {
+	var (
+		block  *pem.Block
+		record string
+	)
+	if rsaKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+		pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+	} else {
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, _ := x509.MarshalPKCS8PrivateKey(key)
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func verifyDKIMTest(t *testing.T, e *mail.Envelope, records map[string]string) *dkim.Verification {
+	verifications, err := dkim.VerifyWithOptions(e.NewReader(), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if r, ok := records[domain]; ok {
+				return []string{r}, nil
+			}
+			return nil, errors.New("no such domain")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 1 {
+		t.Fatal("expecting 1 signature, got", len(verifications))
+	}
+	return verifications[0]
+}
+
+func TestDKIMSign(t *testing.T) {
+	dir := t.TempDir()
+	edPath, rsaPath := filepath.Join(dir, "ed.pem"), filepath.Join(dir, "rsa.pem")
+	records := map[string]string{
+		"ed._domainkey.example.com": writeDKIMTestKey(t, edPath, false),
+		"rs._domainkey.example.org": writeDKIMTestKey(t, rsaPath, true),
+	}
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":               "HeadersParser|DKIMSign",
+		"save_workers_size":          1,
+		"dkim_sign_keys":             "example.com:ed:" + edPath + ", example.org:rs:" + rsaPath,
+		"dkim_sign_headers":          "To,Subject",
+		"dkim_sign_canonicalization": "relaxed/simple",
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gw.Shutdown() }()
+
+	// signed for the parent domain of the From address
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(dkimSignTestMessage)
+	gw.Process(e, TaskSaveMail)
+	if !strings.HasPrefix(e.DeliveryHeader, "DKIM-Signature:") {
+		t.Fatal("expecting a DKIM-Signature header, got", e.DeliveryHeader)
+	}
+	v := verifyDKIMTest(t, e, records)
+	if v.Err != nil || v.Domain != "example.com" {
+		t.Error("expecting a valid signature for example.com, got", v.Domain, v.Err)
+	}
+	if !strings.Contains(e.DeliveryHeader, "c=relaxed/simple") || !strings.Contains(e.DeliveryHeader, "h=From:To:Subject") {
+		t.Error("signature does not use the configured options:", e.DeliveryHeader)
+	}
+
+	// RSA key
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(strings.Replace(dkimSignTestMessage, "mail.example.com", "example.org", 1))
+	gw.Process(e, TaskSaveMail)
+	if v = verifyDKIMTest(t, e, records); v.Err != nil || v.Domain != "example.org" {
+		t.Error("expecting a valid signature for example.org, got", v.Domain, v.Err)
+	}
+
+	// no key for the domain
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(strings.Replace(dkimSignTestMessage, "mail.example.com", "example.net", 1))
+	gw.Process(e, TaskSaveMail)
+	if e.DeliveryHeader != "" {
+		t.Error("not expecting a signature, got", e.DeliveryHeader)
+	}
+
+	// keys are loaded again on reload
+	records["ed._domainkey.example.com"] = writeDKIMTestKey(t, edPath, false)
+	if err = gw.(*BackendGateway).Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(dkimSignTestMessage)
+	gw.Process(e, TaskSaveMail)
+	if v = verifyDKIMTest(t, e, records); v.Err != nil {
+		t.Error("expecting the message to be signed with the new key, got", v.Err)
+	}
+
+	// a broken key keeps the old one
+	if err = os.WriteFile(edPath, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.(*BackendGateway).Reload(); err == nil {
+		t.Error("expecting reload to fail with a broken key")
+	}
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(dkimSignTestMessage)
+	gw.Process(e, TaskSaveMail)
+	if v = verifyDKIMTest(t, e, records); v.Err != nil {
+		t.Error("expecting the message to be signed with the previous key, got", v.Err)
+	}
+}
@@ -0,0 +1,426 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	netmail "net/mail"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/arc"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dmarc
+// ----------------------------------------------------------------------------------
+// Description   : Evaluates the DMARC policy (RFC 7489) of the From header's domain using
+//
+//	: the SPF and DKIM results, and adds an Authentication-Results header (RFC 8601).
+//	: Place it after SPF and DKIM, with spf_defer and dkim_defer enabled,
+//	: eg. "HeadersParser|SPF|DKIM|DMARC"
+//
+// ----------------------------------------------------------------------------------
+// Config Options: dmarc_authserv_id string - the authserv-id of the Authentication-Results
+//
+//	: header, defaults to primary_mail_host
+//	: dmarc_override string - local policy overriding the published one for failing
+//	: messages, as a comma separated list of domain=none|quarantine|reject.
+//	: A domain also matches its sub-domains, "*" matches any domain.
+//	: eg. "lists.example.com=none,*=quarantine"
+//	: dmarc_arc_trusted string - comma separated domains of ARC sealers that are
+//	: trusted, eg. mailing lists. If the message fails, but has a valid ARC chain
+//	: where one of them recorded that the From domain passed DMARC, or had an
+//	: aligned DKIM signature or SPF pass, the policy is not applied (RFC 8617 section 7.2)
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header (optional, set by HeadersParser), e.Values["spf"], e.Values["dkim"],
+//
+//	: e.Values["arc"]
+//
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["dmarc"] is set to the *DMARCResult, and the
+//
+//	: Authentication-Results header is prepended to e.DeliveryHeader, after removing
+//	: the Authentication-Results headers of the message that have our authserv-id.
+//	: The message is rejected if the policy is reject. With quarantine,
+//	: e.Values["quarantine"] is set to the reason and an X-Quarantine header is added
+//
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dmarc"] = func() Decorator {
+		return DMARC()
+	}
+}
+
+// DMARCLookupTXT is used for finding the DMARC records. It can be replaced for testing.
+var DMARCLookupTXT = net.LookupTXT
+
+type DMARCProcessorConfig struct {
+	AuthServID  string `json:"dmarc_authserv_id,omitempty"`
+	Override    string `json:"dmarc_override,omitempty"`
+	ARCTrusted  string `json:"dmarc_arc_trusted,omitempty"`
+	PrimaryHost string `json:"primary_mail_host,omitempty"`
+}
+
+// DMARCResult is the outcome of evaluating the DMARC policy of a message
+type DMARCResult struct {
+	authres.DMARCResult
+	// Policy is the published policy that applies to the From domain, empty if there is none
+	Policy dmarc.Policy
+	// Disposition is what is done with the message, after the pct tag and local override
+	// have been applied. It is always none if the message passed
+	Disposition dmarc.Policy
+}
+
+// dmarcOrgDomain returns the organizational domain, eg. mail.example.co.uk => example.co.uk
+func dmarcOrgDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// dmarcAligned checks the alignment of an authenticated domain with the From domain
+func dmarcAligned(domain, from string, mode dmarc.AlignmentMode) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+	if domain == from {
+		return true
+	}
+	return mode != dmarc.AlignmentStrict && dmarcOrgDomain(domain) == dmarcOrgDomain(from)
+}
+
+// headerFromDomain returns the domain of the From header
+func headerFromDomain(e *mail.Envelope) (string, error) {
+	from := ""
+	if e.Header != nil {
+		from = e.Header.Get("From")
+	} else if m, err := netmail.ReadMessage(e.NewReader()); err == nil {
+		from = m.Header.Get("From")
+	}
+	if from == "" {
+		return "", errors.New("no From header")
+	}
+	addr, err := netmail.ParseAddress(mail.MimeHeaderDecode(from))
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(addr.Address, "@")
+	if i < 0 || i == len(addr.Address)-1 {
+		return "", errors.New("no domain in From header")
+	}
+	return strings.ToLower(addr.Address[i+1:]), nil
+}
+
+// dmarcLookup finds the record of the domain, or of its organizational domain.
+// sub is true if the record was found at the organizational domain
+func dmarcLookup(domain string) (record *dmarc.Record, sub bool, err error) {
+	options := &dmarc.LookupOptions{LookupTXT: DMARCLookupTXT}
+	record, err = dmarc.LookupWithOptions(domain, options)
+	if err == dmarc.ErrNoPolicy {
+		if org := dmarcOrgDomain(domain); org != domain {
+			record, err = dmarc.LookupWithOptions(org, options)
+			sub = true
+		}
+	}
+	return record, sub, err
+}
+
+// dmarcOverride holds the local policy of each domain
+type dmarcOverride map[string]dmarc.Policy
+
+func newDMARCOverride(s string) (dmarcOverride, error) {
+	o := make(dmarcOverride)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid dmarc_override entry [%s], expecting domain=policy", item)
+		}
+		policy := dmarc.Policy(strings.ToLower(strings.TrimSpace(parts[1])))
+		if policy != dmarc.PolicyNone && policy != dmarc.PolicyQuarantine && policy != dmarc.PolicyReject {
+			return nil, fmt.Errorf("invalid dmarc_override policy [%s]", parts[1])
+		}
+		o[strings.ToLower(strings.TrimSpace(parts[0]))] = policy
+	}
+	return o, nil
+}
+
+// get returns the local policy for the domain or its closest parent domain
+func (o dmarcOverride) get(domain string) (dmarc.Policy, bool) {
+	for domain != "" {
+		if policy, ok := o[domain]; ok {
+			return policy, true
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	policy, ok := o["*"]
+	return policy, ok
+}
+
+// evaluateDMARC checks if the SPF or DKIM results of the envelope align with the From domain,
+// and decides what to do with the message according to the policy
+func evaluateDMARC(e *mail.Envelope, override dmarcOverride, arcTrusted map[string]bool) *DMARCResult {
+	result := &DMARCResult{Disposition: dmarc.PolicyNone}
+	from, err := headerFromDomain(e)
+	if err != nil {
+		result.Value, result.Reason = authres.ResultPermError, err.Error()
+		return result
+	}
+	result.From = from
+	record, sub, err := dmarcLookup(from)
+	if err == dmarc.ErrNoPolicy {
+		result.Value = authres.ResultNone
+		return result
+	} else if err != nil {
+		result.Value, result.Reason = authres.ResultPermError, err.Error()
+		if dmarc.IsTempFail(err) {
+			result.Value = authres.ResultTempError
+		}
+		return result
+	}
+	result.Policy = record.Policy
+	if sub && record.SubdomainPolicy != "" {
+		result.Policy = record.SubdomainPolicy
+	}
+
+	if spfResult, ok := e.Values["spf"].(*authres.SPFResult); ok && spfResult.Value == authres.ResultPass {
+		if dmarcAligned(spfDomain(spfResult), from, record.SPFAlignment) {
+			result.Value = authres.ResultPass
+			return result
+		}
+	}
+	if dkimResults, ok := e.Values["dkim"].([]*authres.DKIMResult); ok {
+		for _, r := range dkimResults {
+			if r.Value == authres.ResultPass && dmarcAligned(r.Domain, from, record.DKIMAlignment) {
+				result.Value = authres.ResultPass
+				return result
+			}
+		}
+	}
+
+	result.Value = authres.ResultFail
+	result.Disposition = result.Policy
+	if record.Percent != nil && *record.Percent < 100 && rand.Intn(100) >= *record.Percent {
+		// not sampled, apply the next less strict policy, see RFC 7489 section 6.6.4
+		switch result.Disposition {
+		case dmarc.PolicyReject:
+			result.Disposition = dmarc.PolicyQuarantine
+		case dmarc.PolicyQuarantine:
+			result.Disposition = dmarc.PolicyNone
+		}
+	}
+	if policy, ok := override.get(from); ok {
+		result.Disposition = policy
+	}
+	if chain, ok := e.Values["arc"].(*arc.Result); ok {
+		if sealer, ok := arcTrustedSealer(chain, from, arcTrusted); ok {
+			// the sealer vouches for the authentication results before the message was modified
+			result.Disposition = dmarc.PolicyNone
+			result.Reason = fmt.Sprintf("arc=pass, authenticated by %s (i=%d)", sealer.Domain, sealer.Instance)
+		}
+	}
+	return result
+}
+
+// arcTrustedSealer returns the latest trusted sealer of a passing chain that recorded that the
+// from domain was authenticated, by DMARC, an aligned DKIM signature or an aligned SPF pass
+func arcTrustedSealer(chain *arc.Result, from string, trusted map[string]bool) (arc.Sealer, bool) {
+	if chain.Validation != arc.ChainPass {
+		return arc.Sealer{}, false
+	}
+	for i := len(chain.Sealers) - 1; i >= 0; i-- {
+		sealer := chain.Sealers[i]
+		if !trusted[strings.ToLower(sealer.Domain)] {
+			continue
+		}
+		_, results, err := authres.Parse(sealer.AuthResults)
+		if err != nil {
+			continue
+		}
+		for _, r := range results {
+			switch r := r.(type) {
+			case *authres.DMARCResult:
+				if r.Value == authres.ResultPass && strings.EqualFold(r.From, from) {
+					return sealer, true
+				}
+			case *authres.DKIMResult:
+				if r.Value == authres.ResultPass && dmarcAligned(r.Domain, from, dmarc.AlignmentRelaxed) {
+					return sealer, true
+				}
+			case *authres.SPFResult:
+				if r.Value == authres.ResultPass && dmarcAligned(spfDomain(r), from, dmarc.AlignmentRelaxed) {
+					return sealer, true
+				}
+			}
+		}
+	}
+	return arc.Sealer{}, false
+}
+
+// authResults returns the authentication results of the envelope
+func authResults(e *mail.Envelope) []authres.Result {
+	var results []authres.Result
+	if r, ok := e.Values["spf"].(*authres.SPFResult); ok {
+		results = append(results, r)
+	}
+	if dkimResults, ok := e.Values["dkim"].([]*authres.DKIMResult); ok {
+		if len(dkimResults) == 0 {
+			results = append(results, &authres.DKIMResult{Value: authres.ResultNone})
+		}
+		for _, r := range dkimResults {
+			results = append(results, r)
+		}
+	}
+	if r, ok := e.Values["arc"].(*arc.Result); ok {
+		results = append(results, &authres.GenericResult{Method: "arc", Value: authres.ResultValue(r.Validation)})
+	}
+	if r, ok := e.Values["dmarc"].(*DMARCResult); ok {
+		results = append(results, &r.DMARCResult)
+	}
+	return results
+}
+
+// authenticationResults returns the Authentication-Results header for the results of the envelope
+func authenticationResults(authServID string, e *mail.Envelope) string {
+	return "Authentication-Results: " + authres.Format(authServID, authResults(e)) + "\n"
+}
+
+// stripAuthenticationResults removes the Authentication-Results headers of the message that
+// have our authserv-id, they were not added by us and must not be trusted (RFC 8601 section 5)
+func stripAuthenticationResults(e *mail.Envelope, authServID string) error {
+	r := bufio.NewReader(e.Data.NewReader())
+	var header, field bytes.Buffer
+	stripped := false
+	// flush adds the field to the header, unless it is to be removed
+	flush := func() {
+		name, value, _ := strings.Cut(field.String(), ":")
+		if strings.EqualFold(strings.TrimSpace(name), "Authentication-Results") {
+			if id, _, err := authres.Parse(value); err == nil && strings.EqualFold(id, authServID) {
+				stripped = true
+				field.Reset()
+				return
+			}
+		}
+		header.Write(field.Bytes())
+		field.Reset()
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[0] != ' ' && line[0] != '\t' {
+			flush()
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// the end of the header
+			header.Write(line)
+			break
+		}
+		field.Write(line)
+		if err != nil {
+			flush()
+			break
+		}
+	}
+	if !stripped {
+		return nil
+	}
+	var data mail.Body
+	e.Data.CopyTo(&data)
+	data.Reset()
+	if _, err := data.Write(header.Bytes()); err != nil {
+		return err
+	}
+	if _, err := data.ReadFrom(r); err != nil {
+		data.Reset()
+		return err
+	}
+	data.MoveTo(&e.Data)
+	if e.Header != nil {
+		var kept []string
+		for _, value := range e.Header.Values("Authentication-Results") {
+			if id, _, err := authres.Parse(value); err != nil || !strings.EqualFold(id, authServID) {
+				kept = append(kept, value)
+			}
+		}
+		e.Header.Del("Authentication-Results")
+		for _, value := range kept {
+			e.Header.Add("Authentication-Results", value)
+		}
+	}
+	return nil
+}
+
+func DMARC() Decorator {
+	var (
+		config     *DMARCProcessorConfig
+		override   dmarcOverride
+		arcTrusted = make(map[string]bool)
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&DMARCProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*DMARCProcessorConfig)
+		if config.AuthServID == "" {
+			config.AuthServID = reportingMTA("", config.PrimaryHost)
+		}
+		for _, domain := range strings.Split(config.ARCTrusted, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				arcTrusted[strings.ToLower(domain)] = true
+			}
+		}
+		override, err = newDMARCOverride(config.Override)
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			switch task {
+			case TaskSaveMail, TaskTest:
+				if err := stripAuthenticationResults(e, config.AuthServID); err != nil {
+					Log().WithError(err).Errorf("could not remove the Authentication-Results of %s", e.QueuedId)
+					return NewResult("451 4.3.0 Error: could not process the message"), err
+				}
+				result := evaluateDMARC(e, override, arcTrusted)
+				e.Values["dmarc"] = result
+				header := authenticationResults(config.AuthServID, e)
+				Log().Debugf("DMARC %s for %s, policy=%s disposition=%s %s",
+					result.Value, result.From, result.Policy, result.Disposition, result.Reason)
+				switch result.Disposition {
+				case dmarc.PolicyReject:
+					Log().Infof("DMARC rejected %s from %s", e.QueuedId, result.From)
+					e.DeliveryHeader = header + e.DeliveryHeader
+					return NewResult("550 5.7.1 Email rejected per DMARC policy for " + result.From), DMARCError
+				case dmarc.PolicyQuarantine:
+					Log().Infof("DMARC quarantine for %s from %s", e.QueuedId, result.From)
+					reason := "DMARC policy of " + result.From
+					e.Values["quarantine"] = reason
+					header += "X-Quarantine: " + reason + "\n"
+				}
+				e.DeliveryHeader = header + e.DeliveryHeader
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package backends
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dmarc"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+var dmarcTestRecords = map[string]string{
+	"_dmarc.example.com": "v=DMARC1; p=reject; sp=quarantine; adkim=s",
+	"_dmarc.example.org": "v=DMARC1; p=quarantine; pct=0",
+	"_dmarc.example.net": "v=DMARC1; p=reject",
+}
+
+func dmarcTestLookupTXT(domain string) ([]string, error) {
+	if r, ok := dmarcTestRecords[domain]; ok {
+		return []string{r}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+}
+
+func newDMARCTestGateway(t *testing.T, cfg BackendConfig) Backend {
+	lookup := DMARCLookupTXT
+	DMARCLookupTXT = dmarcTestLookupTXT
+	t.Cleanup(func() { DMARCLookupTXT = lookup })
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(cfg, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = gw.Shutdown() })
+	return gw
+}
+
+func TestDMARC(t *testing.T) {
+	gw := newDMARCTestGateway(t, BackendConfig{
+		"save_process":      "HeadersParser|DMARC",
+		"save_workers_size": 1,
+		"dmarc_authserv_id": "mx.grr.la",
+		"dmarc_override":    "example.net=none",
+	})
+	pass := func(domain string) *authres.DKIMResult {
+		return &authres.DKIMResult{Value: authres.ResultPass, Domain: domain}
+	}
+	tests := []struct {
+		name        string
+		from        string
+		spf         *authres.SPFResult
+		dkim        []*authres.DKIMResult
+		value       authres.ResultValue
+		disposition dmarc.Policy
+		code        int
+	}{
+		{"aligned dkim", "example.com", nil, []*authres.DKIMResult{pass("example.com")}, authres.ResultPass, dmarc.PolicyNone, 250},
+		{"relaxed spf", "example.com", &authres.SPFResult{Value: authres.ResultPass, From: "bounce@mail.example.com"},
+			[]*authres.DKIMResult{pass("mail.example.com")}, authres.ResultPass, dmarc.PolicyNone, 250},
+		{"strict dkim", "example.com", nil, []*authres.DKIMResult{pass("mail.example.com")}, authres.ResultFail, dmarc.PolicyReject, 550},
+		{"unaligned", "example.com", &authres.SPFResult{Value: authres.ResultPass, From: "a@grr.la"},
+			[]*authres.DKIMResult{pass("grr.la")}, authres.ResultFail, dmarc.PolicyReject, 550},
+		{"sub-domain policy", "news.example.com", nil, []*authres.DKIMResult{}, authres.ResultFail, dmarc.PolicyQuarantine, 250},
+		{"not sampled", "example.org", nil, nil, authres.ResultFail, dmarc.PolicyNone, 250},
+		{"local override", "example.net", nil, nil, authres.ResultFail, dmarc.PolicyNone, 250},
+		{"no policy", "example.info", nil, nil, authres.ResultNone, dmarc.PolicyNone, 250},
+	}
+	for _, tt := range tests {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString("From: <sender@" + tt.from + ">\r\nSubject: test\r\n\r\nHello\r\n")
+		if tt.spf != nil {
+			e.Values["spf"] = tt.spf
+		}
+		if tt.dkim != nil {
+			e.Values["dkim"] = tt.dkim
+		}
+		if r := gw.Process(e, TaskSaveMail); r.Code() != tt.code {
+			t.Errorf("%s: expecting %d, got %s", tt.name, tt.code, r)
+		}
+		result, ok := e.Values["dmarc"].(*DMARCResult)
+		if !ok {
+			t.Errorf("%s: no DMARC result", tt.name)
+			continue
+		}
+		if result.Value != tt.value || result.Disposition != tt.disposition {
+			t.Errorf("%s: expecting %s/%s, got %s/%s", tt.name, tt.value, tt.disposition, result.Value, result.Disposition)
+		}
+		if quarantine, _ := e.Values["quarantine"].(string); (tt.disposition == dmarc.PolicyQuarantine) !=
+			(quarantine != "" && strings.Contains(e.DeliveryHeader, "\nX-Quarantine: "+quarantine+"\n")) {
+			t.Errorf("%s: unexpected quarantine [%s] %s", tt.name, quarantine, e.DeliveryHeader)
+		}
+		expect := "Authentication-Results: mx.grr.la;"
+		if !strings.HasPrefix(e.DeliveryHeader, expect) ||
+			!strings.Contains(e.DeliveryHeader, "dmarc="+string(tt.value)+" header.from="+tt.from) {
+			t.Errorf("%s: unexpected header %s", tt.name, e.DeliveryHeader)
+		}
+	}
+}
+
+func TestDMARCWithDKIM(t *testing.T) {
+	gw := newDMARCTestGateway(t, BackendConfig{
+		"save_process":      "HeadersParser|DKIM|DMARC",
+		"save_workers_size": 1,
+		"primary_mail_host": "mx.grr.la",
+		"dkim_defer":        true,
+	})
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(verifiedMailString)
+	if r := gw.Process(e, TaskTest); r.Code() != 250 {
+		t.Error("expecting the signed message to pass, got", r)
+	}
+	if !strings.HasPrefix(e.DeliveryHeader, "Authentication-Results: mx.grr.la; dkim=pass header.d=example.com") ||
+		!strings.Contains(e.DeliveryHeader, "; dmarc=pass header.from=example.com") {
+		t.Error("unexpected header", e.DeliveryHeader)
+	}
+
+	// the invalid signature is not rejected by DKIM, but by the policy of example.com
+	e = mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString(strings.Replace(verifiedMailString, "DKIM is ready", "DKIM is not ready", 1))
+	if r := gw.Process(e, TaskTest); r.Code() != 550 || !strings.Contains(r.String(), "DMARC") {
+		t.Error("expecting the message to be rejected per DMARC policy, got", r)
+	}
+	if !strings.Contains(e.DeliveryHeader, "dkim=fail") {
+		t.Error("expecting dkim=fail, got", e.DeliveryHeader)
+	}
+}
+
+func TestDMARCStripsAuthenticationResults(t *testing.T) {
+	gw := newDMARCTestGateway(t, BackendConfig{
+		"save_process":      "HeadersParser|DMARC",
+		"save_workers_size": 1,
+		"dmarc_authserv_id": "mx.grr.la",
+	})
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Authentication-Results: MX.grr.la;\n dmarc=pass header.from=example.com\n" +
+		"From: <sender@example.com>\n" +
+		"Authentication-Results: mx.example.com; spf=pass smtp.mailfrom=example.com\n" +
+		"Subject: test\n\n" +
+		"Authentication-Results: mx.grr.la; dmarc=pass\n")
+	if r := gw.Process(e, TaskSaveMail); r.Code() != 550 {
+		t.Error("expecting the forged result to be ignored and the message rejected, got", r)
+	}
+	expect := "From: <sender@example.com>\n" +
+		"Authentication-Results: mx.example.com; spf=pass smtp.mailfrom=example.com\n" +
+		"Subject: test\n\n" +
+		"Authentication-Results: mx.grr.la; dmarc=pass\n"
+	if e.Data.String() != expect {
+		t.Errorf("expecting\n%s\ngot\n%s", expect, e.Data.String())
+	}
+	if got := e.Header.Values("Authentication-Results"); len(got) != 1 || !strings.HasPrefix(got[0], "mx.example.com;") {
+		t.Error("expecting the parsed header to be stripped too, got", got)
+	}
+}
@@ -0,0 +1,131 @@
+package backends
+
+import (
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/dsn"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: dsn
+// ----------------------------------------------------------------------------------
+// Description   : Sends a delivery status notification (RFC 3464) to the sender when
+//
+//	: the message was accepted, but some recipients could not be delivered to.
+//	: Place it before the processor that delivers, eg "DSN|Relay"
+//
+// ----------------------------------------------------------------------------------
+// Config Options: dsn_process string - processors to send notifications with, eg "Queue"
+//
+//	: dsn_reporting_mta string - name of this host in notifications,
+//	: defaults to primary_mail_host
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Values["relay_status"] set by the next processors
+// ----------------------------------------------------------------------------------
+// Output        : A notification is sent for the failed recipients that requested one.
+//
+//	: Nothing is sent for a null sender, or when running in the queue_process
+//	: of the Queue processor (enable queue_dsn instead)
+//
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["dsn"] = func() Decorator {
+		return DSN()
+	}
+}
+
+type DSNProcessorConfig struct {
+	Process      string `json:"dsn_process"`
+	ReportingMTA string `json:"dsn_reporting_mta,omitempty"`
+	PrimaryHost  string `json:"primary_mail_host,omitempty"`
+}
+
+// reportingMTA returns the name to use in notifications
+func reportingMTA(reportingMTA, primaryHost string) string {
+	if reportingMTA != "" {
+		return reportingMTA
+	}
+	if primaryHost != "" {
+		return primaryHost
+	}
+	return "localhost"
+}
+
+// newDSNReport returns a report about the recipients that were not delivered to.
+// Temporary failures are reported as failed, since the message will not be retried, with a
+// permanent status. Their reply is only in the Diagnostic-Code
+func newDSNReport(e *mail.Envelope, mta string, statuses []DeliveryStatus) *dsn.Report {
+	r := &dsn.Report{ReportingMTA: mta, MailFrom: e.MailFrom, QueuedId: e.QueuedId, ArrivalDate: time.Now()}
+	for i := range statuses {
+		if statuses[i].Delivered() {
+			continue
+		}
+		rcpt := dsn.Recipient{
+			Rcpt:        statuses[i].Rcpt,
+			Action:      dsn.Failed,
+			Reply:       statuses[i].String(),
+			RemoteMTA:   statuses[i].RemoteMTA,
+			LastAttempt: r.ArrivalDate,
+		}
+		if statuses[i].Temporary() {
+			rcpt.Code = "5.0.0"
+		}
+		r.Recipients = append(r.Recipients, rcpt)
+	}
+	return r
+}
+
+func DSN() Decorator {
+	var (
+		config *DSNProcessorConfig
+		sender Processor
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&DSNProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*DSNProcessorConfig)
+		sender, err = newConfigStack(config.Process, backendConfig)
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			result, err := p.Process(e, task)
+			if task != TaskSaveMail || err != nil || result == nil || result.Code() >= 300 {
+				// the client is told about the failure in the reply
+				return result, err
+			}
+			if _, ok := e.Values["queue_id"]; ok {
+				// the queue will retry, and report when done
+				return result, err
+			}
+			statuses, ok := e.Values["relay_status"].([]DeliveryStatus)
+			if !ok {
+				return result, err
+			}
+			report := newDSNReport(e, reportingMTA(config.ReportingMTA, config.PrimaryHost), statuses)
+			if len(report.Recipients) == 0 {
+				return result, err
+			}
+			notification, dsnErr := report.Envelope(e.NewReader())
+			if dsnErr == dsn.ErrNullSender || dsnErr == dsn.ErrNoNotify {
+				Log().Debugf("no delivery status notification for %s: %s", e.QueuedId, dsnErr)
+				return result, err
+			} else if dsnErr != nil {
+				Log().WithError(dsnErr).Errorf("could not create delivery status notification for %s", e.QueuedId)
+				return result, err
+			}
+			if r, sendErr := sender.Process(notification, TaskSaveMail); sendErr != nil || r == nil || r.Code() >= 300 {
+				Log().WithError(sendErr).Errorf("could not send delivery status notification for %s: %v", e.QueuedId, r)
+			} else {
+				Log().Infof("sent delivery status notification for %s to <%s>", e.QueuedId, e.MailFrom.String())
+			}
+			return result, err
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// dsnTestSent receives the notifications sent by the DSN processor
+var dsnTestSent = make(chan *mail.Envelope, 1)
+
+// dsnTestProcessor sets the status of two recipients, and receives the notifications
+func dsnTestProcessor() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if e.MailFrom.NullPath {
+				dsnTestSent <- e
+				return BackendResultOK, nil
+			}
+			e.Values["relay_status"] = []DeliveryStatus{
+				{Rcpt: e.RcptTo[0], Code: 250, Msg: "2.0.0 OK"},
+				{Rcpt: e.RcptTo[1], Code: 550, Msg: "5.1.1 No such user", RemoteMTA: "mx.grr.la:25"},
+			}
+			return p.Process(e, task)
+		})
+	}
+}
+
+func TestDSNProcessor(t *testing.T) {
+	registerProcessors(t, map[string]ProcessorConstructor{"dsntest": dsnTestProcessor})
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":      "DSN|DSNTest",
+		"save_workers_size": 1,
+		"dsn_process":       "DSNTest",
+		"primary_mail_host": "mx.grr.la",
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gw.Shutdown() }()
+
+	if result := gw.Process(newQueueTestEnvelope(), TaskSaveMail); result.Code() != 250 {
+		t.Error("expecting the message to be accepted, got", result.String())
+	}
+	select {
+	case n := <-dsnTestSent:
+		if !strings.Contains(n.Data.String(), "Final-Recipient: rfc822; b@grr.la") ||
+			strings.Contains(n.Data.String(), "Final-Recipient: rfc822; a@grr.la") {
+			t.Error("expecting only b@grr.la to be reported, got", n.Data.String())
+		}
+		if !strings.Contains(n.Data.String(), "Reporting-MTA: dns; mx.grr.la") {
+			t.Error("expecting primary_mail_host to be the reporting MTA")
+		}
+	default:
+		t.Error("expecting a notification to be sent")
+	}
+
+	// no notification when the recipient asked for none
+	e := newQueueTestEnvelope()
+	e.RcptTo[1].PathParams = [][]string{{"NOTIFY", "NEVER"}}
+	gw.Process(e, TaskSaveMail)
+	select {
+	case <-dsnTestSent:
+		t.Error("not expecting a notification for NOTIFY=NEVER")
+	default:
+	}
+}
+
+func TestDSNReportTemporary(t *testing.T) {
+	e := newQueueTestEnvelope()
+	r := newDSNReport(e, "mx.grr.la", []DeliveryStatus{
+		{Rcpt: e.RcptTo[0], Code: 451, Msg: "4.2.2 Mailbox full"},
+		{Rcpt: e.RcptTo[1], Code: 550, Msg: "5.1.1 No such user"},
+	})
+	if len(r.Recipients) != 2 {
+		t.Fatal("expecting both recipients to be reported, got", r.Recipients)
+	}
+	// the message is not retried, so the failure is permanent
+	if rcpt := r.Recipients[0]; rcpt.Status() != "5.0.0" || rcpt.Reply != "451 4.2.2 Mailbox full" {
+		t.Error("expecting a permanent status with the reply as the diagnostic, got", rcpt.Status(), rcpt.Reply)
+	}
+	if status := r.Recipients[1].Status(); status != "5.1.1" {
+		t.Error("expecting the status of the reply, got", status)
+	}
+}
@@ -99,7 +99,7 @@ type redisClient struct {
 // compressedData struct will be compressed using zlib when printed via fmt
 type compressedData struct {
 	extraHeaders []byte
-	data         *bytes.Buffer
+	data         *mail.Body
 	pool         *sync.Pool
 }
 
@@ -117,7 +117,7 @@ func newCompressedData() *compressedData {
 }
 
 // Set the extraheaders and buffer of data to compress
-func (c *compressedData) set(b []byte, d *bytes.Buffer) {
+func (c *compressedData) set(b []byte, d *mail.Body) {
 	c.extraHeaders = b
 	c.data = d
 }
@@ -139,7 +139,7 @@ func (c *compressedData) String() string {
 	w, _ := zlib.NewWriterLevel(b, zlib.BestSpeed)
 	r = bytes.NewReader(c.extraHeaders)
 	_, _ = io.Copy(w, r)
-	_, _ = io.Copy(w, c.data)
+	_, _ = io.Copy(w, c.data.NewReader())
 	_ = w.Close()
 	return b.String()
 }
@@ -7,10 +7,12 @@ import (
 	"io"
 	"strings"
 	"testing"
+
+	"github.com/phires/go-guerrilla/mail"
 )
 
 func TestCompressedData(t *testing.T) {
-	var b bytes.Buffer
+	var b mail.Body
 	var out bytes.Buffer
 	str := "Hello Hello Hello Hello Hello Hello Hello!"
 	sbj := "Subject:hello\r\n"
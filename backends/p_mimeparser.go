@@ -0,0 +1,91 @@
+package backends
+
+import (
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/mime"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: mimeparser
+// ----------------------------------------------------------------------------------
+// Description   : Parses the message into a tree of MIME parts, with decoded bodies,
+//
+//	: for later processors. Also populates e.Header and e.Subject if the
+//	: headers were not parsed yet. Import mail/encoding or mail/iconv for
+//	: converting more charsets to UTF-8
+//
+// ----------------------------------------------------------------------------------
+// Config Options: mime_max_depth int - limit of nested parts, defaults to 16
+//
+//	: mime_max_parts int - limit of parts, defaults to 1000
+//	: mime_max_part_size int - limit of the decoded size of a part in bytes,
+//	: larger parts are truncated, defaults to 32MB
+//	: mime_max_size int - limit of the decoded size of all the parts in bytes,
+//	: the parts after it are truncated, defaults to 64MB
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["mime"] is set to the *mime.Part at the root of the tree
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["mimeparser"] = func() Decorator {
+		return MimeParser()
+	}
+}
+
+type MimeParserProcessorConfig struct {
+	MaxDepth    int `json:"mime_max_depth,omitempty"`
+	MaxParts    int `json:"mime_max_parts,omitempty"`
+	MaxPartSize int `json:"mime_max_part_size,omitempty"`
+	MaxSize     int `json:"mime_max_size,omitempty"`
+}
+
+// mimeTree returns the tree set by the mimeparser processor, or nil
+func mimeTree(e *mail.Envelope) *mime.Part {
+	if root, ok := e.Values["mime"].(*mime.Part); ok {
+		return root
+	}
+	return nil
+}
+
+func MimeParser() Decorator {
+	var options *mime.Options
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&MimeParserProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config := bcfg.(*MimeParserProcessorConfig)
+		options = &mime.Options{
+			MaxDepth:    config.MaxDepth,
+			MaxParts:    config.MaxParts,
+			MaxPartSize: int64(config.MaxPartSize),
+			MaxSize:     int64(config.MaxSize),
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			switch task {
+			case TaskSaveMail, TaskTest:
+				root, err := mime.Parse(e.Data.NewReader(), options)
+				if err != nil {
+					Log().WithError(err).Error("mime parse error")
+					break
+				}
+				for _, err = range root.Errors() {
+					Log().WithError(err).Debugf("mime part of %s could not be fully parsed", e.QueuedId)
+				}
+				e.Values["mime"] = root
+				if e.Header == nil {
+					e.Header = root.Header
+					e.Subject = mail.MimeHeaderDecode(root.Header.Get("Subject"))
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package backends
+
+import (
+	"testing"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+func TestMimeParser(t *testing.T) {
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":      "MimeParser",
+		"save_workers_size": 1,
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gw.Shutdown() }()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.Data.WriteString("Subject: =?UTF-8?Q?r=C3=A9sum=C3=A9?=\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=cv.pdf\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\nJVBERi0=\r\n--b--\r\n")
+	if r := gw.Process(e, TaskTest); r.Code() != 250 {
+		t.Fatal("unexpected result", r)
+	}
+	root := mimeTree(e)
+	if root == nil {
+		t.Fatal("expecting the MIME tree")
+	}
+	attachments := root.Attachments()
+	if len(attachments) != 1 || attachments[0].Filename != "cv.pdf" || string(attachments[0].Body) != "%PDF-" {
+		t.Error("unexpected attachments", attachments)
+	}
+	if e.Subject != "résumé" || e.Header.Get("Content-Type") == "" {
+		t.Error("expecting the headers to be parsed, got", e.Subject)
+	}
+}
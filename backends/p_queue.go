@@ -0,0 +1,525 @@
+package backends
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/dsn"
+	"github.com/phires/go-guerrilla/queue"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: queue
+// ----------------------------------------------------------------------------------
+// Description   : Writes the envelope to an on-disk spool so that it can be accepted
+//
+//	: straight away, then delivers it with the queue_process stack in the
+//	: background, retrying with an exponential backoff
+//
+// ----------------------------------------------------------------------------------
+// Config Options: queue_dir string - directory of the spool, created if it doesn't exist
+//
+//	: queue_process string - processors to deliver with, eg "Relay" or "HeadersParser|SQL"
+//	: queue_max_age string - how long to keep retrying for, default "120h"
+//	: queue_retry_min string - delay before the first retry, default "1m"
+//	: queue_retry_max string - longest delay between retries, default "1h"
+//	: queue_dsn bool - send a delivery status notification to the sender
+//	: of messages that could not be delivered. Notifications are queued too
+//	: queue_delay_notify string - also notify the sender once when a message
+//	: is still queued after this long, eg "4h". Requires queue_dsn
+//	: dsn_reporting_mta string - name of this host in notifications,
+//	: defaults to primary_mail_host
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.Data, e.DeliveryHeader
+// ----------------------------------------------------------------------------------
+// Output        : the envelope is saved to queue_dir. Delivered messages are removed,
+//
+//	: messages that could not be delivered are moved to queue_dir/failed
+//
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["queue"] = func() Decorator {
+		return Queue()
+	}
+}
+
+const (
+	queueDefaultMaxAge   = time.Hour * 120
+	queueDefaultRetryMin = time.Minute
+	queueDefaultRetryMax = time.Hour
+)
+
+// queueScanInterval is the longest time between scans of the spool. Scanning picks up
+// changes made to the spool by other processes, ie. the 'guerrillad queue' command
+var queueScanInterval = time.Second * 10
+
+type QueueProcessorConfig struct {
+	Dir      string `json:"queue_dir"`
+	Process  string `json:"queue_process"`
+	MaxAge   string `json:"queue_max_age,omitempty"`
+	RetryMin string `json:"queue_retry_min,omitempty"`
+	RetryMax string `json:"queue_retry_max,omitempty"`
+	// DSN options
+	DSN          bool   `json:"queue_dsn,omitempty"`
+	DelayNotify  string `json:"queue_delay_notify,omitempty"`
+	ReportingMTA string `json:"dsn_reporting_mta,omitempty"`
+	PrimaryHost  string `json:"primary_mail_host,omitempty"`
+}
+
+// queueManager schedules the delivery of the items in a spool. All Queue processors
+// using the same queue_dir share a manager, each of them adding a delivery worker
+type queueManager struct {
+	spool    *queue.Spool
+	work     chan *queue.Item
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	inflight map[string]bool
+	refs     int
+	sync.Mutex
+}
+
+var queueManagers = struct {
+	m map[string]*queueManager
+	sync.Mutex
+}{m: make(map[string]*queueManager)}
+
+// acquireQueueManager returns the manager for the dir, starting it if it isn't running.
+// The spool is recovered when the manager starts.
+func acquireQueueManager(dir string) (*queueManager, error) {
+	queueManagers.Lock()
+	defer queueManagers.Unlock()
+	if m, ok := queueManagers.m[dir]; ok {
+		m.refs++
+		return m, nil
+	}
+	spool, err := queue.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = spool.Recover(); err != nil {
+		return nil, err
+	}
+	m := &queueManager{
+		spool:    spool,
+		work:     make(chan *queue.Item),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		inflight: make(map[string]bool),
+		refs:     1,
+	}
+	queueManagers.m[dir] = m
+	go m.schedule()
+	return m, nil
+}
+
+// release stops the manager once it is no longer used by any worker
+func (m *queueManager) release() {
+	queueManagers.Lock()
+	defer queueManagers.Unlock()
+	m.refs--
+	if m.refs > 0 {
+		return
+	}
+	close(m.stop)
+	<-m.done
+	delete(queueManagers.m, m.spool.Dir())
+}
+
+// notify wakes up the scheduler
+func (m *queueManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *queueManager) setInflight(id string, inflight bool) {
+	m.Lock()
+	defer m.Unlock()
+	if inflight {
+		m.inflight[id] = true
+	} else {
+		delete(m.inflight, id)
+	}
+}
+
+func (m *queueManager) isInflight(id string) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.inflight[id]
+}
+
+// schedule hands out the items that are due to the workers
+func (m *queueManager) schedule() {
+	defer close(m.done)
+	for {
+		timer := time.NewTimer(m.dispatch())
+		select {
+		case <-m.stop:
+			timer.Stop()
+			return
+		case <-m.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatch sends all items that are due to the workers, and returns how long to wait
+// until the next item is due
+func (m *queueManager) dispatch() time.Duration {
+	wait := queueScanInterval
+	items, err := m.spool.List()
+	if err != nil {
+		Log().WithError(err).Error("could not list the queue")
+		return wait
+	}
+	now := time.Now()
+	for _, item := range items {
+		if m.isInflight(item.ID) || m.spool.IsLocked(item.ID) {
+			continue
+		}
+		if d := item.NextAttempt.Sub(now); d > 0 {
+			// items are sorted by their next attempt
+			if d < wait {
+				wait = d
+			}
+			break
+		}
+		m.setInflight(item.ID, true)
+		select {
+		case m.work <- item:
+		case <-m.stop:
+			return 0
+		}
+	}
+	return wait
+}
+
+// queueWorker delivers items from a queueManager using its own processor stack
+type queueWorker struct {
+	m        *queueManager
+	p        Processor
+	maxAge   time.Duration
+	retryMin time.Duration
+	retryMax time.Duration
+	// dsn is true if notifications should be sent, from the reporting mta
+	dsn         bool
+	delayNotify time.Duration
+	mta         string
+	stop        chan struct{}
+	done        chan struct{}
+	stopped     bool
+}
+
+func parseQueueDuration(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, err)
+	}
+	return d, nil
+}
+
+func newQueueWorker(config *QueueProcessorConfig, backendConfig BackendConfig) (*queueWorker, error) {
+	w := &queueWorker{stop: make(chan struct{}), done: make(chan struct{})}
+	var err error
+	if w.maxAge, err = parseQueueDuration("queue_max_age", config.MaxAge, queueDefaultMaxAge); err != nil {
+		return nil, err
+	}
+	if w.retryMin, err = parseQueueDuration("queue_retry_min", config.RetryMin, queueDefaultRetryMin); err != nil {
+		return nil, err
+	}
+	if w.retryMax, err = parseQueueDuration("queue_retry_max", config.RetryMax, queueDefaultRetryMax); err != nil {
+		return nil, err
+	}
+	if w.delayNotify, err = parseQueueDuration("queue_delay_notify", config.DelayNotify, 0); err != nil {
+		return nil, err
+	}
+	w.dsn = config.DSN
+	w.mta = reportingMTA(config.ReportingMTA, config.PrimaryHost)
+	if w.retryMin <= 0 || w.retryMax < w.retryMin {
+		return nil, fmt.Errorf("queue_retry_min must be positive and not greater than queue_retry_max")
+	}
+	if w.p, err = newConfigStack(config.Process, backendConfig); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *queueWorker) start(m *queueManager) {
+	w.m = m
+	go func() {
+		defer close(w.done)
+		for {
+			select {
+			case item := <-m.work:
+				w.deliver(item)
+				m.setInflight(item.ID, false)
+				m.notify()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown waits for the current delivery to finish, then releases the manager
+func (w *queueWorker) shutdown() {
+	if w.m == nil || w.stopped {
+		return
+	}
+	w.stopped = true
+	close(w.stop)
+	<-w.done
+	w.m.release()
+}
+
+// backoff returns the delay before the next attempt
+func (w *queueWorker) backoff(attempts int) time.Duration {
+	d := w.retryMin
+	for i := 1; i < attempts && d < w.retryMax; i++ {
+		d *= 2
+	}
+	if d > w.retryMax {
+		d = w.retryMax
+	}
+	return d
+}
+
+// process calls the stack, converting a panic into a temporary failure
+func (w *queueWorker) process(e *mail.Envelope) (result Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			Log().Error("queue worker recovered from panic:", r, string(debug.Stack()))
+			result, err = NewResult("451 4.3.0 Error: processor panic"), fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return w.p.Process(e, TaskSaveMail)
+}
+
+// resultFailure converts the result of a delivery attempt to a queue.Failure
+func resultFailure(rcpt mail.Address, result Result, err error) queue.Failure {
+	f := queue.Failure{Rcpt: rcpt, Code: 451, Msg: "4.3.0 Error: no result from processor"}
+	reply := ""
+	if result != nil {
+		reply = result.String()
+	} else if err != nil {
+		reply = err.Error()
+	}
+	if code, parseErr := strconv.Atoi(strings.SplitN(reply, " ", 2)[0]); parseErr == nil && code >= 400 && code < 600 {
+		f.Code = code
+		f.Msg = strings.TrimSpace(strings.TrimPrefix(reply, strconv.Itoa(code)))
+	} else if reply != "" {
+		f.Msg = "4.3.0 " + reply
+	}
+	return f
+}
+
+// deliver makes a delivery attempt and saves the outcome to the spool
+func (w *queueWorker) deliver(item *queue.Item) {
+	id := item.ID
+	if err := w.m.spool.LockItem(id); err != nil {
+		// another process is changing it, it is picked up again by the next scan
+		Log().WithError(err).Debugf("skipping queued message %s", id)
+		return
+	}
+	defer func() {
+		if err := w.m.spool.UnlockItem(id); err != nil {
+			Log().WithError(err).Errorf("could not unlock queued message %s", id)
+		}
+	}()
+	// re-read the item, it may have been changed or removed since the spool was listed
+	item, err := w.m.spool.Get(id)
+	if err == queue.ErrNotFound {
+		return
+	} else if err != nil {
+		Log().WithError(err).Errorf("could not read queued message %s", id)
+		return
+	}
+	e := item.Envelope()
+	r, err := w.m.spool.Message(item.ID)
+	if err == nil {
+		_, err = e.Data.ReadFrom(r)
+		_ = r.Close()
+	}
+	if err != nil {
+		Log().WithError(err).Errorf("could not read queued message %s", item.ID)
+		return
+	}
+	item.Attempts++
+	e.Values["queue_id"] = item.ID
+	result, err := w.process(e)
+	var pending []mail.Address
+	if statuses, ok := e.Values["relay_status"].([]DeliveryStatus); ok && len(statuses) == len(item.RcptTo) {
+		// the stack reported the outcome of each recipient
+		for _, status := range statuses {
+			if status.Delivered() {
+				continue
+			}
+			f := queue.Failure{Rcpt: status.Rcpt, Code: status.Code, Msg: status.Msg, RemoteMTA: status.RemoteMTA}
+			if status.Temporary() {
+				pending = append(pending, status.Rcpt)
+				item.LastError = status.String()
+			} else {
+				item.Failed = append(item.Failed, f)
+			}
+		}
+	} else if err != nil || result == nil || result.Code() >= 300 {
+		for _, rcpt := range item.RcptTo {
+			f := resultFailure(rcpt, result, err)
+			if f.Code >= 400 && f.Code < 500 {
+				pending = append(pending, rcpt)
+				item.LastError = fmt.Sprintf("%d %s", f.Code, f.Msg)
+			} else {
+				item.Failed = append(item.Failed, f)
+			}
+		}
+	}
+	if len(pending) > 0 && time.Since(item.Created) > w.maxAge {
+		for _, rcpt := range pending {
+			item.Failed = append(item.Failed, queue.Failure{
+				Rcpt: rcpt,
+				Code: 554,
+				Msg:  "5.4.7 Delivery time expired, last error: " + item.LastError,
+			})
+		}
+		pending = nil
+	}
+	item.RcptTo = pending
+	if w.dsn && len(pending) > 0 && w.delayNotify > 0 && !item.DelayNotified &&
+		time.Since(item.Created) > w.delayNotify {
+		w.bounce(item, true)
+		item.DelayNotified = true
+	}
+	switch {
+	case len(pending) > 0:
+		item.NextAttempt = time.Now().Add(w.backoff(item.Attempts))
+		err = w.m.spool.Update(item)
+		Log().Infof("queued message %s deferred until %s: %s",
+			item.ID, item.NextAttempt.Format(time.RFC3339), item.LastError)
+	case len(item.Failed) > 0:
+		if w.dsn {
+			w.bounce(item, false)
+		}
+		err = w.m.spool.Fail(item)
+		Log().Warnf("queued message %s failed for %d recipient(s)", item.ID, len(item.Failed))
+	default:
+		err = w.m.spool.Remove(item.ID)
+		Log().Infof("queued message %s delivered after %d attempt(s)", item.ID, item.Attempts)
+	}
+	if err != nil {
+		Log().WithError(err).Errorf("could not update queued message %s", item.ID)
+	}
+}
+
+// bounce queues a delivery status notification about the failed recipients of the item.
+// If delayed is true, the pending recipients are reported as delayed instead
+func (w *queueWorker) bounce(item *queue.Item, delayed bool) {
+	now := time.Now()
+	report := &dsn.Report{ReportingMTA: w.mta, MailFrom: item.MailFrom, QueuedId: item.QueuedId, ArrivalDate: item.Created}
+	if delayed {
+		for _, rcpt := range item.RcptTo {
+			report.Recipients = append(report.Recipients, dsn.Recipient{
+				Rcpt:           rcpt,
+				Action:         dsn.Delayed,
+				Reply:          item.LastError,
+				LastAttempt:    now,
+				WillRetryUntil: item.Created.Add(w.maxAge),
+			})
+		}
+	} else {
+		for _, f := range item.Failed {
+			report.Recipients = append(report.Recipients, dsn.Recipient{
+				Rcpt:        f.Rcpt,
+				Action:      dsn.Failed,
+				Reply:       fmt.Sprintf("%d %s", f.Code, f.Msg),
+				RemoteMTA:   f.RemoteMTA,
+				LastAttempt: now,
+			})
+		}
+	}
+	r, err := w.m.spool.Message(item.ID)
+	if err != nil {
+		Log().WithError(err).Errorf("could not read queued message %s", item.ID)
+		return
+	}
+	defer func() { _ = r.Close() }()
+	e, err := report.Envelope(io.MultiReader(strings.NewReader(item.DeliveryHeader), r))
+	if err == dsn.ErrNullSender || err == dsn.ErrNoNotify {
+		Log().Debugf("no delivery status notification for queued message %s: %s", item.ID, err)
+		return
+	} else if err != nil {
+		Log().WithError(err).Errorf("could not create delivery status notification for %s", item.ID)
+		return
+	}
+	notification := queue.NewItem(e)
+	if err = w.m.spool.Put(notification, e.Data.NewReader()); err != nil {
+		Log().WithError(err).Errorf("could not queue delivery status notification for %s", item.ID)
+		return
+	}
+	Log().Infof("queued delivery status notification %s for %s to <%s>",
+		notification.ID, item.ID, item.MailFrom.String())
+}
+
+func Queue() Decorator {
+	var (
+		config *QueueProcessorConfig
+		worker *queueWorker
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&QueueProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*QueueProcessorConfig)
+		if worker, err = newQueueWorker(config, backendConfig); err != nil {
+			return err
+		}
+		// start delivering once the processors of the worker's stack have been initialized
+		Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+			m, err := acquireQueueManager(config.Dir)
+			if err != nil {
+				return err
+			}
+			worker.start(m)
+			return nil
+		}))
+		return nil
+	}))
+
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if worker != nil {
+			worker.shutdown()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail {
+				item := queue.NewItem(e)
+				if err := worker.m.spool.Put(item, e.Data.NewReader()); err != nil {
+					Log().WithError(err).Error("could not queue email")
+					return NewResult("451 4.3.0 Error: could not queue email"), StorageError
+				}
+				Log().Debugf("queued %s as %s", e.QueuedId, item.ID)
+				worker.m.notify()
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package backends
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/queue"
+)
+
+// queueTestDelivery is called by the queuetest processor for each delivery attempt
+var queueTestDelivery struct {
+	fn       func(e *mail.Envelope, attempt int) (Result, error)
+	attempts int
+	sync.Mutex
+}
+
+// queueTestProcessor delivers with queueTestDelivery.fn
+func queueTestProcessor() Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			queueTestDelivery.Lock()
+			defer queueTestDelivery.Unlock()
+			queueTestDelivery.attempts++
+			return queueTestDelivery.fn(e, queueTestDelivery.attempts)
+		})
+	}
+}
+
+func newQueueTestGateway(t *testing.T, cfg BackendConfig, fn func(e *mail.Envelope, attempt int) (Result, error)) Backend {
+	registerProcessors(t, map[string]ProcessorConstructor{"queuetest": queueTestProcessor})
+	queueTestDelivery.Lock()
+	queueTestDelivery.fn = fn
+	queueTestDelivery.attempts = 0
+	queueTestDelivery.Unlock()
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	cfg["save_process"] = "Queue"
+	cfg["save_workers_size"] = 1
+	cfg["queue_process"] = "QueueTest"
+	cfg["queue_retry_min"] = "10ms"
+	cfg["queue_retry_max"] = "20ms"
+	gw, err := New(cfg, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return gw
+}
+
+func newQueueTestEnvelope() *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "sender", Host: "example.com"}
+	e.RcptTo = []mail.Address{{User: "a", Host: "grr.la"}, {User: "b", Host: "grr.la"}}
+	e.Data.WriteString("Subject: queue test\r\n\r\nhello\r\n")
+	return e
+}
+
+// waitForQueue waits until the spool has no queued items
+func waitForQueue(t *testing.T, s *queue.Spool) {
+	for i := 0; i < 200; i++ {
+		if items, _ := s.List(); len(items) == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("timed out waiting for the queue to be delivered")
+}
+
+func TestQueueRetry(t *testing.T) {
+	dir := t.TempDir()
+	var delivered []string
+	gw := newQueueTestGateway(t, BackendConfig{"queue_dir": dir}, func(e *mail.Envelope, attempt int) (Result, error) {
+		if attempt == 1 {
+			return NewResult("451 4.4.1 try again later"), nil
+		}
+		if !strings.Contains(e.Data.String(), "hello") {
+			t.Error("expecting the message data to be delivered, got", e.Data.String())
+		}
+		delivered = append(delivered, e.RcptTo[0].String())
+		e.Values["relay_status"] = []DeliveryStatus{
+			{Rcpt: e.RcptTo[0], Code: 250, Msg: "2.0.0 OK"},
+			{Rcpt: e.RcptTo[1], Code: 550, Msg: "5.1.1 No such user", RemoteMTA: "mx.grr.la:25"},
+		}
+		return BackendResultOK, nil
+	})
+	defer func() { _ = gw.Shutdown() }()
+
+	result := gw.Process(newQueueTestEnvelope(), TaskSaveMail)
+	if result.Code() != 250 {
+		t.Error("expecting the email to be accepted, got", result.String())
+	}
+	s, _ := queue.Open(dir)
+	waitForQueue(t, s)
+
+	queueTestDelivery.Lock()
+	if queueTestDelivery.attempts != 2 {
+		t.Error("expecting 2 delivery attempts, got", queueTestDelivery.attempts)
+	}
+	queueTestDelivery.Unlock()
+	if len(delivered) != 1 || delivered[0] != "a@grr.la" {
+		t.Error("expecting a@grr.la to be delivered, got", delivered)
+	}
+	failed, _ := s.ListFailed()
+	if len(failed) != 1 {
+		t.Fatal("expecting 1 failed item, got", len(failed))
+	}
+	if len(failed[0].Failed) != 1 || failed[0].Failed[0].Rcpt.String() != "b@grr.la" ||
+		failed[0].Failed[0].Code != 550 || failed[0].Attempts != 2 {
+		t.Error("expecting b@grr.la to have failed, got", failed[0].Failed)
+	}
+}
+
+func TestQueueExpire(t *testing.T) {
+	dir := t.TempDir()
+	gw := newQueueTestGateway(t, BackendConfig{"queue_dir": dir, "queue_max_age": "30ms"}, func(e *mail.Envelope, attempt int) (Result, error) {
+		return NewResult("421 4.4.2 connection dropped"), nil
+	})
+	defer func() { _ = gw.Shutdown() }()
+
+	gw.Process(newQueueTestEnvelope(), TaskSaveMail)
+	s, _ := queue.Open(dir)
+	waitForQueue(t, s)
+	failed, _ := s.ListFailed()
+	if len(failed) != 1 || len(failed[0].Failed) != 2 {
+		t.Fatal("expecting both recipients to have failed, got", failed)
+	}
+	if f := failed[0].Failed[0]; f.Code != 554 || !strings.Contains(f.Msg, "5.4.7") ||
+		!strings.Contains(f.Msg, "connection dropped") {
+		t.Error("expecting the delivery time to have expired, got", f)
+	}
+}
+
+func TestQueueRecoverOnStart(t *testing.T) {
+	dir := t.TempDir()
+	// a message queued before a restart
+	s, _ := queue.Open(dir)
+	item := queue.NewItem(newQueueTestEnvelope())
+	if err := s.Put(item, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string, 2)
+	gw := newQueueTestGateway(t, BackendConfig{"queue_dir": dir}, func(e *mail.Envelope, attempt int) (Result, error) {
+		done <- e.Data.String()
+		return BackendResultOK, nil
+	})
+	defer func() { _ = gw.Shutdown() }()
+	select {
+	case data := <-done:
+		if data != "hello" {
+			t.Error("unexpected data", data)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("queued message was not delivered after start")
+	}
+	waitForQueue(t, s)
+	if failed, _ := s.ListFailed(); len(failed) != 0 {
+		t.Error("expecting no failed items")
+	}
+}
+
+func TestQueueLockedItem(t *testing.T) {
+	dir := t.TempDir()
+	delivered := make(chan string, 3)
+	gw := newQueueTestGateway(t, BackendConfig{"queue_dir": dir}, func(e *mail.Envelope, attempt int) (Result, error) {
+		delivered <- e.Data.String()
+		return BackendResultOK, nil
+	})
+	defer func() { _ = gw.Shutdown() }()
+	next := func() string {
+		select {
+		case data := <-delivered:
+			return data
+		case <-time.After(time.Second * 2):
+			t.Fatal("timed out waiting for a delivery")
+		}
+		return ""
+	}
+
+	// an item being changed by the 'guerrillad queue' command
+	s, _ := queue.Open(dir)
+	item := queue.NewItem(newQueueTestEnvelope())
+	if err := s.Put(item, strings.NewReader("locked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LockItem(item.ID); err != nil {
+		t.Fatal(err)
+	}
+	// queuing wakes up the scheduler, which must leave the locked item alone
+	gw.Process(newQueueTestEnvelope(), TaskSaveMail)
+	if data := next(); data == "locked" {
+		t.Fatal("expecting the locked item not to be delivered")
+	}
+	select {
+	case data := <-delivered:
+		t.Fatal("expecting the locked item not to be delivered, got", data)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	if err := s.UnlockItem(item.ID); err != nil {
+		t.Fatal(err)
+	}
+	gw.Process(newQueueTestEnvelope(), TaskSaveMail)
+	if first, second := next(), next(); first != "locked" && second != "locked" {
+		t.Error("expecting the unlocked item to be delivered")
+	}
+	waitForQueue(t, s)
+}
+
+func TestQueueDSN(t *testing.T) {
+	dir := t.TempDir()
+	notifications := make(chan *mail.Envelope, 2)
+	attempts := 0
+	gw := newQueueTestGateway(t, BackendConfig{
+		"queue_dir":          dir,
+		"queue_dsn":          true,
+		"queue_delay_notify": "1ns",
+		"dsn_reporting_mta":  "mx.grr.la",
+	}, func(e *mail.Envelope, attempt int) (Result, error) {
+		if e.MailFrom.NullPath {
+			notifications <- e
+			return BackendResultOK, nil
+		}
+		attempts++
+		if attempts == 1 {
+			// a is rejected, b is delayed
+			e.Values["relay_status"] = []DeliveryStatus{
+				{Rcpt: e.RcptTo[0], Code: 550, Msg: "5.1.1 No such user"},
+				{Rcpt: e.RcptTo[1], Code: 451, Msg: "4.4.1 try again later"},
+			}
+			return NewResult("451 4.4.1 try again later"), RelayError
+		}
+		// b is rejected too
+		return NewResult("554 5.7.1 rejected"), nil
+	})
+	defer func() { _ = gw.Shutdown() }()
+
+	gw.Process(newQueueTestEnvelope(), TaskSaveMail)
+	expect := []string{"Action: delayed", "Action: failed"}
+	for i := range expect {
+		select {
+		case n := <-notifications:
+			if len(n.RcptTo) != 1 || n.RcptTo[0].String() != "sender@example.com" {
+				t.Error("expecting the notification to be sent to the sender, got", n.RcptTo)
+			}
+			if !strings.Contains(n.Data.String(), expect[i]) || !strings.Contains(n.Data.String(), "b@grr.la") {
+				t.Error("expecting a notification with", expect[i], "got", n.Data.String())
+			}
+			if i == 1 && (!strings.Contains(n.Data.String(), "a@grr.la") ||
+				!strings.Contains(n.Data.String(), "Status: 5.7.1")) {
+				t.Error("expecting both recipients to be reported as failed, got", n.Data.String())
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatal("timed out waiting for a notification")
+		}
+	}
+	s, _ := queue.Open(dir)
+	waitForQueue(t, s)
+}
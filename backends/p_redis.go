@@ -96,12 +96,13 @@ func Redis() Decorator {
 				if len(e.Hashes) > 0 {
 					e.QueuedId = e.Hashes[0]
 					hash = e.Hashes[0]
-					var stringer fmt.Stringer
+					var data []byte
 					// a compressor was set
 					if c, ok := e.Values["zlib-compressor"]; ok {
-						stringer = c.(*DataCompressor)
-					} else {
-						stringer = e
+						data = c.(*DataCompressor).Bytes()
+					} else if data, redisErr = messageBytes(e); redisErr != nil {
+						Log().WithError(redisErr).Error("Error while reading the email")
+						return NewResult(response.Canned.FailBackendTransaction), redisErr
 					}
 					redisErr = redisClient.redisConnection(config.RedisInterface)
 					if redisErr != nil {
@@ -109,7 +110,7 @@ func Redis() Decorator {
 						result := NewResult(response.Canned.FailBackendTransaction)
 						return result, redisErr
 					}
-					_, doErr := redisClient.conn.Do("SETEX", hash, config.RedisExpireSeconds, stringer)
+					_, doErr := redisClient.conn.Do("SETEX", hash, config.RedisExpireSeconds, data)
 					if doErr != nil {
 						Log().WithError(doErr).Warn("Error while SETEX to redis")
 						result := NewResult(response.Canned.FailBackendTransaction)
@@ -0,0 +1,433 @@
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: relay
+// ----------------------------------------------------------------------------------
+// Description   : Forwards the envelope to a smarthost, a per-domain route or
+//
+//	: the MX of the recipient's domain
+//
+// ----------------------------------------------------------------------------------
+// Config Options: relay_smarthost string - host:port of a smarthost to send all mail to.
+//
+//	: If empty, mail is delivered to the MX of each recipient's domain
+//	: relay_routes string - per-domain routes which take priority over the
+//	: smarthost, eg "example.com=mx.example.com:25,example.org=10.0.0.1:2525"
+//	: relay_username string - username for AUTH PLAIN (smarthost and routes only)
+//	: relay_password string - password for AUTH PLAIN
+//	: relay_starttls string - "opportunistic" (default), "required" or "off"
+//	: relay_tls_skip_verify bool - do not verify the remote certificate
+//	: relay_helo string - name to use in EHLO, defaults to primary_mail_host
+//	: relay_timeout string - timeout for each remote session, eg "30s"
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.MailFrom, e.RcptTo, e.NewReader()
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["relay_status"] is set to a []DeliveryStatus with the
+//
+//	: remote reply for each recipient. If no recipient was accepted,
+//	: the remote reply is returned to the client. Otherwise the message is
+//	: accepted, and the recipients that failed are only reported in
+//	: relay_status, so the stack must have the DSN processor before Relay
+//	: to bounce them, or Relay must run in the queue_process of the Queue
+//	: processor to retry them. Relay fails to initialize without either
+//
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["relay"] = func() Decorator {
+		return Relay()
+	}
+}
+
+const (
+	relayStartTLSOpportunistic = "opportunistic"
+	relayStartTLSRequired      = "required"
+	relayStartTLSOff           = "off"
+
+	// default timeout for each remote session, if 'relay_timeout' not present in config
+	relayTimeout = time.Second * 30
+	// port used when delivering to an MX
+	relayMXPort = "25"
+)
+
+// RelayLookupMX is used for finding the mail exchangers of a recipient domain.
+// It can be replaced for testing.
+var RelayLookupMX = net.LookupMX
+
+type RelayProcessorConfig struct {
+	Smarthost   string `json:"relay_smarthost,omitempty"`
+	Routes      string `json:"relay_routes,omitempty"`
+	Username    string `json:"relay_username,omitempty"`
+	Password    string `json:"relay_password,omitempty"`
+	StartTLS    string `json:"relay_starttls,omitempty"`
+	SkipVerify  bool   `json:"relay_tls_skip_verify,omitempty"`
+	Helo        string `json:"relay_helo,omitempty"`
+	Timeout     string `json:"relay_timeout,omitempty"`
+	PrimaryHost string `json:"primary_mail_host"`
+}
+
+// DeliveryStatus is the outcome of a delivery attempt for a single recipient
+type DeliveryStatus struct {
+	Rcpt mail.Address
+	// Code is the basic SMTP reply code, ie. 250
+	Code int
+	// Msg is the text of the reply, usually starting with an enhanced status code
+	Msg string
+	// RemoteMTA is the host that gave the reply, empty if no host could be reached
+	RemoteMTA string
+}
+
+// Delivered returns true if the recipient was accepted by the remote host
+func (d DeliveryStatus) Delivered() bool {
+	return d.Code >= 200 && d.Code < 300
+}
+
+// Temporary returns true if the delivery may succeed if attempted again
+func (d DeliveryStatus) Temporary() bool {
+	return d.Code >= 400 && d.Code < 500
+}
+
+// String returns the status as a single-line SMTP reply
+func (d DeliveryStatus) String() string {
+	return fmt.Sprintf("%d %s", d.Code, strings.Replace(d.Msg, "\n", " ", -1))
+}
+
+// relayTarget is a list of hosts that can accept mail for a group of recipients
+type relayTarget struct {
+	// hosts are host:port pairs, tried in order
+	hosts []string
+	// auth is true if the credentials may be sent to these hosts
+	auth bool
+}
+
+type relayClient struct {
+	config   *RelayProcessorConfig
+	routes   map[string]string
+	timeout  time.Duration
+	startTLS string
+}
+
+// parseRelayRoutes parses the relay_routes config value into a map of domain => host:port
+func parseRelayRoutes(s string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid relay route [%s], expecting domain=host:port", item)
+		}
+		routes[strings.ToLower(strings.TrimSpace(kv[0]))] = withDefaultPort(strings.TrimSpace(kv[1]))
+	}
+	return routes, nil
+}
+
+// withDefaultPort adds the SMTP port to addr if it does not have one
+func withDefaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), relayMXPort)
+	}
+	return addr
+}
+
+func newRelayClient(config *RelayProcessorConfig) (*relayClient, error) {
+	r := &relayClient{config: config, timeout: relayTimeout, startTLS: relayStartTLSOpportunistic}
+	var err error
+	if r.routes, err = parseRelayRoutes(config.Routes); err != nil {
+		return nil, err
+	}
+	if config.Timeout != "" {
+		if r.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid relay_timeout: %s", err)
+		}
+	}
+	switch strings.ToLower(config.StartTLS) {
+	case "":
+	case relayStartTLSOpportunistic, relayStartTLSRequired, relayStartTLSOff:
+		r.startTLS = strings.ToLower(config.StartTLS)
+	default:
+		return nil, fmt.Errorf("invalid relay_starttls [%s]", config.StartTLS)
+	}
+	return r, nil
+}
+
+// helo returns the name to use in the EHLO command
+func (r *relayClient) helo() string {
+	if r.config.Helo != "" {
+		return r.config.Helo
+	}
+	if r.config.PrimaryHost != "" {
+		return r.config.PrimaryHost
+	}
+	return "localhost"
+}
+
+// route finds where mail for the recipient should go. The returned key groups
+// recipients that can be delivered in the same session.
+func (r *relayClient) route(rcpt mail.Address) (key string, target *relayTarget, err error) {
+	domain := strings.ToLower(rcpt.Host)
+	if addr, ok := r.routes[domain]; ok {
+		return addr, &relayTarget{hosts: []string{addr}, auth: true}, nil
+	}
+	if r.config.Smarthost != "" {
+		addr := withDefaultPort(r.config.Smarthost)
+		return addr, &relayTarget{hosts: []string{addr}, auth: true}, nil
+	}
+	if rcpt.IP != nil {
+		addr := net.JoinHostPort(rcpt.IP.String(), relayMXPort)
+		return addr, &relayTarget{hosts: []string{addr}}, nil
+	}
+	mxs, err := RelayLookupMX(domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return domain, nil, err
+		}
+	}
+	target = &relayTarget{}
+	nullMX := false
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// null MX, the domain does not accept mail (RFC 7505)
+			nullMX = true
+			continue
+		}
+		target.hosts = append(target.hosts, net.JoinHostPort(host, relayMXPort))
+	}
+	if len(mxs) == 0 {
+		// no MX records, use the implicit MX (RFC 5321 section 5.1)
+		target.hosts = append(target.hosts, net.JoinHostPort(domain, relayMXPort))
+	}
+	if nullMX && len(target.hosts) == 0 {
+		return domain, nil, &textproto.Error{Code: 556, Msg: "5.1.10 Recipient address has null MX"}
+	}
+	return domain, target, nil
+}
+
+// relayErrorStatus converts an error to a DeliveryStatus. Errors that were not replies
+// from the remote host are considered temporary
+func relayErrorStatus(rcpt mail.Address, host string, err error) DeliveryStatus {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return DeliveryStatus{Rcpt: rcpt, Code: tpErr.Code, Msg: tpErr.Msg, RemoteMTA: host}
+	}
+	return DeliveryStatus{Rcpt: rcpt, Code: 451, Msg: "4.4.1 " + err.Error(), RemoteMTA: host}
+}
+
+// deliver sends the envelope to the first host of the target that can be reached,
+// returning a status for each of the recipients
+func (r *relayClient) deliver(e *mail.Envelope, target *relayTarget, rcpts []mail.Address) []DeliveryStatus {
+	statuses := make([]DeliveryStatus, len(rcpts))
+	lastErr := errors.New("no hosts to deliver to")
+	lastHost := ""
+	for _, host := range target.hosts {
+		c, err := r.dial(e.Context(), host, target.auth)
+		if err == nil {
+			err = c.Mail(e.MailFrom.String())
+		}
+		if err != nil {
+			lastErr, lastHost = err, host
+			if c != nil {
+				_ = c.Close()
+			}
+			var tpErr *textproto.Error
+			if errors.As(err, &tpErr) && tpErr.Code >= 500 {
+				// permanent failure, other hosts will not do any better
+				break
+			}
+			continue
+		}
+		accepted := make([]int, 0, len(rcpts))
+		for i := range rcpts {
+			if err := c.Rcpt(rcpts[i].String()); err != nil {
+				statuses[i] = relayErrorStatus(rcpts[i], host, err)
+				continue
+			}
+			accepted = append(accepted, i)
+		}
+		if len(accepted) > 0 {
+			err = r.data(c, e)
+			for _, i := range accepted {
+				if err != nil {
+					statuses[i] = relayErrorStatus(rcpts[i], host, err)
+				} else {
+					statuses[i] = DeliveryStatus{Rcpt: rcpts[i], Code: 250, Msg: "2.0.0 OK", RemoteMTA: host}
+				}
+			}
+		}
+		if err := c.Quit(); err != nil {
+			_ = c.Close()
+		}
+		return statuses
+	}
+	for i := range rcpts {
+		statuses[i] = relayErrorStatus(rcpts[i], lastHost, lastErr)
+	}
+	return statuses
+}
+
+// dial connects to the host and gets the session ready for the MAIL command
+func (r *relayClient) dial(ctx context.Context, host string, auth bool) (*smtp.Client, error) {
+	d := net.Dialer{Timeout: r.timeout}
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Now().Add(r.timeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	name, _, _ := net.SplitHostPort(host)
+	c, err := smtp.NewClient(conn, name)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err = c.Hello(r.helo()); err != nil {
+		return c, err
+	}
+	if r.startTLS != relayStartTLSOff {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			tlsConfig := &tls.Config{
+				ServerName:         name,
+				InsecureSkipVerify: r.config.SkipVerify, // #nosec G402 -- only when configured
+				MinVersion:         tls.VersionTLS12,
+			}
+			if err = c.StartTLS(tlsConfig); err != nil {
+				return c, err
+			}
+		} else if r.startTLS == relayStartTLSRequired {
+			return c, &textproto.Error{Code: 451, Msg: "4.7.0 STARTTLS required but not offered by " + host}
+		}
+	}
+	if auth && r.config.Username != "" {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err = c.Auth(smtp.PlainAuth("", r.config.Username, r.config.Password, name)); err != nil {
+				return c, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// data sends the message data, returning the error of the final reply, if any
+func (r *relayClient) data(c *smtp.Client, e *mail.Envelope) error {
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, e.NewReader()); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// relay delivers the envelope to all recipients, grouping them by destination
+func (r *relayClient) relay(e *mail.Envelope) []DeliveryStatus {
+	statuses := make([]DeliveryStatus, len(e.RcptTo))
+	type group struct {
+		target  *relayTarget
+		indexes []int
+	}
+	groups := make(map[string]*group)
+	var order []string
+	for i := range e.RcptTo {
+		key, target, err := r.route(e.RcptTo[i])
+		if err != nil {
+			statuses[i] = relayErrorStatus(e.RcptTo[i], "", err)
+			continue
+		}
+		if _, ok := groups[key]; !ok {
+			groups[key] = &group{target: target}
+			order = append(order, key)
+		}
+		groups[key].indexes = append(groups[key].indexes, i)
+	}
+	for _, key := range order {
+		g := groups[key]
+		rcpts := make([]mail.Address, len(g.indexes))
+		for j, i := range g.indexes {
+			rcpts[j] = e.RcptTo[i]
+		}
+		for j, status := range r.deliver(e, g.target, rcpts) {
+			statuses[g.indexes[j]] = status
+		}
+	}
+	return statuses
+}
+
+// relayResult picks the reply to give to the client when no recipient was delivered.
+// Temporary failures are preferred, so that the client tries again later
+func relayResult(statuses []DeliveryStatus) Result {
+	for i := range statuses {
+		if statuses[i].Temporary() {
+			return NewResult(statuses[i].String())
+		}
+	}
+	return NewResult(statuses[0].String())
+}
+
+func Relay() Decorator {
+	var client *relayClient
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&RelayProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		if !stacksUse(backendConfig, "dsn", "queue") {
+			// a partial delivery is accepted, the failed recipients would be lost
+			return errors.New("the relay processor needs the dsn or queue processor, " +
+				"to report the recipients that could not be delivered to")
+		}
+		client, err = newRelayClient(bcfg.(*RelayProcessorConfig))
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			switch task {
+			case TaskSaveMail, TaskTest:
+				if len(e.RcptTo) == 0 {
+					break
+				}
+				statuses := client.relay(e)
+				e.Values["relay_status"] = statuses
+				delivered := 0
+				for i := range statuses {
+					if statuses[i].Delivered() {
+						delivered++
+					} else {
+						Log().WithError(errors.New(statuses[i].String())).Warnf(
+							"relay to <%s> via [%s] failed", statuses[i].Rcpt.String(), statuses[i].RemoteMTA)
+					}
+				}
+				if delivered == 0 {
+					return relayResult(statuses), RelayError
+				}
+				Log().Infof("relayed %s to %d of %d recipient(s)", e.QueuedId, delivered, len(statuses))
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
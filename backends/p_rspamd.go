@@ -0,0 +1,147 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: rspamd
+// ----------------------------------------------------------------------------------
+// Description   : Scans the message with rspamd, using the /checkv2 endpoint of its HTTP
+//
+//	: protocol, and adds the X-Spam-Flag, X-Spam-Score and X-Spam-Status headers.
+//	: If rspamd cannot be reached, the message is accepted without a score
+//
+// ----------------------------------------------------------------------------------
+// Config Options: rspamd_url string - base URL of rspamd, defaults to http://127.0.0.1:11333
+//
+//	: rspamd_password string - the password of the controller, if set
+//	: spam_tag_score string - score from which X-Spam-Flag is added,
+//	: defaults to the action of rspamd
+//	: spam_reject_score string - score from which the message is rejected,
+//	: defaults to the action of rspamd, reject gives a 5xx reply,
+//	: soft reject and greylist give a 4xx reply
+//	: spam_timeout string - timeout of the scan, defaults to "30s"
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader, e.RemoteIP, e.Helo, e.MailFrom, e.RcptTo
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["spam"] is set to the *SpamResult
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["rspamd"] = func() Decorator {
+		return Rspamd()
+	}
+}
+
+type RspamdProcessorConfig struct {
+	URL      string `json:"rspamd_url,omitempty"`
+	Password string `json:"rspamd_password,omitempty"`
+}
+
+const rspamdDefaultURL = "http://127.0.0.1:11333"
+
+// rspamdReply is the part of the /checkv2 reply that is used
+type rspamdReply struct {
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Action        string  `json:"action"`
+	Symbols       map[string]struct {
+		Score float64 `json:"score"`
+	} `json:"symbols"`
+}
+
+// rspamdCheck posts the message to rspamd, with the envelope in the request headers
+func rspamdCheck(client *http.Client, config *RspamdProcessorConfig, e *mail.Envelope) (*SpamResult, error) {
+	req, err := http.NewRequestWithContext(e.Context(), http.MethodPost, strings.TrimSuffix(config.URL, "/")+"/checkv2", e.NewReader())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("IP", e.RemoteIP)
+	req.Header.Set("Helo", e.Helo)
+	if !e.MailFrom.IsEmpty() {
+		req.Header.Set("From", e.MailFrom.String())
+	}
+	for i := range e.RcptTo {
+		req.Header.Add("Rcpt", e.RcptTo[i].String())
+	}
+	if e.QueuedId != "" {
+		req.Header.Set("Queue-Id", e.QueuedId)
+	}
+	if config.Password != "" {
+		req.Header.Set("Password", config.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd replied with status %s", resp.Status)
+	}
+	var reply rspamdReply
+	if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	result := &SpamResult{
+		Score:    reply.Score,
+		Required: reply.RequiredScore,
+		Action:   reply.Action,
+		Spam:     reply.Action != "no action" && reply.Action != "greylist",
+	}
+	for name := range reply.Symbols {
+		result.Symbols = append(result.Symbols, name)
+	}
+	// map order is random, keep the headers stable
+	sort.Strings(result.Symbols)
+	return result, nil
+}
+
+func Rspamd() Decorator {
+	var (
+		config *RspamdProcessorConfig
+		policy *spamPolicy
+		client *http.Client
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&RspamdProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*RspamdProcessorConfig)
+		if config.URL == "" {
+			config.URL = rspamdDefaultURL
+		}
+		if policy, err = newSpamPolicy(backendConfig); err != nil {
+			return err
+		}
+		client = &http.Client{Timeout: policy.timeout}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail || task == TaskTest {
+				result, err := rspamdCheck(client, config, e)
+				if err != nil {
+					Log().WithError(err).Error("rspamd scan failed, accepting ", e.QueuedId)
+				} else {
+					Log().Debugf("rspamd score %.1f/%.1f action %s for %s",
+						result.Score, result.Required, result.Action, e.QueuedId)
+					if r, err := policy.apply(e, result); err != nil {
+						return r, err
+					}
+				}
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
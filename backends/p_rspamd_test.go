@@ -0,0 +1,99 @@
+package backends
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+func TestRspamd(t *testing.T) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		header = r.Header
+		body, _ := io.ReadAll(r.Body)
+		reply := map[string]interface{}{
+			"score":          2.0,
+			"required_score": 15.0,
+			"action":         "no action",
+			"symbols":        map[string]interface{}{"R_SPF_ALLOW": map[string]interface{}{"score": -0.2}},
+		}
+		switch {
+		case strings.Contains(string(body), "reject me"):
+			reply["score"], reply["action"] = 20.0, "reject"
+		case strings.Contains(string(body), "greylist me"):
+			reply["score"], reply["action"] = 5.0, "greylist"
+		case strings.Contains(string(body), "tag me"):
+			reply["score"], reply["action"] = 8.0, "add header"
+		}
+		_ = json.NewEncoder(w).Encode(reply)
+	}))
+	defer srv.Close()
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+
+	tests := []struct {
+		name   string
+		config BackendConfig
+		body   string
+		code   int
+		flag   bool
+	}{
+		{"ham", BackendConfig{}, "hello", 250, false},
+		{"tagged", BackendConfig{}, "tag me", 250, true},
+		{"rejected", BackendConfig{}, "reject me", 550, false},
+		{"greylisted", BackendConfig{}, "greylist me", 451, false},
+		{"score below reject", BackendConfig{"spam_reject_score": "30"}, "reject me", 250, true},
+		{"score above reject", BackendConfig{"spam_reject_score": "1"}, "hello", 550, false},
+		{"score below tag", BackendConfig{"spam_tag_score": "10"}, "tag me", 250, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := BackendConfig{
+				"save_process":      "rspamd",
+				"save_workers_size": 1,
+				"rspamd_url":        srv.URL,
+			}
+			for k, v := range test.config {
+				config[k] = v
+			}
+			gw, err := New(config, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = gw.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = gw.Shutdown() }()
+			e := mail.NewEnvelope("192.0.2.1", 1)
+			e.Helo = "mail.example.com"
+			e.MailFrom = mail.Address{User: "sender", Host: "example.com"}
+			e.PushRcpt(mail.Address{User: "test", Host: "grr.la"})
+			e.Data.WriteString("Subject: hi\r\n\r\n" + test.body + "\r\n")
+			if r := gw.Process(e, TaskTest); r.Code() != test.code {
+				t.Fatalf("expecting %d, got %s", test.code, r)
+			}
+			if header.Get("IP") != "192.0.2.1" || header.Get("From") != "sender@example.com" ||
+				header.Get("Rcpt") != "test@grr.la" || header.Get("Helo") != "mail.example.com" {
+				t.Error("unexpected request headers", header)
+			}
+			if _, ok := e.Values["spam"].(*SpamResult); !ok {
+				t.Fatal("expecting a result")
+			}
+			if strings.Contains(e.DeliveryHeader, "X-Spam-Flag: YES\n") != test.flag {
+				t.Error("unexpected X-Spam-Flag", e.DeliveryHeader)
+			}
+			if test.code == 250 && !strings.Contains(e.DeliveryHeader, "tests=R_SPF_ALLOW") {
+				t.Error("expecting the symbols in X-Spam-Status", e.DeliveryHeader)
+			}
+		})
+	}
+}
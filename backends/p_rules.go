@@ -0,0 +1,162 @@
+package backends
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: rules
+// ----------------------------------------------------------------------------------
+// Description   : Applies the rules of a file, in order, to each message. Rules match the
+//
+//	: headers, the envelope (helo, remote IP, MAIL FROM, RCPT) or the body with
+//	: regular expressions or substrings, then accept, reject, tempfail, discard,
+//	: add a header, tag, or route the message to another processor chain.
+//	: See rules.go for the syntax. The file is read again when the config is
+//	: reloaded (SIGHUP), the old rules are kept if it has errors
+//
+// ----------------------------------------------------------------------------------
+// Config Options: rules_file string - path to the rules file
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header (optional), e.Values["mime"] (optional, for the body text)
+// ----------------------------------------------------------------------------------
+// Output        : tags are appended to e.Values["tags"] as []string
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["rules"] = func() Decorator {
+		return Rules()
+	}
+}
+
+type RulesProcessorConfig struct {
+	File string `json:"rules_file"`
+}
+
+// ruleSet is the rules of a file, and the processor chains they route to
+type ruleSet struct {
+	rules []*rule
+	// routes are kept across reloads, so that a chain is only built and initialized once
+	routes map[string]Processor
+	sync.RWMutex
+}
+
+// load reads the rules file, and builds the chains of new routes with the named stacks of
+// the backend config. Their initializers are called if initialize is true
+func (rs *ruleSet) load(path string, backendConfig BackendConfig, initialize bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	rules, err := parseRules(f)
+	if err != nil {
+		return err
+	}
+	rs.RLock()
+	built := make(map[string]bool)
+	for chain := range rs.routes {
+		built[chain] = true
+	}
+	rs.RUnlock()
+	routes := make(map[string]Processor)
+	for _, r := range rules {
+		if r.action.name != "route" || built[r.action.value] {
+			continue
+		}
+		if _, ok := routes[r.action.value]; ok {
+			continue
+		}
+		for _, name := range strings.Split(strings.ToLower(r.action.value), "|") {
+			if strings.TrimSpace(name) == "rules" {
+				return fmt.Errorf("rules line %d: a route cannot have the rules processor", r.line)
+			}
+		}
+		if routes[r.action.value], err = newConfigStack(r.action.value, backendConfig); err != nil {
+			return fmt.Errorf("rules line %d: %s", r.line, err)
+		}
+	}
+	if len(routes) > 0 && initialize {
+		// when reloading, the initializers of the new chains are called here
+		if errs := Svc.initialize(backendConfig); len(errs) > 0 {
+			return errs
+		}
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	// the old map may still be in use by a worker, so a new one is made
+	for chain, p := range rs.routes {
+		routes[chain] = p
+	}
+	rs.rules, rs.routes = rules, routes
+	return nil
+}
+
+func (rs *ruleSet) get() ([]*rule, map[string]Processor) {
+	rs.RLock()
+	defer rs.RUnlock()
+	return rs.rules, rs.routes
+}
+
+func Rules() Decorator {
+	var (
+		config *RulesProcessorConfig
+		rs     = &ruleSet{}
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&RulesProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*RulesProcessorConfig)
+		// the initializers of the routes are called by the initialize loop
+		return rs.load(config.File, backendConfig, false)
+	}))
+	Svc.AddReloader(ReloadWith(func(backendConfig BackendConfig) error {
+		if err := rs.load(config.File, backendConfig, true); err != nil {
+			// keep the old rules
+			return fmt.Errorf("could not reload rules: %s", err)
+		}
+		Log().Infof("reloaded rules from %s", config.File)
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail && task != TaskTest {
+				return p.Process(e, task)
+			}
+			rules, routes := rs.get()
+			m := &ruleMessage{e: e}
+			for _, r := range rules {
+				if !r.match(m) {
+					continue
+				}
+				Log().Debugf("rule on line %d matched %s: %s", r.line, e.QueuedId, r.action.name)
+				switch r.action.name {
+				case "accept":
+					return p.Process(e, task)
+				case "reject", "tempfail":
+					return NewResult(r.action.reply), RuleError
+				case "discard":
+					Log().Infof("rule on line %d discarded %s", r.line, e.QueuedId)
+					return NewResult(response.Canned.SuccessMessageQueued, response.SP, e.QueuedId), nil
+				case "add_header":
+					e.DeliveryHeader = r.action.key + ": " + r.action.value + "\n" + e.DeliveryHeader
+				case "tag":
+					tags, _ := e.Values["tags"].([]string)
+					e.Values["tags"] = append(tags, r.action.value)
+				case "route":
+					return routes[r.action.value].Process(e, task)
+				}
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package backends
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const testRules = `# test rules
+header:Subject ~ /cheap\s+pills/i => reject 550 5.7.1 "No pills"
+remote_ip in 192.0.2.0/24,2001:db8::/32 => tempfail
+helo contains "spammer" => reject
+mail_from ~ /@trusted\.example$/ => accept
+rcpt contains "@archive.example" and not body contains "keep" => discard
+rcpt contains "@tenant.example" => \
+    route Header|Debugger
+body contains "invoice" => tag "finance"
+header:X-Mailer contains "bulk" => add_header X-Bulk "yes"
+header:X-Mailer contains "bulk" => tag "bulk"
+`
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 9 {
+		t.Fatal("expecting 9 rules, got", len(rules))
+	}
+	if r := rules[0]; r.line != 2 || r.action.reply != "550 5.7.1 No pills" || r.conditions[0].header != "Subject" {
+		t.Error("unexpected rule", r, r.action)
+	}
+	if r := rules[1]; r.action.reply != "451 4.7.1 Try again later" || len(r.conditions[0].cidrs) != 2 {
+		t.Error("unexpected rule", r, r.action)
+	}
+	if r := rules[5]; r.line != 7 || r.action.value != "Header|Debugger" {
+		t.Error("unexpected continued rule", r, r.action)
+	}
+	for _, bad := range []string{
+		"helo contains spammer => reject",
+		"helo ~ /unterminated => reject",
+		"nothing => accept",
+		"helo contains \"x\" => explode",
+		"helo in 10.0.0.0/8 => accept",
+		"helo contains \"x\" and => accept",
+		"helo contains \"x\" => reject 451",
+		"helo contains \"x\"",
+	} {
+		if _, err := parseRules(strings.NewReader(bad)); err == nil {
+			t.Error("expecting an error for", bad)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules")
+	if err := os.WriteFile(file, []byte(testRules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":       "Rules|Hasher",
+		"save_workers_size":  1,
+		"rules_file":         file,
+		"primary_mail_host":  "example.com",
+		"log_received_mails": false,
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gw.Shutdown() }()
+
+	tests := []struct {
+		name     string
+		ip, helo string
+		from, to string
+		data     string
+		code     int
+		check    func(e *mail.Envelope) bool
+	}{
+		{"no match", "127.0.0.1", "mx.example", "a@example.com", "b@example.com", "Subject: hello\n\nhi\n", 250,
+			func(e *mail.Envelope) bool { return len(e.Hashes) == 1 }},
+		{"header regex", "127.0.0.1", "mx.example", "a@example.com", "b@example.com", "Subject: CHEAP  pills\n\nhi\n", 550,
+			nil},
+		{"remote ip", "192.0.2.7", "mx.example", "a@example.com", "b@example.com", "Subject: hello\n\nhi\n", 451, nil},
+		{"accept", "127.0.0.1", "mx.example", "a@trusted.example", "b@archive.example", "Subject: hello\n\nhi\n", 250,
+			func(e *mail.Envelope) bool { return len(e.Hashes) == 1 }},
+		{"discard", "127.0.0.1", "mx.example", "a@example.com", "b@archive.example", "Subject: hello\n\nhi\n", 250,
+			func(e *mail.Envelope) bool { return len(e.Hashes) == 0 }},
+		{"not discarded", "127.0.0.1", "mx.example", "a@example.com", "b@archive.example", "Subject: hello\n\nKeep it\n", 250,
+			func(e *mail.Envelope) bool { return len(e.Hashes) == 1 }},
+		{"route", "127.0.0.1", "mx.example", "a@example.com", "b@tenant.example", "Subject: hello\n\nhi\n", 250,
+			func(e *mail.Envelope) bool {
+				return len(e.Hashes) == 0 && strings.Contains(e.DeliveryHeader, "Received: from")
+			}},
+		{"tags and header", "127.0.0.1", "mx.example", "a@example.com", "b@example.com",
+			"Subject: hello\nX-Mailer: BulkMailer\n\nyour invoice\n", 250,
+			func(e *mail.Envelope) bool {
+				tags, _ := e.Values["tags"].([]string)
+				return len(tags) == 2 && tags[0] == "finance" && tags[1] == "bulk" &&
+					strings.HasPrefix(e.DeliveryHeader, "X-Bulk: yes\n")
+			}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := mail.NewEnvelope(test.ip, 1)
+			e.Helo = test.helo
+			from, _ := mail.NewAddress(test.from)
+			to, _ := mail.NewAddress(test.to)
+			e.MailFrom = *from
+			e.PushRcpt(*to)
+			e.Data.WriteString(test.data)
+			r := gw.Process(e, TaskTest)
+			if r.Code() != test.code {
+				t.Fatalf("expecting %d, got %s", test.code, r)
+			}
+			if test.check != nil && !test.check(e) {
+				t.Error("unexpected envelope", e.Hashes, e.Values, e.DeliveryHeader)
+			}
+		})
+	}
+
+	// reload with a new route, the old rules are kept if the file has errors
+	reloader := gw.(Reloader)
+	if err = os.WriteFile(file, []byte("helo contains \"x\" => explode\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = reloader.Reload(); err == nil {
+		t.Error("expecting the reload to fail")
+	}
+	if err = os.WriteFile(file, []byte("=> route Header\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	e := mail.NewEnvelope("192.0.2.7", 1)
+	e.PushRcpt(mail.Address{User: "b", Host: "example.com"})
+	e.Data.WriteString("Subject: hello\n\nhi\n")
+	if r := gw.Process(e, TaskTest); r.Code() != 250 || len(e.Hashes) != 0 || !strings.Contains(e.DeliveryHeader, "Received: from") {
+		t.Error("expecting the new rules to route the message", r, e.DeliveryHeader)
+	}
+}
@@ -0,0 +1,462 @@
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/mime"
+	"github.com/phires/go-guerrilla/mail/sieve"
+	"github.com/phires/go-guerrilla/response"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: sieve
+// ----------------------------------------------------------------------------------
+// Description   : Runs the Sieve script (RFC 5228) of each recipient against the message.
+//
+//	: The scripts are read from sieve_dir, named after the recipient, eg.
+//	: bob@example.com.sieve, or from the database with sieve_sql_query.
+//	: Recipients without a script use sieve_default, if set.
+//	: The fileinto, envelope, body, variables and reject extensions are supported.
+//	: Actions:
+//	: keep, fileinto - delivered to the Maildir of the recipient when sieve_maildir
+//	:   is set, fileinto "A/B" to the .A.B folder. Otherwise, the folders are added
+//	:   to the tags of the message. The recipient stays in the envelope
+//	: redirect - a copy is sent through the chain of sieve_redirect_process
+//	: discard - the recipient is removed from the envelope
+//	: reject - the message is rejected if all recipients reject it, otherwise the
+//	:   recipient is removed, since the reply to DATA is for all recipients
+//	: If no recipient is left, the message is not passed to the next processors.
+//	: A script that fails to run keeps the message.
+//	: The message is only deferred with a 451 if it could not be delivered to any
+//	: recipient. Otherwise, the recipients that rejected it, or whose Maildir
+//	: failed, are reported in e.Values["relay_status"]: place the DSN processor
+//	: before it to notify the sender, or run it in the queue_process of the
+//	: Queue processor to retry the failed recipients
+//
+// ----------------------------------------------------------------------------------
+// Config Options: sieve_dir string - directory of the scripts
+//
+//	: sieve_default string - path of the script of recipients without one
+//	: sieve_sql_driver, sieve_sql_dsn string - the database of the scripts
+//	: sieve_sql_query string - returns the script of the address bound to the
+//	:   placeholder, eg. SELECT script FROM sieve WHERE address = ?
+//	: sieve_maildir string - path of the Maildir of a recipient, where %u is
+//	:   the address, %n the local part and %d the domain, eg. /var/mail/%d/%n
+//	: sieve_redirect_process string - chain that sends redirected messages, eg. Queue
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Header (optional), e.Values["mime"] (optional, for the body test)
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["sieve"] is set to a map of the recipients to their *sieve.Result,
+//
+//	: folders are appended to e.Values["tags"] as []string. e.RcptTo only has
+//	: the recipients that kept the message. e.Values["relay_status"] is set
+//	: to a []DeliveryStatus of all the recipients if any was not delivered to
+//
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["sieve"] = func() Decorator {
+		return Sieve()
+	}
+}
+
+type SieveProcessorConfig struct {
+	Dir             string `json:"sieve_dir,omitempty"`
+	Default         string `json:"sieve_default,omitempty"`
+	SQLDriver       string `json:"sieve_sql_driver,omitempty"`
+	SQLDSN          string `json:"sieve_sql_dsn,omitempty"`
+	SQLQuery        string `json:"sieve_sql_query,omitempty"`
+	Maildir         string `json:"sieve_maildir,omitempty"`
+	RedirectProcess string `json:"sieve_redirect_process,omitempty"`
+}
+
+// sieveCacheSize is the limit of parsed scripts that are kept
+const sieveCacheSize = 1000
+
+// sieveScripts finds the scripts of the recipients
+type sieveScripts struct {
+	config *SieveProcessorConfig
+	db     *sql.DB
+	// cache has the parsed scripts, keyed by the hash of their source
+	cache map[[sha256.Size]byte]*sieve.Script
+	sync.Mutex
+}
+
+// source returns the script of a recipient, or nil if there is none
+func (s *sieveScripts) source(ctx context.Context, addr string) ([]byte, error) {
+	if s.db != nil {
+		var script sql.NullString
+		err := s.db.QueryRowContext(ctx, s.config.SQLQuery, addr).Scan(&script)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if script.Valid {
+			return []byte(script.String), nil
+		}
+	} else if s.config.Dir != "" && !strings.ContainsAny(addr, `/\`) && !strings.HasPrefix(addr, ".") {
+		src, err := os.ReadFile(filepath.Join(s.config.Dir, addr+".sieve"))
+		if err == nil {
+			return src, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if s.config.Default != "" {
+		return os.ReadFile(s.config.Default)
+	}
+	return nil, nil
+}
+
+// script returns the parsed script of a recipient, or nil if there is none
+func (s *sieveScripts) script(ctx context.Context, addr string) (*sieve.Script, error) {
+	src, err := s.source(ctx, strings.ToLower(addr))
+	if err != nil || src == nil {
+		return nil, err
+	}
+	key := sha256.Sum256(src)
+	s.Lock()
+	script, ok := s.cache[key]
+	s.Unlock()
+	if ok {
+		return script, nil
+	}
+	if script, err = sieve.Parse(bytes.NewReader(src)); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	if len(s.cache) >= sieveCacheSize {
+		s.cache = make(map[[sha256.Size]byte]*sieve.Script)
+	}
+	s.cache[key] = script
+	s.Unlock()
+	return script, nil
+}
+
+// sieveMessage returns the message that the scripts are run against
+func sieveMessage(e *mail.Envelope) *sieve.Message {
+	if e.Header == nil {
+		_ = e.ParseHeaders()
+	}
+	data := e.Data.Bytes()
+	m := &sieve.Message{
+		Header: e.Header,
+		From:   e.MailFrom.String(),
+		Size:   int64(e.Len()),
+	}
+	if e.MailFrom.NullPath {
+		m.From = ""
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i != -1 {
+		m.Body = string(data[i+2:])
+	} else if i = bytes.Index(data, []byte("\r\n\r\n")); i != -1 {
+		m.Body = string(data[i+4:])
+	}
+	root := mimeTree(e)
+	if root == nil {
+		root, _ = mime.Parse(bytes.NewReader(data), nil)
+	}
+	if root != nil {
+		_ = root.Walk(func(part *mime.Part) error {
+			if len(part.Parts) == 0 && !part.IsMultipart() {
+				m.Parts = append(m.Parts, sieve.Part{ContentType: part.ContentType, Text: string(part.Body)})
+			}
+			return nil
+		})
+	}
+	return m
+}
+
+// maildirFolder returns the directory of a folder in a Maildir++ (the folders are
+// sub-directories named after the path with dots, eg. .Lists.dev)
+func maildirFolder(root, folder string) (string, error) {
+	folder = strings.Trim(folder, "/")
+	if folder == "" || strings.EqualFold(folder, "INBOX") {
+		return root, nil
+	}
+	names := strings.Split(folder, "/")
+	for _, name := range names {
+		if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "\\\x00") {
+			return "", fmt.Errorf("invalid folder [%s]", folder)
+		}
+	}
+	return filepath.Join(root, "."+strings.Join(names, ".")), nil
+}
+
+// maildirPath returns the Maildir of a recipient
+func maildirPath(pattern string, rcpt mail.Address) (string, error) {
+	user, host := strings.ToLower(rcpt.User), strings.ToLower(rcpt.Host)
+	for _, s := range []string{user, host} {
+		if s == "" || strings.HasPrefix(s, ".") || strings.ContainsAny(s, "/\\\x00") {
+			return "", fmt.Errorf("cannot make a Maildir path for <%s>", rcpt.String())
+		}
+	}
+	return strings.NewReplacer("%u", user+"@"+host, "%n", user, "%d", host).Replace(pattern), nil
+}
+
+// sieveCounter makes the names of Maildir files and the ids of redirected copies unique
+var sieveCounter uint64
+
+// maildirDeliver writes the message to the new directory of a Maildir, through its tmp directory
+func maildirDeliver(dir, deliveredTo string, e *mail.Envelope) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	name := fmt.Sprintf("%d.%s_%d.%s", time.Now().Unix(), e.QueuedId, atomic.AddUint64(&sieveCounter, 1), host)
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(f, "Delivered-To: %s\n", deliveredTo); err == nil {
+		_, err = f.ReadFrom(e.NewReader())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, "new", name))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// sieveRedirect returns the copy of a message redirected by a recipient
+func sieveRedirect(e *mail.Envelope, rcpt mail.Address, to string) (*mail.Envelope, error) {
+	addr, err := mail.NewAddress(to)
+	if err != nil {
+		return nil, err
+	}
+	// the Delivered-To headers of earlier redirects stop loops
+	for _, v := range e.Header["Delivered-To"] {
+		if strings.EqualFold(strings.TrimSpace(v), addr.String()) {
+			return nil, fmt.Errorf("redirect loop to <%s>", addr.String())
+		}
+	}
+	r := mail.NewEnvelope(e.RemoteIP, atomic.AddUint64(&sieveCounter, 1))
+	r.Helo, r.ESMTP, r.TLS = e.Helo, e.ESMTP, e.TLS
+	r.MailFrom = e.MailFrom
+	r.RcptTo = []mail.Address{*addr}
+	r.Data.WriteString("Delivered-To: " + rcpt.String() + "\n")
+	_, err = r.Data.ReadFrom(e.NewReader())
+	return r, err
+}
+
+// sieveReply returns the SMTP reply of the reason of a reject
+func sieveReply(reason string) string {
+	reason = strings.TrimSpace(reason)
+	if i := strings.IndexAny(reason, "\r\n"); i != -1 {
+		reason = reason[:i]
+	}
+	reason = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, reason)
+	if reason == "" {
+		reason = "Message rejected"
+	}
+	return "550 5.7.1 " + trimToLimit(reason, 200)
+}
+
+func Sieve() Decorator {
+	var (
+		config   *SieveProcessorConfig
+		scripts  *sieveScripts
+		redirect Processor
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SieveProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*SieveProcessorConfig)
+		scripts = &sieveScripts{config: config, cache: make(map[[sha256.Size]byte]*sieve.Script)}
+		if config.SQLDriver != "" {
+			if config.SQLQuery == "" {
+				return convertError("missing/invalid: 'sieve_sql_query' of type: string")
+			}
+			if scripts.db, err = sql.Open(config.SQLDriver, config.SQLDSN); err != nil {
+				return err
+			}
+		} else if config.Dir == "" && config.Default == "" {
+			return convertError("missing/invalid: 'sieve_dir' of type: string")
+		}
+		if config.RedirectProcess != "" {
+			if redirect, err = newConfigStack(config.RedirectProcess, backendConfig); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	Svc.AddShutdowner(ShutdownWith(func() error {
+		if scripts != nil && scripts.db != nil {
+			return scripts.db.Close()
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task != TaskSaveMail && task != TaskTest {
+				return p.Process(e, task)
+			}
+			m := sieveMessage(e)
+			var (
+				results = make(map[string]*sieve.Result)
+				kept    []mail.Address
+				// rejects has the reason of each recipient whose status is a rejection
+				rejects []string
+				// statuses has the outcome of each recipient, keptAt the positions of kept
+				statuses  = make([]DeliveryStatus, 0, len(e.RcptTo))
+				keptAt    []int
+				delivered bool
+				failed    bool
+			)
+			tags, _ := e.Values["tags"].([]string)
+			for _, rcpt := range e.RcptTo {
+				addr := rcpt.String()
+				script, err := scripts.script(e.Context(), addr)
+				if err != nil {
+					Log().WithError(err).Errorf("could not load the sieve script of <%s>", addr)
+				}
+				result := &sieve.Result{Actions: []sieve.Action{{Type: sieve.Keep, Implicit: true}}}
+				if script != nil {
+					m.To = addr
+					if result, err = script.Run(m); err != nil {
+						Log().WithError(err).Errorf("sieve script of <%s> failed for %s", addr, e.QueuedId)
+					}
+				}
+				results[addr] = result
+				keep, maildirErr, rejected := false, error(nil), ""
+			actions:
+				for _, action := range result.Actions {
+					switch action.Type {
+					case sieve.Keep, sieve.FileInto:
+						keep = true
+						if config.Maildir == "" {
+							if action.Type == sieve.FileInto && !hasTag(tags, action.Arg) {
+								tags = append(tags, action.Arg)
+							}
+							continue
+						}
+						dir, err := maildirPath(config.Maildir, rcpt)
+						if err == nil {
+							dir, err = maildirFolder(dir, action.Arg)
+						}
+						if err == nil {
+							err = maildirDeliver(dir, addr, e)
+						}
+						if err != nil {
+							// the actions done so far are not repeated when the recipient is retried
+							Log().WithError(err).Errorf("could not deliver %s to the Maildir of <%s>", e.QueuedId, addr)
+							maildirErr = err
+							break actions
+						}
+					case sieve.Redirect:
+						if redirect == nil {
+							Log().Errorf("sieve script of <%s> redirects, but sieve_redirect_process is not set", addr)
+							keep = true
+							continue
+						}
+						copied, err := sieveRedirect(e, rcpt, action.Arg)
+						if err == nil {
+							var r Result
+							if r, err = ProcessContext(e.Context(), redirect, copied, TaskSaveMail); err == nil && (r == nil || r.Code() >= 300) {
+								err = fmt.Errorf("redirect failed: %v", r)
+							}
+						}
+						if err != nil {
+							// the message is kept rather than lost
+							Log().WithError(err).Errorf("could not redirect %s of <%s> to <%s>", e.QueuedId, addr, action.Arg)
+							keep = true
+						} else {
+							Log().Infof("redirected %s of <%s> to <%s>", e.QueuedId, addr, action.Arg)
+						}
+					case sieve.Reject:
+						rejected = action.Arg
+					}
+				}
+				status := DeliveryStatus{Rcpt: rcpt, Code: 250, Msg: "2.0.0 OK"}
+				switch {
+				case maildirErr != nil:
+					status.Code, status.Msg = 451, "4.3.0 Error: could not deliver email"
+				case keep:
+					keptAt = append(keptAt, len(statuses))
+					kept = append(kept, rcpt)
+				case rejected != "":
+					rejects = append(rejects, rejected)
+					status.Code, status.Msg = 550, strings.TrimPrefix(sieveReply(rejected), "550 ")
+				}
+				if status.Delivered() {
+					delivered = true
+				} else {
+					failed = true
+				}
+				statuses = append(statuses, status)
+			}
+			e.Values["sieve"] = results
+			if len(tags) > 0 {
+				e.Values["tags"] = tags
+			}
+			if len(rejects) > 0 && len(rejects) == len(e.RcptTo) {
+				return NewResult(sieveReply(rejects[0])), SieveError
+			}
+			if failed && !delivered {
+				// nothing was delivered, the whole message can be tried again
+				return NewResult("451 4.3.0 Error: could not deliver email"), StorageError
+			}
+			if len(kept) == 0 {
+				Log().Infof("no recipient of %s kept the message after sieve", e.QueuedId)
+				if failed {
+					e.Values["relay_status"] = statuses
+				}
+				return NewResult(response.Canned.SuccessMessageQueued, response.SP, e.QueuedId), nil
+			}
+			e.RcptTo = kept
+			result, err := p.Process(e, task)
+			if !failed || err != nil || result == nil || result.Code() >= 300 {
+				return result, err
+			}
+			// the outcome of the kept recipients may be reported by the next processors
+			if next, ok := e.Values["relay_status"].([]DeliveryStatus); ok && len(next) == len(keptAt) {
+				for i, at := range keptAt {
+					statuses[at] = next[i]
+				}
+			}
+			e.Values["relay_status"] = statuses
+			return result, err
+		})
+	}
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package backends
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/sieve"
+)
+
+var testSieveScripts = map[string]string{
+	"bob@example.com.sieve": `require ["fileinto", "variables"];
+if header :matches "List-Id" "<*.example.org>" { fileinto "Lists/${1}"; stop; }
+if header :contains "Subject" "lottery" { discard; }`,
+	"carol@example.com.sieve": `require "reject";
+if header :contains "Subject" "lottery" { reject "I do not play"; }`,
+	"dave@example.com.sieve":   `redirect "dave@elsewhere.example"; keep;`,
+	"broken@example.com.sieve": `if true { keep }`,
+}
+
+func TestSieve(t *testing.T) {
+	dir, maildir := t.TempDir(), t.TempDir()
+	for name, script := range testSieveScripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":           "Sieve|Hasher",
+		"save_workers_size":      1,
+		"sieve_dir":              dir,
+		"sieve_maildir":          filepath.Join(maildir, "%d", "%n"),
+		"sieve_redirect_process": "Hasher",
+		"primary_mail_host":      "example.com",
+		"log_received_mails":     false,
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gw.Shutdown() }()
+
+	tests := []struct {
+		name  string
+		rcpt  []string
+		data  string
+		code  int
+		rcpts int
+		files []string
+		// status has the reported codes of the recipients, if any was not delivered to
+		status []int
+	}{
+		{"no script", []string{"erin@example.com"}, "Subject: hello\n\nhi\n", 250, 1,
+			[]string{"example.com/erin/new"}, nil},
+		{"fileinto", []string{"bob@example.com"}, "Subject: hello\nList-Id: <dev.example.org>\n\nhi\n", 250, 1,
+			[]string{"example.com/bob/.Lists.dev/new"}, nil},
+		{"discard", []string{"bob@example.com"}, "Subject: lottery\n\nhi\n", 250, 0, nil, nil},
+		{"reject", []string{"carol@example.com"}, "Subject: lottery\n\nhi\n", 550, 0, nil, nil},
+		{"reject one", []string{"carol@example.com", "erin@example.com"}, "Subject: lottery\n\nhi\n", 250, 1,
+			[]string{"example.com/erin/new"}, []int{550, 250}},
+		{"redirect", []string{"dave@example.com"}, "Subject: hello\n\nhi\n", 250, 1,
+			[]string{"example.com/dave/new"}, nil},
+		{"broken script", []string{"broken@example.com"}, "Subject: hello\n\nhi\n", 250, 1,
+			[]string{"example.com/broken/new"}, nil},
+		// the Maildir of frank cannot be created
+		{"maildir fails", []string{"frank@example.com"}, "Subject: hello\n\nhi\n", 451, 0, nil, nil},
+		{"maildir fails for one", []string{"frank@example.com", "erin@example.com"}, "Subject: hello\n\nhi\n", 250, 1,
+			[]string{"example.com/erin/new"}, []int{451, 250}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_ = os.RemoveAll(filepath.Join(maildir, "example.com"))
+			if err := os.MkdirAll(filepath.Join(maildir, "example.com"), 0o700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(maildir, "example.com", "frank"), nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			e := mail.NewEnvelope("127.0.0.1", 1)
+			from, _ := mail.NewAddress("alice@example.net")
+			e.MailFrom = *from
+			for _, rcpt := range test.rcpt {
+				to, _ := mail.NewAddress(rcpt)
+				e.PushRcpt(*to)
+			}
+			e.Data.WriteString(test.data)
+			r := gw.Process(e, TaskTest)
+			if r.Code() != test.code {
+				t.Fatalf("expecting %d, got %s", test.code, r)
+			}
+			if test.code == 451 {
+				return
+			}
+			if test.code != 250 {
+				if !strings.Contains(r.String(), "I do not play") {
+					t.Error("expecting the reason of the reject, got", r)
+				}
+				return
+			}
+			if len(e.Hashes) != test.rcpts {
+				t.Errorf("expecting %d recipients saved, got %d", test.rcpts, len(e.Hashes))
+			}
+			for _, d := range test.files {
+				entries, err := os.ReadDir(filepath.Join(maildir, d))
+				if err != nil || len(entries) != 1 {
+					t.Fatalf("expecting a message in %s: %v", d, err)
+				}
+				data, _ := os.ReadFile(filepath.Join(maildir, d, entries[0].Name()))
+				if !strings.HasPrefix(string(data), "Delivered-To: ") || !strings.HasSuffix(string(data), test.data) {
+					t.Errorf("unexpected message in %s: %q", d, data)
+				}
+			}
+			if _, ok := e.Values["sieve"].(map[string]*sieve.Result); !ok {
+				t.Error("expecting the sieve results")
+			}
+			statuses, _ := e.Values["relay_status"].([]DeliveryStatus)
+			if len(statuses) != len(test.status) {
+				t.Fatal("unexpected delivery statuses", statuses)
+			}
+			for i := range statuses {
+				if statuses[i].Code != test.status[i] || statuses[i].Rcpt.String() != test.rcpt[i] {
+					t.Errorf("expecting %d for <%s>, got %s", test.status[i], test.rcpt[i], statuses[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSieveTags(t *testing.T) {
+	dir := t.TempDir()
+	script := `require "fileinto"; if header :contains "Subject" "invoice" { fileinto "Finance"; }`
+	if err := os.WriteFile(filepath.Join(dir, "bob@example.com.sieve"), []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":       "Sieve|Hasher",
+		"save_workers_size":  1,
+		"sieve_dir":          dir,
+		"primary_mail_host":  "example.com",
+		"log_received_mails": false,
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gw.Shutdown() }()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	to, _ := mail.NewAddress("bob@example.com")
+	e.PushRcpt(*to)
+	e.Data.WriteString("Subject: your invoice\n\nhi\n")
+	if r := gw.Process(e, TaskTest); r.Code() != 250 {
+		t.Fatal("expecting 250, got", r)
+	}
+	if tags, _ := e.Values["tags"].([]string); len(tags) != 1 || tags[0] != "Finance" {
+		t.Error("expecting the Finance tag, got", e.Values["tags"])
+	}
+}
+
+func TestMaildirFolder(t *testing.T) {
+	for folder, want := range map[string]string{
+		"":          "/m",
+		"INBOX":     "/m",
+		"Lists/dev": "/m/.Lists.dev",
+		"Junk":      "/m/.Junk",
+		"../etc":    "",
+		"a//b":      "",
+	} {
+		got, err := maildirFolder("/m", folder)
+		if want == "" && err == nil || want != "" && got != want {
+			t.Errorf("folder %q: got %q, %v, expecting %q", folder, got, err, want)
+		}
+	}
+}
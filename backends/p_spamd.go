@@ -0,0 +1,197 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// ----------------------------------------------------------------------------------
+// Processor Name: spamd
+// ----------------------------------------------------------------------------------
+// Description   : Scans the message with SpamAssassin's spamd, using the SPAMC protocol,
+//
+//	: and adds the X-Spam-Flag, X-Spam-Score and X-Spam-Status headers.
+//	: If spamd cannot be reached, the message is accepted without a score
+//
+// ----------------------------------------------------------------------------------
+// Config Options: spamd_addr string - address of spamd, host:port or unix:/path/to/socket
+//
+//	: spamd_user string - the user whose preferences are used
+//	: spam_tag_score string - score from which X-Spam-Flag is added,
+//	: defaults to the required score of spamd
+//	: spam_reject_score string - score from which the message is rejected,
+//	: messages are not rejected if empty
+//	: spam_timeout string - timeout of the scan, defaults to "30s"
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.Data, e.DeliveryHeader
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["spam"] is set to the *SpamResult
+// ----------------------------------------------------------------------------------
+func init() {
+	processors["spamd"] = func() Decorator {
+		return Spamd()
+	}
+}
+
+type SpamdProcessorConfig struct {
+	Addr string `json:"spamd_addr"`
+	User string `json:"spamd_user,omitempty"`
+}
+
+// spamdDial connects to spamd, addr is host:port or unix:/path/to/socket.
+// The deadline of the connection is the timeout, or the deadline of ctx if it is earlier
+func spamdDial(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// spamdCheck sends the message with the SYMBOLS command and parses the reply, eg.
+//
+//	SPAMD/1.1 0 EX_OK
+//	Content-length: 29
+//	Spam: True ; 15.0 / 5.0
+//
+//	GTUBE,NO_RECEIVED,NO_RELAYS
+func spamdCheck(ctx context.Context, addr, user string, timeout time.Duration, msg io.Reader) (*SpamResult, error) {
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := spamdDial(ctx, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	var req bytes.Buffer
+	req.WriteString("SYMBOLS SPAMC/1.5\r\n")
+	_, _ = fmt.Fprintf(&req, "Content-length: %d\r\n", len(data))
+	if user != "" {
+		req.WriteString("User: " + user + "\r\n")
+	}
+	req.WriteString("\r\n")
+	req.Write(data)
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+	// let spamd know that the message is complete
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	status := strings.Fields(line)
+	if len(status) < 2 || !strings.HasPrefix(status[0], "SPAMD/") {
+		return nil, fmt.Errorf("unexpected spamd reply [%s]", strings.TrimSpace(line))
+	}
+	if status[1] != "0" {
+		return nil, fmt.Errorf("spamd error [%s]", strings.TrimSpace(line))
+	}
+	result := &SpamResult{}
+	found := false
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(name, "Spam") {
+			continue
+		}
+		// True ; 15.0 / 5.0
+		verdict, scores, _ := strings.Cut(value, ";")
+		score, required, _ := strings.Cut(scores, "/")
+		result.Spam = strings.EqualFold(strings.TrimSpace(verdict), "true") ||
+			strings.EqualFold(strings.TrimSpace(verdict), "yes")
+		if result.Score, err = strconv.ParseFloat(strings.TrimSpace(score), 64); err != nil {
+			return nil, fmt.Errorf("invalid spamd score [%s]", value)
+		}
+		if result.Required, err = strconv.ParseFloat(strings.TrimSpace(required), 64); err != nil {
+			return nil, fmt.Errorf("invalid spamd score [%s]", value)
+		}
+		found = true
+	}
+	if !found {
+		return nil, errors.New("no Spam header in the spamd reply")
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, symbol := range strings.Split(string(body), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			result.Symbols = append(result.Symbols, symbol)
+		}
+	}
+	return result, nil
+}
+
+func Spamd() Decorator {
+	var (
+		config *SpamdProcessorConfig
+		policy *spamPolicy
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SpamdProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*SpamdProcessorConfig)
+		policy, err = newSpamPolicy(backendConfig)
+		return err
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if task == TaskSaveMail || task == TaskTest {
+				result, err := spamdCheck(e.Context(), config.Addr, config.User, policy.timeout, e.NewReader())
+				if err != nil {
+					Log().WithError(err).Error("spamd scan failed, accepting ", e.QueuedId)
+				} else {
+					Log().Debugf("spamd score %.1f/%.1f for %s", result.Score, result.Required, e.QueuedId)
+					if r, err := policy.apply(e, result); err != nil {
+						return r, err
+					}
+				}
+			}
+			// next processor
+			return p.Process(e, task)
+		})
+	}
+}
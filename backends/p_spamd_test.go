@@ -0,0 +1,162 @@
+package backends
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// fakeSpamd scores messages containing the GTUBE string with 1000, and others with 1.5
+func fakeSpamd(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer func() { _ = conn.Close() }()
+				r := textproto.NewReader(bufio.NewReader(conn))
+				if line, err := r.ReadLine(); err != nil || line != "SYMBOLS SPAMC/1.5" {
+					_, _ = fmt.Fprintf(conn, "SPAMD/1.5 76 Bad header line: %s\r\n", line)
+					return
+				}
+				header, err := r.ReadMIMEHeader()
+				if err != nil {
+					return
+				}
+				length, _ := strconv.Atoi(header.Get("Content-Length"))
+				body := make([]byte, length)
+				if _, err = io.ReadFull(r.R, body); err != nil {
+					return
+				}
+				spam, score, symbols := "False", "1.5", "NO_RELAYS"
+				if strings.Contains(string(body), "XJS*C4JDBQADN1.NSBN3*2IDNEN*GTUBE-STANDARD-ANTI-UBE-TEST-EMAIL*C.34X") {
+					spam, score, symbols = "True", "1000.0", "GTUBE,NO_RELAYS"
+				}
+				_, _ = fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: %s ; %s / 5.0\r\n\r\n%s",
+					len(symbols), spam, score, symbols)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+const gtubeMail = "Subject: Test spam mail (GTUBE)\r\n\r\n" +
+	"XJS*C4JDBQADN1.NSBN3*2IDNEN*GTUBE-STANDARD-ANTI-UBE-TEST-EMAIL*C.34X\r\n"
+
+func TestSpamd(t *testing.T) {
+	addr := fakeSpamd(t)
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	tests := []struct {
+		name     string
+		config   BackendConfig
+		data     string
+		code     int
+		flag     bool
+		score    float64
+		noResult bool
+	}{
+		{"ham", BackendConfig{}, "Subject: hi\r\n\r\nhello\r\n", 250, false, 1.5, false},
+		{"tagged by verdict", BackendConfig{}, gtubeMail, 250, true, 1000, false},
+		{"tagged by score", BackendConfig{"spam_tag_score": "1"}, "Subject: hi\r\n\r\nhello\r\n", 250, true, 1.5, false},
+		{"rejected", BackendConfig{"spam_reject_score": "20"}, gtubeMail, 550, false, 1000, false},
+		{"unreachable", BackendConfig{"spamd_addr": "127.0.0.1:1"}, gtubeMail, 250, false, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := BackendConfig{
+				"save_process":      "spamd",
+				"save_workers_size": 1,
+				"spamd_addr":        addr,
+				"spam_timeout":      "5s",
+			}
+			for k, v := range test.config {
+				config[k] = v
+			}
+			gw, err := New(config, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = gw.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = gw.Shutdown() }()
+			e := mail.NewEnvelope("127.0.0.1", 1)
+			e.Data.WriteString(test.data)
+			if r := gw.Process(e, TaskTest); r.Code() != test.code {
+				t.Fatalf("expecting %d, got %s", test.code, r)
+			}
+			result, ok := e.Values["spam"].(*SpamResult)
+			if test.noResult {
+				if ok {
+					t.Fatal("expecting no result, got", result)
+				}
+				return
+			}
+			if !ok || result.Score != test.score || result.Required != 5 {
+				t.Fatal("unexpected result", e.Values["spam"])
+			}
+			if strings.Contains(e.DeliveryHeader, "X-Spam-Flag: YES\n") != test.flag {
+				t.Error("unexpected X-Spam-Flag", e.DeliveryHeader)
+			}
+			if test.code == 250 && !strings.Contains(e.DeliveryHeader, "X-Spam-Status: ") {
+				t.Error("expecting X-Spam-Status", e.DeliveryHeader)
+			}
+		})
+	}
+}
+
+func TestSpamStatusFolding(t *testing.T) {
+	result := &SpamResult{Score: 7.2, Required: 5}
+	for i := 0; i < 20; i++ {
+		result.Symbols = append(result.Symbols, fmt.Sprintf("SOME_LONG_RULE_NAME_%d", i))
+	}
+	status := spamStatus(result, true)
+	if !strings.HasPrefix(status, "X-Spam-Flag: YES\nX-Spam-Score: 7.2\nX-Spam-Status: Yes, score=7.2 required=5.0 tests=") {
+		t.Fatal("unexpected headers", status)
+	}
+	for _, line := range strings.Split(status, "\n") {
+		if len(line) > 78 {
+			t.Error("line is too long", line)
+		}
+	}
+}
+
+func TestSpamdDialDeadline(t *testing.T) {
+	// a listener that never replies
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = spamdCheck(ctx, ln.Addr().String(), "", time.Minute, strings.NewReader(gtubeMail)); err == nil {
+		t.Error("expecting the check to time out")
+	}
+	if spent := time.Since(start); spent > 5*time.Second {
+		t.Error("expecting the deadline of the context to be used, took", spent)
+	}
+
+	// an expired context does not dial
+	if _, err = spamdDial(ctx, ln.Addr().String(), time.Minute); err == nil {
+		t.Error("expecting an error for an expired context")
+	}
+}
@@ -1,32 +1,208 @@
 package backends
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 
 	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+
 	"github.com/phires/go-guerrilla/mail"
 )
 
+// ----------------------------------------------------------------------------------
+// Processor Name: spf
+// ----------------------------------------------------------------------------------
+// Description   : Checks the SPF record (RFC 7208) of the sender's domain, or of the HELO
+//
+//	: domain if the sender is null, and adds a Received-SPF header.
+//	: Add it to validate_process to check when the first recipient is given,
+//	: right after MAIL FROM, and also to save_process to add the header.
+//	: The check is only done once for each message
+//
+// ----------------------------------------------------------------------------------
+// Config Options: spf_actions string - action for each result, as a comma separated list of
+//
+//	: result=action, where result is pass, neutral, softfail, fail, none,
+//	: temperror or permerror, and action is one of
+//	: accept - accept the message
+//	: tag - accept the message and add the Received-SPF header
+//	: tempfail - reject with a 4xx reply
+//	: reject - reject with a 5xx reply
+//	: Defaults to "fail=reject", the other results are tagged
+//	: spf_defer bool - do not reject or tempfail, and leave the decision to a
+//	: later processor, eg. DMARC
+//	: primary_mail_host string - the receiver in the Received-SPF header
+//
+// --------------:-------------------------------------------------------------------
+// Input         : e.RemoteIP, e.MailFrom, e.Helo
+// ----------------------------------------------------------------------------------
+// Output        : e.Values["spf"] is set to the *authres.SPFResult
+// ----------------------------------------------------------------------------------
 func init() {
 	processors["spf"] = func() Decorator {
 		return SPF()
 	}
 }
 
+// SPFResolver is used for the DNS lookups of the SPF checks. It can be replaced for testing.
+var SPFResolver spf.DNSResolver = net.DefaultResolver
+
+type SPFProcessorConfig struct {
+	Actions     string `json:"spf_actions,omitempty"`
+	Defer       bool   `json:"spf_defer,omitempty"`
+	PrimaryHost string `json:"primary_mail_host,omitempty"`
+}
+
+// spfAction is what to do with a message for an SPF result
+type spfAction string
+
+const (
+	spfAccept   spfAction = "accept"
+	spfTag      spfAction = "tag"
+	spfTempFail spfAction = "tempfail"
+	spfReject   spfAction = "reject"
+)
+
+// newSPFActions parses the spf_actions config option
+func newSPFActions(s string) (map[spf.Result]spfAction, error) {
+	actions := map[spf.Result]spfAction{
+		spf.Pass:      spfTag,
+		spf.Neutral:   spfTag,
+		spf.SoftFail:  spfTag,
+		spf.Fail:      spfReject,
+		spf.None:      spfTag,
+		spf.TempError: spfTag,
+		spf.PermError: spfTag,
+	}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.ToLower(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid spf_actions entry [%s], expecting result=action", item)
+		}
+		result, action := spf.Result(strings.TrimSpace(parts[0])), spfAction(strings.TrimSpace(parts[1]))
+		if _, ok := actions[result]; !ok {
+			return nil, fmt.Errorf("invalid spf_actions result [%s]", result)
+		}
+		switch action {
+		case spfAccept, spfTag, spfTempFail, spfReject:
+			actions[result] = action
+		default:
+			return nil, fmt.Errorf("invalid spf_actions action [%s]", action)
+		}
+	}
+	return actions, nil
+}
+
+// spfCheck checks the sender, or the HELO domain if the sender is null
+func spfCheck(e *mail.Envelope) *authres.SPFResult {
+	result := &authres.SPFResult{}
+	sender := ""
+	if e.MailFrom.NullPath || e.MailFrom.IsEmpty() {
+		result.Helo = e.Helo
+	} else {
+		sender = e.MailFrom.String()
+		result.From = sender
+	}
+	res, err := spf.CheckHostWithSender(net.ParseIP(e.RemoteIP), e.Helo, sender, spf.WithResolver(SPFResolver))
+	result.Value = authres.ResultValue(res)
+	if err != nil {
+		result.Reason = err.Error()
+	}
+	return result
+}
+
+// spfDomain returns the domain that was checked
+func spfDomain(result *authres.SPFResult) string {
+	if result.From == "" {
+		return result.Helo
+	}
+	return result.From[strings.LastIndex(result.From, "@")+1:]
+}
+
+// receivedSPF returns the Received-SPF header (RFC 7208 section 9.1)
+func receivedSPF(e *mail.Envelope, result *authres.SPFResult, receiver string) string {
+	identity, sender := "mailfrom", result.From
+	if sender == "" {
+		identity, sender = "helo", "postmaster@"+result.Helo
+	}
+	var comment string
+	switch spf.Result(result.Value) {
+	case spf.Pass:
+		comment = "domain of " + sender + " designates " + e.RemoteIP + " as permitted sender"
+	case spf.Fail:
+		comment = "domain of " + sender + " does not designate " + e.RemoteIP + " as permitted sender"
+	case spf.SoftFail:
+		comment = "transitioning domain of " + sender + " does not designate " + e.RemoteIP + " as permitted sender"
+	case spf.Neutral:
+		comment = e.RemoteIP + " is neither permitted nor denied by domain of " + sender
+	case spf.None:
+		comment = "domain of " + sender + " does not provide an SPF record"
+	default:
+		comment = "error in processing the SPF record of " + sender
+	}
+	return fmt.Sprintf("Received-SPF: %s (%s: %s) client-ip=%s; envelope-from=\"%s\"; helo=%s; receiver=%s; identity=%s;\n",
+		result.Value, receiver, comment, e.RemoteIP, result.From, e.Helo, receiver, identity)
+}
+
 func SPF() Decorator {
+	var (
+		config  *SPFProcessorConfig
+		actions map[spf.Result]spfAction
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&SPFProcessorConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*SPFProcessorConfig)
+		actions, err = newSPFActions(config.Actions)
+		return err
+	}))
+
 	return func(p Processor) Processor {
 		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
 			switch task {
-			case TaskSaveMail, TaskTest:
-				res, err := spf.CheckHostWithSender(net.ParseIP(e.RemoteIP), e.MailFrom.Host, e.MailFrom.String())
-				if err != nil {
-					Log().WithError(err).Error("SPF error: ", err)
+			case TaskSaveMail, TaskTest, TaskValidateRcpt:
+				result, ok := e.Values["spf"].(*authres.SPFResult)
+				if !ok {
+					// not checked yet for this message
+					result = spfCheck(e)
+					e.Values["spf"] = result
+					if result.Reason != "" {
+						Log().Error("SPF error: ", result.Reason)
+					}
+					Log().Debugf("SPF %s result for %s", result.Value, spfDomain(result))
+				}
+				action := actions[spf.Result(result.Value)]
+				if config.Defer && (action == spfTempFail || action == spfReject) {
+					action = spfTag
+				}
+				var reply string
+				switch action {
+				case spfTag:
+					if task != TaskValidateRcpt {
+						e.DeliveryHeader = receivedSPF(e, result, reportingMTA("", config.PrimaryHost)) + e.DeliveryHeader
+					}
+				case spfTempFail:
+					reply = "451 4.7.24 SPF validation error: " + string(result.Value) + " for " + spfDomain(result)
+				case spfReject:
+					reply = "550 5.7.23 SPF validation failed: " + string(result.Value) + " for " + spfDomain(result)
 				}
-				if res == spf.Fail {
-					Log().Debugln("SPF fail result:", res)
-					return NewResult("556 5.7.0 Unauthorized sender. Email blocked due to policy reasons."), SpfError
+				if reply != "" {
+					if task == TaskValidateRcpt {
+						// the reply is given to the client as the RCPT TO response
+						return nil, RcptError(errors.New(reply))
+					}
+					return NewResult(reply), SpfError
 				}
-				Log().Debugln("SPF pass result:", res)
 			}
 			// next processor
 			return p.Process(e, task)
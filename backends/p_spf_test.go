@@ -1,6 +1,8 @@
 package backends
 
 import (
+	"context"
+	"net"
 	"os"
 	"strings"
 	"testing"
@@ -9,8 +11,46 @@ import (
 	"github.com/phires/go-guerrilla/mail"
 )
 
-func TestSpf(t *testing.T) {
+// spfTestResolver answers the TXT lookups of the SPF checks
+type spfTestResolver struct {
+	records map[string]string
+	lookups int
+}
+
+func (r *spfTestResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	r.lookups++
+	if txt, ok := r.records[name]; ok {
+		return []string{txt}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
 
+func (r *spfTestResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *spfTestResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *spfTestResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func useSPFTestResolver(t *testing.T) *spfTestResolver {
+	r := &spfTestResolver{records: map[string]string{
+		"guerrillamail.com": "v=spf1 ip4:168.119.142.36 -all",
+		"example.com":       "v=spf1 ip4:192.0.2.1 ~all",
+		"mail.example.org":  "v=spf1 ip4:192.0.2.1 -all",
+	}}
+	resolver := SPFResolver
+	SPFResolver = r
+	t.Cleanup(func() { SPFResolver = resolver })
+	return r
+}
+
+func TestSpf(t *testing.T) {
+	useSPFTestResolver(t)
 	e := mail.NewEnvelope("168.119.142.36", 1) //DNS spf ip record
 	e.MailFrom = mail.Address{User: "test", Host: "guerrillamail.com"}
 	e.Data.WriteString("Subject: Test\n\nThis is a test nbnb nbnb hgghgh nnnbnb nbnbnb nbnbn.")
@@ -53,3 +93,102 @@ func TestSpf(t *testing.T) {
 		return
 	}
 }
+
+func TestSPFActions(t *testing.T) {
+	useSPFTestResolver(t)
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	tests := []struct {
+		name     string
+		ip       string
+		from     mail.Address
+		config   BackendConfig
+		code     int
+		header   string
+		noHeader bool
+	}{
+		{"pass", "192.0.2.1", mail.Address{User: "a", Host: "example.com"}, nil, 250,
+			"Received-SPF: pass (mx.grr.la: domain of a@example.com designates 192.0.2.1 as permitted sender)", false},
+		{"fail", "192.0.2.2", mail.Address{User: "a", Host: "guerrillamail.com"}, nil, 550, "", true},
+		{"softfail tempfail", "192.0.2.2", mail.Address{User: "a", Host: "example.com"},
+			BackendConfig{"spf_actions": "softfail=tempfail"}, 451, "", true},
+		{"deferred", "192.0.2.2", mail.Address{User: "a", Host: "guerrillamail.com"},
+			BackendConfig{"spf_defer": true}, 250, "Received-SPF: fail", false},
+		{"accept", "192.0.2.2", mail.Address{User: "a", Host: "example.com"},
+			BackendConfig{"spf_actions": "softfail=accept"}, 250, "", true},
+		{"helo", "192.0.2.1", mail.Address{NullPath: true}, nil, 250,
+			"Received-SPF: pass (mx.grr.la: domain of postmaster@mail.example.org designates", false},
+		{"helo fail", "192.0.2.2", mail.Address{NullPath: true}, nil, 550, "", true},
+	}
+	for _, tt := range tests {
+		cfg := BackendConfig{
+			"save_process":      "SPF",
+			"save_workers_size": 1,
+			"primary_mail_host": "mx.grr.la",
+		}
+		for k, v := range tt.config {
+			cfg[k] = v
+		}
+		gw, err := New(cfg, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = gw.Start(); err != nil {
+			t.Fatal(err)
+		}
+		e := mail.NewEnvelope(tt.ip, 1)
+		e.Helo = "mail.example.org"
+		e.MailFrom = tt.from
+		r := gw.Process(e, TaskSaveMail)
+		_ = gw.Shutdown()
+		if r.Code() != tt.code {
+			t.Errorf("%s: expecting %d, got %s", tt.name, tt.code, r)
+		}
+		if tt.noHeader && e.DeliveryHeader != "" {
+			t.Errorf("%s: not expecting a header, got %s", tt.name, e.DeliveryHeader)
+		} else if !strings.HasPrefix(e.DeliveryHeader, tt.header) {
+			t.Errorf("%s: expecting the header %s, got %s", tt.name, tt.header, e.DeliveryHeader)
+		}
+	}
+}
+
+func TestSPFValidateRcpt(t *testing.T) {
+	resolver := useSPFTestResolver(t)
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":      "SPF",
+		"validate_process":  "SPF",
+		"save_workers_size": 1,
+		"spf_actions":       "softfail=tempfail",
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gw.Shutdown() }()
+
+	e := mail.NewEnvelope("192.0.2.2", 1)
+	e.MailFrom = mail.Address{User: "a", Host: "example.com"}
+	e.PushRcpt(mail.Address{User: "b", Host: "grr.la"})
+	if err := gw.ValidateRcpt(e); err == nil || !strings.HasPrefix(err.Error(), "451 4.7.24 SPF") {
+		t.Error("expecting a temporary failure, got", err)
+	}
+
+	// checked once, when the first recipient is given
+	e = mail.NewEnvelope("192.0.2.1", 1)
+	e.MailFrom = mail.Address{User: "a", Host: "example.com"}
+	resolver.lookups = 0
+	for _, user := range []string{"b", "c"} {
+		e.PushRcpt(mail.Address{User: user, Host: "grr.la"})
+		if err := gw.ValidateRcpt(e); err != nil {
+			t.Error("expecting the recipient to be accepted, got", err)
+		}
+	}
+	if r := gw.Process(e, TaskSaveMail); r.Code() != 250 || !strings.HasPrefix(e.DeliveryHeader, "Received-SPF: pass") {
+		t.Error("expecting the message to be accepted with a header, got", r, e.DeliveryHeader)
+	}
+	if resolver.lookups != 1 {
+		t.Error("expecting the SPF record to be looked up once, got", resolver.lookups)
+	}
+}
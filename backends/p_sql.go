@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -35,6 +36,15 @@ import (
 //	: idle connection pool. The default is 2
 //	: sql_max_conn_lifetime - sets the maximum amount of time
 //	: a connection may be reused
+//	: sql_values - the values of the insert, the default is
+//	: "(NOW(), ?, ?, ?, ? , ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+//	: sql_spam_score bool - sql_values has a placeholder for the spam score
+//	: after the mail column. Always true with the default sql_values
+//	: sql_has_attach bool - sql_values has a placeholder for has_attach
+//	: after the recipient column. Always true with the default sql_values
+//	: sql_attach_table string - table for the metadata of the attachments
+//	: saved by the attachments processor, with the columns mail_hash,
+//	: attach_hash, name, content_type and size
 //
 // --------------:-------------------------------------------------------------------
 // Input         : e.Data
@@ -42,6 +52,9 @@ import (
 //	: e.DeliveryHeader generated by ParseHeader() processor
 //	: e.MailFrom
 //	: e.Subject - generated by by ParseHeader() processor
+//	: e.Values["spam"] - the spam score, set by the spamd or rspamd processor
+//	: e.Values["mime"] - the MIME tree set by the mimeparser processor, for has_attach
+//	: e.Values["attachments"] - set by the attachments processor
 //
 // ----------------------------------------------------------------------------------
 // Output        : Sets e.QueuedId with the first item fromHashes[0]
@@ -62,13 +75,23 @@ type SQLProcessorConfig struct {
 	MaxConnLifetime string `json:"sql_max_conn_lifetime,omitempty"`
 	MaxOpenConns    int    `json:"sql_max_open_conns,omitempty"`
 	MaxIdleConns    int    `json:"sql_max_idle_conns,omitempty"`
+	AttachTable     string `json:"sql_attach_table,omitempty"`
+	SpamScore       bool   `json:"sql_spam_score,omitempty"`
+	HasAttach       bool   `json:"sql_has_attach,omitempty"`
 }
 
 type SQLProcessor struct {
 	cache  stmtCache
 	config *SQLProcessorConfig
+	// spamScore is true if the spam_score column is bound
+	spamScore bool
+	// hasAttach is true if the has_attach column is bound
+	hasAttach bool
 }
 
+// sqlDefaultValues is the default value of sql_values
+const sqlDefaultValues = "(NOW(), ?, ?, ?, ? , ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
 func (s *SQLProcessor) connect() (*sql.DB, error) {
 	var db *sql.DB
 	var err error
@@ -126,7 +149,7 @@ func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
 	if s.config.SQLValues != "" {
 		values = s.config.SQLValues
 	} else {
-		values = "(NOW(), ?, ?, ?, ? , ?, 0, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?)"
+		values = sqlDefaultValues
 	}
 	// add more rows
 	comma := ""
@@ -145,7 +168,7 @@ func (s *SQLProcessor) prepareInsertQuery(rows int, db *sql.DB) *sql.Stmt {
 	return stmt
 }
 
-func (s *SQLProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]interface{}) (execErr error) {
+func (s *SQLProcessor) doQuery(ctx context.Context, c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]interface{}) (execErr error) {
 	defer func() {
 		if r := recover(); r != nil {
 			Log().Error("Recovered form panic:", r, string(debug.Stack()))
@@ -161,7 +184,7 @@ func (s *SQLProcessor) doQuery(c int, db *sql.DB, insertStmt *sql.Stmt, vals *[]
 	}()
 	// prepare the query used to insert when rows reaches batchMax
 	insertStmt = s.prepareInsertQuery(c, db)
-	_, execErr = insertStmt.Exec(*vals...)
+	_, execErr = insertStmt.ExecContext(ctx, *vals...)
 	if execErr != nil {
 		Log().WithError(execErr).Error("There was a problem the insert")
 	}
@@ -191,6 +214,22 @@ func (s *SQLProcessor) fillAddressFromHeader(e *mail.Envelope, headerKey string)
 	return ""
 }
 
+// insertAttachments saves the metadata of the attachments to the sql_attach_table
+func (s *SQLProcessor) insertAttachments(db *sql.DB, hash string, e *mail.Envelope) error {
+	attachments, ok := e.Values["attachments"].([]*Attachment)
+	if !ok || s.config.AttachTable == "" {
+		return nil
+	}
+	query := "INSERT INTO " + s.config.AttachTable +
+		" (`mail_hash`, `attach_hash`, `name`, `content_type`, `size`) VALUES (?, ?, ?, ?, ?)"
+	for _, a := range attachments {
+		if _, err := db.ExecContext(e.Context(), query, hash, a.Hash, trimToLimit(a.Name, 255), trimToLimit(a.ContentType, 255), a.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func SQL() Decorator {
 	var config *SQLProcessorConfig
 	var vals []interface{}
@@ -206,6 +245,10 @@ func SQL() Decorator {
 		}
 		config = bcfg.(*SQLProcessorConfig)
 		s.config = config
+		// the default sql_values binds the spam score and has_attach, a custom one
+		// binds them if configured to
+		s.spamScore = config.SQLValues == "" || config.SpamScore
+		s.hasAttach = config.SQLValues == "" || config.HasAttach
 		db, err = s.connect()
 		if err != nil {
 			return err
@@ -233,11 +276,12 @@ func SQL() Decorator {
 					e.QueuedId = e.Hashes[0]
 				}
 
-				var co *DataCompressor
+				var compressed []byte
 				// a compressor was set by the Compress processor
 				if c, ok := e.Values["zlib-compressor"]; ok {
 					body = "gzip"
-					co = c.(*DataCompressor)
+					// the same data is saved for each recipient
+					compressed = c.(*DataCompressor).Bytes()
 				}
 				// was saved in redis by the Redis processor
 				if _, ok := e.Values["redis"]; ok {
@@ -279,18 +323,38 @@ func SQL() Decorator {
 					if body == "redis" {
 						// data already saved in redis
 						vals = append(vals, "")
-					} else if co != nil {
+					} else if compressed != nil {
 						// use a compressor (automatically adds e.DeliveryHeader)
-						vals = append(vals, co.String())
+						vals = append(vals, compressed)
 
+					} else if data, err := messageBytes(e); err != nil {
+						Log().WithError(err).Error("Error while reading the email")
+						return NewResult(response.Canned.FailBackendTransaction), StorageError
 					} else {
-						vals = append(vals, e.String())
+						vals = append(vals, data)
+					}
+					if s.spamScore {
+						// `spam_score` column
+						score := 0.0
+						if spam, ok := e.Values["spam"].(*SpamResult); ok {
+							score = spam.Score
+						}
+						vals = append(vals, score)
 					}
 
 					vals = append(vals,
 						hash, // hash (redis hash if saved in redis)
 						contentType,
 						recipient,
+					)
+					if s.hasAttach {
+						hasAttach := 0
+						if root := mimeTree(e); root != nil && len(root.Attachments()) > 0 {
+							hasAttach = 1
+						}
+						vals = append(vals, hasAttach)
+					}
+					vals = append(vals,
 						s.ip2bint(e.RemoteIP).Bytes(),         // ip_addr store as varbinary(16)
 						trimToLimit(e.MailFrom.String(), 255), // return_path
 						// is_tls
@@ -303,11 +367,15 @@ func SQL() Decorator {
 					)
 
 					stmt := s.prepareInsertQuery(1, db)
-					err := s.doQuery(1, db, stmt, &vals)
+					err := s.doQuery(e.Context(), 1, db, stmt, &vals)
 					if err != nil {
 						return NewResult("554 Error: could not save email"), StorageError
 					}
 				}
+				if err := s.insertAttachments(db, hash, e); err != nil {
+					Log().WithError(err).Error("could not save the attachments of ", hash)
+					return NewResult("554 Error: could not save email"), StorageError
+				}
 			case TaskValidateRcpt:
 				// if you need to validate the e.Rcpt then change to:
 				if len(e.RcptTo) > 0 {
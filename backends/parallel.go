@@ -0,0 +1,232 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// A parallel group in a stack config, eg. "HeadersParser|{SPF, DKIM|DMARC, 5s: Spamd}|SQL",
+// runs its branches at the same time, each on a copy of the envelope. It is meant for
+// read-only processors, such as checks that query other servers. The copies share the
+// parsed header of the envelope, which must not be changed.
+//
+// When all the branches are done, the values they set in e.Values and the headers they
+// added to e.DeliveryHeader are copied to the envelope, in the order of the branches, so
+// the last branch wins when two set the same value. The results of the branches are in
+// e.Values["parallel"] as []ParallelResult.
+//
+// If a branch fails, the group fails with its result, a permanent failure (5xx) winning
+// over a temporary one. A branch may start with its timeout, eg. "5s:", the default is
+// parallel_timeout. A branch that times out fails the group with a temporary failure,
+// unless parallel_fail_open is set; it is left to finish in the background.
+
+// ParallelConfig is the config of the parallel groups
+type ParallelConfig struct {
+	// Timeout of a branch, eg. "10s". Defaults to gw_save_timeout
+	Timeout string `json:"parallel_timeout,omitempty"`
+	// FailOpen ignores the branches that time out
+	FailOpen bool `json:"parallel_fail_open,omitempty"`
+	// SaveTimeout is the gateway's gw_save_timeout
+	SaveTimeout string `json:"gw_save_timeout,omitempty"`
+}
+
+// ParallelResult is the result of a branch of a parallel group
+type ParallelResult struct {
+	// Chain is the config of the branch, eg. "dkim|dmarc"
+	Chain    string
+	Result   Result
+	Err      error
+	Duration time.Duration
+	TimedOut bool
+}
+
+var errParallelTimeout = errors.New("parallel branch timed out")
+
+type parallelBranch struct {
+	chain string
+	// timeout is zero for the default
+	timeout time.Duration
+	p       Processor
+}
+
+// parallelMerge copies the values and headers that the branches added to the envelope,
+// then releases the data of the copies
+func parallelMerge(e *mail.Envelope, copies []*mail.Envelope) {
+	before := make(map[string]interface{}, len(e.Values))
+	for k, v := range e.Values {
+		before[k] = v
+	}
+	header := e.DeliveryHeader
+	var prepended, appended strings.Builder
+	for _, c := range copies {
+		if c == nil {
+			continue
+		}
+		for k, v := range c.Values {
+			if old, ok := before[k]; !ok || !reflect.DeepEqual(old, v) {
+				e.Values[k] = v
+			}
+		}
+		if strings.HasSuffix(c.DeliveryHeader, header) {
+			prepended.WriteString(strings.TrimSuffix(c.DeliveryHeader, header))
+		} else if strings.HasPrefix(c.DeliveryHeader, header) {
+			appended.WriteString(strings.TrimPrefix(c.DeliveryHeader, header))
+		}
+		c.Data.Reset()
+	}
+	e.DeliveryHeader = prepended.String() + header + appended.String()
+}
+
+// parallelDecision returns the failure of the group, or nil if there is none
+func parallelDecision(results []ParallelResult, failOpen bool) (Result, error) {
+	var (
+		decision    Result
+		decisionErr error
+	)
+	for _, r := range results {
+		result, err := r.Result, r.Err
+		switch {
+		case r.TimedOut:
+			if failOpen {
+				continue
+			}
+			result, err = NewResult("451 4.3.0 Error: "+r.Chain+" timed out"), errParallelTimeout
+		case err != nil && result == nil:
+			result = NewResult("451 4.3.0 Error: " + r.Chain + " failed")
+		case err == nil && (result == nil || result.Code() < 300):
+			continue
+		}
+		// a permanent failure wins over a temporary one
+		if decision == nil || result.Code() >= 500 && decision.Code() < 500 {
+			decision, decisionErr = result, err
+		}
+	}
+	return decision, decisionErr
+}
+
+func parallelDecorator(branches []parallelBranch) Decorator {
+	var (
+		config  *ParallelConfig
+		timeout time.Duration
+	)
+	Svc.AddInitializer(InitializeWith(func(backendConfig BackendConfig) error {
+		configType := BaseConfig(&ParallelConfig{})
+		bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+		if err != nil {
+			return err
+		}
+		config = bcfg.(*ParallelConfig)
+		timeout = saveTimeout
+		if config.SaveTimeout != "" {
+			if t, err := time.ParseDuration(config.SaveTimeout); err == nil {
+				timeout = t
+			}
+		}
+		if config.Timeout != "" {
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil {
+				return fmt.Errorf("invalid parallel_timeout [%s]: %s", config.Timeout, err)
+			}
+		}
+		return nil
+	}))
+
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			if e.Header == nil {
+				// parsed once here, rather than by each branch
+				_ = e.ParseHeaders()
+			}
+			type outcome struct {
+				i      int
+				copy   *mail.Envelope
+				result Result
+				err    error
+			}
+			// buffered, so that a branch that timed out can still finish
+			done := make(chan outcome, len(branches))
+			start := time.Now()
+			deadlines := make([]time.Time, len(branches))
+			for i, b := range branches {
+				deadlines[i] = start.Add(timeout)
+				if b.timeout > 0 {
+					deadlines[i] = start.Add(b.timeout)
+				}
+				go func(i int, b parallelBranch, c *mail.Envelope) {
+					o := outcome{i: i, copy: c}
+					// the context of the branch is cancelled when it times out
+					ctx, cancel := context.WithDeadline(c.Context(), deadlines[i])
+					defer cancel()
+					defer func() {
+						if r := recover(); r != nil {
+							Log().Errorf("parallel branch [%s] panicked: %v", b.chain, r)
+							o.result, o.err = nil, fmt.Errorf("panic: %v", r)
+						}
+						done <- o
+					}()
+					o.result, o.err = ProcessContext(ctx, b.p, c, task)
+				}(i, b, copyEnvelope(e))
+			}
+			results := make([]ParallelResult, len(branches))
+			copies := make([]*mail.Envelope, len(branches))
+			finished := make([]bool, len(branches))
+			// late is the number of branches that timed out and are still running
+			late := 0
+			for pending := len(branches); pending > 0; {
+				var next time.Time
+				for i := range branches {
+					if !finished[i] && (next.IsZero() || deadlines[i].Before(next)) {
+						next = deadlines[i]
+					}
+				}
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case o := <-done:
+					if finished[o.i] {
+						// timed out, its copy is dropped
+						o.copy.Data.Reset()
+						late--
+						break
+					}
+					finished[o.i] = true
+					pending--
+					copies[o.i] = o.copy
+					results[o.i] = ParallelResult{
+						Chain: branches[o.i].chain, Result: o.result, Err: o.err, Duration: time.Since(start),
+					}
+				case now := <-timer.C:
+					for i := range branches {
+						if !finished[i] && !deadlines[i].After(now) {
+							finished[i] = true
+							pending--
+							late++
+							results[i] = ParallelResult{Chain: branches[i].chain, TimedOut: true, Duration: time.Since(start)}
+							Log().Warnf("parallel branch [%s] timed out for %s", branches[i].chain, e.QueuedId)
+						}
+					}
+				}
+				timer.Stop()
+			}
+			if late > 0 {
+				// the copies of the branches that timed out are released when they finish
+				go func(late int) {
+					for ; late > 0; late-- {
+						o := <-done
+						o.copy.Data.Reset()
+					}
+				}(late)
+			}
+			parallelMerge(e, copies)
+			e.Values["parallel"] = results
+			if result, err := parallelDecision(results, config.FailOpen); result != nil {
+				return result, err
+			}
+			return p.Process(e, task)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// sleepProcessors wait, then set a value and a header named after them
+func sleepProcessors() map[string]ProcessorConstructor {
+	constructors := make(map[string]ProcessorConstructor)
+	for name, d := range map[string]time.Duration{"sleepa": 100 * time.Millisecond, "sleepb": 100 * time.Millisecond, "sleepc": time.Second} {
+		name, d := name, d
+		constructors[name] = func() Decorator {
+			return func(p Processor) Processor {
+				return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+					time.Sleep(d)
+					if e.Header.Get("X-Reject") == name {
+						return NewResult("554 5.7.1 rejected by " + name), PolicyError
+					}
+					if e.Header.Get("X-Defer") == name {
+						return NewResult("451 4.7.1 deferred by " + name), PolicyError
+					}
+					e.Values[name] = true
+					e.DeliveryHeader = "X-" + name + ": yes\n" + e.DeliveryHeader
+					return p.Process(e, task)
+				})
+			}
+		}
+	}
+	return constructors
+}
+
+func newParallelTestGateway(t *testing.T, failOpen bool) Backend {
+	registerProcessors(t, traceProcessors())
+	registerProcessors(t, sleepProcessors())
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process":       "{SleepA, SleepB|TraceB, 300ms: SleepC}|TraceA",
+		"save_workers_size":  1,
+		"parallel_timeout":   "2s",
+		"parallel_fail_open": failOpen,
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return gw
+}
+
+func TestParallel(t *testing.T) {
+	gw := newParallelTestGateway(t, true)
+	defer func() { _ = gw.Shutdown() }()
+
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.DeliveryHeader = "Received: from test\n"
+	e.Data.WriteString("Subject: hi\n\nhi\n")
+	start := time.Now()
+	r := gw.Process(e, TaskTest)
+	if r.Code() != 250 {
+		t.Fatal("expecting 250, got", r)
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Error("the branches did not run in parallel, took", elapsed)
+	}
+	if e.Values["sleepa"] != true || e.Values["sleepb"] != true || e.Values["sleepc"] != nil {
+		t.Error("unexpected values", e.Values)
+	}
+	if trace, _ := e.Values["trace"].([]string); strings.Join(trace, " ") != "traceb: tracea:" {
+		t.Error("unexpected trace", trace)
+	}
+	if e.DeliveryHeader != "X-sleepa: yes\nX-sleepb: yes\nReceived: from test\n" {
+		t.Errorf("unexpected delivery header %q", e.DeliveryHeader)
+	}
+	results, _ := e.Values["parallel"].([]ParallelResult)
+	if len(results) != 3 || results[1].Chain != "sleepb|traceb" || !results[2].TimedOut || results[0].Result.Code() != 200 {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
+
+func TestParallelDecision(t *testing.T) {
+	gw := newParallelTestGateway(t, false)
+	defer func() { _ = gw.Shutdown() }()
+
+	for _, test := range []struct {
+		header string
+		code   int
+	}{
+		{"", 451},
+		{"X-Defer: sleepa\nX-Reject: sleepb\n", 554},
+	} {
+		e := mail.NewEnvelope("127.0.0.1", 1)
+		e.Data.WriteString(test.header + "Subject: hi\n\nhi\n")
+		r := gw.Process(e, TaskTest)
+		if r.Code() != test.code {
+			t.Errorf("expecting %d, got %s", test.code, r)
+		}
+		if trace, _ := e.Values["trace"].([]string); strings.Contains(strings.Join(trace, " "), "tracea") {
+			t.Error("the next processor should not run after a failure")
+		}
+	}
+}
+
+func TestParallelParse(t *testing.T) {
+	registerProcessors(t, traceProcessors())
+	for _, cfg := range []string{
+		"{TraceA, TraceB",
+		"{TraceA; TraceB}",
+		"{0s: TraceA}",
+		"{soon: TraceA}",
+		"{TraceA,}",
+	} {
+		if _, err := newStack(cfg, nil); err == nil {
+			t.Error("expecting an error for", cfg)
+		}
+	}
+	if _, err := newStack("{TraceA, (tls => TraceB; TraceC), 1s: @x}", nil); err == nil || !strings.Contains(err.Error(), "[x] not found") {
+		t.Error("expecting the named stack to be parsed, got", err)
+	}
+}
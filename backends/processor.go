@@ -1,6 +1,8 @@
 package backends
 
 import (
+	"context"
+
 	"github.com/phires/go-guerrilla/mail"
 )
 
@@ -43,6 +45,50 @@ func (f ProcessWith) Process(e *mail.Envelope, task SelectTask) (Result, error)
 	return f(e, task)
 }
 
+// ProcessContext makes ProcessWith satisfy the ContextProcessor interface,
+// the function gets the context from e.Context()
+func (f ProcessWith) ProcessContext(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+	defer e.SetContext(e.Context())
+	e.SetContext(ctx)
+	return f(e, task)
+}
+
+// ContextProcessor is a processor that takes the context of the transaction, which is
+// cancelled when the client disconnects, the gateway times out or the backend shuts down.
+// A processor that is not a ContextProcessor can get it from e.Context()
+type ContextProcessor interface {
+	Processor
+	ProcessContext(context.Context, *mail.Envelope, SelectTask) (Result, error)
+}
+
+// Signature of ContextProcessor
+type ProcessWithContext func(context.Context, *mail.Envelope, SelectTask) (Result, error)
+
+// Process makes ProcessWithContext satisfy the Processor interface, with the context of e
+func (f ProcessWithContext) Process(e *mail.Envelope, task SelectTask) (Result, error) {
+	return f(e.Context(), e, task)
+}
+
+// ProcessContext makes ProcessWithContext satisfy the ContextProcessor interface.
+// The context is also set on the envelope while f runs, so that the next processors get it
+// even if f calls their Process method
+func (f ProcessWithContext) ProcessContext(ctx context.Context, e *mail.Envelope, task SelectTask) (Result, error) {
+	defer e.SetContext(e.Context())
+	e.SetContext(ctx)
+	return f(ctx, e, task)
+}
+
+// ProcessContext calls the processor with a context, eg. one with a deadline.
+// The context is passed to processors that are not a ContextProcessor with the envelope
+func ProcessContext(ctx context.Context, p Processor, e *mail.Envelope, task SelectTask) (Result, error) {
+	if cp, ok := p.(ContextProcessor); ok {
+		return cp.ProcessContext(ctx, e, task)
+	}
+	defer e.SetContext(e.Context())
+	e.SetContext(ctx)
+	return p.Process(e, task)
+}
+
 // DefaultProcessor is a undecorated worker that does nothing
 // Notice DefaultProcessor has no knowledge of the other decorators that have orthogonal concerns.
 type DefaultProcessor struct{}
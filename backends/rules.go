@@ -0,0 +1,441 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	netmail "net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/mime"
+)
+
+// The rules file has one rule per line, a line can be continued with a \ at its end.
+// A rule is a list of conditions joined by "and", then "=>" and an action:
+//
+//	# comment
+//	header:Subject ~ /viagra|cialis/i => reject 550 5.7.1 "No thanks"
+//	remote_ip in 10.0.0.0/8,192.168.0.0/16 => accept
+//	rcpt contains "@support.example.com" and not body contains "unsubscribe" => route sql|debugger
+//	=> add_header X-Filtered "yes"
+//
+// The fields are helo, mail_from, rcpt (any of the recipients), remote_ip, body and
+// header:<Name> (any of the values). The operators are ~ for a regular expression,
+// contains for a case-insensitive substring, and in for a comma separated list of CIDRs.
+// The actions are accept, reject [code] [status] ["text"], tempfail [code] [status] ["text"],
+// discard, add_header <Name> "value", tag "text" and route <processor chain>.
+// The rules are evaluated in order; accept, reject, tempfail, discard and route end the
+// evaluation, add_header and tag continue it.
+
+// ruleCondition matches a field of the envelope
+type ruleCondition struct {
+	field  string
+	header string // the name of the header, for the header field
+	not    bool
+	regex  *regexp.Regexp
+	substr string
+	cidrs  []*net.IPNet
+}
+
+// ruleAction is what is done with a message when all the conditions of a rule matched
+type ruleAction struct {
+	name  string
+	reply string // reject, tempfail
+	key   string // add_header
+	value string // add_header, tag, route
+}
+
+type rule struct {
+	line       int
+	conditions []*ruleCondition
+	action     ruleAction
+}
+
+// ruleFields are the fields that conditions can match, other than header:<Name>
+var ruleFields = map[string]bool{"helo": true, "mail_from": true, "rcpt": true, "remote_ip": true, "body": true}
+
+// ruleTokens splits a line into words, "quoted strings" and /regular expressions/flags.
+// Quoted strings keep their opening quote to tell them apart, see ruleUnquote
+func ruleTokens(line string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			var buf strings.Builder
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' && j+1 < len(line) {
+					j++
+				}
+				buf.WriteByte(line[j])
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, "\""+buf.String())
+			i = j + 1
+		case c == '/':
+			j := i + 1
+			for ; j < len(line) && line[j] != '/'; j++ {
+				if line[j] == '\\' && j+1 < len(line) {
+					j++
+				}
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated regular expression")
+			}
+			// flags
+			for j++; j < len(line) && line[j] != ' ' && line[j] != '\t'; j++ {
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		default:
+			j := i
+			for ; j < len(line) && line[j] != ' ' && line[j] != '\t'; j++ {
+			}
+			tokens = append(tokens, line[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// unquote returns the text of a quoted token, ok is false if it was not quoted
+func ruleUnquote(token string) (string, bool) {
+	if strings.HasPrefix(token, "\"") {
+		return token[1:], true
+	}
+	return token, false
+}
+
+// parseRuleRegex compiles a /regular expression/flags token, the flags are i, m and s
+func parseRuleRegex(token string) (*regexp.Regexp, error) {
+	end := strings.LastIndex(token, "/")
+	if !strings.HasPrefix(token, "/") || end < 1 {
+		return nil, fmt.Errorf("expecting a /regular expression/, got [%s]", token)
+	}
+	expr, flags := strings.ReplaceAll(token[1:end], `\/`, "/"), token[end+1:]
+	for _, f := range flags {
+		if f != 'i' && f != 'm' && f != 's' {
+			return nil, fmt.Errorf("invalid regular expression flag [%c]", f)
+		}
+	}
+	if flags != "" {
+		expr = "(?" + flags + ")" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+func parseRuleCondition(tokens []string) (*ruleCondition, error) {
+	c := &ruleCondition{}
+	if len(tokens) > 0 && tokens[0] == "not" {
+		c.not, tokens = true, tokens[1:]
+	}
+	if len(tokens) != 3 {
+		return nil, fmt.Errorf("expecting a condition as field operator value, got [%s]", strings.Join(tokens, " "))
+	}
+	c.field = strings.ToLower(tokens[0])
+	if strings.HasPrefix(c.field, "header:") {
+		c.header, c.field = textproto.CanonicalMIMEHeaderKey(tokens[0][len("header:"):]), "header"
+		if c.header == "" {
+			return nil, fmt.Errorf("missing header name")
+		}
+	} else if !ruleFields[c.field] {
+		return nil, fmt.Errorf("unknown field [%s]", tokens[0])
+	}
+	var err error
+	switch op, value := tokens[1], tokens[2]; op {
+	case "~":
+		if c.regex, err = parseRuleRegex(value); err != nil {
+			return nil, err
+		}
+	case "contains":
+		text, quoted := ruleUnquote(value)
+		if !quoted {
+			return nil, fmt.Errorf("expecting a \"quoted string\" after contains, got [%s]", value)
+		}
+		c.substr = strings.ToLower(text)
+	case "in":
+		if c.field != "remote_ip" {
+			return nil, fmt.Errorf("the in operator is only for remote_ip")
+		}
+		for _, s := range strings.Split(value, ",") {
+			s = strings.TrimSpace(s)
+			if !strings.Contains(s, "/") {
+				if strings.Contains(s, ":") {
+					s += "/128"
+				} else {
+					s += "/32"
+				}
+			}
+			_, cidr, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			c.cidrs = append(c.cidrs, cidr)
+		}
+	default:
+		return nil, fmt.Errorf("unknown operator [%s]", op)
+	}
+	return c, nil
+}
+
+// parseRuleReply parses the optional [code] [status] ["text"] of reject and tempfail
+func parseRuleReply(args []string, class byte, defaultReply string) (string, error) {
+	code, status, text := "", "", ""
+	for _, arg := range args {
+		if t, quoted := ruleUnquote(arg); quoted {
+			text = t
+		} else if n, err := strconv.Atoi(arg); err == nil && n >= 200 && n <= 599 && code == "" && text == "" {
+			code = arg
+		} else if strings.Count(arg, ".") == 2 && status == "" && text == "" {
+			status = arg
+		} else {
+			return "", fmt.Errorf("unexpected [%s], expecting [code] [status] [\"text\"]", arg)
+		}
+	}
+	if code != "" && code[0] != class {
+		return "", fmt.Errorf("the code must be %cxx, got %s", class, code)
+	}
+	if code == "" && status == "" && text == "" {
+		return defaultReply, nil
+	}
+	parts := strings.SplitN(defaultReply, " ", 3)
+	if code == "" {
+		code = parts[0]
+	}
+	if status == "" {
+		status = parts[1]
+	}
+	if text == "" {
+		text = parts[2]
+	}
+	return code + " " + status + " " + text, nil
+}
+
+func parseRuleAction(tokens []string) (ruleAction, error) {
+	if len(tokens) == 0 {
+		return ruleAction{}, fmt.Errorf("missing action")
+	}
+	a := ruleAction{name: strings.ToLower(tokens[0])}
+	args := tokens[1:]
+	var err error
+	switch a.name {
+	case "accept", "discard":
+		if len(args) > 0 {
+			return a, fmt.Errorf("%s has no arguments", a.name)
+		}
+	case "reject":
+		a.reply, err = parseRuleReply(args, '5', "550 5.7.1 Message rejected by policy")
+	case "tempfail":
+		a.reply, err = parseRuleReply(args, '4', "451 4.7.1 Try again later")
+	case "add_header":
+		if len(args) != 2 {
+			return a, fmt.Errorf("expecting add_header Name \"value\"")
+		}
+		a.key = textproto.CanonicalMIMEHeaderKey(strings.TrimSuffix(args[0], ":"))
+		a.value, _ = ruleUnquote(args[1])
+		if strings.ContainsAny(a.key+a.value, "\r\n") {
+			return a, fmt.Errorf("the header cannot have line breaks")
+		}
+	case "tag", "route":
+		if len(args) != 1 {
+			return a, fmt.Errorf("expecting %s and one argument", a.name)
+		}
+		a.value, _ = ruleUnquote(args[0])
+	default:
+		return a, fmt.Errorf("unknown action [%s]", tokens[0])
+	}
+	return a, err
+}
+
+// parseRules reads a rules file
+func parseRules(r io.Reader) ([]*rule, error) {
+	var rules []*rule
+	scanner := bufio.NewScanner(r)
+	lineNo, start := 0, 0
+	var line string
+	for scanner.Scan() {
+		lineNo++
+		text := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			start = lineNo
+		}
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		line += text
+		if line == "" || strings.HasPrefix(line, "#") {
+			line = ""
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("rules line %d: %s", start, err)
+		}
+		r.line = start
+		rules = append(rules, r)
+		line = ""
+	}
+	return rules, scanner.Err()
+}
+
+func parseRule(line string) (*rule, error) {
+	tokens, err := ruleTokens(line)
+	if err != nil {
+		return nil, err
+	}
+	arrow := -1
+	for i, t := range tokens {
+		if t == "=>" {
+			arrow = i
+			break
+		}
+	}
+	if arrow < 0 {
+		return nil, fmt.Errorf("missing => before the action")
+	}
+	r := &rule{}
+	if r.action, err = parseRuleAction(tokens[arrow+1:]); err != nil {
+		return nil, err
+	}
+	conditions := tokens[:arrow]
+	for len(conditions) > 0 {
+		end := len(conditions)
+		for i, t := range conditions {
+			if t == "and" {
+				end = i
+				break
+			}
+		}
+		c, err := parseRuleCondition(conditions[:end])
+		if err != nil {
+			return nil, err
+		}
+		r.conditions = append(r.conditions, c)
+		if end == len(conditions) {
+			break
+		}
+		conditions = conditions[end+1:]
+		if len(conditions) == 0 {
+			return nil, fmt.Errorf("missing condition after and")
+		}
+	}
+	return r, nil
+}
+
+// ruleMessage gives the parts of the message to the conditions, the header and body are
+// only read if a condition needs them
+type ruleMessage struct {
+	e      *mail.Envelope
+	header textproto.MIMEHeader
+	body   *string
+}
+
+func (m *ruleMessage) headerValues(name string) []string {
+	if m.header == nil {
+		if m.e.Header != nil {
+			m.header = m.e.Header
+		} else if msg, err := netmail.ReadMessage(m.e.Data.NewReader()); err == nil {
+			m.header = textproto.MIMEHeader(msg.Header)
+		} else {
+			m.header = textproto.MIMEHeader{}
+		}
+	}
+	values := m.header[name]
+	decoded := make([]string, len(values))
+	for i := range values {
+		decoded[i] = mail.MimeHeaderDecode(values[i])
+	}
+	return decoded
+}
+
+// bodyText returns the text parts of the message if it was parsed by mimeparser,
+// or else the raw body
+func (m *ruleMessage) bodyText() string {
+	if m.body != nil {
+		return *m.body
+	}
+	var body string
+	if root := mimeTree(m.e); root != nil {
+		var buf strings.Builder
+		_ = root.Walk(func(part *mime.Part) error {
+			if strings.HasPrefix(part.ContentType, "text/") && !part.IsAttachment() {
+				buf.Write(part.Body)
+				buf.WriteString("\n")
+			}
+			return nil
+		})
+		body = buf.String()
+	} else {
+		data := m.e.Data.Bytes()
+		if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+			body = string(data[i+2:])
+		} else if i = bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+			body = string(data[i+4:])
+		}
+	}
+	m.body = &body
+	return body
+}
+
+func (c *ruleCondition) matchValue(value string) bool {
+	if c.regex != nil {
+		return c.regex.MatchString(value)
+	}
+	return strings.Contains(strings.ToLower(value), c.substr)
+}
+
+func (c *ruleCondition) match(m *ruleMessage) bool {
+	var values []string
+	switch c.field {
+	case "helo":
+		values = []string{m.e.Helo}
+	case "mail_from":
+		values = []string{m.e.MailFrom.String()}
+	case "rcpt":
+		for i := range m.e.RcptTo {
+			values = append(values, m.e.RcptTo[i].String())
+		}
+	case "remote_ip":
+		if c.cidrs != nil {
+			ip := net.ParseIP(m.e.RemoteIP)
+			for _, cidr := range c.cidrs {
+				if ip != nil && cidr.Contains(ip) {
+					return !c.not
+				}
+			}
+			return c.not
+		}
+		values = []string{m.e.RemoteIP}
+	case "body":
+		values = []string{m.bodyText()}
+	case "header":
+		values = m.headerValues(c.header)
+	}
+	for _, v := range values {
+		if c.matchValue(v) {
+			return !c.not
+		}
+	}
+	return c.not
+}
+
+// match returns true if all the conditions match
+func (r *rule) match(m *ruleMessage) bool {
+	for _, c := range r.conditions {
+		if !c.match(m) {
+			return false
+		}
+	}
+	return true
+}
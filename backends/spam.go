@@ -0,0 +1,120 @@
+package backends
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// SpamResult is the verdict of a spam scanner, the spamd and rspamd processors
+// save it in e.Values["spam"]
+type SpamResult struct {
+	Score float64
+	// Required is the score from which the scanner considers the message to be spam
+	Required float64
+	// Spam is true if the scanner considers the message to be spam
+	Spam bool
+	// Symbols are the names of the rules that matched
+	Symbols []string
+	// Action is the action recommended by the scanner (rspamd only), eg. "add header"
+	Action string
+}
+
+// SpamProcessorConfig is the config shared by the spam scanning processors
+type SpamProcessorConfig struct {
+	TagScore    string `json:"spam_tag_score,omitempty"`
+	RejectScore string `json:"spam_reject_score,omitempty"`
+	Timeout     string `json:"spam_timeout,omitempty"`
+}
+
+const spamDefaultTimeout = 30 * time.Second
+
+// spamPolicy decides what to do with a message, given the verdict of a scanner
+type spamPolicy struct {
+	tagScore    *float64
+	rejectScore *float64
+	timeout     time.Duration
+}
+
+func parseSpamScore(name, s string) (*float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s [%s]", name, s)
+	}
+	return &score, nil
+}
+
+func newSpamPolicy(backendConfig BackendConfig) (*spamPolicy, error) {
+	configType := BaseConfig(&SpamProcessorConfig{})
+	bcfg, err := Svc.ExtractConfig(backendConfig, configType)
+	if err != nil {
+		return nil, err
+	}
+	config := bcfg.(*SpamProcessorConfig)
+	p := &spamPolicy{timeout: spamDefaultTimeout}
+	if p.tagScore, err = parseSpamScore("spam_tag_score", config.TagScore); err != nil {
+		return nil, err
+	}
+	if p.rejectScore, err = parseSpamScore("spam_reject_score", config.RejectScore); err != nil {
+		return nil, err
+	}
+	if config.Timeout != "" {
+		if p.timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid spam_timeout [%s]: %s", config.Timeout, err)
+		}
+	}
+	return p, nil
+}
+
+// spamStatus returns the X-Spam-* headers, the tests are folded so that the lines are not too long
+func spamStatus(result *SpamResult, tagged bool) string {
+	flag := "No"
+	if tagged {
+		flag = "Yes"
+	}
+	status := fmt.Sprintf("X-Spam-Status: %s, score=%.1f required=%.1f tests=", flag, result.Score, result.Required)
+	line := len(status)
+	for i, symbol := range result.Symbols {
+		if i > 0 {
+			status += ","
+			line++
+		}
+		if line+len(symbol) > 76 {
+			status += "\n\t"
+			line = 1
+		}
+		status += symbol
+		line += len(symbol)
+	}
+	header := ""
+	if tagged {
+		header = "X-Spam-Flag: YES\n"
+	}
+	return header + fmt.Sprintf("X-Spam-Score: %.1f\n", result.Score) + status + "\n"
+}
+
+// apply saves the result to the envelope, adds the headers, and returns a Result if
+// the message should be rejected.
+// Without spam_tag_score, the verdict of the scanner is used for tagging. Without
+// spam_reject_score, messages are only rejected if the scanner recommends so (rspamd)
+func (p *spamPolicy) apply(e *mail.Envelope, result *SpamResult) (Result, error) {
+	e.Values["spam"] = result
+	switch {
+	case p.rejectScore != nil && result.Score >= *p.rejectScore,
+		p.rejectScore == nil && result.Action == "reject":
+		return NewResult(fmt.Sprintf("550 5.7.1 Message rejected as spam (score %.1f)", result.Score)), SpamError
+	case p.rejectScore == nil && (result.Action == "soft reject" || result.Action == "greylist"):
+		return NewResult("451 4.7.1 Try again later"), SpamError
+	}
+	tagged := result.Spam
+	if p.tagScore != nil {
+		tagged = result.Score >= *p.tagScore
+	}
+	e.DeliveryHeader = spamStatus(result, tagged) + e.DeliveryHeader
+	return nil, nil
+}
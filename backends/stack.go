@@ -0,0 +1,510 @@
+package backends
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// The stack config, such as save_process, is a chain of processors separated by |.
+// An item of a chain may also be:
+//
+//	@name - the chain of the stack with this name in the "stacks" option, as if it was
+//	        written in its place, eg. "stacks": {"storage": "Hasher|SQL"}
+//	(condition => chain; condition => chain; chain) - a branch, the chain of the first
+//	        condition that matches is run, then the next processor after the branch.
+//	        The chain without a condition is run when none matched, it must be the last
+//	{chain, 5s: chain} - a parallel group, the chains are run at the same time, see parallel.go
+//	Name[timeout=5s, retries=2] - a processor with a timeout, retries or a circuit breaker,
+//	        see middleware.go
+//
+// A condition is one or more tests joined with &, each is a field, an operator and a
+// comma separated list of values:
+//
+//	= is one of the values, != is none of them, ~ contains one of them
+//	fields: helo, mail_from, mail_from_domain, rcpt, rcpt_domain,
+//	        remote_ip (= and != only, the values can be CIDRs), tls (= true or false),
+//	        header:Name (without an operator, true if the header exists)
+//
+// The conditions on rcpt and rcpt_domain are per recipient: the chain is run with the
+// recipients that match, the others are left for the next cases. The recipients of the
+// envelope are restored after the branch.
+// If a chain of a branch fails, its result is returned and the next processors are not run.
+//
+// eg. "HeadersParser|(rcpt_domain=a.example => @tenant_a; remote_ip=10.0.0.0/8 & tls=false => Redis; SQL)|Debugger"
+
+// namedStacks returns the stacks of the "stacks" option of the backend config, by lower-cased name
+func namedStacks(cfg BackendConfig) (map[string]string, error) {
+	stacks := make(map[string]string)
+	switch v := cfg["stacks"].(type) {
+	case nil:
+	case map[string]string:
+		for name, chain := range v {
+			stacks[strings.ToLower(name)] = chain
+		}
+	case map[string]interface{}:
+		for name, chain := range v {
+			s, ok := chain.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid stack [%s], expecting a string", name)
+			}
+			stacks[strings.ToLower(name)] = s
+		}
+	default:
+		return nil, convertError("property missing/invalid: 'stacks' of expected type: object")
+	}
+	return stacks, nil
+}
+
+// stacksUse returns true if save_process or a named stack of the backend config has one of
+// the processors. It only looks at the names, the stacks are not built
+func stacksUse(cfg BackendConfig, names ...string) bool {
+	chains := []string{}
+	if s, ok := cfg["save_process"].(string); ok {
+		chains = append(chains, s)
+	}
+	stacks, _ := namedStacks(cfg)
+	for _, chain := range stacks {
+		chains = append(chains, chain)
+	}
+	for _, chain := range chains {
+		for _, item := range strings.FieldsFunc(strings.ToLower(chain), func(r rune) bool {
+			return strings.ContainsRune("|;(){},", r)
+		}) {
+			// drop the condition of a case, the timeout of a parallel branch and the options
+			if i := strings.LastIndex(item, "=>"); i != -1 {
+				item = item[i+2:]
+			}
+			if i := strings.IndexByte(item, '['); i != -1 {
+				item = item[:i]
+			}
+			if i := strings.LastIndexByte(item, ':'); i != -1 {
+				item = item[i+1:]
+			}
+			item = strings.TrimSpace(item)
+			for _, name := range names {
+				if item == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// stackParser parses a stack config into decorators
+type stackParser struct {
+	s   string
+	pos int
+	// stacks are the named stacks that can be included
+	stacks map[string]string
+	// names are the named stacks being parsed, to find a stack that includes itself
+	names []string
+}
+
+func (sp *stackParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("invalid stack [%s]: %s", sp.s, fmt.Sprintf(format, a...))
+}
+
+func (sp *stackParser) skipSpace() {
+	for sp.pos < len(sp.s) && (sp.s[sp.pos] == ' ' || sp.s[sp.pos] == '\t' || sp.s[sp.pos] == '\n') {
+		sp.pos++
+	}
+}
+
+func (sp *stackParser) peek() byte {
+	if sp.pos < len(sp.s) {
+		return sp.s[sp.pos]
+	}
+	return 0
+}
+
+// chain parses processors separated by |, the decorators are returned in the order of the stack
+func (sp *stackParser) chain() ([]Decorator, error) {
+	var decorators []Decorator
+	for {
+		items, err := sp.item()
+		if err != nil {
+			return nil, err
+		}
+		decorators = append(decorators, items...)
+		sp.skipSpace()
+		if sp.peek() != '|' {
+			return decorators, nil
+		}
+		sp.pos++
+	}
+}
+
+func (sp *stackParser) item() ([]Decorator, error) {
+	sp.skipSpace()
+	if c := sp.peek(); c == '(' || c == '{' {
+		sp.pos++
+		var (
+			d   Decorator
+			err error
+		)
+		if c == '(' {
+			d, err = sp.branch()
+		} else {
+			d, err = sp.parallel()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []Decorator{d}, nil
+	}
+	start := sp.pos
+	for sp.pos < len(sp.s) && strings.IndexByte("|;(){},[]", sp.s[sp.pos]) == -1 {
+		sp.pos++
+	}
+	name := strings.TrimSpace(sp.s[start:sp.pos])
+	if name == "" {
+		return nil, sp.errorf("missing processor at position %d", start)
+	}
+	var options *middlewareOptions
+	if sp.peek() == '[' {
+		end := strings.IndexByte(sp.s[sp.pos:], ']')
+		if end == -1 {
+			return nil, sp.errorf("missing ] at position %d", len(sp.s))
+		}
+		var err error
+		if options, err = parseMiddlewareOptions(sp.s[sp.pos+1 : sp.pos+end]); err != nil {
+			return nil, sp.errorf("%s of %s", err, name)
+		}
+		sp.pos += end + 1
+	}
+	if strings.HasPrefix(name, "@") {
+		if options != nil {
+			return nil, sp.errorf("options of stack [%s], only processors have options", name[1:])
+		}
+		return sp.named(name[1:])
+	}
+	makeFunc, ok := processors[name]
+	if !ok {
+		ErrProcessorNotFound = fmt.Errorf("processor [%s] not found", name)
+		return nil, ErrProcessorNotFound
+	}
+	d := makeFunc()
+	if options != nil {
+		d = middlewareDecorator(name, options, d)
+	}
+	return []Decorator{instrumentDecorator(name, d)}, nil
+}
+
+// named parses the stack of a name
+func (sp *stackParser) named(name string) ([]Decorator, error) {
+	chain, ok := sp.stacks[name]
+	if !ok {
+		return nil, fmt.Errorf("stack [%s] not found", name)
+	}
+	for _, n := range sp.names {
+		if n == name {
+			return nil, fmt.Errorf("stack [%s] includes itself", name)
+		}
+	}
+	sub := &stackParser{
+		s:      strings.ToLower(strings.TrimSpace(chain)),
+		stacks: sp.stacks,
+		names:  append(sp.names[:len(sp.names):len(sp.names)], name),
+	}
+	decorators, err := sub.chain()
+	if err != nil {
+		return nil, err
+	}
+	if sub.pos != len(sub.s) {
+		return nil, sub.errorf("unexpected %q at position %d", sub.s[sub.pos], sub.pos)
+	}
+	return decorators, nil
+}
+
+// stackCase is a case of a branch
+type stackCase struct {
+	// cond is nil for the case without a condition
+	cond stackCondition
+	p    Processor
+}
+
+// branch parses the cases of a branch, up to the closing parenthesis
+func (sp *stackParser) branch() (Decorator, error) {
+	var cases []stackCase
+	for {
+		sp.skipSpace()
+		var c stackCase
+		// a condition ends with =>, it cannot have the characters of a chain
+		end := sp.pos
+		for end < len(sp.s) && strings.IndexByte("|;(){}", sp.s[end]) == -1 && !strings.HasPrefix(sp.s[end:], "=>") {
+			end++
+		}
+		if strings.HasPrefix(sp.s[end:], "=>") {
+			cond, err := parseStackCondition(sp.s[sp.pos:end])
+			if err != nil {
+				return nil, sp.errorf("%s", err)
+			}
+			c.cond = cond
+			sp.pos = end + 2
+		}
+		decorators, err := sp.chain()
+		if err != nil {
+			return nil, err
+		}
+		c.p = Decorate(DefaultProcessor{}, reverseDecorators(decorators)...)
+		cases = append(cases, c)
+		sp.skipSpace()
+		switch sp.peek() {
+		case ';':
+			if c.cond == nil {
+				return nil, sp.errorf("the case without a condition must be the last, at position %d", sp.pos)
+			}
+			sp.pos++
+		case ')':
+			sp.pos++
+			return branchDecorator(cases), nil
+		default:
+			return nil, sp.errorf("missing ) at position %d", sp.pos)
+		}
+	}
+}
+
+// parallel parses the branches of a parallel group, up to the closing brace
+func (sp *stackParser) parallel() (Decorator, error) {
+	var branches []parallelBranch
+	for {
+		sp.skipSpace()
+		var b parallelBranch
+		// a branch may start with its timeout, eg. 5s:
+		end := sp.pos
+		for end < len(sp.s) && strings.IndexByte("|,;(){}:", sp.s[end]) == -1 {
+			end++
+		}
+		if end < len(sp.s) && sp.s[end] == ':' {
+			d, err := time.ParseDuration(strings.TrimSpace(sp.s[sp.pos:end]))
+			if err != nil || d <= 0 {
+				return nil, sp.errorf("invalid timeout at position %d", sp.pos)
+			}
+			b.timeout = d
+			sp.pos = end + 1
+		}
+		start := sp.pos
+		decorators, err := sp.chain()
+		if err != nil {
+			return nil, err
+		}
+		b.chain = strings.TrimSpace(sp.s[start:sp.pos])
+		b.p = Decorate(DefaultProcessor{}, reverseDecorators(decorators)...)
+		branches = append(branches, b)
+		sp.skipSpace()
+		switch sp.peek() {
+		case ',':
+			sp.pos++
+		case '}':
+			sp.pos++
+			return parallelDecorator(branches), nil
+		default:
+			return nil, sp.errorf("missing } at position %d", sp.pos)
+		}
+	}
+}
+
+// reverseDecorators returns the decorators in reverse order, since decorators are stacked
+func reverseDecorators(decorators []Decorator) []Decorator {
+	reversed := make([]Decorator, len(decorators))
+	for i, d := range decorators {
+		reversed[len(decorators)-1-i] = d
+	}
+	return reversed
+}
+
+func branchDecorator(cases []stackCase) Decorator {
+	return func(p Processor) Processor {
+		return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+			rcpts := e.RcptTo
+			remaining := rcpts
+			for _, c := range cases {
+				if len(remaining) == 0 {
+					break
+				}
+				var matched, rest []mail.Address
+				switch {
+				case c.cond == nil:
+					matched = remaining
+				case c.cond.perRcpt():
+					for i := range remaining {
+						if c.cond.match(e, &remaining[i]) {
+							matched = append(matched, remaining[i])
+						} else {
+							rest = append(rest, remaining[i])
+						}
+					}
+				case c.cond.match(e, nil):
+					matched = remaining
+				default:
+					rest = remaining
+				}
+				remaining = rest
+				if len(matched) == 0 {
+					continue
+				}
+				e.RcptTo = matched
+				result, err := c.p.Process(e, task)
+				if err != nil || result != nil && result.Code() >= 300 {
+					e.RcptTo = rcpts
+					return result, err
+				}
+			}
+			e.RcptTo = rcpts
+			return p.Process(e, task)
+		})
+	}
+}
+
+// stackTest is a test of a condition of a branch
+type stackTest struct {
+	field  string
+	header string
+	op     string
+	values []string
+	nets   []*net.IPNet
+}
+
+// stackCondition is the tests of a condition, which must all be true
+type stackCondition []*stackTest
+
+func parseStackCondition(s string) (stackCondition, error) {
+	var cond stackCondition
+	for _, part := range strings.Split(s, "&") {
+		part = strings.TrimSpace(part)
+		t := &stackTest{}
+		i := strings.IndexAny(part, "!=~")
+		if i == -1 {
+			t.field = part
+		} else {
+			t.field = strings.TrimSpace(part[:i])
+			t.op = part[i : i+1]
+			if part[i] == '!' {
+				if !strings.HasPrefix(part[i:], "!=") {
+					return nil, fmt.Errorf("invalid condition [%s]", part)
+				}
+				t.op = "!="
+			}
+			for _, v := range strings.Split(part[i+len(t.op):], ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					t.values = append(t.values, v)
+				}
+			}
+			if len(t.values) == 0 {
+				return nil, fmt.Errorf("missing value in condition [%s]", part)
+			}
+		}
+		if strings.HasPrefix(t.field, "header:") {
+			t.header = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(t.field[len("header:"):]))
+			if t.header == "" {
+				return nil, fmt.Errorf("missing header name in condition [%s]", part)
+			}
+			t.field = "header"
+		}
+		switch t.field {
+		case "helo", "mail_from", "mail_from_domain", "rcpt", "rcpt_domain":
+			if t.op == "" {
+				return nil, fmt.Errorf("missing operator in condition [%s]", part)
+			}
+		case "header":
+		case "remote_ip":
+			if t.op != "=" && t.op != "!=" {
+				return nil, fmt.Errorf("remote_ip expects = or != in condition [%s]", part)
+			}
+			for _, v := range t.values {
+				if !strings.Contains(v, "/") {
+					if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+						v += "/32"
+					} else {
+						v += "/128"
+					}
+				}
+				_, ipNet, err := net.ParseCIDR(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid IP or CIDR [%s] in condition [%s]", v, part)
+				}
+				t.nets = append(t.nets, ipNet)
+			}
+		case "tls":
+			if t.op == "" {
+				t.op, t.values = "=", []string{"true"}
+			}
+			if t.op != "=" || len(t.values) != 1 || t.values[0] != "true" && t.values[0] != "false" {
+				return nil, fmt.Errorf("tls expects = true or false in condition [%s]", part)
+			}
+		default:
+			return nil, fmt.Errorf("unknown field [%s] in condition [%s]", t.field, part)
+		}
+		cond = append(cond, t)
+	}
+	return cond, nil
+}
+
+// perRcpt is true if the condition tests the recipients
+func (c stackCondition) perRcpt() bool {
+	for _, t := range c {
+		if t.field == "rcpt" || t.field == "rcpt_domain" {
+			return true
+		}
+	}
+	return false
+}
+
+// match tests the envelope, and the recipient for the rcpt fields
+func (c stackCondition) match(e *mail.Envelope, rcpt *mail.Address) bool {
+	for _, t := range c {
+		if !t.match(e, rcpt) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *stackTest) match(e *mail.Envelope, rcpt *mail.Address) bool {
+	var subjects []string
+	switch t.field {
+	case "helo":
+		subjects = []string{e.Helo}
+	case "mail_from":
+		subjects = []string{e.MailFrom.String()}
+	case "mail_from_domain":
+		subjects = []string{e.MailFrom.Host}
+	case "rcpt":
+		subjects = []string{rcpt.String()}
+	case "rcpt_domain":
+		subjects = []string{rcpt.Host}
+	case "header":
+		if e.Header == nil {
+			_ = e.ParseHeaders()
+		}
+		subjects = e.Header[t.header]
+		if t.op == "" {
+			return len(subjects) > 0
+		}
+	case "remote_ip":
+		ip := net.ParseIP(e.RemoteIP)
+		found := false
+		for _, n := range t.nets {
+			found = found || ip != nil && n.Contains(ip)
+		}
+		return found == (t.op == "=")
+	case "tls":
+		return e.TLS == (t.values[0] == "true")
+	}
+	found := false
+	for _, s := range subjects {
+		s = strings.ToLower(strings.TrimSpace(s))
+		for _, v := range t.values {
+			if t.op == "~" && strings.Contains(s, v) || t.op != "~" && s == v {
+				found = true
+			}
+		}
+	}
+	return found == (t.op != "!=")
+}
@@ -0,0 +1,165 @@
+package backends
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// registerProcessors adds processors until the end of the test
+func registerProcessors(t *testing.T, constructors map[string]ProcessorConstructor) {
+	for name, c := range constructors {
+		processors[name] = c
+	}
+	t.Cleanup(func() {
+		for name := range constructors {
+			delete(processors, name)
+		}
+	})
+}
+
+// traceProcessors append their name and recipients to e.Values["trace"],
+// tracefail fails
+func traceProcessors() map[string]ProcessorConstructor {
+	constructors := make(map[string]ProcessorConstructor)
+	for _, name := range []string{"tracea", "traceb", "tracec", "traced"} {
+		name := name
+		constructors[name] = func() Decorator {
+			return func(p Processor) Processor {
+				return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+					var rcpts []string
+					for i := range e.RcptTo {
+						rcpts = append(rcpts, e.RcptTo[i].User)
+					}
+					trace, _ := e.Values["trace"].([]string)
+					e.Values["trace"] = append(trace, name+":"+strings.Join(rcpts, ","))
+					return p.Process(e, task)
+				})
+			}
+		}
+	}
+	constructors["tracefail"] = func() Decorator {
+		return func(p Processor) Processor {
+			return ProcessWith(func(e *mail.Envelope, task SelectTask) (Result, error) {
+				return NewResult("554 5.0.0 failed"), StorageError
+			})
+		}
+	}
+	return constructors
+}
+
+func TestStackBranches(t *testing.T) {
+	registerProcessors(t, traceProcessors())
+	l, _ := log.GetLogger(log.OutputOff.String(), "debug")
+	gw, err := New(BackendConfig{
+		"save_process": "TraceA|(rcpt_domain=a.example,b.example => @tenant; remote_ip=192.0.2.0/24 & tls=false => TraceC;" +
+			" header:X-Fail => TraceFail; TraceD)|TraceA",
+		"save_workers_size": 1,
+		"stacks":            map[string]interface{}{"tenant": "TraceB|(header:X-Priority=1 => TraceC)", "unused": "@unused"},
+	}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = gw.Shutdown() }()
+
+	tests := []struct {
+		name  string
+		ip    string
+		tls   bool
+		rcpts []string
+		data  string
+		code  int
+		trace string
+	}{
+		{"else", "127.0.0.1", false, []string{"x@c.example"}, "Subject: hi\n\nhi\n", 250,
+			"tracea:x traced:x tracea:x"},
+		{"named stack", "127.0.0.1", false, []string{"x@a.example"}, "Subject: hi\n\nhi\n", 250,
+			"tracea:x traceb:x tracea:x"},
+		{"nested branch", "127.0.0.1", false, []string{"x@b.example"}, "X-Priority: 1\n\nhi\n", 250,
+			"tracea:x traceb:x tracec:x tracea:x"},
+		{"split recipients", "127.0.0.1", false, []string{"x@a.example", "y@c.example", "z@b.example"}, "Subject: hi\n\nhi\n", 250,
+			"tracea:x,y,z traceb:x,z traced:y tracea:x,y,z"},
+		{"remote ip", "192.0.2.1", false, []string{"y@c.example"}, "Subject: hi\n\nhi\n", 250,
+			"tracea:y tracec:y tracea:y"},
+		{"tls", "192.0.2.1", true, []string{"y@c.example"}, "Subject: hi\n\nhi\n", 250,
+			"tracea:y traced:y tracea:y"},
+		{"failure", "127.0.0.1", false, []string{"y@c.example"}, "X-Fail: yes\n\nhi\n", 554,
+			"tracea:y"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := mail.NewEnvelope(test.ip, 1)
+			e.TLS = test.tls
+			for _, rcpt := range test.rcpts {
+				to, _ := mail.NewAddress(rcpt)
+				e.PushRcpt(*to)
+			}
+			e.Data.WriteString(test.data)
+			r := gw.Process(e, TaskTest)
+			if r.Code() != test.code {
+				t.Fatalf("expecting %d, got %s", test.code, r)
+			}
+			trace, _ := e.Values["trace"].([]string)
+			if got := strings.Join(trace, " "); got != test.trace {
+				t.Errorf("got trace %q, expecting %q", got, test.trace)
+			}
+			if len(e.RcptTo) != len(test.rcpts) {
+				t.Error("the recipients were not restored", e.RcptTo)
+			}
+		})
+	}
+}
+
+func TestStackErrors(t *testing.T) {
+	registerProcessors(t, traceProcessors())
+	stacks, err := namedStacks(BackendConfig{"stacks": map[string]interface{}{"loop": "TraceA|@loop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cfg := range []string{
+		"TraceA|",
+		"TraceA|(rcpt_domain=a.example => TraceB",
+		"TraceA|(TraceB; rcpt_domain=a.example => TraceC)",
+		"TraceA|(rcpt_domain => TraceB)",
+		"TraceA|(remote_ip~10.0.0.1 => TraceB)",
+		"TraceA|(remote_ip=10.0.0.300 => TraceB)",
+		"TraceA|(tls=maybe => TraceB)",
+		"TraceA|(size=1 => TraceB)",
+		"TraceA|@missing",
+		"TraceA|@loop",
+		"TraceA|NoSuchProcessor",
+		"TraceA)",
+	} {
+		if _, err := newStack(cfg, stacks); err == nil {
+			t.Error("expecting an error for", cfg)
+		}
+	}
+}
+
+func TestStackProcessorErrors(t *testing.T) {
+	registerProcessors(t, traceProcessors())
+	p, err := newStack("TraceA|TraceFail", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traceA, traceFail := processorErrors.With("tracea").Value(), processorErrors.With("tracefail").Value()
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	if _, err = p.Process(e, TaskSaveMail); err != StorageError {
+		t.Fatal("expecting the error of TraceFail, got", err)
+	}
+	if e.Values["failed_processor"] != "tracefail" {
+		t.Error("expecting TraceFail to be the failed processor, got", e.Values["failed_processor"])
+	}
+	// the error is only counted for the processor that returned it first
+	if v := processorErrors.With("tracea").Value() - traceA; v != 0 {
+		t.Error("expecting no error for TraceA, got", v)
+	}
+	if v := processorErrors.With("tracefail").Value() - traceFail; v != 1 {
+		t.Error("expecting an error for TraceFail, got", v)
+	}
+}
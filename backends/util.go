@@ -11,6 +11,8 @@ import (
 	"strings"
 
 	"golang.org/x/crypto/blake2s"
+
+	"github.com/phires/go-guerrilla/mail"
 )
 
 // First capturing group is header name, second is header value.
@@ -109,3 +111,48 @@ func Compress(stringArguments ...string) string {
 	_ = w.Close()
 	return b.String()
 }
+
+// messageBytes reads the message with its delivery header in one allocation,
+// for the storage that needs all of it at once. The message cannot be streamed to
+// Redis or SQL: SETEX and the query parameters take the whole value, so a spilled
+// body is loaded into memory there
+func messageBytes(e *mail.Envelope) ([]byte, error) {
+	data := make([]byte, e.Len())
+	_, err := io.ReadFull(e.NewReader(), data)
+	return data, err
+}
+
+// copyEnvelope returns a copy of the envelope, for a processor that runs in its own goroutine.
+// The copy shares the parsed header, which must not be changed. Its data must be reset or
+// restored when it is dropped, so that a spilled body is released
+func copyEnvelope(e *mail.Envelope) *mail.Envelope {
+	c := &mail.Envelope{
+		RemoteIP:       e.RemoteIP,
+		Helo:           e.Helo,
+		MailFrom:       e.MailFrom,
+		RcptTo:         append([]mail.Address(nil), e.RcptTo...),
+		Subject:        e.Subject,
+		TLS:            e.TLS,
+		Header:         e.Header,
+		Values:         make(map[string]interface{}, len(e.Values)),
+		Hashes:         append([]string(nil), e.Hashes...),
+		DeliveryHeader: e.DeliveryHeader,
+		QueuedId:       e.QueuedId,
+		ESMTP:          e.ESMTP,
+	}
+	for k, v := range e.Values {
+		c.Values[k] = v
+	}
+	e.Data.CopyTo(&c.Data)
+	c.SetContext(e.Context())
+	return c
+}
+
+// restoreEnvelope sets the envelope to its copy, after the processing of the copy
+func restoreEnvelope(e, c *mail.Envelope) {
+	e.RemoteIP, e.Helo, e.TLS, e.ESMTP = c.RemoteIP, c.Helo, c.TLS, c.ESMTP
+	e.MailFrom, e.RcptTo = c.MailFrom, c.RcptTo
+	e.Subject, e.Header, e.Values, e.Hashes = c.Subject, c.Header, c.Values, c.Hashes
+	e.DeliveryHeader, e.QueuedId = c.DeliveryHeader, c.QueuedId
+	c.Data.MoveTo(&e.Data)
+}
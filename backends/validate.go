@@ -16,4 +16,11 @@ var (
 	StorageError        = RcptError(errors.New("storage error"))
 	SpfError            = RcptError(errors.New("spf error"))
 	DKIMError           = RcptError(errors.New("DKIM error"))
+	RelayError          = RcptError(errors.New("relay error"))
+	DMARCError          = RcptError(errors.New("DMARC error"))
+	SpamError           = RcptError(errors.New("spam"))
+	VirusError          = RcptError(errors.New("virus"))
+	PolicyError         = RcptError(errors.New("content policy"))
+	RuleError           = RcptError(errors.New("rule"))
+	SieveError          = RcptError(errors.New("sieve"))
 )
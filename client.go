@@ -3,12 +3,14 @@ package guerrilla
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/textproto"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/phires/go-guerrilla/log"
@@ -37,6 +39,37 @@ const (
 	ClientShutdown
 )
 
+func (s ClientState) String() string {
+	switch s {
+	case ClientConnected:
+		return "connected"
+	case ClientProxy:
+		return "proxy"
+	case ClientGreeting:
+		return "greeting"
+	case ClientCmd:
+		return "command"
+	case ClientData:
+		return "data"
+	case ClientStartTLS:
+		return "starttls"
+	case ClientShutdown:
+		return "shutdown"
+	}
+	return "unknown"
+}
+
+// ClientInfo describes a connected client, eg. as listed by the admin API
+type ClientInfo struct {
+	ID           uint64    `json:"id"`
+	RemoteIP     string    `json:"remote_ip"`
+	Helo         string    `json:"helo"`
+	State        string    `json:"state"`
+	TLS          bool      `json:"tls"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	MessagesSent int       `json:"messages_sent"`
+}
+
 type client struct {
 	*mail.Envelope
 	ID          uint64
@@ -59,6 +92,14 @@ type client struct {
 	connGuard sync.Mutex
 	log       log.Logger
 	parser    rfc5321.Parser
+	// values are the values of the session, see Session
+	values map[string]interface{}
+	// replyCode is the code of the response to be written, eg. "250"
+	replyCode string
+	// info stores the ClientInfo, so that it can be read while the client is served
+	info atomic.Value
+	// disconnected is set by disconnect, the client stops at its next turn
+	disconnected int32
 }
 
 // NewClient allocates a new client.
@@ -77,6 +118,7 @@ func NewClient(conn net.Conn, clientID uint64, logger log.Logger, envelope *mail
 
 	// used for reading the DATA state
 	c.smtpReader = textproto.NewReader(c.bufin.Reader)
+	c.storeInfo()
 	return c
 }
 
@@ -92,7 +134,8 @@ func (c *client) sendResponse(r ...interface{}) {
 	if c.bufErr != nil {
 		c.bufErr = nil
 	}
-	for _, item := range r {
+	c.replyCode = ""
+	for i, item := range r {
 		switch v := item.(type) {
 		case error:
 			out = v.Error()
@@ -101,6 +144,9 @@ func (c *client) sendResponse(r ...interface{}) {
 		case string:
 			out = v
 		}
+		if i == 0 && len(out) >= 3 {
+			c.replyCode = out[:3]
+		}
 		if _, c.bufErr = c.bufout.WriteString(out); c.bufErr != nil {
 			c.log.WithError(c.bufErr).Error("could not write to c.bufout")
 		}
@@ -143,7 +189,18 @@ func (c *client) kill() {
 
 // isAlive returns true if the client is to close on the next turn
 func (c *client) isAlive() bool {
-	return c.KilledAt.IsZero()
+	return c.KilledAt.IsZero() && atomic.LoadInt32(&c.disconnected) == 0
+}
+
+// disconnect closes the connection of a client that is being served, goroutine safe.
+// The reads and writes of the client fail, and it stops on its next turn
+func (c *client) disconnect() {
+	atomic.StoreInt32(&c.disconnected, 1)
+	c.connGuard.Lock()
+	defer c.connGuard.Unlock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
 }
 
 // setTimeout adjust the timeout on the connection, goroutine safe
@@ -156,6 +213,37 @@ func (c *client) setTimeout(t time.Duration) (err error) {
 	return
 }
 
+// watchConn cancels the context of the transaction if the client disconnects while the backend
+// processes the message. The client waits for the reply, so any read error but a timeout means
+// that the connection is gone. It returns a function that stops watching
+func (c *client) watchConn(cancel context.CancelFunc) (stop func()) {
+	switch c.conn.(type) {
+	case *net.TCPConn, *tls.Conn:
+	default:
+		// a read deadline is needed to stop watching, other connections may ignore it
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := c.bufin.Peek(1); err != nil && err != ErrLineLimitExceeded {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				cancel()
+			}
+		}
+	}()
+	return func() {
+		c.connGuard.Lock()
+		if c.conn != nil {
+			// unblock the Peek
+			_ = c.conn.SetReadDeadline(time.Now())
+		}
+		c.connGuard.Unlock()
+		<-done
+	}
+}
+
 // closeConn closes a client connection, , goroutine safe
 func (c *client) closeConn() {
 	defer c.connGuard.Unlock()
@@ -173,11 +261,34 @@ func (c *client) init(conn net.Conn, clientID uint64, ep *mail.Pool) {
 	// reset session data
 	c.state = 0
 	c.KilledAt = time.Time{}
+	atomic.StoreInt32(&c.disconnected, 0)
 	c.ConnectedAt = time.Now()
 	c.ID = clientID
 	c.errors = 0
+	c.values = nil
 	// borrow an envelope from the envelope pool
 	c.Envelope = ep.Borrow(getRemoteAddr(conn), clientID)
+	c.messagesSent = 0
+	c.storeInfo()
+}
+
+// storeInfo stores the ClientInfo of the client, it is called by the goroutine serving it
+func (c *client) storeInfo() {
+	c.info.Store(ClientInfo{
+		ID:           c.ID,
+		RemoteIP:     c.RemoteIP,
+		Helo:         c.Helo,
+		State:        c.state.String(),
+		TLS:          c.TLS,
+		ConnectedAt:  c.ConnectedAt,
+		MessagesSent: c.messagesSent,
+	})
+}
+
+// getInfo returns the ClientInfo of the client, goroutine safe
+func (c *client) getInfo() ClientInfo {
+	info, _ := c.info.Load().(ClientInfo)
+	return info
 }
 
 // getID returns the client's unique ID
@@ -223,7 +334,7 @@ func (c *client) parsePath(in []byte, p pathParser) (mail.Address, error) {
 		return address, errors.New(response.Canned.FailInvalidAddress.String())
 	} else if c.parser.NullPath {
 		// bounce has empty from address
-		address = mail.Address{}
+		address = mail.Address{NullPath: true, PathParams: c.parser.PathParams}
 	} else if len(c.parser.LocalPart) > rfc5321.LimitLocalPart {
 		err = errors.New(response.Canned.FailLocalPartTooLong.String())
 	} else if len(c.parser.Domain) > rfc5321.LimitDomain {
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/phires/go-guerrilla"
+	"github.com/phires/go-guerrilla/queue"
+)
+
+var (
+	queueDir        string
+	queueConfigPath string
+
+	queueCmd = &cobra.Command{
+		Use:   "queue",
+		Short: "inspect and manage the delivery queue",
+		Long: `Inspect and manage the on-disk delivery queue used by the Queue processor.
+The queue directory is taken from queue_dir in the backend_config, or from the --dir flag.`,
+	}
+
+	queueListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "list queued and failed messages",
+		Args:  cobra.NoArgs,
+		Run:   queueList,
+	}
+
+	queueShowCmd = &cobra.Command{
+		Use:   "show <id>",
+		Short: "print the delivery state of a message",
+		Args:  cobra.ExactArgs(1),
+		Run:   queueShow,
+	}
+
+	queueRemoveCmd = &cobra.Command{
+		Use:   "remove <id>",
+		Short: "remove a queued or failed message",
+		Args:  cobra.ExactArgs(1),
+		Run:   queueRemove,
+	}
+
+	queueRetryCmd = &cobra.Command{
+		Use:   "retry <id>",
+		Short: "schedule a queued or failed message for delivery now",
+		Args:  cobra.ExactArgs(1),
+		Run:   queueRetry,
+	}
+)
+
+func init() {
+	queueCmd.PersistentFlags().StringVarP(&queueConfigPath, "config", "c",
+		"goguerrilla.conf.json", "Path to the configuration file")
+	queueCmd.PersistentFlags().StringVarP(&queueDir, "dir", "d",
+		"", "Path to the queue directory, overrides the config file")
+	queueCmd.AddCommand(queueListCmd, queueShowCmd, queueRemoveCmd, queueRetryCmd)
+	rootCmd.AddCommand(queueCmd)
+}
+
+// openQueue opens the spool from the --dir flag, or the queue_dir of the config file
+func openQueue() *queue.Spool {
+	dir := queueDir
+	if dir == "" {
+		var daemon guerrilla.Daemon
+		c, err := daemon.LoadConfig(queueConfigPath)
+		if err != nil {
+			mainlog.WithError(err).Fatal("Error while reading config")
+		}
+		dir, _ = c.BackendConfig["queue_dir"].(string)
+		if dir == "" {
+			mainlog.Fatal("queue_dir is not set in the backend_config, use --dir")
+		}
+	}
+	if _, err := os.Stat(dir); err != nil {
+		mainlog.WithError(err).Fatal("Cannot open queue")
+	}
+	s, err := queue.Open(dir)
+	if err != nil {
+		mainlog.WithError(err).Fatal("Cannot open queue")
+	}
+	return s
+}
+
+func printQueueItems(w io.Writer, state string, items []*queue.Item) {
+	for _, item := range items {
+		next := item.NextAttempt.Format(time.RFC3339)
+		rcpts := len(item.RcptTo)
+		if state == "failed" {
+			next = "-"
+			rcpts = len(item.Failed)
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+			item.ID, state, item.MailFrom.String(), rcpts, item.Size, item.Attempts, next, item.LastError)
+	}
+}
+
+func queueList(cmd *cobra.Command, args []string) {
+	s := openQueue()
+	queued, err := s.List()
+	if err != nil {
+		mainlog.WithError(err).Fatal("Cannot list queue")
+	}
+	failed, err := s.ListFailed()
+	if err != nil {
+		mainlog.WithError(err).Fatal("Cannot list queue")
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "ID\tSTATE\tFROM\tRCPTS\tSIZE\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+	printQueueItems(w, "queued", queued)
+	printQueueItems(w, "failed", failed)
+	_ = w.Flush()
+}
+
+func queueShow(cmd *cobra.Command, args []string) {
+	s := openQueue()
+	item, err := s.Get(args[0])
+	if err == queue.ErrNotFound {
+		item, err = s.GetFailed(args[0])
+	}
+	if err != nil {
+		mainlog.WithError(err).Fatalf("Cannot show %s", args[0])
+	}
+	data, _ := json.MarshalIndent(item, "", "  ")
+	_, _ = fmt.Fprintln(cmd.OutOrStdout(), string(data))
+}
+
+// lockedQueueItem calls fn with the item locked, so that a running daemon does not deliver it meanwhile
+func lockedQueueItem(s *queue.Spool, id string, fn func() error) error {
+	if err := s.LockItem(id); err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.UnlockItem(id); err != nil {
+			mainlog.WithError(err).Errorf("Cannot unlock %s", id)
+		}
+	}()
+	return fn()
+}
+
+func queueRemove(cmd *cobra.Command, args []string) {
+	s := openQueue()
+	err := lockedQueueItem(s, args[0], func() error {
+		err := s.Remove(args[0])
+		if err == queue.ErrNotFound {
+			err = s.RemoveFailed(args[0])
+		}
+		return err
+	})
+	if err != nil {
+		mainlog.WithError(err).Fatalf("Cannot remove %s", args[0])
+	}
+	mainlog.Infof("removed %s", args[0])
+}
+
+func queueRetry(cmd *cobra.Command, args []string) {
+	s := openQueue()
+	err := lockedQueueItem(s, args[0], func() error {
+		item, err := s.Get(args[0])
+		if err == nil {
+			item.NextAttempt = time.Now()
+			return s.Update(item)
+		} else if err == queue.ErrNotFound {
+			_, err = s.Retry(args[0])
+		}
+		return err
+	})
+	if err != nil {
+		mainlog.WithError(err).Fatalf("Cannot retry %s", args[0])
+	}
+	mainlog.Infof("%s scheduled for delivery", args[0])
+}
@@ -60,7 +60,7 @@ func init() {
 
 func serve(cmd *cobra.Command, args []string) {
 	logVersion()
-	d = guerrilla.Daemon{Logger: mainlog}
+	d = guerrilla.Daemon{Logger: mainlog, ConfigReloader: reloadConfig}
 	c, err := readConfig(configPath, pidFile)
 	if err != nil {
 		mainlog.WithError(err).Fatal("Error while reading config")
@@ -82,6 +82,16 @@ func serve(cmd *cobra.Command, args []string) {
 
 }
 
+// reloadConfig reads the config file again and reloads it, when a SIG_HUP is caught
+// or when asked by the admin API
+func reloadConfig() error {
+	ac, err := readConfig(configPath, pidFile)
+	if err != nil {
+		return err
+	}
+	return d.ReloadConfig(*ac)
+}
+
 // ReadConfig is called at startup, or when a SIG_HUP is caught
 func readConfig(path string, pidFile string) (*guerrilla.AppConfig, error) {
 	// Load in the config.
@@ -31,9 +31,7 @@ func sigHandler() {
 	)
 	for sig := range signalChannel {
 		if sig == syscall.SIGHUP {
-			if ac, err := readConfig(configPath, pidFile); err == nil {
-				_ = d.ReloadConfig(*ac)
-			} else {
+			if err := reloadConfig(); err != nil {
 				mainlog.WithError(err).Error("Could not reload config")
 			}
 		} else if sig == syscall.SIGUSR1 {
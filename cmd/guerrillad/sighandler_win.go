@@ -30,9 +30,7 @@ func sigHandler() {
 	)
 	for sig := range signalChannel {
 		if sig == syscall.SIGHUP {
-			if ac, err := readConfig(configPath, pidFile); err == nil {
-				_ = d.ReloadConfig(*ac)
-			} else {
+			if err := reloadConfig(); err != nil {
 				mainlog.WithError(err).Error("Could not reload config")
 			}
 		} else if sig == syscall.SIGTERM || sig == syscall.SIGQUIT || sig == syscall.SIGINT || sig == os.Kill {
@@ -0,0 +1,170 @@
+package guerrilla
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// Session is the SMTP session of a client, as seen by the commands added with AddCommand
+type Session interface {
+	// ID is the id of the client
+	ID() uint64
+	// Envelope is the current transaction: the sender, the recipients, the HELO name and so on
+	Envelope() *mail.Envelope
+	// Value returns a value of the session, it is kept until the client disconnects
+	Value(key string) interface{}
+	// SetValue sets a value of the session
+	SetValue(key string, value interface{})
+	// Respond sets the reply to the client, eg. "250 OK", replacing the previous one. The arguments
+	// are strings, errors or fmt.Stringers, such as response.Canned, and are joined together.
+	// A reply of many lines is made of lines ending with \r\n, but the last one
+	Respond(r ...interface{})
+	// Close closes the connection after the reply
+	Close()
+	// Log is the log of the server
+	Log() log.Logger
+}
+
+// CommandHandler handles an SMTP command. args is the rest of the line after the verb,
+// eg. "FROM:<alice@example.com>" for "MAIL FROM:<alice@example.com>"
+type CommandHandler func(s Session, args string)
+
+// CommandWrapper wraps the handler of a command, next is the handler it wraps. The wrapper may
+// change the args it passes to next, the built-in commands use them. next must be called with
+// the session the wrapper was given
+type CommandWrapper func(next CommandHandler) CommandHandler
+
+// registeredCommand is a command added or wrapped with the registry
+type registeredCommand struct {
+	// handler replaces the built-in command, nil to keep it
+	handler  CommandHandler
+	wrappers []CommandWrapper
+}
+
+var commands = struct {
+	m map[string]*registeredCommand
+	// extensions are the keywords added to the EHLO reply
+	extensions []string
+	sync.RWMutex
+}{m: make(map[string]*registeredCommand)}
+
+// AddCommand adds a command to the SMTP servers, or replaces a built-in command such as VRFY.
+// The verb is the first word of the command, eg. "XSTATUS"
+func AddCommand(verb string, handler CommandHandler) {
+	commands.Lock()
+	defer commands.Unlock()
+	c := commandFor(verb)
+	c.handler = handler
+}
+
+// WrapCommand wraps a command, built-in or added with AddCommand. The last wrapper is called first
+func WrapCommand(verb string, wrapper CommandWrapper) {
+	commands.Lock()
+	defer commands.Unlock()
+	c := commandFor(verb)
+	c.wrappers = append(c.wrappers, wrapper)
+}
+
+// AddExtension adds a keyword to the EHLO reply, eg. "ETRN" or "XSTATUS ON"
+func AddExtension(keyword string) {
+	commands.Lock()
+	defer commands.Unlock()
+	for _, k := range commands.extensions {
+		if k == keyword {
+			return
+		}
+	}
+	commands.extensions = append(commands.extensions, keyword)
+}
+
+// commandFor returns the registered command of a verb, creating it. The registry must be locked
+func commandFor(verb string) *registeredCommand {
+	verb = strings.ToUpper(verb)
+	c, ok := commands.m[verb]
+	if !ok {
+		c = &registeredCommand{}
+		commands.m[verb] = c
+	}
+	return c
+}
+
+// commandVerb splits a command line into its verb, in upper case, and its arguments
+func commandVerb(input []byte) (verb, args string) {
+	verb, args, _ = strings.Cut(strings.TrimRight(string(input), "\r\n"), " ")
+	return strings.ToUpper(verb), args
+}
+
+// commandHandler returns the handler of a verb, builtIn is the handler of the server.
+// It returns nil if the command was not added or wrapped
+func commandHandler(verb string, builtIn CommandHandler) CommandHandler {
+	commands.RLock()
+	defer commands.RUnlock()
+	c, ok := commands.m[verb]
+	if !ok || c.handler == nil && len(c.wrappers) == 0 {
+		return nil
+	}
+	h := builtIn
+	if c.handler != nil {
+		h = c.handler
+	}
+	for _, w := range c.wrappers {
+		h = w(h)
+	}
+	return h
+}
+
+// ehloExtensions returns the lines of the EHLO reply for the extensions
+func ehloExtensions() string {
+	commands.RLock()
+	defer commands.RUnlock()
+	var b strings.Builder
+	for _, k := range commands.extensions {
+		b.WriteString("250-" + k + "\r\n")
+	}
+	return b.String()
+}
+
+// session is the Session of a client
+type session struct {
+	c  *client
+	s  *server
+	sc *ServerConfig
+	// ctx and verb are those of the command being handled
+	ctx  context.Context
+	verb string
+}
+
+func (s *session) ID() uint64 {
+	return s.c.ID
+}
+
+func (s *session) Envelope() *mail.Envelope {
+	return s.c.Envelope
+}
+
+func (s *session) Value(key string) interface{} {
+	return s.c.values[key]
+}
+
+func (s *session) SetValue(key string, value interface{}) {
+	if s.c.values == nil {
+		s.c.values = make(map[string]interface{})
+	}
+	s.c.values[key] = value
+}
+
+func (s *session) Respond(r ...interface{}) {
+	s.c.sendResponse(r...)
+}
+
+func (s *session) Close() {
+	s.c.kill()
+}
+
+func (s *session) Log() log.Logger {
+	return s.s.log()
+}
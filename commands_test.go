@@ -0,0 +1,131 @@
+package guerrilla
+
+import (
+	"bufio"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// resetCommands restores the registry after a test
+func resetCommands() {
+	commands.Lock()
+	defer commands.Unlock()
+	commands.m = make(map[string]*registeredCommand)
+	commands.extensions = nil
+}
+
+func TestCommands(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	defer resetCommands()
+
+	AddExtension("XSTATUS")
+	AddCommand("xstatus", func(s Session, args string) {
+		n, _ := s.Value("xstatus").(int)
+		s.SetValue("xstatus", n+1)
+		if n > 0 {
+			s.Respond("250 again, ", s.Envelope().Helo)
+			return
+		}
+		s.Respond("250 status ", args)
+	})
+	AddCommand("VRFY", func(s Session, args string) {
+		s.Respond("252 2.1.5 Cannot verify ", args)
+	})
+	WrapCommand("MAIL", func(next CommandHandler) CommandHandler {
+		return func(s Session, args string) {
+			if strings.Contains(args, "@blocked.example") {
+				s.Respond("550 5.7.1 Sender blocked")
+				return
+			}
+			// the built-in command uses the arguments it is passed
+			next(s, strings.Replace(args, "@alias.example", "@example.com", 1))
+		}
+	})
+
+	sc := getMockServerConfig()
+	mainlog, _ := log.GetLogger(sc.LogFile, "debug")
+	conn, server := getMockServerConn(sc, t)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	_, _ = r.ReadLine()
+
+	if err := w.PrintfLine("EHLO test.example"); err != nil {
+		t.Fatal(err)
+	}
+	_, ehlo, err := r.ReadResponse(250)
+	if err != nil || !strings.Contains(ehlo, "\nXSTATUS\n") {
+		t.Errorf("expecting the extension in the EHLO reply, got %q, %v", ehlo, err)
+	}
+	for _, test := range []struct {
+		cmd, reply string
+	}{
+		{"XSTATUS now", "250 status now"},
+		{"xstatus", "250 again, test.example"},
+		{"VRFY bob", "252 2.1.5 Cannot verify bob"},
+		{"MAIL FROM:<eve@blocked.example>", "550 5.7.1 Sender blocked"},
+		{"MAIL FROM:<alice@alias.example>", "250 2.1.0 OK"},
+		{"XUNKNOWN", "554 5.5.1 Unrecognized command"},
+	} {
+		if err := w.PrintfLine("%s", test.cmd); err != nil {
+			t.Fatal(err)
+		}
+		if line, _ := r.ReadLine(); !strings.HasPrefix(line, test.reply) {
+			t.Errorf("%s: expecting %q, got %q", test.cmd, test.reply, line)
+		}
+	}
+	if client.MailFrom.String() != "alice@example.com" {
+		t.Error("expecting the wrapped MAIL command to run with the rewritten sender, got", client.MailFrom)
+	}
+	if err := w.PrintfLine("QUIT"); err != nil {
+		t.Error(err)
+	}
+	_, _ = r.ReadLine()
+	wg.Wait()
+}
+
+func TestDisconnectClient(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	defer resetCommands()
+
+	sc := getMockServerConfig()
+	mainlog, _ := log.GetLogger(sc.LogFile, "debug")
+	conn, server := getMockServerConn(sc, t)
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	// the client is disconnected while its command is handled, before the reply is written
+	AddCommand("XKILL", func(s Session, args string) {
+		client.disconnect()
+		s.Respond("250 OK")
+	})
+	done := make(chan struct{})
+	go func() {
+		server.handleClient(client)
+		close(done)
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	_, _ = r.ReadLine()
+	if err := w.PrintfLine("XKILL"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expecting the client to be disconnected")
+	}
+	if _, err := r.ReadLine(); err == nil {
+		t.Error("expecting the connection to be closed")
+	}
+}
@@ -31,6 +31,17 @@ type AppConfig struct {
 	LogLevel string `json:"log_level,omitempty"`
 	// BackendConfig configures the email envelope processing backend
 	BackendConfig backends.BackendConfig `json:"backend_config"`
+	// MetricsInterface is the address of the listener of the Prometheus metrics,
+	// served at /metrics, eg. "127.0.0.1:9100". No metrics are served if empty
+	MetricsInterface string `json:"metrics_interface,omitempty"`
+	// TracingEndpoint is the OpenTelemetry collector where the spans of the sessions and
+	// the processors are sent with OTLP over HTTP, eg. "http://127.0.0.1:4318". No spans if empty
+	TracingEndpoint string `json:"tracing_endpoint,omitempty"`
+	// AdminInterface is the address of the listener of the admin HTTP API, eg. "127.0.0.1:8025".
+	// The API is not served if empty
+	AdminInterface string `json:"admin_interface,omitempty"`
+	// AdminToken authenticates the requests to the admin API, sent as "Authorization: Bearer <token>"
+	AdminToken string `json:"admin_token,omitempty"`
 }
 
 // ServerConfig specifies config options for a single server
@@ -50,6 +61,11 @@ type ServerConfig struct {
 	// MaxSize is the maximum size of an email that will be accepted for delivery.
 	// Defaults to 10 Mebibytes
 	MaxSize int64 `json:"max_size"`
+	// SpillSize is the size above which the data of an email is kept in a temporary file
+	// rather than in memory. Defaults to 1 Mebibyte, -1 keeps all of it in memory
+	SpillSize int64 `json:"spill_size,omitempty"`
+	// SpillDir is the directory of the temporary files. Defaults to os.TempDir()
+	SpillDir string `json:"spill_dir,omitempty"`
 	// Timeout specifies the connection timeout in seconds. Defaults to 30
 	Timeout int `json:"timeout"`
 	// MaxClients controls how many maximum clients we can handle at once.
@@ -62,6 +78,9 @@ type ServerConfig struct {
 	XClientOn bool `json:"xclient_on,omitempty"`
 	// Proxied when using a loadbalancer such as HAProxy, set to true to enable
 	ProxyOn bool `json:"proxyon,omitempty"`
+	// DSN advertises the DSN extension (RFC 3461), so that clients send the NOTIFY, RET, ENVID
+	// and ORCPT parameters. Turn it on when the backend sends notifications, eg. with queue_dsn
+	DSN bool `json:"dsn,omitempty"`
 }
 
 type ServerTLSConfig struct {
@@ -170,6 +189,8 @@ const defaultTimeout = 30
 const defaultInterface = "127.0.0.1:2525"
 const defaultMaxSize = int64(10 << 20) // 10 Mebibytes
 
+const defaultSpillSize = int64(1 << 20) // 1 Mebibyte
+
 // Unmarshalls json data into AppConfig struct and any other initialization of the struct
 // also does validation, returns error if validation failed or something went wrong
 func (c *AppConfig) Load(jsonBytes []byte) error {
@@ -215,6 +236,9 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	// has backend changed?
 	if !reflect.DeepEqual((*c).BackendConfig, (*oldConfig).BackendConfig) {
 		app.Publish(EventConfigBackendConfig, c)
+	} else {
+		// let the backend refresh its resources, eg. keys
+		app.Publish(EventConfigBackendReload, c)
 	}
 	// has config changed, general check
 	if !reflect.DeepEqual(oldConfig, c) {
@@ -236,6 +260,18 @@ func (c *AppConfig) EmitChangeEvents(oldConfig *AppConfig, app Guerrilla) {
 	if strings.Compare(oldConfig.LogLevel, c.LogLevel) != 0 {
 		app.Publish(EventConfigLogLevel, c)
 	}
+	// has the metrics listener changed?
+	if oldConfig.MetricsInterface != c.MetricsInterface {
+		app.Publish(EventConfigMetricsInterface, c)
+	}
+	// has the tracing endpoint changed?
+	if oldConfig.TracingEndpoint != c.TracingEndpoint {
+		app.Publish(EventConfigTracingEndpoint, c)
+	}
+	// has the admin listener changed?
+	if oldConfig.AdminInterface != c.AdminInterface || oldConfig.AdminToken != c.AdminToken {
+		app.Publish(EventConfigAdminInterface, c)
+	}
 	// server config changes
 	oldServers := oldConfig.getServers()
 	for iface, newServer := range c.getServers() {
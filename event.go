@@ -1,7 +1,12 @@
 package guerrilla
 
 import (
+	"fmt"
+
 	evbus "github.com/asaskevich/EventBus"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/mail"
 )
 
 type Event int
@@ -41,6 +46,38 @@ const (
 	EventConfigServerMaxClients
 	// when a server's TLS config changed
 	EventConfigServerTLSConfig
+	// when the config was reloaded, but the backend's config did not change
+	EventConfigBackendReload
+
+	// The events of the clients and their transactions. The handlers are called by the client's
+	// goroutine, so they should be quick, or hand the work to another goroutine.
+
+	// when a client connected, the argument is a *ConnectionEvent
+	EventClientConnect
+	// when a client disconnected, the argument is a *ConnectionEvent
+	EventClientDisconnect
+	// when a client established TLS, the argument is a *ConnectionEvent with the version and cipher
+	EventClientTLS
+	// when a transaction started with MAIL, the argument is a *TransactionEvent
+	EventTransactionStart
+	// when a recipient was accepted, the argument is a *TransactionEvent with the recipient
+	EventRcptAccepted
+	// when a recipient was rejected, the argument is a *TransactionEvent with the recipient and the reply
+	EventRcptRejected
+	// when a message was accepted, the argument is a *TransactionEvent with the queued id, size and reply
+	EventMessageAccepted
+	// when a message was rejected, the argument is a *TransactionEvent with the queued id, size and reply
+	EventMessageRejected
+	// when the backend timed out, the argument is a *BackendEvent
+	EventBackendTimeout
+	// when a backend worker recovered from a panic, the argument is a *BackendEvent
+	EventWorkerPanic
+	// when metrics_interface changed
+	EventConfigMetricsInterface
+	// when tracing_endpoint changed
+	EventConfigTracingEndpoint
+	// when admin_interface or admin_token changed
+	EventConfigAdminInterface
 )
 
 var eventList = [...]string{
@@ -61,27 +98,108 @@ var eventList = [...]string{
 	"server_change:timeout",
 	"server_change:max_clients",
 	"server_change:tls_config",
+	"config_change:backend_reload",
+	"client:connect",
+	"client:disconnect",
+	"client:tls",
+	"transaction:start",
+	"transaction:rcpt_accepted",
+	"transaction:rcpt_rejected",
+	"transaction:message_accepted",
+	"transaction:message_rejected",
+	"backend:timeout",
+	"backend:worker_panic",
+	"config_change:metrics_interface",
+	"config_change:tracing_endpoint",
+	"config_change:admin_interface",
 }
 
 func (e Event) String() string {
 	return eventList[e]
 }
 
+// ConnectionEvent is the argument of the events of a client
+type ConnectionEvent struct {
+	// ClientID is the id of the client
+	ClientID uint64
+	// Server is the listen interface of the server, eg. "127.0.0.1:25"
+	Server   string
+	RemoteIP string
+	// TLSVersion and CipherSuite are set when TLS was established, eg. "TLS 1.3"
+	TLSVersion  string
+	CipherSuite string
+}
+
+// TransactionEvent is the argument of the events of a transaction
+type TransactionEvent struct {
+	ConnectionEvent
+	// QueuedID is the id of the message
+	QueuedID string
+	MailFrom mail.Address
+	// Rcpt is the recipient of the rcpt events
+	Rcpt mail.Address
+	// Size is the size of the message
+	Size int64
+	// Code and Reply are the reply to the client, eg. 250 and "250 2.0.0 OK: queued as ..."
+	Code  int
+	Reply string
+}
+
+// BackendEvent is the argument of the events of the backend
+type BackendEvent struct {
+	// QueuedID is the id of the message, if there was one
+	QueuedID string
+	// Task is the task that timed out
+	Task backends.SelectTask
+	// Panic is the value of the panic of a worker
+	Panic interface{}
+}
+
+// isLifecycle returns true for the events of the clients, the transactions and the backend
+func (e Event) isLifecycle() bool {
+	switch e {
+	case EventClientConnect, EventClientDisconnect, EventClientTLS,
+		EventTransactionStart, EventRcptAccepted, EventRcptRejected,
+		EventMessageAccepted, EventMessageRejected,
+		EventBackendTimeout, EventWorkerPanic:
+		return true
+	}
+	return false
+}
+
 type EventHandler struct {
 	evbus.Bus
+	// lifecycle is the bus of the lifecycle events. The handlers of a bus are called with it locked,
+	// so the clients publish on their own bus, eg. while a config change waits for them to leave
+	lifecycle evbus.Bus
+}
+
+// bus returns the bus of a topic
+func (h *EventHandler) bus(topic Event) evbus.Bus {
+	if topic.isLifecycle() {
+		return h.lifecycle
+	}
+	return h.Bus
 }
 
 func (h *EventHandler) Subscribe(topic Event, fn interface{}) error {
 	if h.Bus == nil {
 		h.Bus = evbus.New()
+		h.lifecycle = evbus.New()
 	}
-	return h.Bus.Subscribe(topic.String(), fn)
+	return h.bus(topic).Subscribe(topic.String(), fn)
 }
 
 func (h *EventHandler) Publish(topic Event, args ...interface{}) {
-	h.Bus.Publish(topic.String(), args...)
+	if b := h.bus(topic); b != nil {
+		b.Publish(topic.String(), args...)
+	}
 }
 
 func (h *EventHandler) Unsubscribe(topic Event, handler interface{}) error {
-	return h.Bus.Unsubscribe(topic.String(), handler)
+	b := h.bus(topic)
+	if b == nil {
+		return fmt.Errorf("topic %s doesn't exist", topic)
+	}
+	return b.Unsubscribe(topic.String(), handler)
 }
@@ -3,12 +3,14 @@ package guerrilla
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"sync"
 	"sync/atomic"
 
 	"github.com/phires/go-guerrilla/backends"
 	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/tracing"
 )
 
 const (
@@ -53,6 +55,12 @@ type guerrilla struct {
 	EventHandler
 	logStore
 	backendStore
+	// metricsServer serves the metrics, nil if metrics_interface is not set
+	metricsServer *http.Server
+	metricsGuard  sync.Mutex
+	// tracingExporter sends the spans, nil if tracing_endpoint is not set
+	tracingExporter *tracing.OTLPExporter
+	tracingGuard    sync.Mutex
 }
 
 type logStore struct {
@@ -114,10 +122,24 @@ func New(ac *AppConfig, b backends.Backend, l log.Logger) (Guerrilla, error) {
 
 	// subscribe for any events that may come in while running
 	g.subscribeEvents()
+	// publish the notifications of the backend
+	backends.Svc.SetNotifier(g.notify)
+	g.registerMetrics()
 
 	return g, err
 }
 
+// notify publishes a notification of the backend as an event
+func (g *guerrilla) notify(n backends.Notification, queuedID string, value interface{}) {
+	switch n {
+	case backends.NotifyTimeout:
+		task, _ := value.(backends.SelectTask)
+		g.Publish(EventBackendTimeout, &BackendEvent{QueuedID: queuedID, Task: task})
+	case backends.NotifyPanic:
+		g.Publish(EventWorkerPanic, &BackendEvent{QueuedID: queuedID, Panic: value})
+	}
+}
+
 // Instantiate servers
 func (g *guerrilla) makeServers() error {
 	g.mainlog().Debug("making servers")
@@ -141,6 +163,7 @@ func (g *guerrilla) makeServers() error {
 			if server != nil {
 				g.servers[sc.ListenInterface] = server
 				server.setAllowedHosts(g.Config.AllowedHosts)
+				server.events = &g.EventHandler
 			}
 		}
 	}
@@ -230,6 +253,20 @@ func (g *guerrilla) subscribeEvents() {
 
 	})
 
+	// the metrics listener changed, restart it
+	events[EventConfigMetricsInterface] = daemonEvent(func(c *AppConfig) {
+		g.stopMetrics()
+		if err := g.startMetrics(c.MetricsInterface); err != nil {
+			g.mainlog().WithError(err).Error("metrics listener failed to restart")
+		}
+	})
+
+	// the tracing endpoint changed, send the spans to the new one
+	events[EventConfigTracingEndpoint] = daemonEvent(func(c *AppConfig) {
+		g.stopTracing()
+		g.startTracing(c.TracingEndpoint)
+	})
+
 	// re-open the main log file (file not changed)
 	events[EventConfigLogReopen] = daemonEvent(func(c *AppConfig) {
 		err := g.mainlog().Reopen()
@@ -288,7 +325,7 @@ func (g *guerrilla) subscribeEvents() {
 	// start a server that already exists in the config and has been enabled
 	events[EventConfigServerStart] = serverEvent(func(sc *ServerConfig) {
 		if server, err := g.findServer(sc.ListenInterface); err == nil {
-			if server.state == ServerStateStopped || server.state == ServerStateNew {
+			if server.getState() == ServerStateStopped || server.getState() == ServerStateNew {
 				g.mainlog().Infof("Starting server [%s]", server.listenInterface)
 				err := g.Start()
 				if err != nil {
@@ -301,7 +338,7 @@ func (g *guerrilla) subscribeEvents() {
 	// stop running a server
 	events[EventConfigServerStop] = serverEvent(func(sc *ServerConfig) {
 		if server, err := g.findServer(sc.ListenInterface); err == nil {
-			if server.state == ServerStateRunning {
+			if server.getState() == ServerStateRunning || server.getState() == ServerStateDraining {
 				server.Shutdown()
 				g.mainlog().Infof("Server [%s] stopped.", sc.ListenInterface)
 			}
@@ -405,6 +442,16 @@ func (g *guerrilla) subscribeEvents() {
 			g.storeBackend(newBackend)
 		}
 	})
+	// when the config was reloaded, without changes to the backend
+	events[EventConfigBackendReload] = daemonEvent(func(appConfig *AppConfig) {
+		if r, ok := g.backend().(backends.Reloader); ok {
+			if err := r.Reload(); err != nil {
+				g.mainlog().WithError(err).Error("Backend failed to reload")
+				return
+			}
+			g.mainlog().Info("backend reloaded")
+		}
+	})
 	var err error
 	for topic, fn := range events {
 		switch f := fn.(type) {
@@ -446,6 +493,10 @@ func (g *guerrilla) Start() error {
 	if len(g.servers) == 0 {
 		return append(startErrors, errors.New("no servers to start, please check the config"))
 	}
+	if err := g.startMetrics(g.Config.MetricsInterface); err != nil {
+		startErrors = append(startErrors, err)
+	}
+	g.startTracing(g.Config.TracingEndpoint)
 	if g.state == daemonStateStopped {
 		// when a backend is shutdown, we need to re-initialize before it can be started again
 		if err := g.backend().Reinitialize(); err != nil {
@@ -465,8 +516,8 @@ func (g *guerrilla) Start() error {
 			// not enabled
 			continue
 		}
-		if g.servers[ListenInterface].state != ServerStateNew &&
-			g.servers[ListenInterface].state != ServerStateStopped {
+		if g.servers[ListenInterface].getState() != ServerStateNew &&
+			g.servers[ListenInterface].getState() != ServerStateStopped {
 			continue
 		}
 		startWG.Add(1)
@@ -494,10 +545,11 @@ func (g *guerrilla) Start() error {
 }
 
 func (g *guerrilla) Shutdown() {
+	g.stopMetrics()
 
 	// shut down the servers first
 	g.mapServers(func(s *server) {
-		if s.state == ServerStateRunning {
+		if s.getState() == ServerStateRunning || s.getState() == ServerStateDraining {
 			s.Shutdown()
 			g.mainlog().Infof("shutdown completed for [%s]", s.listenInterface)
 		}
@@ -514,6 +566,8 @@ func (g *guerrilla) Shutdown() {
 	} else {
 		g.mainlog().Infof("Backend shutdown completed")
 	}
+	// after the backend, so that the spans of its processors are sent
+	g.stopTracing()
 }
 
 // SetLogger sets the logger for the app and propagates it to sub-packages (eg.
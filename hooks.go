@@ -0,0 +1,40 @@
+package guerrilla
+
+import (
+	"sync"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/response"
+)
+
+var sessionHooks = struct {
+	list []backends.SessionHooks
+	sync.RWMutex
+}{}
+
+// AddHooks adds hooks called by the SMTP servers at each stage of a session,
+// eg. to reject a client after HELO. See backends.SessionHooks
+func AddHooks(h backends.SessionHooks) {
+	sessionHooks.Lock()
+	defer sessionHooks.Unlock()
+	sessionHooks.list = append(sessionHooks.list, h)
+}
+
+// hooks returns the hooks added with AddHooks, then the hooks of the processors
+func hooks() []backends.SessionHooks {
+	sessionHooks.RLock()
+	list := append([]backends.SessionHooks{}, sessionHooks.list...)
+	sessionHooks.RUnlock()
+	return append(list, backends.Svc.Hooks()...)
+}
+
+// runHooks calls a hook of each SessionHooks, until one of them refuses the stage.
+// It returns the reply of the hook that refused, or nil
+func runHooks(hook func(h backends.SessionHooks) *response.Response) *response.Response {
+	for _, h := range hooks() {
+		if r := hook(h); r != nil {
+			return r
+		}
+	}
+	return nil
+}
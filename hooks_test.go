@@ -0,0 +1,124 @@
+package guerrilla
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/response"
+)
+
+// policyHooks refuses some names, senders, recipients and bodies, and counts the connections
+type policyHooks struct {
+	backends.BaseHooks
+	connected    []string
+	disconnected int
+}
+
+func (p *policyHooks) OnConnect(_ context.Context, remoteIP string, _ *tls.ConnectionState) *response.Response {
+	p.connected = append(p.connected, remoteIP)
+	return nil
+}
+
+func (p *policyHooks) OnHelo(_ context.Context, e *mail.Envelope) *response.Response {
+	if e.Helo == "bad.example" {
+		return &response.Response{EnhancedCode: ".7.0", Class: response.ClassPermanentFailure, Comment: "Go away"}
+	}
+	return nil
+}
+
+func (p *policyHooks) OnMailFrom(_ context.Context, e *mail.Envelope) *response.Response {
+	if e.MailFrom.Host == "spam.example" {
+		return &response.Response{EnhancedCode: ".7.1", BasicCode: 550, Class: response.ClassPermanentFailure, Comment: "Sender blocked"}
+	}
+	return nil
+}
+
+func (p *policyHooks) OnRcptTo(_ context.Context, e *mail.Envelope) *response.Response {
+	if e.RcptTo[len(e.RcptTo)-1].User == "full" {
+		return &response.Response{EnhancedCode: response.MailboxFull, BasicCode: 452, Class: response.ClassTransientFailure}
+	}
+	return nil
+}
+
+func (p *policyHooks) OnDataEnd(_ context.Context, e *mail.Envelope) *response.Response {
+	if strings.Contains(e.String(), "spam") {
+		return &response.Response{EnhancedCode: ".7.0", Class: response.ClassPermanentFailure, Comment: "Content rejected"}
+	}
+	return nil
+}
+
+func (p *policyHooks) OnDisconnect(context.Context, *mail.Envelope) {
+	p.disconnected++
+}
+
+func TestHooks(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	p := &policyHooks{}
+	AddHooks(p)
+	defer func() {
+		sessionHooks.Lock()
+		sessionHooks.list = nil
+		sessionHooks.Unlock()
+	}()
+
+	sc := getMockServerConfig()
+	mainlog, _ := log.GetLogger(sc.LogFile, "debug")
+	conn, server := getMockServerConn(sc, t)
+	server.setAllowedHosts([]string{"test.com"})
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	if line, _ := r.ReadLine(); !strings.HasPrefix(line, "220 ") {
+		t.Error("expecting the greeting, got", line)
+	}
+
+	for _, test := range []struct {
+		cmd, reply string
+	}{
+		{"HELO bad.example", "550 5.7.0 Go away"},
+		{"HELO test.example", "250 "},
+		{"MAIL FROM:<eve@spam.example>", "550 5.7.1 Sender blocked"},
+		{"MAIL FROM:<alice@example.com>", "250 2.1.0 OK"},
+		{"RCPT TO:<full@test.com>", "452 4.2.2"},
+		{"RCPT TO:<bob@test.com>", "250 2.1.5 OK"},
+		{"DATA", "354 "},
+		{"Subject: spam\r\n\r\nbuy now\r\n.", "550 5.7.0 Content rejected"},
+		{"MAIL FROM:<alice@example.com>", "250 2.1.0 OK"},
+	} {
+		if err := w.PrintfLine("%s", test.cmd); err != nil {
+			t.Fatal(err)
+		}
+		if line, _ := r.ReadLine(); !strings.HasPrefix(line, test.reply) {
+			t.Errorf("%s: expecting %q, got %q", test.cmd, test.reply, line)
+		}
+	}
+	if err := w.PrintfLine("QUIT"); err != nil {
+		t.Error(err)
+	}
+	_, _ = r.ReadLine()
+	wg.Wait()
+	if len(p.connected) != 1 || p.connected[0] != client.RemoteIP {
+		t.Error("expecting the connect hook to get the address of the client, got", p.connected)
+	}
+	if p.disconnected != 1 {
+		t.Error("expecting the disconnect hook to be called once, got", p.disconnected)
+	}
+}
@@ -0,0 +1,683 @@
+// Package arc verifies and seals Authenticated Received Chains (RFC 8617).
+//
+// An ARC set is made of the ARC-Authentication-Results, ARC-Message-Signature and
+// ARC-Seal header fields of one instance. Each intermediary that forwards a message
+// adds a set, recording the authentication results it found, so that the final
+// receiver can trust them even if the message was modified on the way.
+// Public keys are published in the same way as for DKIM.
+//
+// The signatures are computed here rather than with github.com/emersion/go-msgauth/dkim:
+// it only signs and verifies whole DKIM-Signature fields, and keeps its canonicalization
+// and key parsing unexported. The name of a signature field is part of what is signed,
+// so an ARC-Message-Signature cannot be verified as a renamed DKIM-Signature, and the
+// ARC-Seal has no DKIM counterpart. The canonicalization, hashing and signing below are
+// tested against the dkim package, in both directions, and against RFC 6376 section 3.4.5.
+package arc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChainValidation is the state of the chain, the cv= tag of ARC-Seal
+type ChainValidation string
+
+const (
+	ChainNone ChainValidation = "none"
+	ChainPass ChainValidation = "pass"
+	ChainFail ChainValidation = "fail"
+)
+
+const (
+	headerSeal             = "ARC-Seal"
+	headerMessageSignature = "ARC-Message-Signature"
+	headerAuthResults      = "ARC-Authentication-Results"
+
+	// MaxInstance is the most ARC sets a message can have
+	MaxInstance = 50
+
+	// minRSAKeyBits is the smallest RSA key that is accepted, as per RFC 8301
+	minRSAKeyBits = 1024
+)
+
+var (
+	ErrChainFailed  = errors.New("arc: the chain has already failed, it cannot be sealed again")
+	ErrTooManySets  = errors.New("arc: the message has too many ARC sets")
+	ErrNoAuthResult = errors.New("arc: no authentication results to seal")
+
+	// DefaultHeaderKeys are signed by the ARC-Message-Signature, if present in the message
+	DefaultHeaderKeys = []string{
+		"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To",
+		"In-Reply-To", "References", "MIME-Version", "Content-Type",
+		"Content-Transfer-Encoding", "DKIM-Signature",
+	}
+)
+
+// Sealer is an intermediary that added an ARC set to the message
+type Sealer struct {
+	// Instance is the instance of its ARC set
+	Instance int
+	// Domain is the d= of its ARC-Seal
+	Domain string
+	// AuthResults are the authentication results it recorded,
+	// eg. "mx.example.com; spf=pass smtp.mailfrom=example.org"
+	AuthResults string
+}
+
+// Result is the outcome of validating the chain of a message
+type Result struct {
+	Validation ChainValidation
+	// Instance is the instance of the last ARC set, zero if there are none
+	Instance int
+	// Domain is the domain that added the last ARC set
+	Domain string
+	// AuthResults are the authentication results recorded in the last ARC set
+	AuthResults string
+	// Sealers are the intermediaries of the chain, ordered by instance. They can only
+	// be trusted if the chain passed
+	Sealers []Sealer
+	// Reason explains why the chain failed
+	Reason string
+}
+
+// VerifyOptions customizes Verify
+type VerifyOptions struct {
+	// LookupTXT returns the DNS TXT records for the given domain name. If nil, net.LookupTXT is used
+	LookupTXT func(domain string) ([]string, error)
+}
+
+// SealOptions are the options for adding an ARC set to a message
+type SealOptions struct {
+	// Domain and Selector of the key, published at selector._domainkey.domain
+	Domain   string
+	Selector string
+	// Signer is an RSA or Ed25519 private key
+	Signer crypto.Signer
+	// HeaderKeys are the header fields to sign, defaults to DefaultHeaderKeys
+	HeaderKeys []string
+	// AuthResults are the authentication results to record, as the value of an
+	// Authentication-Results header, eg. "mx.example.com; spf=pass smtp.mailfrom=example.org"
+	AuthResults string
+	// Validation is the result of verifying the existing chain
+	Validation ChainValidation
+	// Time of the signatures, defaults to now
+	Time time.Time
+}
+
+// field is a raw header field, the folding is kept
+type field struct {
+	name string
+	// raw includes the name and the trailing CRLF
+	raw string
+}
+
+// value returns the unfolded value of the field
+func (f field) value() string {
+	v := f.raw[strings.Index(f.raw, ":")+1:]
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "").Replace(v))
+}
+
+// readMessage splits the message into its header fields and body. Line endings are
+// normalized to CRLF
+func readMessage(r io.Reader) ([]field, []byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	data = bytes.ReplaceAll(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	var fields []field
+	for len(data) > 0 {
+		end := bytes.Index(data, []byte("\r\n"))
+		if end < 0 {
+			end = len(data)
+			data = append(data, '\r', '\n')
+		}
+		line := data[:end+2]
+		data = data[end+2:]
+		if end == 0 {
+			// the empty line before the body
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += string(line)
+			continue
+		}
+		i := bytes.IndexByte(line, ':')
+		if i < 0 {
+			return nil, nil, fmt.Errorf("arc: malformed header field: %q", line)
+		}
+		fields = append(fields, field{name: strings.TrimSpace(string(line[:i])), raw: string(line)})
+	}
+	return fields, data, nil
+}
+
+// isWSP matches whitespace, including the CRLF of folded lines
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\r' || r == '\n'
+}
+
+// canonHeader canonicalizes a raw header field with the simple or relaxed algorithm (RFC 6376 3.4)
+func canonHeader(raw string, relaxed bool) string {
+	if !relaxed {
+		return raw
+	}
+	i := strings.Index(raw, ":")
+	name := strings.ToLower(strings.TrimSpace(raw[:i]))
+	value := strings.Join(strings.FieldsFunc(raw[i+1:], isWSP), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// canonBody canonicalizes the body with the simple or relaxed algorithm (RFC 6376 3.4)
+func canonBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if relaxed {
+		for i, line := range lines {
+			lines[i] = strings.Join(strings.FieldsFunc(line, func(r rune) bool {
+				return r == ' ' || r == '\t'
+			}), " ")
+			if lines[i] != "" && (line[0] == ' ' || line[0] == '\t') {
+				// leading whitespace is reduced to a single space
+				lines[i] = " " + lines[i]
+			}
+		}
+	}
+	// remove the empty lines at the end
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// parseTags parses a tag-list (RFC 6376 3.2), the whitespace in values is removed
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, item := range strings.Split(s, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("arc: malformed tag [%s]", strings.TrimSpace(item))
+		}
+		k := strings.TrimSpace(kv[0])
+		if _, ok := tags[k]; ok {
+			return nil, fmt.Errorf("arc: duplicate tag [%s]", k)
+		}
+		tags[k] = strings.Join(strings.FieldsFunc(kv[1], isWSP), "")
+	}
+	return tags, nil
+}
+
+// stripSignature removes the value of the b= tag from a raw header field, without the CRLF
+func stripSignature(raw string) string {
+	raw = strings.TrimSuffix(raw, "\r\n")
+	i := strings.Index(raw, ":")
+	items := strings.Split(raw[i+1:], ";")
+	for j, item := range items {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "b" {
+			items[j] = kv[0] + "="
+		}
+	}
+	return raw[:i+1] + strings.Join(items, ";")
+}
+
+// selectHeaders returns the fields named by keys. If a name is repeated,
+// the fields are taken from the bottom up, as per RFC 6376 5.4.2
+func selectHeaders(fields []field, keys []string) []field {
+	used := make(map[int]bool)
+	var selected []field
+	for _, key := range keys {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, key) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// signatureHash hashes the header fields for a signature, where sig is the signature's
+// own raw header field
+func signatureHash(fields []field, sig string, relaxed bool) []byte {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(canonHeader(f.raw, relaxed)))
+	}
+	h.Write([]byte(strings.TrimSuffix(canonHeader(stripSignature(sig)+"\r\n", relaxed), "\r\n")))
+	return h.Sum(nil)
+}
+
+func bodyHash(body []byte, relaxed bool) string {
+	sum := sha256.Sum256(canonBody(body, relaxed))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// algorithm returns the name of the signing algorithm of the key
+func algorithm(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", fmt.Errorf("arc: unsupported key type %T", signer.Public())
+}
+
+// sign signs the hash, returning the base64 encoded signature
+func sign(signer crypto.Signer, hashed []byte) (string, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		// Ed25519 signs the hash itself, see RFC 8463
+		opts = crypto.Hash(0)
+	}
+	sig, err := signer.Sign(rand.Reader, hashed, opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// fold breaks the signature into lines, so that the header field is not too long
+func fold(b string) string {
+	var s strings.Builder
+	for len(b) > 0 {
+		n := 72
+		if n > len(b) {
+			n = len(b)
+		}
+		s.WriteString("\r\n\t" + b[:n])
+		b = b[n:]
+	}
+	return s.String()
+}
+
+// lookupKey finds the public key of the selector
+func lookupKey(domain, selector string, options *VerifyOptions) (crypto.PublicKey, error) {
+	if domain == "" || selector == "" || strings.ContainsAny(domain+selector, " \t;/\\") {
+		return nil, fmt.Errorf("arc: invalid domain [%s] or selector [%s]", domain, selector)
+	}
+	lookupTXT := net.LookupTXT
+	if options != nil && options.LookupTXT != nil {
+		lookupTXT = options.LookupTXT
+	}
+	txts, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, fmt.Errorf("arc: key unavailable for %s._domainkey.%s: %s", selector, domain, err)
+	}
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("arc: unsupported key record version [%s]", v)
+	}
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("arc: no key in the record of %s._domainkey.%s", selector, domain)
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		var rsaKey *rsa.PublicKey
+		if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+			rsaKey, _ = key.(*rsa.PublicKey)
+		}
+		if rsaKey == nil {
+			if rsaKey, err = x509.ParsePKCS1PublicKey(data); err != nil {
+				return nil, err
+			}
+		}
+		if rsaKey.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("arc: the key of %s._domainkey.%s is too short", selector, domain)
+		}
+		return rsaKey, nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New("arc: invalid ed25519 key")
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	return nil, fmt.Errorf("arc: unsupported key type [%s]", tags["k"])
+}
+
+// requireTags returns an error if one of the tags is missing
+func requireTags(name string, tags map[string]string, required ...string) error {
+	for _, tag := range required {
+		if tags[tag] == "" {
+			return fmt.Errorf("arc: %s has no %s= tag", name, tag)
+		}
+	}
+	return nil
+}
+
+// verifySignature checks the b= tag of a signature against the hash
+func verifySignature(tags map[string]string, hashed []byte, options *VerifyOptions) error {
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return errors.New("arc: malformed signature")
+	}
+	key, err := lookupKey(tags["d"], tags["s"], options)
+	if err != nil {
+		return err
+	}
+	switch tags["a"] {
+	case "rsa-sha256":
+		if k, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed, sig)
+		}
+	case "ed25519-sha256":
+		if k, ok := key.(ed25519.PublicKey); ok {
+			if !ed25519.Verify(k, hashed, sig) {
+				return errors.New("arc: ed25519 verification failed")
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("arc: unsupported algorithm [%s]", tags["a"])
+	}
+	return fmt.Errorf("arc: key does not match algorithm [%s]", tags["a"])
+}
+
+// set is an ARC set of one instance
+type set struct {
+	instance     int
+	seal         *field
+	signature    *field
+	authResults  *field
+	sealTags     map[string]string
+	signatureTag map[string]string
+}
+
+// authResultsInstance parses the instance from "i=1; mx.example.com; spf=pass"
+func authResultsInstance(v string) (int, string, error) {
+	parts := strings.SplitN(v, ";", 2)
+	kv := strings.SplitN(parts[0], "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) != "i" || len(parts) != 2 {
+		return 0, "", errors.New("arc: malformed ARC-Authentication-Results")
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+	return i, strings.TrimSpace(parts[1]), err
+}
+
+// collectSets returns the ARC sets of the message ordered by instance.
+// An error is returned if the sets are not complete
+func collectSets(fields []field) ([]*set, error) {
+	sets := make(map[int]*set)
+	get := func(i int) (*set, error) {
+		if i < 1 || i > MaxInstance {
+			return nil, fmt.Errorf("arc: invalid instance %d", i)
+		}
+		if sets[i] == nil {
+			sets[i] = &set{instance: i}
+		}
+		return sets[i], nil
+	}
+	for n := range fields {
+		f := &fields[n]
+		switch {
+		case strings.EqualFold(f.name, headerAuthResults):
+			i, _, err := authResultsInstance(f.value())
+			if err != nil {
+				return nil, err
+			}
+			s, err := get(i)
+			if err != nil {
+				return nil, err
+			}
+			if s.authResults != nil {
+				return nil, fmt.Errorf("arc: duplicate %s for instance %d", headerAuthResults, i)
+			}
+			s.authResults = f
+		case strings.EqualFold(f.name, headerMessageSignature), strings.EqualFold(f.name, headerSeal):
+			tags, err := parseTags(f.value())
+			if err != nil {
+				return nil, err
+			}
+			i, err := strconv.Atoi(tags["i"])
+			if err != nil {
+				return nil, fmt.Errorf("arc: invalid instance in %s", f.name)
+			}
+			s, err := get(i)
+			if err != nil {
+				return nil, err
+			}
+			if strings.EqualFold(f.name, headerSeal) {
+				if s.seal != nil {
+					return nil, fmt.Errorf("arc: duplicate %s for instance %d", headerSeal, i)
+				}
+				s.seal, s.sealTags = f, tags
+			} else {
+				if s.signature != nil {
+					return nil, fmt.Errorf("arc: duplicate %s for instance %d", headerMessageSignature, i)
+				}
+				s.signature, s.signatureTag = f, tags
+			}
+		}
+	}
+	list := make([]*set, 0, len(sets))
+	for _, s := range sets {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].instance < list[j].instance })
+	for n, s := range list {
+		if s.instance != n+1 {
+			return nil, fmt.Errorf("arc: missing instance %d", n+1)
+		}
+		if s.seal == nil || s.signature == nil || s.authResults == nil {
+			return nil, fmt.Errorf("arc: incomplete set for instance %d", s.instance)
+		}
+	}
+	return list, nil
+}
+
+// sealHash hashes the ARC sets for the seal of the last set, as per RFC 8617 5.1.1
+func sealHash(sets []*set, seal string) []byte {
+	h := sha256.New()
+	for i, s := range sets {
+		h.Write([]byte(canonHeader(s.authResults.raw, true)))
+		h.Write([]byte(canonHeader(s.signature.raw, true)))
+		if i < len(sets)-1 {
+			h.Write([]byte(canonHeader(s.seal.raw, true)))
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(canonHeader(stripSignature(seal)+"\r\n", true), "\r\n")))
+	return h.Sum(nil)
+}
+
+// verifyMessageSignature checks a DKIM style signature, such as the ARC-Message-Signature of a set
+func verifyMessageSignature(fields []field, body []byte, sig *field, tags map[string]string, options *VerifyOptions) error {
+	if err := requireTags(sig.name, tags, "a", "b", "bh", "d", "s", "h"); err != nil {
+		return err
+	}
+	if _, ok := tags["l"]; ok {
+		return fmt.Errorf("arc: the l= tag of %s is not supported", sig.name)
+	}
+	keys := strings.Split(tags["h"], ":")
+	from := false
+	for _, key := range keys {
+		switch {
+		case strings.EqualFold(key, "From"):
+			from = true
+		case strings.EqualFold(key, headerSeal):
+			// RFC 8617 section 4.1.2
+			return fmt.Errorf("arc: %s must not sign %s", sig.name, headerSeal)
+		}
+	}
+	if !from {
+		return fmt.Errorf("arc: %s does not sign the From header", sig.name)
+	}
+	c := strings.SplitN(tags["c"], "/", 2)
+	for _, canon := range c {
+		if canon != "simple" && canon != "relaxed" {
+			return fmt.Errorf("arc: unsupported canonicalization [%s]", tags["c"])
+		}
+	}
+	headerRelaxed := c[0] == "relaxed"
+	bodyRelaxed := len(c) == 2 && c[1] == "relaxed"
+	if bodyHash(body, bodyRelaxed) != tags["bh"] {
+		return errors.New("arc: body hash did not verify")
+	}
+	hashed := signatureHash(selectHeaders(fields, keys), sig.raw, headerRelaxed)
+	return verifySignature(tags, hashed, options)
+}
+
+// Verify validates the ARC sets of a message, as per RFC 8617 5.2.
+// An error is only returned if the message could not be read.
+func Verify(r io.Reader, options *VerifyOptions) (*Result, error) {
+	fields, body, err := readMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	return verify(fields, body, options), nil
+}
+
+func verify(fields []field, body []byte, options *VerifyOptions) *Result {
+	result := &Result{Validation: ChainFail}
+	sets, err := collectSets(fields)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	if len(sets) == 0 {
+		result.Validation = ChainNone
+		return result
+	}
+	for _, s := range sets {
+		sealer := Sealer{Instance: s.instance, Domain: s.sealTags["d"]}
+		_, sealer.AuthResults, _ = authResultsInstance(s.authResults.value())
+		result.Sealers = append(result.Sealers, sealer)
+	}
+	last := sets[len(sets)-1]
+	result.Instance = last.instance
+	result.Domain = last.sealTags["d"]
+	result.AuthResults = result.Sealers[len(sets)-1].AuthResults
+	for _, s := range sets {
+		if err = requireTags(headerSeal, s.sealTags, "a", "b", "cv", "d", "s"); err != nil {
+			result.Reason = err.Error()
+			return result
+		}
+		if _, ok := s.sealTags["h"]; ok {
+			// RFC 8617 section 4.1.3
+			result.Reason = fmt.Sprintf("instance %d: %s must not have an h= tag", s.instance, headerSeal)
+			return result
+		}
+		expect := ChainPass
+		if s.instance == 1 {
+			expect = ChainNone
+		}
+		if cv := ChainValidation(s.sealTags["cv"]); cv != expect {
+			result.Reason = fmt.Sprintf("instance %d has cv=%s", s.instance, cv)
+			return result
+		}
+	}
+	if err = verifyMessageSignature(fields, body, last.signature, last.signatureTag, options); err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	for i := len(sets); i > 0; i-- {
+		if err = verifySignature(sets[i-1].sealTags, sealHash(sets[:i], sets[i-1].seal.raw), options); err != nil {
+			result.Reason = fmt.Sprintf("seal of instance %d: %s", i, err)
+			return result
+		}
+	}
+	result.Validation = ChainPass
+	return result
+}
+
+// Seal returns a new ARC set for the message, to be prepended to it. The header fields
+// end with CRLF
+func Seal(r io.Reader, options *SealOptions) (string, error) {
+	if options.AuthResults == "" {
+		return "", ErrNoAuthResult
+	}
+	algo, err := algorithm(options.Signer)
+	if err != nil {
+		return "", err
+	}
+	fields, body, err := readMessage(r)
+	if err != nil {
+		return "", err
+	}
+	sets, err := collectSets(fields)
+	if err != nil {
+		return "", err
+	}
+	cv := options.Validation
+	if len(sets) == 0 {
+		cv = ChainNone
+	} else if ChainValidation(sets[len(sets)-1].sealTags["cv"]) == ChainFail {
+		return "", ErrChainFailed
+	} else if len(sets) >= MaxInstance {
+		return "", ErrTooManySets
+	} else if cv != ChainPass {
+		cv = ChainFail
+	}
+	t := options.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	instance := len(sets) + 1
+	s := &set{instance: instance}
+
+	aar := headerAuthResults + ": i=" + strconv.Itoa(instance) + "; " + options.AuthResults + "\r\n"
+	s.authResults = &field{name: headerAuthResults, raw: aar}
+
+	keys := options.HeaderKeys
+	if len(keys) == 0 {
+		keys = DefaultHeaderKeys
+	}
+	var present []string
+	for _, key := range keys {
+		for _, f := range fields {
+			if strings.EqualFold(f.name, key) {
+				present = append(present, key)
+				break
+			}
+		}
+	}
+	ams := fmt.Sprintf("%s: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s; b=",
+		headerMessageSignature, instance, algo, options.Domain, options.Selector, t.Unix(),
+		strings.Join(present, ":"), bodyHash(body, true))
+	b, err := sign(options.Signer, signatureHash(selectHeaders(fields, present), ams, true))
+	if err != nil {
+		return "", err
+	}
+	ams += fold(b) + "\r\n"
+	s.signature = &field{name: headerMessageSignature, raw: ams}
+
+	seal := fmt.Sprintf("%s: i=%d; a=%s; t=%d; cv=%s;\r\n\td=%s; s=%s; b=",
+		headerSeal, instance, algo, t.Unix(), cv, options.Domain, options.Selector)
+	sealed := append(sets, s)
+	if cv == ChainFail {
+		// a failed chain is not covered by the seal
+		sealed = []*set{s}
+	}
+	b, err = sign(options.Signer, sealHash(sealed, seal))
+	if err != nil {
+		return "", err
+	}
+	seal += fold(b) + "\r\n"
+	return seal + ams + aar, nil
+}
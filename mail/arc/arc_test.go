@@ -0,0 +1,299 @@
+package arc
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const testMessage = "From: Sender <sender@example.org>\r\n" +
+	"To: list@lists.example.com\r\n" +
+	"Subject:   folded\r\n" +
+	"  subject \t line\r\n" +
+	"Date: Mon, 4 Nov 2024 21:00:37 -0500\r\n" +
+	"\r\n" +
+	"Hello  \t world \r\n" +
+	"\t indented\r\n" +
+	"\r\n" +
+	"\r\n"
+
+type testKeys map[string]string
+
+func (k testKeys) lookupTXT(domain string) ([]string, error) {
+	if r, ok := k[domain]; ok {
+		return []string{r}, nil
+	}
+	return nil, errors.New("no such domain")
+}
+
+func (k testKeys) add(t *testing.T, domain, selector string, rsaKey bool) crypto.Signer {
+	name := selector + "._domainkey." + domain
+	if rsaKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		k[name] = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+		return key
+	}
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k[name] = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	return key
+}
+
+// TestCanonicalization checks the canonicalization and hashing against the DKIM verifier
+func TestCanonicalization(t *testing.T) {
+	keys := testKeys{}
+	signer := keys.add(t, "example.org", "test", false)
+	fields, body, err := readMessage(strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"simple/simple", "relaxed/relaxed", "relaxed/simple", "simple/relaxed"} {
+		canon := strings.Split(c, "/")
+		sig := fmt.Sprintf("DKIM-Signature: v=1; a=ed25519-sha256; c=%s; d=example.org; s=test;\r\n\th=From:Subject:To;  bh=%s; b=",
+			c, bodyHash(body, canon[1] == "relaxed"))
+		b, err := sign(signer, signatureHash(selectHeaders(fields, []string{"From", "Subject", "To"}), sig, canon[0] == "relaxed"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifications, err := dkim.VerifyWithOptions(strings.NewReader(sig+fold(b)+"\r\n"+testMessage),
+			&dkim.VerifyOptions{LookupTXT: keys.lookupTXT})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(verifications) != 1 || verifications[0].Err != nil {
+			t.Errorf("%s: signature did not verify: %v", c, verifications[0].Err)
+		}
+	}
+}
+
+// TestCanonicalizationExample checks the example of RFC 6376 section 3.4.5
+func TestCanonicalizationExample(t *testing.T) {
+	msg := "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+	fields, body, err := readMessage(strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var relaxed, simple string
+	for _, f := range fields {
+		relaxed += canonHeader(f.raw, true)
+		simple += canonHeader(f.raw, false)
+	}
+	if relaxed != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("unexpected relaxed header %q", relaxed)
+	}
+	if simple != "A: X\r\nB : Y\t\r\n\tZ  \r\n" {
+		t.Errorf("unexpected simple header %q", simple)
+	}
+	if got := string(canonBody(body, true)); got != " C\r\nD E\r\n" {
+		t.Errorf("unexpected relaxed body %q", got)
+	}
+	if got := string(canonBody(body, false)); got != " C \r\nD \t E\r\n" {
+		t.Errorf("unexpected simple body %q", got)
+	}
+	// empty bodies, RFC 6376 section 3.4.3 and 3.4.4
+	if canonBody(nil, true) != nil || string(canonBody([]byte("\r\n\r\n"), false)) != "\r\n" {
+		t.Error("unexpected canonicalization of an empty body")
+	}
+}
+
+// TestVerifyDKIMSignatures checks the verification of signatures made by the DKIM signer
+func TestVerifyDKIMSignatures(t *testing.T) {
+	keys := testKeys{}
+	options := &VerifyOptions{LookupTXT: keys.lookupTXT}
+	signers := map[string]crypto.Signer{
+		"rsa":     keys.add(t, "example.org", "rsa", true),
+		"ed25519": keys.add(t, "example.org", "ed25519", false),
+	}
+	for _, c := range []dkim.Canonicalization{dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed} {
+		for selector, signer := range signers {
+			var signed strings.Builder
+			if err := dkim.Sign(&signed, strings.NewReader(testMessage), &dkim.SignOptions{
+				Domain: "example.org", Selector: selector, Signer: signer,
+				HeaderCanonicalization: c, BodyCanonicalization: c,
+				HeaderKeys: []string{"From", "To", "Subject", "Date"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range []string{signed.String(), signed.String() + "appended\r\n"} {
+				fields, body, err := readMessage(strings.NewReader(msg))
+				if err != nil {
+					t.Fatal(err)
+				}
+				tags, err := parseTags(fields[0].value())
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = verifyMessageSignature(fields, body, &fields[0], tags, options)
+				if valid := msg == signed.String(); valid != (err == nil) {
+					t.Errorf("%s/%s: expecting valid %v, got %v", c, selector, valid, err)
+				}
+			}
+		}
+	}
+}
+
+func TestVerifyMessageSignatureRules(t *testing.T) {
+	keys := testKeys{}
+	options := &VerifyOptions{LookupTXT: keys.lookupTXT}
+	signer := keys.add(t, "example.org", "test", false)
+	short, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&short.PublicKey)
+	keys["short._domainkey.example.org"] = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+
+	fields, body, err := readMessage(strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, a, s, h, reason string
+		key                   crypto.Signer
+	}{
+		{"valid", "ed25519-sha256", "test", "From:Subject", "", signer},
+		{"seal signed", "ed25519-sha256", "test", "From:ARC-Seal", "must not sign", signer},
+		{"from not signed", "ed25519-sha256", "test", "Subject", "From", signer},
+		{"short key", "rsa-sha256", "short", "From", "too short", short},
+	}
+	for _, tt := range tests {
+		sig := fmt.Sprintf("%s: i=1; a=%s; c=relaxed/relaxed; d=example.org; s=%s;\r\n\th=%s; bh=%s; b=",
+			headerMessageSignature, tt.a, tt.s, tt.h, bodyHash(body, true))
+		b, err := sign(tt.key, signatureHash(selectHeaders(fields, strings.Split(tt.h, ":")), sig, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := field{name: headerMessageSignature, raw: sig + b + "\r\n"}
+		tags, _ := parseTags(f.value())
+		err = verifyMessageSignature(fields, body, &f, tags, options)
+		if tt.reason == "" && err != nil {
+			t.Errorf("%s: expecting the signature to verify, got %v", tt.name, err)
+		} else if tt.reason != "" && (err == nil || !strings.Contains(err.Error(), tt.reason)) {
+			t.Errorf("%s: expecting an error with [%s], got %v", tt.name, tt.reason, err)
+		}
+	}
+	tags, _ := parseTags("i=1; a=ed25519-sha256; d=example.org; s=test; h=From; b=AAAA")
+	if err = verifyMessageSignature(fields, body, &field{name: headerMessageSignature}, tags, options); err == nil ||
+		!strings.Contains(err.Error(), "bh=") {
+		t.Error("expecting a missing bh= tag to fail, got", err)
+	}
+}
+
+func TestSealAndVerify(t *testing.T) {
+	keys := testKeys{}
+	options := &VerifyOptions{LookupTXT: keys.lookupTXT}
+	listKey := keys.add(t, "lists.example.com", "arc", true)
+	fwdKey := keys.add(t, "forwarder.example.net", "arc", false)
+
+	r, err := Verify(strings.NewReader(testMessage), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Validation != ChainNone || r.Instance != 0 {
+		t.Fatal("expecting no chain, got", r.Validation, r.Instance)
+	}
+
+	// the mailing list seals the message, then modifies the subject
+	set, err := Seal(strings.NewReader(testMessage), &SealOptions{
+		Domain: "lists.example.com", Selector: "arc", Signer: listKey,
+		AuthResults: "lists.example.com; dkim=pass header.d=example.org",
+		Validation:  r.Validation,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := set + strings.Replace(testMessage, "Subject:   folded", "Subject: [list] folded", 1)
+	if !strings.Contains(set, "ARC-Seal: i=1; a=rsa-sha256;") || !strings.Contains(set, "cv=none;") {
+		t.Error("unexpected seal:", set)
+	}
+	// the subject was signed, so the ARC-Message-Signature no longer verifies
+	if r, _ = Verify(strings.NewReader(msg), options); r.Validation != ChainFail {
+		t.Error("expecting the modified message to fail, got", r.Validation)
+	}
+	msg = set + testMessage
+	if r, _ = Verify(strings.NewReader(msg), options); r.Validation != ChainPass || r.Instance != 1 ||
+		r.Domain != "lists.example.com" || r.AuthResults != "lists.example.com; dkim=pass header.d=example.org" {
+		t.Fatalf("expecting the chain to pass, got %+v", r)
+	}
+
+	// a forwarder adds another set
+	set, err = Seal(strings.NewReader(msg), &SealOptions{
+		Domain: "forwarder.example.net", Selector: "arc", Signer: fwdKey,
+		AuthResults: "forwarder.example.net; arc=pass",
+		Validation:  r.Validation,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = set + msg
+	if r, _ = Verify(strings.NewReader(msg), options); r.Validation != ChainPass || r.Instance != 2 ||
+		r.Domain != "forwarder.example.net" {
+		t.Fatalf("expecting the chain to pass, got %+v", r)
+	}
+	if len(r.Sealers) != 2 || r.Sealers[0] != (Sealer{Instance: 1, Domain: "lists.example.com",
+		AuthResults: "lists.example.com; dkim=pass header.d=example.org"}) || r.Sealers[1].Domain != "forwarder.example.net" {
+		t.Errorf("unexpected sealers %+v", r.Sealers)
+	}
+
+	// the body of the last message signature is checked
+	if r, _ = Verify(strings.NewReader(msg+"appended\r\n"), options); r.Validation != ChainFail {
+		t.Error("expecting a modified body to fail, got", r.Validation)
+	}
+	// the seals cover the earlier sets
+	tampered := strings.Replace(msg, "lists.example.com; dkim=pass", "lists.example.com; dkim=fail", 1)
+	if r, _ = Verify(strings.NewReader(tampered), options); r.Validation != ChainFail || !strings.Contains(r.Reason, "seal") {
+		t.Error("expecting a modified ARC set to fail, got", r.Validation, r.Reason)
+	}
+	// a missing set
+	i := strings.Index(msg, "ARC-Seal: i=1")
+	if r, _ = Verify(strings.NewReader(msg[:i]+msg[strings.Index(msg[i:], "\r\nARC-")+i+2:]), options); r.Validation != ChainFail {
+		t.Error("expecting an incomplete set to fail, got", r.Validation)
+	}
+}
+
+func TestSealFailedChain(t *testing.T) {
+	keys := testKeys{}
+	options := &VerifyOptions{LookupTXT: keys.lookupTXT}
+	key := keys.add(t, "example.com", "arc", false)
+	seal := func(msg string, cv ChainValidation) (string, error) {
+		return Seal(strings.NewReader(msg), &SealOptions{
+			Domain: "example.com", Selector: "arc", Signer: key,
+			AuthResults: "example.com; none",
+			Validation:  cv,
+		})
+	}
+	set, err := seal(testMessage, ChainNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the chain failed verification, it is sealed with cv=fail
+	msg := set + testMessage + "modified\r\n"
+	if set, err = seal(msg, ChainFail); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(set, "cv=fail") {
+		t.Error("expecting cv=fail, got", set)
+	}
+	msg = set + msg
+	if r, _ := Verify(strings.NewReader(msg), options); r.Validation != ChainFail {
+		t.Error("expecting the chain to fail, got", r.Validation)
+	}
+	if _, err = seal(msg, ChainFail); err != ErrChainFailed {
+		t.Error("expecting ErrChainFailed, got", err)
+	}
+}
@@ -0,0 +1,218 @@
+package mail
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Body is the data of a message. It is kept in memory until it grows over the spill size,
+// then it is moved to a temporary file, so that large messages don't take up memory.
+// The zero value is an empty body that is always kept in memory, see SetSpill.
+//
+// Use NewReader to read the body, it can be called many times. Bytes and String load a body
+// that was spilled into memory.
+type Body struct {
+	buf bytes.Buffer
+	// spill is the temporary file, nil when the body is in memory
+	spill *spillFile
+	size  int64
+	// spillSize is the size above which the body is spilled, 0 to never spill
+	spillSize int64
+	spillDir  string
+}
+
+// spillFile is the temporary file of a body, it may be shared by its copies
+type spillFile struct {
+	f    *os.File
+	name string
+	// refs is the number of bodies using the file
+	refs int32
+}
+
+// SetSpill sets the size above which the body is moved to a temporary file in dir,
+// 0 or less to keep it in memory. The default dir is os.TempDir()
+func (b *Body) SetSpill(size int64, dir string) {
+	if size < 0 {
+		size = 0
+	}
+	b.spillSize, b.spillDir = size, dir
+}
+
+// Spilled returns true if the body is in a temporary file
+func (b *Body) Spilled() bool {
+	return b.spill != nil
+}
+
+// Write appends p to the body
+func (b *Body) Write(p []byte) (int, error) {
+	if b.spill == nil {
+		if b.spillSize == 0 || int64(b.buf.Len()+len(p)) <= b.spillSize {
+			n, err := b.buf.Write(p)
+			b.size += int64(n)
+			return n, err
+		}
+		if err := b.moveToFile(); err != nil {
+			return 0, err
+		}
+	} else if atomic.LoadInt32(&b.spill.refs) > 1 {
+		// copy on write
+		if err := b.unshare(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.spill.f.WriteAt(p, b.size)
+	b.size += int64(n)
+	return n, err
+}
+
+// WriteString appends s to the body
+func (b *Body) WriteString(s string) (int, error) {
+	if b.spill == nil && (b.spillSize == 0 || int64(b.buf.Len()+len(s)) <= b.spillSize) {
+		n, err := b.buf.WriteString(s)
+		b.size += int64(n)
+		return n, err
+	}
+	return b.Write([]byte(s))
+}
+
+// ReadFrom appends the data of r to the body, until EOF
+func (b *Body) ReadFrom(r io.Reader) (int64, error) {
+	if b.spillSize == 0 {
+		n, err := b.buf.ReadFrom(r)
+		b.size += n
+		return n, err
+	}
+	var total int64
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			if _, werr := b.Write(chunk[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Len returns the size of the body
+func (b *Body) Len() int {
+	return int(b.size)
+}
+
+// NewReader returns a reader of the body. The reader is only valid until the body is changed
+func (b *Body) NewReader() *io.SectionReader {
+	if b.spill != nil {
+		return io.NewSectionReader(b.spill.f, 0, b.size)
+	}
+	return io.NewSectionReader(bytes.NewReader(b.buf.Bytes()), 0, b.size)
+}
+
+// Bytes returns the body. A body that was spilled is read from its file,
+// prefer NewReader for large messages
+func (b *Body) Bytes() []byte {
+	if b.spill == nil {
+		return b.buf.Bytes()
+	}
+	data := make([]byte, b.size)
+	n, _ := b.spill.f.ReadAt(data, 0)
+	return data[:n]
+}
+
+// String returns the body as a string, see Bytes
+func (b *Body) String() string {
+	if b.spill == nil {
+		return b.buf.String()
+	}
+	return string(b.Bytes())
+}
+
+// Reset empties the body and removes its temporary file, keeping the spill settings
+func (b *Body) Reset() {
+	b.buf.Reset()
+	b.size = 0
+	if b.spill != nil {
+		b.spill.release()
+		b.spill = nil
+	}
+}
+
+// CopyTo sets dst to a copy of the body. A body in a temporary file shares it with the copy,
+// until one of them is changed
+func (b *Body) CopyTo(dst *Body) {
+	dst.Reset()
+	dst.spillSize, dst.spillDir = b.spillSize, b.spillDir
+	if b.spill != nil {
+		atomic.AddInt32(&b.spill.refs, 1)
+		dst.spill, dst.size = b.spill, b.size
+		return
+	}
+	dst.buf.Write(b.buf.Bytes())
+	dst.size = b.size
+}
+
+// MoveTo moves the body to dst, leaving it empty
+func (b *Body) MoveTo(dst *Body) {
+	dst.Reset()
+	dst.spillSize, dst.spillDir = b.spillSize, b.spillDir
+	dst.buf, b.buf = b.buf, bytes.Buffer{}
+	dst.spill, dst.size = b.spill, b.size
+	b.spill, b.size = nil, 0
+}
+
+// moveToFile moves the body from memory to a new temporary file
+func (b *Body) moveToFile() error {
+	s, err := newSpillFile(b.spillDir)
+	if err != nil {
+		return err
+	}
+	if _, err = s.f.Write(b.buf.Bytes()); err != nil {
+		s.release()
+		return err
+	}
+	b.spill = s
+	b.buf = bytes.Buffer{}
+	return nil
+}
+
+// unshare copies the shared temporary file to a new one
+func (b *Body) unshare() error {
+	s, err := newSpillFile(b.spillDir)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(s.f, io.NewSectionReader(b.spill.f, 0, b.size)); err != nil {
+		s.release()
+		return err
+	}
+	b.spill.release()
+	b.spill = s
+	return nil
+}
+
+// newSpillFile creates a temporary file. Its name is removed right away where the system
+// allows it, so that the file goes away with the last reference to it
+func newSpillFile(dir string) (*spillFile, error) {
+	f, err := os.CreateTemp(dir, "guerrilla-body-")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(f.Name())
+	return &spillFile{f: f, name: f.Name(), refs: 1}, nil
+}
+
+func (s *spillFile) release() {
+	if atomic.AddInt32(&s.refs, -1) == 0 {
+		_ = s.f.Close()
+		// where it could not be removed while open
+		_ = os.Remove(s.name)
+	}
+}
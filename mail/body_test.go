@@ -0,0 +1,78 @@
+package mail
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readBody(t *testing.T, b *Body) string {
+	data, err := io.ReadAll(b.NewReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBodySpill(t *testing.T) {
+	dir := t.TempDir()
+	var b Body
+	b.SetSpill(16, dir)
+	b.WriteString("Subject: hi\n\n")
+	if b.Spilled() {
+		t.Error("a small body should be kept in memory")
+	}
+	if _, err := b.ReadFrom(strings.NewReader("a body that is too long\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Spilled() {
+		t.Error("expecting the body to be spilled")
+	}
+	want := "Subject: hi\n\na body that is too long\n"
+	for i := 0; i < 2; i++ {
+		if got := readBody(t, &b); got != want {
+			t.Errorf("expecting %q, got %q", want, got)
+		}
+	}
+	if b.String() != want || b.Len() != len(want) {
+		t.Errorf("unexpected body %q of %d bytes", b.String(), b.Len())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Error("the temporary file should not have a name")
+	}
+	b.Reset()
+	if b.Spilled() || b.Len() != 0 || readBody(t, &b) != "" {
+		t.Error("expecting an empty body after a reset")
+	}
+}
+
+func TestBodyCopy(t *testing.T) {
+	var b Body
+	b.SetSpill(8, t.TempDir())
+	b.WriteString("0123456789")
+
+	var c Body
+	b.CopyTo(&c)
+	if c.spill != b.spill {
+		t.Error("expecting the copy to share the file")
+	}
+	c.WriteString("copy")
+	if readBody(t, &b) != "0123456789" || readBody(t, &c) != "0123456789copy" {
+		t.Errorf("unexpected bodies %q and %q", b.String(), c.String())
+	}
+
+	var d Body
+	c.MoveTo(&d)
+	if c.Len() != 0 || readBody(t, &d) != "0123456789copy" {
+		t.Errorf("unexpected bodies %q and %q", c.String(), d.String())
+	}
+
+	var small, copied Body
+	small.WriteString("hi")
+	small.CopyTo(&copied)
+	copied.WriteString("!")
+	if small.String() != "hi" || copied.String() != "hi!" {
+		t.Errorf("unexpected bodies %q and %q", small.String(), copied.String())
+	}
+}
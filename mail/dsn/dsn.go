@@ -0,0 +1,460 @@
+// Package dsn generates delivery status notifications (RFC 3464) for messages
+// that could not be delivered, or were delayed.
+//
+// The NOTIFY and ORCPT parameters of each recipient, and the RET and ENVID parameters
+// of the sender (RFC 3461) are taken from the PathParams of the addresses.
+// Notifications are never generated for messages with a null sender.
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// Action is the action performed by the reporting MTA for a recipient
+type Action string
+
+const (
+	Failed    Action = "failed"
+	Delayed   Action = "delayed"
+	Delivered Action = "delivered"
+	Relayed   Action = "relayed"
+	Expanded  Action = "expanded"
+)
+
+var (
+	ErrNullSender = errors.New("no delivery status notification for a null sender")
+	ErrNoNotify   = errors.New("no recipients requested a delivery status notification")
+	errNotDSN     = errors.New("not a DSN parameter")
+
+	enhancedStatus = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}`)
+)
+
+// Recipient is the delivery status of a recipient
+type Recipient struct {
+	Rcpt   mail.Address
+	Action Action
+	// Reply is the SMTP reply that caused the action, eg "550 5.1.1 No such user"
+	Reply string
+	// Code is the enhanced status code to report, if not the one of the reply
+	Code string
+	// RemoteMTA is the host that gave the reply, if any. A port is ignored
+	RemoteMTA string
+	// LastAttempt is when the last delivery attempt was made, zero if unknown
+	LastAttempt time.Time
+	// WillRetryUntil is when a delayed message will expire
+	WillRetryUntil time.Time
+}
+
+// Status returns the enhanced status code of the reply, eg. 5.1.1.
+// If the reply does not have one, a generic code is derived from the basic code.
+// Code is returned instead, if set
+func (r Recipient) Status() string {
+	if r.Code != "" {
+		return r.Code
+	}
+	reply := strings.TrimSpace(r.Reply)
+	if len(reply) > 4 {
+		if s := enhancedStatus.FindString(reply[4:]); s != "" {
+			return s
+		}
+	}
+	switch {
+	case strings.HasPrefix(reply, "4"):
+		return "4.0.0"
+	case strings.HasPrefix(reply, "2"):
+		return "2.0.0"
+	case r.Action == Delayed:
+		return "4.0.0"
+	case r.Action == Failed:
+		return "5.0.0"
+	}
+	return "2.0.0"
+}
+
+// param returns the value of an ESMTP parameter, the keyword is case-insensitive
+func param(params [][]string, keyword string) (string, bool) {
+	for _, p := range params {
+		if len(p) > 0 && strings.EqualFold(p[0], keyword) {
+			if len(p) > 1 {
+				return p[1], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// isXtext returns true if s is a valid xtext (RFC 3461 section 4)
+func isXtext(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			if i+2 >= len(s) || !isHexUpper(s[i+1]) || !isHexUpper(s[i+2]) {
+				return false
+			}
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return false
+		}
+	}
+	return true
+}
+
+func isHexUpper(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'F')
+}
+
+// checkParams checks the DSN parameters among params with check, each may only be given once
+func checkParams(params [][]string, check func(keyword, value string) error) error {
+	seen := make(map[string]bool)
+	for _, p := range params {
+		if len(p) == 0 {
+			continue
+		}
+		keyword := strings.ToUpper(p[0])
+		value := ""
+		if len(p) > 1 {
+			value = p[1]
+		}
+		if err := check(keyword, value); err == errNotDSN {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if seen[keyword] {
+			return fmt.Errorf("duplicate %s parameter", keyword)
+		}
+		seen[keyword] = true
+	}
+	return nil
+}
+
+// CheckMailParams returns an error if the RET or ENVID parameter of a MAIL command is malformed
+func CheckMailParams(params [][]string) error {
+	return checkParams(params, func(keyword, value string) error {
+		switch keyword {
+		case "RET":
+			if !strings.EqualFold(value, "FULL") && !strings.EqualFold(value, "HDRS") {
+				return errors.New("RET must be FULL or HDRS")
+			}
+		case "ENVID":
+			if value == "" || len(value) > 100 || !isXtext(value) {
+				return errors.New("ENVID must be an xtext of at most 100 characters")
+			}
+		default:
+			return errNotDSN
+		}
+		return nil
+	})
+}
+
+// CheckRcptParams returns an error if the NOTIFY or ORCPT parameter of a RCPT command is malformed
+func CheckRcptParams(params [][]string) error {
+	return checkParams(params, func(keyword, value string) error {
+		switch keyword {
+		case "NOTIFY":
+			values := strings.Split(strings.ToUpper(value), ",")
+			for _, v := range values {
+				switch v {
+				case "SUCCESS", "FAILURE", "DELAY":
+				case "NEVER":
+					if len(values) > 1 {
+						return errors.New("NOTIFY=NEVER cannot be combined with other values")
+					}
+				default:
+					return errors.New("NOTIFY must be NEVER, or a list of SUCCESS, FAILURE and DELAY")
+				}
+			}
+		case "ORCPT":
+			i := strings.IndexByte(value, ';')
+			if i < 1 || i == len(value)-1 || len(value) > 500 || !isXtext(value[i+1:]) {
+				return errors.New("ORCPT must be addr-type;xtext")
+			}
+		default:
+			return errNotDSN
+		}
+		return nil
+	})
+}
+
+// DecodeXtext decodes an xtext value (RFC 3461 section 4), such as the value of ENVID
+func DecodeXtext(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if b, err := hex.DecodeString(s[i+1 : i+3]); err == nil {
+				out.WriteByte(b[0])
+				i += 2
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+// Requested returns true if a notification with the action was requested for the recipient.
+// Without a NOTIFY parameter, failures and delays are reported.
+func Requested(rcpt mail.Address, action Action) bool {
+	notify, ok := param(rcpt.PathParams, "NOTIFY")
+	if !ok {
+		return action == Failed || action == Delayed
+	}
+	for _, v := range strings.Split(strings.ToUpper(notify), ",") {
+		switch strings.TrimSpace(v) {
+		case "NEVER":
+			return false
+		case "SUCCESS":
+			if action == Delivered || action == Relayed || action == Expanded {
+				return true
+			}
+		case "FAILURE":
+			if action == Failed {
+				return true
+			}
+		case "DELAY":
+			if action == Delayed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Report is a delivery status notification about a message
+type Report struct {
+	// ReportingMTA is the name of the host generating the report
+	ReportingMTA string
+	// MailFrom is the sender of the original message, who the report is sent to
+	MailFrom mail.Address
+	// QueuedId is the id the original message was accepted with
+	QueuedId string
+	// ArrivalDate is when the original message was accepted, zero if unknown
+	ArrivalDate time.Time
+	Recipients  []Recipient
+}
+
+// requested returns the recipients that asked to be notified
+func (r *Report) requested() []Recipient {
+	var rcpts []Recipient
+	for i := range r.Recipients {
+		if Requested(r.Recipients[i].Rcpt, r.Recipients[i].Action) {
+			rcpts = append(rcpts, r.Recipients[i])
+		}
+	}
+	return rcpts
+}
+
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func writeFields(b *bytes.Buffer, fields ...string) {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i+1] != "" {
+			b.WriteString(fields[i] + ": " + fields[i+1] + "\r\n")
+		}
+	}
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC1123Z)
+}
+
+// subject returns the Subject and the human-readable explanation
+func (r *Report) describe(rcpts []Recipient) (subject string, text string) {
+	var b bytes.Buffer
+	failed := false
+	for i := range rcpts {
+		if rcpts[i].Action == Failed {
+			failed = true
+		}
+	}
+	b.WriteString("This is the mail system at host " + r.ReportingMTA + ".\r\n\r\n")
+	switch {
+	case failed:
+		subject = "Undelivered Mail Returned to Sender"
+		b.WriteString("Your message could not be delivered to one or more recipients.\r\n")
+		b.WriteString("It's attached below.\r\n")
+	case rcpts[0].Action == Delayed:
+		subject = "Delayed Mail (still being retried)"
+		b.WriteString("Your message could not be delivered to one or more recipients yet.\r\n")
+		b.WriteString("Delivery will be retried, you do not need to send it again.\r\n")
+	default:
+		subject = "Successful Mail Delivery Report"
+		b.WriteString("Your message was successfully delivered to the recipients below.\r\n")
+	}
+	b.WriteString("\r\n")
+	for i := range rcpts {
+		b.WriteString("<" + rcpts[i].Rcpt.String() + ">: ")
+		if rcpts[i].Reply != "" {
+			b.WriteString(strings.Replace(rcpts[i].Reply, "\n", " ", -1))
+		} else {
+			b.WriteString(string(rcpts[i].Action))
+		}
+		if rcpts[i].RemoteMTA != "" {
+			b.WriteString(" (from " + hostOnly(rcpts[i].RemoteMTA) + ")")
+		}
+		b.WriteString("\r\n")
+		if !rcpts[i].WillRetryUntil.IsZero() {
+			b.WriteString("    will retry until " + formatDate(rcpts[i].WillRetryUntil) + "\r\n")
+		}
+	}
+	return subject, b.String()
+}
+
+// headers returns the header section of the original message
+func headers(original []byte) []byte {
+	r := bufio.NewReader(bytes.NewReader(original))
+	n := 0
+	for {
+		line, err := r.ReadSlice('\n')
+		n += len(line)
+		if err != nil || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	return original[:n]
+}
+
+// Message returns the notification as a multipart/report message, with the original
+// message or its headers attached, depending on the RET parameter of the sender.
+// Only the recipients that requested a notification are included.
+func (r *Report) Message(original io.Reader) ([]byte, error) {
+	if r.MailFrom.NullPath || r.MailFrom.IsEmpty() {
+		return nil, ErrNullSender
+	}
+	rcpts := r.requested()
+	if len(rcpts) == 0 {
+		return nil, ErrNoNotify
+	}
+	data, err := io.ReadAll(original)
+	if err != nil {
+		return nil, err
+	}
+	rb := make([]byte, 12)
+	if _, err = rand.Read(rb); err != nil {
+		return nil, err
+	}
+	boundary := hex.EncodeToString(rb) + "/" + r.ReportingMTA
+	now := time.Now()
+	subject, text := r.describe(rcpts)
+
+	var b bytes.Buffer
+	writeFields(&b,
+		"From", "Mail Delivery System <MAILER-DAEMON@"+r.ReportingMTA+">",
+		"To", "<"+r.MailFrom.String()+">",
+		"Subject", subject,
+		"Date", now.Format(time.RFC1123Z),
+		"Message-ID", fmt.Sprintf("<%s.%d@%s>", hex.EncodeToString(rb[:6]), now.UnixNano(), r.ReportingMTA),
+		"Auto-Submitted", "auto-replied",
+		"MIME-Version", "1.0",
+		"Content-Type", `multipart/report; report-type=delivery-status; boundary="`+boundary+`"`,
+	)
+	b.WriteString("\r\nThis is a MIME-encapsulated message.\r\n\r\n")
+
+	// the human-readable part
+	b.WriteString("--" + boundary + "\r\n")
+	writeFields(&b,
+		"Content-Description", "Notification",
+		"Content-Type", "text/plain; charset=us-ascii",
+	)
+	b.WriteString("\r\n" + text + "\r\n")
+
+	// the machine-readable part
+	b.WriteString("--" + boundary + "\r\n")
+	writeFields(&b,
+		"Content-Description", "Delivery report",
+		"Content-Type", "message/delivery-status",
+	)
+	b.WriteString("\r\n")
+	envID, _ := param(r.MailFrom.PathParams, "ENVID")
+	writeFields(&b,
+		"Reporting-MTA", "dns; "+r.ReportingMTA,
+		"X-Guerrilla-Queue-ID", r.QueuedId,
+		"Original-Envelope-Id", DecodeXtext(envID),
+		"Arrival-Date", formatDate(r.ArrivalDate),
+	)
+	for i := range rcpts {
+		b.WriteString("\r\n")
+		orcpt, _ := param(rcpts[i].Rcpt.PathParams, "ORCPT")
+		diagnostic := ""
+		if rcpts[i].Reply != "" {
+			diagnostic = "smtp; " + strings.Replace(rcpts[i].Reply, "\n", " ", -1)
+		}
+		remoteMTA := ""
+		if rcpts[i].RemoteMTA != "" {
+			remoteMTA = "dns; " + hostOnly(rcpts[i].RemoteMTA)
+		}
+		writeFields(&b,
+			"Original-Recipient", DecodeXtext(orcpt),
+			"Final-Recipient", "rfc822; "+rcpts[i].Rcpt.String(),
+			"Action", string(rcpts[i].Action),
+			"Status", rcpts[i].Status(),
+			"Remote-MTA", remoteMTA,
+			"Diagnostic-Code", diagnostic,
+			"Last-Attempt-Date", formatDate(rcpts[i].LastAttempt),
+			"Will-Retry-Until", formatDate(rcpts[i].WillRetryUntil),
+		)
+	}
+	b.WriteString("\r\n")
+
+	// the original message
+	b.WriteString("--" + boundary + "\r\n")
+	if ret, _ := param(r.MailFrom.PathParams, "RET"); strings.EqualFold(ret, "HDRS") {
+		writeFields(&b,
+			"Content-Description", "Undelivered Message Headers",
+			"Content-Type", "text/rfc822-headers",
+		)
+		b.WriteString("\r\n")
+		b.Write(headers(data))
+	} else {
+		writeFields(&b,
+			"Content-Description", "Undelivered Message",
+			"Content-Type", "message/rfc822",
+		)
+		b.WriteString("\r\n")
+		b.Write(data)
+	}
+	if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n--" + boundary + "--\r\n")
+	return b.Bytes(), nil
+}
+
+// Envelope returns an envelope for sending the notification to the sender of
+// the original message. The envelope has a null sender, so that it is never bounced itself.
+func (r *Report) Envelope(original io.Reader) (*mail.Envelope, error) {
+	data, err := r.Message(original)
+	if err != nil {
+		return nil, err
+	}
+	e := mail.NewEnvelope("127.0.0.1", 0)
+	e.Helo = r.ReportingMTA
+	e.ESMTP = true
+	e.MailFrom = mail.Address{NullPath: true}
+	rcpt := r.MailFrom
+	rcpt.PathParams = nil
+	e.RcptTo = []mail.Address{rcpt}
+	e.Data.Write(data)
+	return e, nil
+}
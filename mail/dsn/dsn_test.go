@@ -0,0 +1,197 @@
+package dsn
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const original = "Subject: hello\r\nFrom: <sender@example.com>\r\n\r\nThe body\r\n"
+
+func testReport() *Report {
+	return &Report{
+		ReportingMTA: "mx.grr.la",
+		MailFrom: mail.Address{User: "sender", Host: "example.com",
+			PathParams: [][]string{{"ENVID", "QQ314159+2B1"}}},
+		QueuedId:    "abc123",
+		ArrivalDate: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Recipients: []Recipient{
+			{
+				Rcpt: mail.Address{User: "nobody", Host: "grr.la",
+					PathParams: [][]string{{"ORCPT", "rfc822;Nobody+40grr.la"}}},
+				Action:    Failed,
+				Reply:     "550 5.1.1 No such user",
+				RemoteMTA: "mx.grr.la:25",
+			},
+			{
+				Rcpt:   mail.Address{User: "quiet", Host: "grr.la", PathParams: [][]string{{"notify", "never"}}},
+				Action: Failed,
+				Reply:  "550 5.1.1 No such user",
+			},
+		},
+	}
+}
+
+func TestMessage(t *testing.T) {
+	msg, err := testReport().Message(strings.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(msg)
+	for _, expect := range []string{
+		"To: <sender@example.com>\r\n",
+		"Subject: Undelivered Mail Returned to Sender\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"Content-Type: message/delivery-status\r\n",
+		"Reporting-MTA: dns; mx.grr.la\r\n",
+		"Original-Envelope-Id: QQ314159+1\r\n",
+		"Arrival-Date: Tue, 02 Jan 2024 03:04:05 +0000\r\n",
+		"Original-Recipient: rfc822;Nobody@grr.la\r\n",
+		"Final-Recipient: rfc822; nobody@grr.la\r\n",
+		"Action: failed\r\n",
+		"Status: 5.1.1\r\n",
+		"Remote-MTA: dns; mx.grr.la\r\n",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+		"Content-Type: message/rfc822\r\n",
+		"The body\r\n",
+	} {
+		if !strings.Contains(s, expect) {
+			t.Error("expecting the notification to contain", expect, "got:\n", s)
+		}
+	}
+	if strings.Contains(s, "quiet@grr.la") {
+		t.Error("recipient with NOTIFY=NEVER should not be reported")
+	}
+}
+
+func TestMessageHeadersOnly(t *testing.T) {
+	r := testReport()
+	r.MailFrom.PathParams = [][]string{{"RET", "HDRS"}}
+	msg, err := r.Message(strings.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(msg), "Content-Type: text/rfc822-headers\r\n") ||
+		!strings.Contains(string(msg), "Subject: hello\r\n") {
+		t.Error("expecting the headers to be returned, got:\n", string(msg))
+	}
+	if strings.Contains(string(msg), "The body") {
+		t.Error("not expecting the body to be returned with RET=HDRS")
+	}
+}
+
+func TestNoNotification(t *testing.T) {
+	r := testReport()
+	r.MailFrom = mail.Address{NullPath: true}
+	if _, err := r.Message(strings.NewReader(original)); err != ErrNullSender {
+		t.Error("expecting ErrNullSender, got", err)
+	}
+	r = testReport()
+	r.Recipients = r.Recipients[1:]
+	if _, err := r.Message(strings.NewReader(original)); err != ErrNoNotify {
+		t.Error("expecting ErrNoNotify, got", err)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	e, err := testReport().Envelope(strings.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.MailFrom.NullPath || e.MailFrom.String() != "" {
+		t.Error("expecting a null sender, got", e.MailFrom.String())
+	}
+	if len(e.RcptTo) != 1 || e.RcptTo[0].String() != "sender@example.com" || len(e.RcptTo[0].PathParams) != 0 {
+		t.Error("expecting the notification to be sent to the sender, got", e.RcptTo)
+	}
+	if !strings.Contains(e.Data.String(), "multipart/report") {
+		t.Error("expecting the data to be the notification")
+	}
+}
+
+func TestRequested(t *testing.T) {
+	rcpt := func(notify string) mail.Address {
+		if notify == "" {
+			return mail.Address{User: "a", Host: "grr.la"}
+		}
+		return mail.Address{User: "a", Host: "grr.la", PathParams: [][]string{{"NOTIFY", notify}}}
+	}
+	tests := []struct {
+		notify string
+		action Action
+		want   bool
+	}{
+		{"", Failed, true},
+		{"", Delayed, true},
+		{"", Delivered, false},
+		{"NEVER", Failed, false},
+		{"SUCCESS", Failed, false},
+		{"SUCCESS", Delivered, true},
+		{"SUCCESS,FAILURE", Failed, true},
+		{"failure", Delayed, false},
+		{"FAILURE,DELAY", Delayed, true},
+	}
+	for _, tt := range tests {
+		if got := Requested(rcpt(tt.notify), tt.action); got != tt.want {
+			t.Errorf("Requested(NOTIFY=%s, %s) = %v, want %v", tt.notify, tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestCheckParams(t *testing.T) {
+	tests := []struct {
+		params [][]string
+		mail   bool
+		valid  bool
+	}{
+		{[][]string{{"SIZE", "100"}, {"BODY", "8BITMIME"}}, true, true},
+		{[][]string{{"RET", "FULL"}, {"ENVID", "QQ+2B314"}}, true, true},
+		{[][]string{{"RET", "hdrs"}}, true, true},
+		{[][]string{{"RET", "BODY"}}, true, false},
+		{[][]string{{"RET"}}, true, false},
+		{[][]string{{"RET", "FULL"}, {"ret", "HDRS"}}, true, false},
+		{[][]string{{"ENVID", ""}}, true, false},
+		{[][]string{{"ENVID", "a=b"}}, true, false},
+		{[][]string{{"ENVID", "a+2"}}, true, false},
+		{[][]string{{"ENVID", "a+2b"}}, true, false},
+		{[][]string{{"ENVID", strings.Repeat("a", 101)}}, true, false},
+		{[][]string{{"NOTIFY", "NEVER"}}, false, true},
+		{[][]string{{"NOTIFY", "success,FAILURE,DELAY"}, {"ORCPT", "rfc822;a+40grr.la"}}, false, true},
+		{[][]string{{"NOTIFY", "NEVER,FAILURE"}}, false, false},
+		{[][]string{{"NOTIFY", "FAILURE,"}}, false, false},
+		{[][]string{{"NOTIFY", ""}}, false, false},
+		{[][]string{{"ORCPT", "a@grr.la"}}, false, false},
+		{[][]string{{"ORCPT", ";a@grr.la"}}, false, false},
+		{[][]string{{"ORCPT", "rfc822;"}}, false, false},
+		{[][]string{{"ORCPT", "rfc822;a b"}}, false, false},
+	}
+	for _, tt := range tests {
+		check := CheckRcptParams
+		if tt.mail {
+			check = CheckMailParams
+		}
+		if err := check(tt.params); (err == nil) != tt.valid {
+			t.Errorf("check(%v) = %v, want valid %v", tt.params, err, tt.valid)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		r    Recipient
+		want string
+	}{
+		{Recipient{Action: Failed, Reply: "550 5.1.1 No such user"}, "5.1.1"},
+		{Recipient{Action: Failed, Reply: "554 Error: could not save email"}, "5.0.0"},
+		{Recipient{Action: Delayed, Reply: "451 try again later"}, "4.0.0"},
+		{Recipient{Action: Delayed}, "4.0.0"},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Status(); got != tt.want {
+			t.Errorf("Status(%q) = %s, want %s", tt.r.Reply, got, tt.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/mime"
 )
 
 // This will use the golang.org/x/net/html/charset encoder
@@ -83,3 +84,14 @@ func TestEncodingMimeHeaderDecodeMulti(t *testing.T) {
 		t.Error("expecting 【本日削除】実は不採用のネタの方が多いです, got:", str)
 	}
 }
+
+// TestEncodingMimeParse tests that the parts are converted with the registered charset reader
+func TestEncodingMimeParse(t *testing.T) {
+	root, err := mime.Parse(strings.NewReader("Content-Type: text/plain; charset=windows-1252\r\n\r\n\x93quoted\x94"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.UTF8 || string(root.Body) != "“quoted”" {
+		t.Error("expecting “quoted”, got:", string(root.Body))
+	}
+}
@@ -3,6 +3,7 @@ package mail
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -129,8 +130,8 @@ type Envelope struct {
 	MailFrom Address
 	// Recipients
 	RcptTo []Address
-	// Data stores the header and message body
-	Data bytes.Buffer
+	// Data stores the header and message body, see Body
+	Data Body
 	// Subject stores the subject of the email, extracted and decoded after calling ParseHeaders()
 	Subject string
 	// TLS is true if the email was received using a TLS connection
@@ -149,6 +150,8 @@ type Envelope struct {
 	ESMTP bool
 	// When locked, it means that the envelope is being processed by the backend
 	sync.Mutex
+	// ctx is the context of the transaction, see Context()
+	ctx context.Context
 }
 
 func NewEnvelope(remoteAddr string, clientID uint64) *Envelope {
@@ -180,11 +183,10 @@ func (e *Envelope) ParseHeaders() error {
 	if e.Header != nil {
 		return errors.New("headers already parsed")
 	}
-	buf := e.Data.Bytes()
 	// find where the header ends, assuming that over 30 kb would be max
-	if len(buf) > maxHeaderChunk {
-		buf = buf[:maxHeaderChunk]
-	}
+	buf := make([]byte, maxHeaderChunk)
+	n, _ := e.Data.NewReader().ReadAt(buf, 0)
+	buf = buf[:n]
 
 	headerEnd := bytes.Index(buf, []byte{'\n', '\n'}) // the first two new-lines chars are the End Of Header
 	if headerEnd > -1 {
@@ -212,12 +214,13 @@ func (e *Envelope) Len() int {
 func (e *Envelope) NewReader() io.Reader {
 	return io.MultiReader(
 		strings.NewReader(e.DeliveryHeader),
-		bytes.NewReader(e.Data.Bytes()),
+		e.Data.NewReader(),
 	)
 }
 
 // String converts the email to string.
-// Typically, you would want to use the compressor guerrilla.Processor for more efficiency, or use NewReader
+// Typically, you would want to use the compressor guerrilla.Processor for more efficiency, or use NewReader.
+// A large message is read from its temporary file, see Body
 func (e *Envelope) String() string {
 	return e.DeliveryHeader + e.Data.String()
 }
@@ -241,6 +244,22 @@ func (e *Envelope) ResetTransaction() {
 	e.Hashes = make([]string, 0)
 	e.DeliveryHeader = ""
 	e.Values = make(map[string]interface{})
+	e.ctx = nil
+}
+
+// Context returns the context of the transaction. It is cancelled when the transaction
+// is abandoned, eg. when the client disconnected or the backend timed out.
+// It is never nil, the background context is returned if none was set
+func (e *Envelope) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// SetContext sets the context of the transaction
+func (e *Envelope) SetContext(ctx context.Context) {
+	e.ctx = ctx
 }
 
 // Reseed is called when used with a new connection, once it's accepted
@@ -0,0 +1,469 @@
+// Package mime parses messages (RFC 2045, RFC 2046) into a tree of parts, with the bodies
+// decoded from their transfer encoding, and text converted to UTF-8.
+//
+// Charsets other than UTF-8, US-ASCII and ISO-8859-1 are converted with the
+// mail.Dec.CharsetReader, import the mail/encoding or mail/iconv package to set it.
+// The parser is lenient: the parts of a malformed message that could be read are kept,
+// and the error is recorded in the part where it happened.
+//
+// The decoded bodies are read into memory. Options limit the size of each part and of all
+// the bodies of a message, larger bodies are truncated.
+package mime
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	// DefaultMaxDepth is the default limit of nested multiparts and messages
+	DefaultMaxDepth = 16
+	// DefaultMaxParts is the default limit of parts in a message
+	DefaultMaxParts = 1000
+	// DefaultMaxPartSize is the default limit of the decoded size of a part
+	DefaultMaxPartSize = 32 << 20 // 32MB
+	// DefaultMaxSize is the default limit of the decoded size of all the parts
+	DefaultMaxSize = 64 << 20 // 64MB
+)
+
+var (
+	ErrTooDeep      = errors.New("mime: too many nested parts")
+	ErrTooManyParts = errors.New("mime: too many parts")
+	ErrPartTooBig   = errors.New("mime: part is too big, body truncated")
+	ErrTooBig       = errors.New("mime: message is too big, body truncated")
+	ErrNoBoundary   = errors.New("mime: multipart without a boundary")
+	ErrNotLocated   = errors.New("mime: the parts do not match the message")
+)
+
+// Options limit the resources used for parsing, zero values use the defaults
+type Options struct {
+	MaxDepth    int
+	MaxParts    int
+	MaxPartSize int64
+	// MaxSize limits the bodies of all the parts together, the bodies after it is
+	// reached are truncated
+	MaxSize int64
+}
+
+// Part is a node of the tree. A multipart has the sub-parts, a message/rfc822 has
+// the parsed message as its only sub-part, other parts have a body
+type Part struct {
+	// Path is the position of the part in the tree, as in IMAP, eg. "1.2". It is empty for the root
+	Path   string
+	Header textproto.MIMEHeader
+	// ContentType is the lower-cased media type, eg. "text/plain"
+	ContentType string
+	// Params are the parameters of the Content-Type header
+	Params map[string]string
+	// Charset is the charset parameter as given, lower-cased
+	Charset string
+	// TransferEncoding is the lower-cased Content-Transfer-Encoding
+	TransferEncoding string
+	// Disposition is "inline", "attachment" or empty
+	Disposition string
+	// Filename is from Content-Disposition, or the name parameter of Content-Type
+	Filename string
+	// Body is transfer-decoded, and converted to UTF-8 for text if UTF8 is true.
+	// The body of a message/rfc822 is only kept if it is an attachment, its parsed
+	// message is in Parts
+	Body []byte
+	// Raw is the transfer-decoded body before the charset conversion, it is Body for
+	// parts that are not text, or already in UTF-8
+	Raw []byte
+	// UTF8 is true if Body is text in UTF-8
+	UTF8 bool
+	// Size is the length of the decoded body
+	Size int64
+	// Truncated is true if the body was larger than MaxPartSize, or MaxSize was reached
+	Truncated bool
+	Parts     []*Part
+	// Err is set if the part could not be fully parsed, the sub-parts before the error are kept
+	Err error
+	// Offset, BodyOffset and End are the positions of the header, the body, and the end of the
+	// part in the message, set by Locate. End is 0 if the part could not be located
+	Offset, BodyOffset, End int
+}
+
+// IsMultipart returns true for multipart/* parts
+func (p *Part) IsMultipart() bool {
+	return strings.HasPrefix(p.ContentType, "multipart/")
+}
+
+// IsAttachment returns true if the part is a file, and not the text of the message
+func (p *Part) IsAttachment() bool {
+	if p.IsMultipart() {
+		return false
+	}
+	return p.Disposition == "attachment" || p.Filename != ""
+}
+
+// Walk calls fn for the part and its sub-parts, depth first. It stops at the first error
+func (p *Part) Walk(fn func(*Part) error) error {
+	if err := fn(p); err != nil {
+		return err
+	}
+	for _, sub := range p.Parts {
+		if err := sub.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attachments returns the parts that are attachments, in the order they appear
+func (p *Part) Attachments() []*Part {
+	var attachments []*Part
+	_ = p.Walk(func(part *Part) error {
+		if part.IsAttachment() {
+			attachments = append(attachments, part)
+		}
+		return nil
+	})
+	return attachments
+}
+
+// Errors returns the errors of the part and its sub-parts
+func (p *Part) Errors() []error {
+	var errs []error
+	_ = p.Walk(func(part *Part) error {
+		if part.Err != nil {
+			errs = append(errs, part.Err)
+		}
+		return nil
+	})
+	return errs
+}
+
+// Locate sets the positions of the parts in the message, which must be what was parsed.
+// The parts of a message/rfc822 that has a transfer encoding cannot be located
+func (p *Part) Locate(message []byte) error {
+	return p.locate(message, 0, len(message))
+}
+
+func (p *Part) locate(m []byte, start, end int) error {
+	p.Offset, p.End = start, end
+	p.BodyOffset = end
+	if i := headerEnd(m[start:end]); i >= 0 {
+		p.BodyOffset = start + i
+	}
+	switch {
+	case p.IsMultipart() && len(p.Parts) > 0:
+		delim := []byte("--" + p.Params["boundary"])
+		i, n := p.BodyOffset, 0
+		partStart := -1
+		for i < end {
+			lineEnd := bytes.IndexByte(m[i:end], '\n')
+			if lineEnd < 0 {
+				lineEnd = end
+			} else {
+				lineEnd += i + 1
+			}
+			if line := m[i:lineEnd]; bytes.HasPrefix(line, delim) {
+				rest := bytes.TrimRight(line[len(delim):], " \t\r\n")
+				if len(rest) == 0 || bytes.Equal(rest, []byte("--")) {
+					if partStart >= 0 {
+						// the line break before the delimiter belongs to it
+						partEnd := i - 1
+						if partEnd > partStart && m[partEnd-1] == '\r' {
+							partEnd--
+						}
+						if partEnd < partStart {
+							partEnd = partStart
+						}
+						if n >= len(p.Parts) {
+							return ErrNotLocated
+						}
+						if err := p.Parts[n].locate(m, partStart, partEnd); err != nil {
+							return err
+						}
+						n++
+					}
+					if len(rest) > 0 {
+						break
+					}
+					partStart = lineEnd
+				}
+			}
+			i = lineEnd
+		}
+		if n != len(p.Parts) {
+			return ErrNotLocated
+		}
+	case len(p.Parts) == 1 && (p.TransferEncoding == "" || p.TransferEncoding == "7bit" ||
+		p.TransferEncoding == "8bit" || p.TransferEncoding == "binary"):
+		return p.Parts[0].locate(m, p.BodyOffset, end)
+	}
+	return nil
+}
+
+// headerEnd returns the position after the blank line that ends the header, or -1
+func headerEnd(b []byte) int {
+	if len(b) > 0 && b[0] == '\n' {
+		return 1
+	}
+	if bytes.HasPrefix(b, []byte("\r\n")) {
+		return 2
+	}
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\n' {
+			continue
+		}
+		if bytes.HasPrefix(b[i+1:], []byte("\n")) {
+			return i + 2
+		}
+		if bytes.HasPrefix(b[i+1:], []byte("\r\n")) {
+			return i + 3
+		}
+	}
+	return -1
+}
+
+type parser struct {
+	options Options
+	parts   int
+	// size is the decoded size of the bodies read so far
+	size int64
+}
+
+// Parse reads the message and returns the root of its tree. An error is only returned if the
+// header could not be read, other errors are recorded in the parts
+func Parse(r io.Reader, options *Options) (*Part, error) {
+	p := &parser{}
+	if options != nil {
+		p.options = *options
+	}
+	if p.options.MaxDepth <= 0 {
+		p.options.MaxDepth = DefaultMaxDepth
+	}
+	if p.options.MaxParts <= 0 {
+		p.options.MaxParts = DefaultMaxParts
+	}
+	if p.options.MaxPartSize <= 0 {
+		p.options.MaxPartSize = DefaultMaxPartSize
+	}
+	if p.options.MaxSize <= 0 {
+		p.options.MaxSize = DefaultMaxSize
+	}
+	return p.parseMessage(bufio.NewReader(r), "", 0)
+}
+
+// parseMessage reads the header, then the body of a message
+func (p *parser) parseMessage(r *bufio.Reader, path string, depth int) (*Part, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(header) > 0) {
+		return nil, err
+	}
+	part := &Part{Path: path}
+	p.parseHeader(part, header, "text/plain")
+	p.parseBody(part, r, depth)
+	return part, nil
+}
+
+// parseHeader fills the fields of the part from its header
+func (p *parser) parseHeader(part *Part, header textproto.MIMEHeader, defaultType string) {
+	part.Header = header
+	part.ContentType = defaultType
+	if ct := header.Get("Content-Type"); ct != "" {
+		mediaType, params, err := mime.ParseMediaType(ct)
+		if err == nil || err == mime.ErrInvalidMediaParameter {
+			part.ContentType, part.Params = strings.ToLower(mediaType), params
+		}
+	}
+	if part.Params == nil {
+		part.Params = make(map[string]string)
+	}
+	part.Charset = strings.ToLower(part.Params["charset"])
+	part.TransferEncoding = strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+	if cd := header.Get("Content-Disposition"); cd != "" {
+		disposition, params, err := mime.ParseMediaType(cd)
+		if err == nil || err == mime.ErrInvalidMediaParameter {
+			part.Disposition = strings.ToLower(disposition)
+			part.Filename = params["filename"]
+		}
+	}
+	if part.Filename == "" {
+		part.Filename = part.Params["name"]
+	}
+	// some clients use RFC 2047 encoded words, rather than RFC 2231
+	part.Filename = mail.MimeHeaderDecode(part.Filename)
+}
+
+// parseBody reads the body of the part, or its sub-parts
+func (p *parser) parseBody(part *Part, r io.Reader, depth int) {
+	switch {
+	case part.IsMultipart():
+		if depth >= p.options.MaxDepth {
+			part.Err = ErrTooDeep
+			return
+		}
+		p.parseMultipart(part, r, depth)
+	case part.ContentType == "message/rfc822" || part.ContentType == "message/global":
+		p.readBody(part, r)
+		if part.Err != nil {
+			return
+		}
+		if depth >= p.options.MaxDepth {
+			part.Err = ErrTooDeep
+			return
+		}
+		if err := p.count(); err != nil {
+			part.Err = err
+			return
+		}
+		body := part.Body
+		if !part.IsAttachment() {
+			// the parsed message holds the same data
+			part.Body, part.Raw = nil, nil
+			p.size -= int64(len(body))
+		}
+		sub, err := p.parseMessage(bufio.NewReader(bytes.NewReader(body)), p.subPath(part, 1), depth+1)
+		if err != nil {
+			part.Err = err
+			return
+		}
+		part.Parts = append(part.Parts, sub)
+	default:
+		p.readBody(part, r)
+	}
+}
+
+func (p *parser) subPath(part *Part, i int) string {
+	if part.Path == "" {
+		return strconv.Itoa(i)
+	}
+	return part.Path + "." + strconv.Itoa(i)
+}
+
+func (p *parser) count() error {
+	p.parts++
+	if p.parts > p.options.MaxParts {
+		return ErrTooManyParts
+	}
+	return nil
+}
+
+func (p *parser) parseMultipart(part *Part, r io.Reader, depth int) {
+	boundary := part.Params["boundary"]
+	if boundary == "" {
+		part.Err = ErrNoBoundary
+		p.readBody(part, r)
+		return
+	}
+	mr := multipart.NewReader(r, boundary)
+	// the default type of the parts of a multipart/digest is message/rfc822
+	defaultType := "text/plain"
+	if part.ContentType == "multipart/digest" {
+		defaultType = "message/rfc822"
+	}
+	for i := 1; ; i++ {
+		// NextRawPart does not remove the Content-Transfer-Encoding
+		mp, err := mr.NextRawPart()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			part.Err = err
+			return
+		}
+		if err = p.count(); err != nil {
+			part.Err = err
+			return
+		}
+		sub := &Part{Path: p.subPath(part, i)}
+		p.parseHeader(sub, mp.Header, defaultType)
+		p.parseBody(sub, mp, depth+1)
+		part.Parts = append(part.Parts, sub)
+		if sub.Err == ErrTooManyParts || sub.Err == ErrTooBig {
+			part.Err = sub.Err
+			return
+		}
+	}
+}
+
+// readBody reads and decodes the body of the part
+func (p *parser) readBody(part *Part, r io.Reader) {
+	switch part.TransferEncoding {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r})
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	limit, limitErr := p.options.MaxPartSize, ErrPartTooBig
+	if left := p.options.MaxSize - p.size; left < limit {
+		limit, limitErr = max(left, 0), ErrTooBig
+	}
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if int64(len(body)) > limit {
+		body, part.Truncated = body[:limit], true
+		part.Err = limitErr
+	} else if err != nil {
+		part.Err = err
+	}
+	part.Body, part.Raw, part.Size = body, body, int64(len(body))
+	if strings.HasPrefix(part.ContentType, "text/") {
+		part.Body, part.UTF8 = toUTF8(part.Charset, part.Body)
+		part.Size = int64(len(part.Body))
+		if len(body) > 0 && len(part.Body) > 0 && &body[0] != &part.Body[0] {
+			// the raw body is kept too
+			p.size += int64(len(body))
+		}
+	}
+	p.size += part.Size
+}
+
+// toUTF8 converts the text, ok is false if the charset is not supported
+func toUTF8(charset string, text []byte) ([]byte, bool) {
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return text, true
+	}
+	if mail.Dec.CharsetReader != nil {
+		if r, err := mail.Dec.CharsetReader(charset, bytes.NewReader(text)); err == nil {
+			if converted, err := io.ReadAll(r); err == nil {
+				return converted, true
+			}
+		}
+		return text, false
+	}
+	switch charset {
+	case "iso-8859-1", "latin1":
+		converted := make([]rune, len(text))
+		for i := range text {
+			converted[i] = rune(text[i])
+		}
+		return []byte(string(converted)), true
+	}
+	return text, false
+}
+
+// base64Cleaner drops the characters that are not part of the base64 alphabet,
+// such as white space, which some clients add
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '+' || b == '/' || b == '=' {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
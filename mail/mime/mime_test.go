@@ -0,0 +1,168 @@
+package mime
+
+import (
+	"strings"
+	"testing"
+)
+
+const multipartMail = "From: test@example.com\r\n" +
+	"Subject: parts\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Andr=E9 says hi\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>hi</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=\"=?UTF-8?Q?r=C3=A9sum=C3=A9.bin?=\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"AwQF\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"Content-Disposition: attachment; filename*=UTF-8''forwarded%20mail.eml\r\n" +
+	"\r\n" +
+	"Subject: inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"forwarded\r\n" +
+	"--outer--\r\n"
+
+func TestParse(t *testing.T) {
+	root, err := Parse(strings.NewReader(multipartMail), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := root.Errors(); len(errs) != 0 {
+		t.Fatal("unexpected errors", errs)
+	}
+	if root.ContentType != "multipart/mixed" || len(root.Parts) != 3 || root.Header.Get("Subject") != "parts" {
+		t.Fatal("unexpected root", root)
+	}
+	alternative := root.Parts[0]
+	if alternative.Path != "1" || len(alternative.Parts) != 2 {
+		t.Fatal("unexpected alternative part", alternative)
+	}
+	text := alternative.Parts[0]
+	if text.Path != "1.1" || string(text.Body) != "André says hi" || string(text.Raw) != "Andr\xe9 says hi" ||
+		!text.UTF8 || text.Charset != "iso-8859-1" {
+		t.Errorf("unexpected text part %q %+v", text.Body, text)
+	}
+	if html := alternative.Parts[1]; html.ContentType != "text/html" || string(html.Body) != "<p>hi</p>" {
+		t.Errorf("unexpected html part %q", html.Body)
+	}
+	bin := root.Parts[1]
+	if bin.Filename != "résumé.bin" || bin.Size != 6 || string(bin.Body) != "\x00\x01\x02\x03\x04\x05" {
+		t.Errorf("unexpected attachment %q %+v", bin.Body, bin)
+	}
+	msg := root.Parts[2]
+	if msg.Filename != "forwarded mail.eml" || len(msg.Parts) != 1 {
+		t.Fatal("unexpected message part", msg)
+	}
+	if inner := msg.Parts[0]; inner.Path != "3.1" || inner.Header.Get("Subject") != "inner" ||
+		string(inner.Body) != "forwarded" {
+		t.Errorf("unexpected forwarded message %q %+v", inner.Body, inner)
+	}
+	attachments := root.Attachments()
+	if len(attachments) != 2 || attachments[0] != bin || attachments[1] != msg {
+		t.Error("unexpected attachments", attachments)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	// the closing boundary is missing, the parts that were read are kept
+	truncated := multipartMail[:strings.Index(multipartMail, "--outer\r\nContent-Type: message/rfc822")]
+	root, err := Parse(strings.NewReader(truncated), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Parts) != 2 || root.Err == nil {
+		t.Error("expecting 2 parts and an error, got", len(root.Parts), root.Err)
+	}
+
+	root, _ = Parse(strings.NewReader(multipartMail), &Options{MaxParts: 3})
+	if root.Err != ErrTooManyParts {
+		t.Error("expecting too many parts, got", root.Err)
+	}
+	root, _ = Parse(strings.NewReader(multipartMail), &Options{MaxDepth: 1})
+	if root.Parts[0].Err != ErrTooDeep {
+		t.Error("expecting too deep, got", root.Parts[0].Err)
+	}
+	root, _ = Parse(strings.NewReader(multipartMail), &Options{MaxPartSize: 4})
+	if bin := root.Parts[1]; !bin.Truncated || bin.Size != 4 || bin.Err != ErrPartTooBig {
+		t.Error("expecting the attachment to be truncated", bin)
+	}
+	// the text parts take 36 bytes with the raw ISO-8859-1 text, 2 are left for the attachment
+	root, _ = Parse(strings.NewReader(multipartMail), &Options{MaxSize: 38})
+	if root.Err != ErrTooBig || len(root.Parts) != 2 {
+		t.Fatal("expecting the message to be too big, got", root.Err, len(root.Parts))
+	}
+	if bin := root.Parts[1]; !bin.Truncated || bin.Size != 2 || bin.Err != ErrTooBig {
+		t.Error("expecting the attachment to be truncated", bin)
+	}
+}
+
+func TestParseInlineMessage(t *testing.T) {
+	inline := strings.Replace(multipartMail,
+		"Content-Disposition: attachment; filename*=UTF-8''forwarded%20mail.eml\r\n", "", 1)
+	root, err := Parse(strings.NewReader(inline), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the body is only in the parsed message
+	msg := root.Parts[2]
+	if msg.Body != nil || msg.Size == 0 || len(msg.Parts) != 1 || string(msg.Parts[0].Body) != "forwarded" {
+		t.Errorf("unexpected message part %q %+v", msg.Body, msg)
+	}
+}
+
+func TestParseSinglePart(t *testing.T) {
+	root, err := Parse(strings.NewReader("Subject: plain\r\n\r\nhello\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.ContentType != "text/plain" || string(root.Body) != "hello\r\n" || root.IsAttachment() || root.Path != "" {
+		t.Error("unexpected part", root)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	for _, message := range []string{multipartMail, strings.ReplaceAll(multipartMail, "\r\n", "\n")} {
+		root, err := Parse(strings.NewReader(message), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = root.Locate([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		bin := root.Parts[1]
+		if raw := message[bin.Offset:bin.End]; !strings.HasPrefix(raw, "Content-Type: application/octet-stream") ||
+			!strings.HasSuffix(raw, "AwQF") {
+			t.Errorf("unexpected attachment %q", raw)
+		}
+		if body := message[bin.BodyOffset:bin.End]; strings.ReplaceAll(body, "\r", "") != "AAEC\nAwQF" {
+			t.Errorf("unexpected attachment body %q", body)
+		}
+		html := root.Parts[0].Parts[1]
+		if raw := message[html.BodyOffset:html.End]; raw != "<p>hi</p>" {
+			t.Errorf("unexpected html body %q", raw)
+		}
+		inner := root.Parts[2].Parts[0]
+		if raw := message[inner.Offset:inner.End]; !strings.HasPrefix(raw, "Subject: inner") ||
+			!strings.HasSuffix(raw, "forwarded") {
+			t.Errorf("unexpected forwarded message %q", raw)
+		}
+	}
+}
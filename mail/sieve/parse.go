@@ -0,0 +1,442 @@
+package sieve
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenPunct
+)
+
+type token struct {
+	typ  tokenType
+	text string
+	num  int64
+	line int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokenEOF:
+		return "end of script"
+	case tokenTag:
+		return ":" + t.text
+	case tokenString:
+		return strconv.Quote(t.text)
+	case tokenNumber:
+		return strconv.FormatInt(t.num, 10)
+	}
+	return t.text
+}
+
+// lexer splits a script into tokens (RFC 5228 section 8.1)
+type lexer struct {
+	r    *bufio.Reader
+	line int
+}
+
+func (l *lexer) errorf(format string, a ...interface{}) error {
+	return &Error{Line: l.line, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (l *lexer) read() (byte, bool) {
+	c, err := l.r.ReadByte()
+	if err != nil {
+		return 0, false
+	}
+	if c == '\n' {
+		l.line++
+	}
+	return c, true
+}
+
+func (l *lexer) unread(c byte) {
+	_ = l.r.UnreadByte()
+	if c == '\n' {
+		l.line--
+	}
+}
+
+func (l *lexer) peek() (byte, bool) {
+	b, err := l.r.Peek(1)
+	if err != nil {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// skip skips white space and comments
+func (l *lexer) skip() error {
+	for {
+		c, ok := l.read()
+		if !ok {
+			return nil
+		}
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case c == '#':
+			for c != '\n' {
+				if c, ok = l.read(); !ok {
+					return nil
+				}
+			}
+		case c == '/':
+			if next, _ := l.peek(); next != '*' {
+				return l.errorf("unexpected character '/'")
+			}
+			l.read()
+			var prev byte
+			for {
+				if c, ok = l.read(); !ok {
+					return l.errorf("unterminated comment")
+				}
+				if prev == '*' && c == '/' {
+					break
+				}
+				prev = c
+			}
+		default:
+			l.unread(c)
+			return nil
+		}
+	}
+}
+
+func (l *lexer) word() string {
+	var b strings.Builder
+	for {
+		c, ok := l.read()
+		if !ok {
+			break
+		}
+		if !isAlpha(c) && !isDigit(c) {
+			l.unread(c)
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skip(); err != nil {
+		return token{}, err
+	}
+	line := l.line
+	c, ok := l.read()
+	if !ok {
+		return token{typ: tokenEOF, line: line}, nil
+	}
+	switch {
+	case isAlpha(c):
+		l.unread(c)
+		word := l.word()
+		if strings.EqualFold(word, "text") {
+			if next, _ := l.peek(); next == ':' {
+				l.read()
+				s, err := l.multiline()
+				return token{typ: tokenString, text: s, line: line}, err
+			}
+		}
+		return token{typ: tokenIdentifier, text: strings.ToLower(word), line: line}, nil
+	case c == ':':
+		if next, _ := l.peek(); !isAlpha(next) {
+			return token{}, l.errorf("invalid tag")
+		}
+		return token{typ: tokenTag, text: strings.ToLower(l.word()), line: line}, nil
+	case isDigit(c):
+		l.unread(c)
+		digits := l.word()
+		mult := int64(1)
+		switch digits[len(digits)-1] {
+		case 'K', 'k':
+			mult = 1 << 10
+		case 'M', 'm':
+			mult = 1 << 20
+		case 'G', 'g':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			digits = digits[:len(digits)-1]
+		}
+		n, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil || n > (1<<62)/mult {
+			return token{}, l.errorf("invalid number %s", digits)
+		}
+		return token{typ: tokenNumber, num: n * mult, line: line}, nil
+	case c == '"':
+		s, err := l.quoted()
+		return token{typ: tokenString, text: s, line: line}, err
+	case strings.IndexByte(";,()[]{}", c) != -1:
+		return token{typ: tokenPunct, text: string(c), line: line}, nil
+	}
+	return token{}, l.errorf("unexpected character %q", c)
+}
+
+// quoted reads a quoted string, only \" and \\ are escapes, a backslash before
+// any other character is removed
+func (l *lexer) quoted() (string, error) {
+	var b strings.Builder
+	for {
+		c, ok := l.read()
+		if !ok {
+			return "", l.errorf("unterminated string")
+		}
+		switch c {
+		case '"':
+			return normalizeNewlines(b.String()), nil
+		case '\\':
+			if c, ok = l.read(); !ok {
+				return "", l.errorf("unterminated string")
+			}
+		}
+		b.WriteByte(c)
+	}
+}
+
+// multiline reads a text: string, up to a line with a single dot. Lines starting
+// with a dot have it doubled
+func (l *lexer) multiline() (string, error) {
+	// the rest of the line after text: can only have white space or a comment
+	for {
+		c, ok := l.read()
+		if !ok {
+			return "", l.errorf("unterminated multi-line string")
+		}
+		if c == '\n' {
+			break
+		}
+		if c == '#' {
+			for c != '\n' {
+				if c, ok = l.read(); !ok {
+					return "", l.errorf("unterminated multi-line string")
+				}
+			}
+			break
+		}
+		if c != ' ' && c != '\t' && c != '\r' {
+			return "", l.errorf("unexpected %q after text:", c)
+		}
+	}
+	var b strings.Builder
+	for {
+		line, err := l.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if strings.HasSuffix(line, "\n") {
+			l.line++
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "." {
+			return b.String(), nil
+		}
+		if err == io.EOF {
+			return "", l.errorf("unterminated multi-line string")
+		}
+		trimmed = strings.TrimPrefix(trimmed, ".")
+		b.WriteString(trimmed + "\r\n")
+	}
+}
+
+// normalizeNewlines makes all the line endings of a string CRLF
+func normalizeNewlines(s string) string {
+	if !strings.Contains(s, "\n") {
+		return s
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// argument is a tag, a number or a string list
+type argument struct {
+	tok     token
+	strings []string
+}
+
+// node is a command or a test, as parsed
+type node struct {
+	name  string
+	line  int
+	args  []argument
+	tests []*node
+	block []*node
+	// hasBlock is set when the command has a block, even if it is empty
+	hasBlock bool
+}
+
+type parser struct {
+	lex *lexer
+	tok token
+}
+
+func (p *parser) advance() error {
+	var err error
+	p.tok, err = p.lex.next()
+	return err
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return &Error{Line: p.tok.line, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (p *parser) isPunct(s string) bool {
+	return p.tok.typ == tokenPunct && p.tok.text == s
+}
+
+func (p *parser) expect(s string) error {
+	if !p.isPunct(s) {
+		return p.errorf("expecting %s, got %s", s, p.tok)
+	}
+	return p.advance()
+}
+
+// commands parses commands until the end of a block or the script
+func (p *parser) commands() ([]*node, error) {
+	var cmds []*node
+	for p.tok.typ != tokenEOF && !p.isPunct("}") {
+		if p.tok.typ != tokenIdentifier {
+			return nil, p.errorf("expecting a command, got %s", p.tok)
+		}
+		cmd := &node{name: p.tok.text, line: p.tok.line}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if err := p.arguments(cmd); err != nil {
+			return nil, err
+		}
+		if p.isPunct("{") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			block, err := p.commands()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("}"); err != nil {
+				return nil, err
+			}
+			cmd.block, cmd.hasBlock = block, true
+		} else if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// arguments parses the arguments of a command or a test, then its tests
+func (p *parser) arguments(n *node) error {
+	for {
+		switch {
+		case p.tok.typ == tokenTag || p.tok.typ == tokenNumber:
+			n.args = append(n.args, argument{tok: p.tok})
+			if err := p.advance(); err != nil {
+				return err
+			}
+			continue
+		case p.tok.typ == tokenString:
+			n.args = append(n.args, argument{tok: p.tok, strings: []string{p.tok.text}})
+			if err := p.advance(); err != nil {
+				return err
+			}
+			continue
+		case p.isPunct("["):
+			arg := argument{tok: p.tok}
+			if err := p.advance(); err != nil {
+				return err
+			}
+			for {
+				if p.tok.typ != tokenString {
+					return p.errorf("expecting a string, got %s", p.tok)
+				}
+				arg.strings = append(arg.strings, p.tok.text)
+				if err := p.advance(); err != nil {
+					return err
+				}
+				if !p.isPunct(",") {
+					break
+				}
+				if err := p.advance(); err != nil {
+					return err
+				}
+			}
+			if err := p.expect("]"); err != nil {
+				return err
+			}
+			n.args = append(n.args, arg)
+			continue
+		}
+		break
+	}
+	switch {
+	case p.tok.typ == tokenIdentifier:
+		t, err := p.test()
+		if err != nil {
+			return err
+		}
+		n.tests = []*node{t}
+	case p.isPunct("("):
+		for {
+			if err := p.advance(); err != nil {
+				return err
+			}
+			t, err := p.test()
+			if err != nil {
+				return err
+			}
+			n.tests = append(n.tests, t)
+			if !p.isPunct(",") {
+				break
+			}
+		}
+		return p.expect(")")
+	}
+	return nil
+}
+
+func (p *parser) test() (*node, error) {
+	if p.tok.typ != tokenIdentifier {
+		return nil, p.errorf("expecting a test, got %s", p.tok)
+	}
+	t := &node{name: p.tok.text, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	return t, p.arguments(t)
+}
+
+// parse returns the commands of a script
+func parse(r io.Reader) ([]*node, error) {
+	p := &parser{lex: &lexer{r: bufio.NewReader(r), line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.typ != tokenEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return cmds, nil
+}
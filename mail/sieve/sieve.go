@@ -0,0 +1,870 @@
+// Package sieve is an interpreter of Sieve mail filtering scripts (RFC 5228).
+//
+// The keep, discard, redirect and stop commands, and the fileinto, envelope, body (RFC 5173),
+// variables (RFC 5229) and reject (RFC 5429) extensions are supported, with the i;octet
+// and i;ascii-casemap comparators. Running a script does not deliver anything, it returns
+// the actions to take, which are up to the caller.
+package sieve
+
+import (
+	"fmt"
+	"io"
+	netmail "net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+// MaxRedirects is the limit of redirect actions that a script may take for a message
+const MaxRedirects = 10
+
+// Error is a syntax error of a script, or an error when running it
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("sieve: line %d: %s", e.Line, e.Msg)
+}
+
+// ActionType is the type of an action taken by a script
+type ActionType string
+
+const (
+	Keep     ActionType = "keep"
+	FileInto ActionType = "fileinto"
+	Redirect ActionType = "redirect"
+	Discard  ActionType = "discard"
+	Reject   ActionType = "reject"
+)
+
+// Action is an action taken by a script
+type Action struct {
+	Type ActionType
+	// Arg is the folder of fileinto, the address of redirect, or the reason of reject
+	Arg string
+	// Implicit is set for the keep taken when no action cancelled it
+	Implicit bool
+}
+
+// Result is the actions taken by a script, in order
+type Result struct {
+	Actions []Action
+}
+
+// Part is a part of the message for the body test
+type Part struct {
+	// ContentType is the media type of the part, eg. text/plain
+	ContentType string
+	// Text is the decoded content of the part
+	Text string
+}
+
+// Message is the message a script is run against
+type Message struct {
+	Header textproto.MIMEHeader
+	// From is the envelope sender, empty for the null sender
+	From string
+	// To is the envelope recipient the script is run for
+	To string
+	// Size is the size of the message, in bytes
+	Size int64
+	// Body is the body of the message as received, for body :raw
+	Body string
+	// Parts are the leaf parts of the message, for body :text and :content
+	Parts []Part
+}
+
+var capabilities = map[string]bool{
+	"fileinto":                   true,
+	"envelope":                   true,
+	"body":                       true,
+	"variables":                  true,
+	"reject":                     true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+// Script is a parsed script, it may be run concurrently
+type Script struct {
+	cmds      []*command
+	variables bool
+}
+
+type branch struct {
+	// cond is nil for the else branch
+	cond  *test
+	block []*command
+}
+
+type command struct {
+	name      string
+	line      int
+	branches  []branch
+	args      []string
+	modifiers []string
+}
+
+type test struct {
+	name         string
+	line         int
+	tests        []*test
+	comparator   string
+	match        string
+	addressPart  string
+	transform    string
+	contentTypes []string
+	// headers are the header names or envelope parts, or the source strings of the string test
+	headers []string
+	keys    []string
+	size    int64
+	over    bool
+}
+
+// Parse parses a script. The extensions used must be in its require commands
+func Parse(r io.Reader) (*Script, error) {
+	nodes, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	c := &compiler{required: make(map[string]bool)}
+	cmds, err := c.commands(nodes, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{cmds: cmds, variables: c.required["variables"]}, nil
+}
+
+type compiler struct {
+	required map[string]bool
+}
+
+func errorf(line int, format string, a ...interface{}) error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (c *compiler) requires(line int, ext, name string) error {
+	if !c.required[ext] {
+		return errorf(line, "%s requires the %s extension", name, ext)
+	}
+	return nil
+}
+
+// positional returns the arguments that are not tags
+func positional(n *node) ([]argument, error) {
+	var args []argument
+	for _, arg := range n.args {
+		if arg.tok.typ == tokenTag {
+			return nil, errorf(arg.tok.line, "unexpected tag :%s for %s", arg.tok.text, n.name)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// stringArgs checks that a command has the expected number of arguments, each a single string
+func stringArgs(n *node, count int) ([]string, error) {
+	args, err := positional(n)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != count {
+		return nil, errorf(n.line, "%s expects %d argument(s)", n.name, count)
+	}
+	var values []string
+	for _, arg := range args {
+		if len(arg.strings) != 1 || arg.tok.typ == tokenPunct {
+			return nil, errorf(n.line, "%s expects a string argument", n.name)
+		}
+		values = append(values, arg.strings[0])
+	}
+	return values, nil
+}
+
+func (c *compiler) commands(nodes []*node, top bool) ([]*command, error) {
+	var (
+		cmds []*command
+		// lastIf is the if that an elsif or else continues
+		lastIf *command
+	)
+	requireAllowed := top
+	for _, n := range nodes {
+		if n.name != "require" {
+			requireAllowed = false
+		}
+		if n.hasBlock != (n.name == "if" || n.name == "elsif" || n.name == "else") {
+			if n.hasBlock {
+				return nil, errorf(n.line, "%s cannot have a block", n.name)
+			}
+			return nil, errorf(n.line, "%s expects a block", n.name)
+		}
+		if len(n.tests) > 0 && n.name != "if" && n.name != "elsif" {
+			return nil, errorf(n.line, "%s cannot have a test", n.name)
+		}
+		cmd := &command{name: n.name, line: n.line}
+		switch n.name {
+		case "require":
+			if !requireAllowed {
+				return nil, errorf(n.line, "require must come before the other commands")
+			}
+			args, err := positional(n)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 || args[0].tok.typ == tokenNumber {
+				return nil, errorf(n.line, "require expects a string list")
+			}
+			for _, ext := range args[0].strings {
+				if !capabilities[ext] {
+					return nil, errorf(n.line, "unsupported extension %q", ext)
+				}
+				c.required[ext] = true
+			}
+			continue
+		case "if", "elsif", "else":
+			if n.name != "else" && len(n.tests) != 1 {
+				return nil, errorf(n.line, "%s expects one test", n.name)
+			}
+			if len(n.args) > 0 {
+				return nil, errorf(n.line, "%s cannot have arguments", n.name)
+			}
+			b := branch{}
+			var err error
+			if n.name != "else" {
+				if b.cond, err = c.test(n.tests[0]); err != nil {
+					return nil, err
+				}
+			}
+			if b.block, err = c.commands(n.block, false); err != nil {
+				return nil, err
+			}
+			if n.name == "if" {
+				cmd.branches = []branch{b}
+				cmds = append(cmds, cmd)
+				lastIf = cmd
+				continue
+			}
+			if lastIf == nil {
+				return nil, errorf(n.line, "%s without an if", n.name)
+			}
+			lastIf.branches = append(lastIf.branches, b)
+			if n.name == "else" {
+				lastIf = nil
+			}
+			continue
+		case "stop", "keep", "discard":
+			if len(n.args) > 0 {
+				return nil, errorf(n.line, "%s cannot have arguments", n.name)
+			}
+		case "fileinto", "redirect", "reject":
+			if n.name != "redirect" {
+				if err := c.requires(n.line, n.name, n.name); err != nil {
+					return nil, err
+				}
+			}
+			args, err := stringArgs(n, 1)
+			if err != nil {
+				return nil, err
+			}
+			cmd.args = args
+		case "set":
+			if err := c.requires(n.line, "variables", n.name); err != nil {
+				return nil, err
+			}
+			var rest []argument
+			for _, arg := range n.args {
+				if arg.tok.typ != tokenTag {
+					rest = append(rest, arg)
+					continue
+				}
+				if modifierPrecedence[arg.tok.text] == 0 {
+					return nil, errorf(n.line, "unknown modifier :%s", arg.tok.text)
+				}
+				cmd.modifiers = append(cmd.modifiers, arg.tok.text)
+			}
+			args, err := stringArgs(&node{name: n.name, line: n.line, args: rest}, 2)
+			if err != nil {
+				return nil, err
+			}
+			if !validVariableName(args[0]) {
+				return nil, errorf(n.line, "invalid variable name %q", args[0])
+			}
+			cmd.args = args
+		default:
+			return nil, errorf(n.line, "unknown command %s", n.name)
+		}
+		cmds = append(cmds, cmd)
+		lastIf = nil
+	}
+	return cmds, nil
+}
+
+// modifierPrecedence is the order in which set applies its modifiers, highest first (RFC 5229 section 4.1)
+var modifierPrecedence = map[string]int{
+	"lower":         40,
+	"upper":         40,
+	"lowerfirst":    30,
+	"upperfirst":    30,
+	"quotewildcard": 20,
+	"length":        10,
+}
+
+func validVariableName(name string) bool {
+	if name == "" || isDigit(name[0]) {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isAlpha(name[i]) && !isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// tests with their number of string list arguments, and the tags they take
+var testArgs = map[string]struct {
+	lists int
+	match bool
+	tags  []string
+}{
+	"address":  {2, true, []string{"all", "localpart", "domain"}},
+	"envelope": {2, true, []string{"all", "localpart", "domain"}},
+	"header":   {2, true, nil},
+	"string":   {2, true, nil},
+	"body":     {1, true, []string{"raw", "text", "content"}},
+	"exists":   {1, false, nil},
+}
+
+func (c *compiler) test(n *node) (*test, error) {
+	t := &test{name: n.name, line: n.line}
+	switch n.name {
+	case "true", "false":
+		if len(n.args) > 0 || len(n.tests) > 0 {
+			return nil, errorf(n.line, "%s cannot have arguments", n.name)
+		}
+		return t, nil
+	case "not", "allof", "anyof":
+		if len(n.args) > 0 {
+			return nil, errorf(n.line, "%s cannot have arguments", n.name)
+		}
+		if n.name == "not" && len(n.tests) != 1 || len(n.tests) == 0 {
+			return nil, errorf(n.line, "%s expects tests", n.name)
+		}
+		for _, sub := range n.tests {
+			st, err := c.test(sub)
+			if err != nil {
+				return nil, err
+			}
+			t.tests = append(t.tests, st)
+		}
+		return t, nil
+	case "size":
+		if len(n.args) != 2 || n.args[0].tok.typ != tokenTag || n.args[1].tok.typ != tokenNumber ||
+			(n.args[0].tok.text != "over" && n.args[0].tok.text != "under") {
+			return nil, errorf(n.line, "size expects :over or :under and a number")
+		}
+		t.over, t.size = n.args[0].tok.text == "over", n.args[1].tok.num
+		return t, nil
+	case "envelope", "body":
+		if err := c.requires(n.line, n.name, n.name); err != nil {
+			return nil, err
+		}
+	case "string":
+		if err := c.requires(n.line, "variables", n.name); err != nil {
+			return nil, err
+		}
+	case "address", "header", "exists":
+	default:
+		return nil, errorf(n.line, "unknown test %s", n.name)
+	}
+	if len(n.tests) > 0 {
+		return nil, errorf(n.line, "%s cannot have tests", n.name)
+	}
+	spec := testArgs[n.name]
+	var lists [][]string
+	for i := 0; i < len(n.args); i++ {
+		arg := n.args[i]
+		if arg.tok.typ == tokenNumber {
+			return nil, errorf(n.line, "%s does not take a number", n.name)
+		}
+		if arg.tok.typ != tokenTag {
+			lists = append(lists, arg.strings)
+			continue
+		}
+		tag := arg.tok.text
+		switch {
+		case spec.match && (tag == "is" || tag == "contains" || tag == "matches"):
+			if t.match != "" {
+				return nil, errorf(n.line, "more than one match type")
+			}
+			t.match = tag
+			continue
+		case spec.match && tag == "comparator":
+			if i+1 >= len(n.args) || len(n.args[i+1].strings) != 1 {
+				return nil, errorf(n.line, ":comparator expects a string")
+			}
+			i++
+			t.comparator = n.args[i].strings[0]
+			if t.comparator != "i;octet" && t.comparator != "i;ascii-casemap" {
+				return nil, errorf(n.line, "unsupported comparator %q", t.comparator)
+			}
+			continue
+		}
+		known := false
+		for _, allowed := range spec.tags {
+			known = known || allowed == tag
+		}
+		if !known {
+			return nil, errorf(n.line, "unexpected tag :%s for %s", tag, n.name)
+		}
+		if n.name == "body" {
+			if t.transform != "" {
+				return nil, errorf(n.line, "more than one body transform")
+			}
+			t.transform = tag
+			if tag == "content" {
+				if i+1 >= len(n.args) || n.args[i+1].tok.typ == tokenTag || n.args[i+1].tok.typ == tokenNumber {
+					return nil, errorf(n.line, ":content expects a string list")
+				}
+				i++
+				t.contentTypes = n.args[i].strings
+			}
+			continue
+		}
+		if t.addressPart != "" {
+			return nil, errorf(n.line, "more than one address part")
+		}
+		t.addressPart = tag
+	}
+	if len(lists) != spec.lists {
+		return nil, errorf(n.line, "%s expects %d string list(s)", n.name, spec.lists)
+	}
+	if spec.lists == 2 {
+		t.headers, t.keys = lists[0], lists[1]
+	} else if n.name == "exists" {
+		t.headers = lists[0]
+	} else {
+		t.keys = lists[0]
+	}
+	if n.name == "envelope" {
+		for _, part := range t.headers {
+			if p := strings.ToLower(part); p != "from" && p != "to" {
+				return nil, errorf(n.line, "unsupported envelope part %q", part)
+			}
+		}
+	}
+	if t.match == "" {
+		t.match = "is"
+	}
+	if t.comparator == "" {
+		t.comparator = "i;ascii-casemap"
+	}
+	if t.addressPart == "" {
+		t.addressPart = "all"
+	}
+	if t.transform == "" {
+		t.transform = "text"
+	}
+	return t, nil
+}
+
+// run is the state of a script running against a message
+type run struct {
+	script    *Script
+	msg       *Message
+	vars      map[string]string
+	matches   []string
+	actions   []Action
+	cancelled bool
+	redirects int
+	stopped   bool
+	patterns  map[string]*regexp.Regexp
+}
+
+// Run runs the script against the message. On an error, the result is the implicit keep
+func (s *Script) Run(m *Message) (*Result, error) {
+	r := &run{script: s, msg: m, vars: make(map[string]string), patterns: make(map[string]*regexp.Regexp)}
+	if err := r.commands(s.cmds); err != nil {
+		return &Result{Actions: []Action{{Type: Keep, Implicit: true}}}, err
+	}
+	if !r.cancelled {
+		r.actions = append(r.actions, Action{Type: Keep, Implicit: true})
+	}
+	return &Result{Actions: r.actions}, nil
+}
+
+func (r *run) commands(cmds []*command) error {
+	for _, cmd := range cmds {
+		if r.stopped {
+			return nil
+		}
+		if err := r.command(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *run) command(cmd *command) error {
+	switch cmd.name {
+	case "if":
+		for _, b := range cmd.branches {
+			if b.cond == nil || r.test(b.cond) {
+				return r.commands(b.block)
+			}
+		}
+	case "stop":
+		r.stopped = true
+	case "keep":
+		r.cancelled = true
+		return r.add(cmd.line, Action{Type: Keep})
+	case "discard":
+		r.cancelled = true
+		return r.add(cmd.line, Action{Type: Discard})
+	case "fileinto":
+		r.cancelled = true
+		return r.add(cmd.line, Action{Type: FileInto, Arg: r.expand(cmd.args[0])})
+	case "redirect":
+		addr := r.expand(cmd.args[0])
+		parsed, err := netmail.ParseAddress(addr)
+		if err != nil {
+			return errorf(cmd.line, "invalid redirect address %q", addr)
+		}
+		r.cancelled = true
+		return r.add(cmd.line, Action{Type: Redirect, Arg: parsed.Address})
+	case "reject":
+		r.cancelled = true
+		return r.add(cmd.line, Action{Type: Reject, Arg: r.expand(cmd.args[0])})
+	case "set":
+		r.set(cmd)
+	}
+	return nil
+}
+
+// add adds an action, unless it was already taken
+func (r *run) add(line int, a Action) error {
+	for _, prev := range r.actions {
+		if prev.Type == Reject && delivers(a.Type) || a.Type == Reject && delivers(prev.Type) {
+			return errorf(line, "reject cannot be used with keep, fileinto or redirect")
+		}
+		if prev.Type == a.Type && prev.Arg == a.Arg {
+			return nil
+		}
+	}
+	if a.Type == Redirect {
+		if r.redirects++; r.redirects > MaxRedirects {
+			return errorf(line, "too many redirects")
+		}
+	}
+	r.actions = append(r.actions, a)
+	return nil
+}
+
+// delivers is true for the actions that deliver the message somewhere
+func delivers(t ActionType) bool {
+	return t == Keep || t == FileInto || t == Redirect
+}
+
+func (r *run) set(cmd *command) {
+	value := r.expand(cmd.args[1])
+	mods := append([]string(nil), cmd.modifiers...)
+	// apply the modifiers with the highest precedence first
+	for p := 40; p > 0; p -= 10 {
+		for _, mod := range mods {
+			if modifierPrecedence[mod] != p {
+				continue
+			}
+			switch mod {
+			case "lower":
+				value = strings.ToLower(value)
+			case "upper":
+				value = strings.ToUpper(value)
+			case "lowerfirst", "upperfirst":
+				if value == "" {
+					break
+				}
+				first, size := utf8.DecodeRuneInString(value)
+				if mod == "lowerfirst" {
+					value = string(unicode.ToLower(first)) + value[size:]
+				} else {
+					value = string(unicode.ToUpper(first)) + value[size:]
+				}
+			case "quotewildcard":
+				value = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(value)
+			case "length":
+				value = strconv.Itoa(len([]rune(value)))
+			}
+		}
+	}
+	r.vars[strings.ToLower(cmd.args[0])] = value
+}
+
+// expand replaces the variables in a string, when the variables extension is used
+func (r *run) expand(s string) string {
+	if !r.script.variables || !strings.Contains(s, "${") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end == -1 {
+			break
+		}
+		name := s[start+2 : start+end]
+		b.WriteString(s[:start])
+		if n, err := strconv.Atoi(name); err == nil && name[0] != '+' && name[0] != '-' {
+			if n < len(r.matches) {
+				b.WriteString(r.matches[n])
+			}
+		} else if validVariableName(name) {
+			b.WriteString(r.vars[strings.ToLower(name)])
+		} else {
+			// not a variable, kept as it is
+			b.WriteString(s[start : start+end+1])
+		}
+		s = s[start+end+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func (r *run) expandAll(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = r.expand(s)
+	}
+	return out
+}
+
+func (r *run) test(t *test) bool {
+	switch t.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !r.test(t.tests[0])
+	case "allof":
+		for _, sub := range t.tests {
+			if !r.test(sub) {
+				return false
+			}
+		}
+		return true
+	case "anyof":
+		for _, sub := range t.tests {
+			if r.test(sub) {
+				return true
+			}
+		}
+		return false
+	case "size":
+		if t.over {
+			return r.msg.Size > t.size
+		}
+		return r.msg.Size < t.size
+	case "exists":
+		for _, name := range r.expandAll(t.headers) {
+			if len(r.msg.Header[textproto.CanonicalMIMEHeaderKey(name)]) == 0 {
+				return false
+			}
+		}
+		return true
+	case "header":
+		return r.match(t, r.headerValues(t.headers))
+	case "address":
+		var values []string
+		for _, v := range r.headerValues(t.headers) {
+			for _, addr := range parseAddresses(v) {
+				values = append(values, addressPart(addr, t.addressPart))
+			}
+		}
+		return r.match(t, values)
+	case "envelope":
+		var values []string
+		for _, part := range r.expandAll(t.headers) {
+			addr := r.msg.To
+			if strings.ToLower(part) == "from" {
+				addr = r.msg.From
+			}
+			values = append(values, addressPart(addr, t.addressPart))
+		}
+		return r.match(t, values)
+	case "body":
+		return r.match(t, r.bodyValues(t))
+	case "string":
+		return r.match(t, r.expandAll(t.headers))
+	}
+	return false
+}
+
+func (r *run) headerValues(names []string) []string {
+	var values []string
+	for _, name := range r.expandAll(names) {
+		for _, v := range r.msg.Header[textproto.CanonicalMIMEHeaderKey(name)] {
+			values = append(values, mail.MimeHeaderDecode(strings.TrimSpace(v)))
+		}
+	}
+	return values
+}
+
+func (r *run) bodyValues(t *test) []string {
+	if t.transform == "raw" {
+		return []string{r.msg.Body}
+	}
+	types := []string{"text"}
+	if t.transform == "content" {
+		types = r.expandAll(t.contentTypes)
+	}
+	var values []string
+	for _, p := range r.msg.Parts {
+		for _, want := range types {
+			if contentTypeMatches(p.ContentType, want) {
+				values = append(values, p.Text)
+				break
+			}
+		}
+	}
+	return values
+}
+
+// contentTypeMatches matches a media type against a type of the :content list,
+// which may be empty for any type, or only the top-level type (RFC 5173 section 5.2)
+func contentTypeMatches(contentType, want string) bool {
+	contentType, want = strings.ToLower(contentType), strings.ToLower(want)
+	if want == "" || contentType == want {
+		return true
+	}
+	return !strings.Contains(want, "/") && strings.HasPrefix(contentType, want+"/")
+}
+
+// parseAddresses returns the addresses of a header value, or the value if they cannot be parsed
+func parseAddresses(v string) []string {
+	list, err := netmail.ParseAddressList(v)
+	if err != nil {
+		return []string{v}
+	}
+	addrs := make([]string, len(list))
+	for i, a := range list {
+		addrs[i] = a.Address
+	}
+	return addrs
+}
+
+func addressPart(addr, part string) string {
+	at := strings.LastIndexByte(addr, '@')
+	switch part {
+	case "localpart":
+		if at == -1 {
+			return addr
+		}
+		return addr[:at]
+	case "domain":
+		if at == -1 {
+			return ""
+		}
+		return addr[at+1:]
+	}
+	return addr
+}
+
+// match compares the values with the keys of a test
+func (r *run) match(t *test, values []string) bool {
+	keys := r.expandAll(t.keys)
+	fold := t.comparator == "i;ascii-casemap"
+	for _, v := range values {
+		for _, k := range keys {
+			switch t.match {
+			case "is":
+				if v == k || fold && asciiLower(v) == asciiLower(k) {
+					return true
+				}
+			case "contains":
+				if strings.Contains(v, k) || fold && strings.Contains(asciiLower(v), asciiLower(k)) {
+					return true
+				}
+			case "matches":
+				if m := r.wildcard(k, v, fold); m != nil {
+					if r.script.variables {
+						r.matches = m
+					}
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// wildcard matches a value with a pattern of the :matches type, where * matches any
+// characters and ? a single character. It returns the match variables, or nil.
+// A pattern that is not valid UTF-8 matches nothing
+func (r *run) wildcard(pattern, value string, fold bool) []string {
+	if fold {
+		pattern = asciiLower(pattern)
+	}
+	re, ok := r.patterns[pattern]
+	if !ok {
+		var b strings.Builder
+		b.WriteString("(?s)^")
+		for i := 0; i < len(pattern); i++ {
+			switch c := pattern[i]; c {
+			case '*':
+				b.WriteString("(.*?)")
+			case '?':
+				b.WriteString("(.)")
+			case '\\':
+				if i+1 < len(pattern) {
+					i++
+				}
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			default:
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		}
+		b.WriteString("$")
+		// the key may come from the message through variables, so it cannot panic
+		re, _ = regexp.Compile(b.String())
+		r.patterns[pattern] = re
+	}
+	if re == nil {
+		return nil
+	}
+	subject := value
+	if fold {
+		// lowering ASCII keeps the offsets, so the match variables are taken from the value
+		subject = asciiLower(value)
+	}
+	loc := re.FindStringSubmatchIndex(subject)
+	if loc == nil {
+		return nil
+	}
+	m := make([]string, len(loc)/2)
+	for i := range m {
+		if loc[2*i] >= 0 {
+			m[i] = value[loc[2*i]:loc[2*i+1]]
+		}
+	}
+	return m
+}
+
+// asciiLower lowers the case of ASCII letters only, as the i;ascii-casemap comparator does
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,185 @@
+package sieve
+
+import (
+	"errors"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testMessage() *Message {
+	return &Message{
+		Header: textproto.MIMEHeader{
+			"From":    {`"Alice" <Alice@Example.com>`},
+			"To":      {"bob@example.org, carol@lists.example.net"},
+			"Subject": {"=?UTF-8?Q?Re:_caf=C3=A9_[project-x]_meeting?="},
+			"List-Id": {"<dev.lists.example.net>"},
+		},
+		From: "alice@example.com",
+		To:   "Bob+Lists@example.org",
+		Size: 20 << 10,
+		Body: "--b\r\nContent-Type: text/plain\r\n\r\nHello, the build is BROKEN\r\n--b--\r\n",
+		Parts: []Part{
+			{ContentType: "text/plain", Text: "Hello, the build is BROKEN\r\n"},
+			{ContentType: "application/pdf", Text: "%PDF-1.4"},
+		},
+	}
+}
+
+func runScript(t *testing.T, script string, m *Message) []Action {
+	t.Helper()
+	s, err := Parse(strings.NewReader(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.Run(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.Actions
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []Action
+	}{
+		{"empty", ``, []Action{{Type: Keep, Implicit: true}}},
+		{"header contains", `require "fileinto";
+			if header :contains "subject" "café" { fileinto "Cafe"; }`,
+			[]Action{{Type: FileInto, Arg: "Cafe"}}},
+		{"header is casemap", `require ["fileinto"];
+			if header :is "List-Id" "<DEV.lists.example.net>" { fileinto "dev"; stop; }
+			fileinto "other";`,
+			[]Action{{Type: FileInto, Arg: "dev"}}},
+		{"octet comparator", `if header :comparator "i;octet" :is "List-Id" "<DEV.lists.example.net>" { discard; }`,
+			[]Action{{Type: Keep, Implicit: true}}},
+		{"address domain", `if address :domain :is ["to", "cc"] "lists.example.net" { discard; }`,
+			[]Action{{Type: Discard}}},
+		{"address localpart", `if address :localpart :is "from" "alice" { keep; discard; }`,
+			[]Action{{Type: Keep}, {Type: Discard}}},
+		{"envelope", `require "envelope";
+			if envelope :localpart :matches "to" "bob+*" { redirect "lists@example.org"; }`,
+			[]Action{{Type: Redirect, Arg: "lists@example.org"}}},
+		{"exists", `if exists ["From", "X-Spam-Flag"] { discard; } elsif exists "list-id" { keep; } else { discard; }`,
+			[]Action{{Type: Keep}}},
+		{"size", `if size :over 10K { discard; }`, []Action{{Type: Discard}}},
+		{"size under", `if size :under 1M { discard; }`, []Action{{Type: Discard}}},
+		{"allof anyof not", `if allof (not false, anyof (false, size :under 1)) { discard; }`,
+			[]Action{{Type: Keep, Implicit: true}}},
+		{"body text", `require "body";
+			if body :contains "broken" { discard; }`,
+			[]Action{{Type: Discard}}},
+		{"body content", `require "body";
+			if body :content "application" :contains "PDF-1" { discard; }`,
+			[]Action{{Type: Discard}}},
+		{"body raw", `require "body";
+			if body :raw :contains "content-type: text/plain" { discard; }`,
+			[]Action{{Type: Discard}}},
+		{"reject", `require "reject";
+			if header :contains "from" "example.com" { reject text:
+Not wanted
+..here
+.
+; }`,
+			[]Action{{Type: Reject, Arg: "Not wanted\r\n.here\r\n"}}},
+		{"duplicates", `require "fileinto"; fileinto "a"; fileinto "a"; keep; keep;`,
+			[]Action{{Type: FileInto, Arg: "a"}, {Type: Keep}}},
+		{"variables", `require ["variables", "fileinto"];
+			if header :matches "List-Id" "<*.lists.*>" { set :upperfirst "list" "${1}"; }
+			set :length "len" "${list}";
+			fileinto "Lists/${list}-${len}";`,
+			[]Action{{Type: FileInto, Arg: "Lists/Dev-3"}}},
+		{"set modifiers", `require ["variables", "fileinto"];
+			set :lower :upperfirst "name" "JOHN";
+			set :quotewildcard "q" "a*b?";
+			if string :is "${q}" "a\\*b\\?" { fileinto "${name}"; }`,
+			[]Action{{Type: FileInto, Arg: "John"}}},
+		{"matches question mark", `require ["variables", "fileinto", "envelope"];
+			if envelope :all :matches "from" "?lice@*" { fileinto "${0}/${2}/${9}"; }`,
+			[]Action{{Type: FileInto, Arg: "alice@example.com/example.com/"}}},
+		{"matches invalid utf-8", "if header :matches \"Subject\" \"caf\xe9*\" { discard; }",
+			[]Action{{Type: Keep, Implicit: true}}},
+		{"comments", `# a comment
+			/* a
+			   block comment */
+			discard; # done`,
+			[]Action{{Type: Discard}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runScript(t, tt.script, testMessage())
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		script string
+		line   int
+	}{
+		{`fileinto "x";`, 1},
+		{`require "imap4flags";`, 1},
+		{"keep;\nrequire \"fileinto\";", 2},
+		{`keep`, 1},
+		{`if true keep;`, 1},
+		{"\n\nelse { keep; }", 3},
+		{`if true { keep; } else { keep; } else { keep; }`, 1},
+		{`if header :is :contains "a" "b" { keep; }`, 1},
+		{`if header :is "a" { keep; }`, 1},
+		{`if size 10 { keep; }`, 1},
+		{`redirect ["a@example.com", "b@example.com"];`, 1},
+		{`if header :comparator "i;ascii-numeric" "a" "b" { keep; }`, 1},
+		{`"unterminated`, 1},
+		{"require \"variables\";\nset \"1a\" \"x\";", 2},
+		{`unknown;`, 1},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.script))
+		var serr *Error
+		if !errors.As(err, &serr) {
+			t.Errorf("%q: expected a sieve error, got %v", tt.script, err)
+			continue
+		}
+		if serr.Line != tt.line {
+			t.Errorf("%q: error on line %d, expected %d: %s", tt.script, serr.Line, tt.line, serr)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	for _, script := range []string{
+		`require "reject"; keep; reject "no";`,
+		`redirect "not an address";`,
+		`redirect "a1@example.com"; redirect "a2@example.com"; redirect "a3@example.com";
+		 redirect "a4@example.com"; redirect "a5@example.com"; redirect "a6@example.com";
+		 redirect "a7@example.com"; redirect "a8@example.com"; redirect "a9@example.com";
+		 redirect "a10@example.com"; redirect "a11@example.com";`,
+	} {
+		s, err := Parse(strings.NewReader(script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := s.Run(testMessage())
+		if err == nil {
+			t.Errorf("%q: expected an error", script)
+		}
+		if want := []Action{{Type: Keep, Implicit: true}}; !reflect.DeepEqual(result.Actions, want) {
+			t.Errorf("%q: on an error, the result should be the implicit keep, got %+v", script, result.Actions)
+		}
+	}
+}
+
+func TestNullSender(t *testing.T) {
+	m := testMessage()
+	m.From = ""
+	got := runScript(t, `require "envelope"; if envelope :is "from" "" { discard; }`, m)
+	if len(got) != 1 || got[0].Type != Discard {
+		t.Errorf("expected discard for the null sender, got %+v", got)
+	}
+}
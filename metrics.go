@@ -0,0 +1,95 @@
+package guerrilla
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/phires/go-guerrilla/metrics"
+)
+
+var (
+	metricConnections = metrics.Default.Counter("guerrilla_connections_total",
+		"Connections by server, accepted or rejected.", "server", "result")
+	metricCommands = metrics.Default.Counter("guerrilla_commands_total",
+		"SMTP commands by server and verb.", "server", "verb")
+	metricResponses = metrics.Default.Counter("guerrilla_responses_total",
+		"Replies to the clients by server and code.", "server", "code")
+	metricMessageSize = metrics.Default.Histogram("guerrilla_message_size_bytes",
+		"Sizes of the messages received.", metrics.ExponentialBuckets(1024, 4, 10), "server")
+	metricTLS = metrics.Default.Counter("guerrilla_tls_handshakes_total",
+		"TLS handshakes by server, ok or failed.", "server", "result")
+)
+
+// builtInVerbs are the verbs counted by name, along with the added commands. Others are "unknown"
+var builtInVerbs = map[string]bool{
+	"HELO": true, "EHLO": true, "HELP": true, "XCLIENT": true, "MAIL": true, "RCPT": true, "RSET": true,
+	"VRFY": true, "NOOP": true, "QUIT": true, "DATA": true, "STARTTLS": true,
+}
+
+// metricVerb returns the label of a verb, so that clients cannot make up new ones
+func metricVerb(verb string) string {
+	if builtInVerbs[verb] {
+		return verb
+	}
+	commands.RLock()
+	defer commands.RUnlock()
+	if _, ok := commands.m[verb]; ok {
+		return verb
+	}
+	return "unknown"
+}
+
+// registerMetrics registers the gauges read from the servers and the backend
+func (g *guerrilla) registerMetrics() {
+	metrics.Default.GaugeFunc("guerrilla_server_active_clients",
+		"Clients connected to each server.", []string{"server"},
+		func(set func(float64, ...string)) {
+			g.mapServers(func(s *server) {
+				set(float64(s.GetActiveClientsCount()), s.listenInterface)
+			})
+		})
+	metrics.Default.GaugeFunc("guerrilla_backend_queue_depth",
+		"Messages and recipients waiting for a backend worker.", nil,
+		func(set func(float64, ...string)) {
+			if q, ok := g.backend().(interface{ QueueDepth() int }); ok {
+				set(float64(q.QueueDepth()))
+			}
+		})
+}
+
+// startMetrics serves the metrics on http://iface/metrics, if iface is not empty
+func (g *guerrilla) startMetrics(iface string) error {
+	if iface == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", iface)
+	if err != nil {
+		return fmt.Errorf("cannot listen on the metrics interface: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	g.metricsGuard.Lock()
+	g.metricsServer = srv
+	g.metricsGuard.Unlock()
+	go func() {
+		if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			g.mainlog().WithError(err).Error("metrics listener failed")
+		}
+	}()
+	g.mainlog().Infof("Serving metrics on http://%s/metrics", iface)
+	return nil
+}
+
+// stopMetrics stops serving the metrics
+func (g *guerrilla) stopMetrics() {
+	g.metricsGuard.Lock()
+	defer g.metricsGuard.Unlock()
+	if g.metricsServer != nil {
+		_ = g.metricsServer.Close()
+		g.metricsServer = nil
+	}
+}
@@ -0,0 +1,331 @@
+// Package metrics keeps counters, gauges and histograms, and exposes them in the
+// Prometheus text format, eg. to be scraped from the metrics_interface listener.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry of the servers and the backend
+var Default = NewRegistry()
+
+// Registry is a set of metrics
+type Registry struct {
+	metrics map[string]metric
+	sync.Mutex
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register adds m, or returns the metric already registered with the name
+func (r *Registry) register(name string, m metric) metric {
+	r.Lock()
+	defer r.Unlock()
+	if old, ok := r.metrics[name]; ok {
+		return old
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// Counter registers a counter, or returns the one already registered with the name
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, labels)}
+	return r.register(name, c).(*CounterVec)
+}
+
+// Histogram registers a histogram with the upper bounds of its buckets, in increasing order,
+// or returns the one already registered with the name
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec: newVec(name, help, labels), buckets: buckets}
+	return r.register(name, h).(*HistogramVec)
+}
+
+// GaugeFunc registers a gauge read when the metrics are written. collect calls set with
+// each value and its label values. It replaces the function of a gauge with the same name
+func (r *Registry) GaugeFunc(name, help string, labels []string, collect func(set func(v float64, values ...string))) {
+	r.Lock()
+	defer r.Unlock()
+	r.metrics[name] = &gaugeFunc{vec: newVec(name, help, labels), collect: collect}
+}
+
+// WriteTo writes the metrics in the Prometheus text format, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.Unlock()
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP writes the metrics, so that the registry can be the handler of /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// vec is the name, help and labels of a metric, and its series by label values
+type vec struct {
+	name, help string
+	labels     []string
+	series     sync.Map
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{name: name, help: help, labels: labels}
+}
+
+// get returns the series of the label values, made with create if it is new
+func (v *vec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	if s, ok := v.series.Load(key); ok {
+		return s
+	}
+	s, _ := v.series.LoadOrStore(key, create())
+	return s
+}
+
+// each calls fn with the label values and the series, sorted by label values
+func (v *vec) each(fn func(values []string, s interface{})) {
+	var keys []string
+	v.series.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, _ := v.series.Load(k)
+		var values []string
+		if len(v.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		fn(values, s)
+	}
+}
+
+func (v *vec) header(w *bufio.Writer, typ string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escape(v.help, false), v.name, typ)
+}
+
+// sample writes a sample, extra is an additional label, eg. le="0.5"
+func (v *vec) sample(w *bufio.Writer, suffix string, values []string, extra string, value float64) {
+	_, _ = w.WriteString(v.name + suffix)
+	if len(values) > 0 || extra != "" {
+		_ = w.WriteByte('{')
+		for i, l := range v.labels {
+			if i > 0 {
+				_ = w.WriteByte(',')
+			}
+			_, _ = w.WriteString(l + `="` + escape(values[i], true) + `"`)
+		}
+		if extra != "" {
+			if len(values) > 0 {
+				_ = w.WriteByte(',')
+			}
+			_, _ = w.WriteString(extra)
+		}
+		_ = w.WriteByte('}')
+	}
+	_, _ = w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// atomicFloat is a float64 that can be added to atomically
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		if atomic.CompareAndSwapUint64(&f.bits, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+// CounterVec is a counter for each combination of label values
+type CounterVec struct {
+	vec
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	v atomicFloat
+}
+
+// With returns the counter of the label values, in the order of the labels
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+// Inc adds 1 to the counter
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add adds v, which must not be negative, to the counter
+func (c *Counter) Add(v float64) {
+	c.v.add(v)
+}
+
+// Value returns the value of the counter
+func (c *Counter) Value() float64 {
+	return c.v.load()
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w, "counter")
+	c.each(func(values []string, s interface{}) {
+		c.sample(w, "", values, "", s.(*Counter).Value())
+	})
+}
+
+// HistogramVec is a histogram for each combination of label values
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// Histogram counts the observations in buckets
+type Histogram struct {
+	counts []uint64
+	count  uint64
+	sum    atomicFloat
+	bounds []float64
+}
+
+// With returns the histogram of the label values, in the order of the labels
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.get(values, func() interface{} {
+		return &Histogram{counts: make([]uint64, len(h.buckets)), bounds: h.buckets}
+	}).(*Histogram)
+}
+
+// Observe adds an observation, eg. a duration in seconds
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	h.sum.add(v)
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w, "histogram")
+	h.each(func(values []string, s interface{}) {
+		hist := s.(*Histogram)
+		count := hist.Count()
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += atomic.LoadUint64(&hist.counts[i])
+			h.sample(w, "_bucket", values, `le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		h.sample(w, "_bucket", values, `le="+Inf"`, float64(count))
+		h.sample(w, "_sum", values, "", hist.sum.load())
+		h.sample(w, "_count", values, "", float64(count))
+	})
+}
+
+type gaugeFunc struct {
+	vec
+	collect func(set func(v float64, values ...string))
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.header(w, "gauge")
+	type sample struct {
+		values []string
+		v      float64
+	}
+	var samples []sample
+	g.collect(func(v float64, values ...string) {
+		samples = append(samples, sample{values, v})
+	})
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].values, "\xff") < strings.Join(samples[j].values, "\xff")
+	})
+	for _, s := range samples {
+		g.sample(w, "", s.values, "", s.v)
+	}
+}
+
+// ExponentialBuckets returns count upper bounds, starting at start and multiplied by factor
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	b := make([]float64, count)
+	for i := range b {
+		b[i] = start
+		start *= factor
+	}
+	return b
+}
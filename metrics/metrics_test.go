@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_commands_total", "Commands by verb.", "server", "verb")
+	c.With("127.0.0.1:25", "MAIL").Inc()
+	c.With("127.0.0.1:25", "MAIL").Inc()
+	c.With("127.0.0.1:25", `X"Q`).Add(3)
+	if r.Counter("test_commands_total", "again", "server", "verb") != c {
+		t.Error("expecting the registered counter")
+	}
+	h := r.Histogram("test_size_bytes", "Sizes.", []float64{10, 100})
+	for _, v := range []float64{5, 10, 50, 500} {
+		h.With().Observe(v)
+	}
+	r.GaugeFunc("test_active", "Active.", []string{"server"}, func(set func(float64, ...string)) {
+		set(2, "b")
+		set(1, "a")
+	})
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_active Active.
+# TYPE test_active gauge
+test_active{server="a"} 1
+test_active{server="b"} 2
+# HELP test_commands_total Commands by verb.
+# TYPE test_commands_total counter
+test_commands_total{server="127.0.0.1:25",verb="MAIL"} 2
+test_commands_total{server="127.0.0.1:25",verb="X\"Q"} 3
+# HELP test_size_bytes Sizes.
+# TYPE test_size_bytes histogram
+test_size_bytes_bucket{le="10"} 2
+test_size_bytes_bucket{le="100"} 3
+test_size_bytes_bucket{le="+Inf"} 4
+test_size_bytes_sum 565
+test_size_bytes_count 4
+`
+	if b.String() != want {
+		t.Errorf("expecting\n%s\ngot\n%s", want, b.String())
+	}
+}
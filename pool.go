@@ -104,6 +104,12 @@ func (p *Pool) ShutdownWait() {
 	p.isShuttingDownFlg.Store(false)
 }
 
+// DrainWait waits for the lent clients to be returned, without notifying them to stop.
+// Unlike ShutdownWait, borrowing is not locked, so that ShutdownState can be called meanwhile
+func (p *Pool) DrainWait() {
+	p.activeClients.wg.Wait()
+}
+
 // returns true if the pool is shutting down
 func (p *Pool) IsShuttingDown() bool {
 	if value, ok := p.isShuttingDownFlg.Load().(bool); ok {
@@ -0,0 +1,13 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package queue
+
+import "syscall"
+
+// processRunning returns true if a process with the pid is running
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM is a process of another user
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,476 @@
+// Package queue implements a durable on-disk spool for envelopes that are waiting for delivery.
+//
+// Each queued message is kept as two files in the spool directory: <id>.msg holding the
+// message data, and <id>.json holding the envelope and the delivery state. Both are written
+// to a temporary file first then renamed, and the .json is always written last, so
+// a message is only considered queued once its .json file exists.
+// Messages that could not be delivered are moved to the 'failed' sub-directory.
+// A message that is being delivered or changed is locked with an <id>.lock file, so that
+// a running daemon and the 'guerrillad queue' command do not change it at the same time.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+const (
+	metaExt   = ".json"
+	msgExt    = ".msg"
+	tmpExt    = ".tmp"
+	lockExt   = ".lock"
+	failedDir = "failed"
+)
+
+var (
+	ErrNotFound  = errors.New("message not found in queue")
+	ErrInvalidID = errors.New("invalid queue id")
+	ErrLocked    = errors.New("message is locked by another delivery or process, try again later")
+
+	validID = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+)
+
+// Failure is the reason why delivery to a recipient failed
+type Failure struct {
+	Rcpt mail.Address `json:"rcpt"`
+	// Code is the basic SMTP reply code, ie. 550
+	Code int `json:"code"`
+	// Msg is the text of the reply, usually starting with an enhanced status code
+	Msg string `json:"msg"`
+	// RemoteMTA is the host that gave the reply, if any
+	RemoteMTA string `json:"remote_mta,omitempty"`
+}
+
+// Item is a queued envelope with its delivery state
+type Item struct {
+	ID             string         `json:"id"`
+	QueuedId       string         `json:"queued_id"`
+	RemoteIP       string         `json:"remote_ip"`
+	Helo           string         `json:"helo"`
+	TLS            bool           `json:"tls"`
+	ESMTP          bool           `json:"esmtp"`
+	MailFrom       mail.Address   `json:"mail_from"`
+	RcptTo         []mail.Address `json:"rcpt_to"`
+	DeliveryHeader string         `json:"delivery_header"`
+	Size           int64          `json:"size"`
+	// Created is when the message was accepted
+	Created time.Time `json:"created"`
+	// Attempts is the number of delivery attempts so far
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	// LastError is the reply of the last failed attempt
+	LastError string `json:"last_error,omitempty"`
+	// Failed are the recipients that will not be delivered to
+	Failed []Failure `json:"failed,omitempty"`
+	// DelayNotified is true if the sender was notified that delivery is delayed
+	DelayNotified bool `json:"delay_notified,omitempty"`
+}
+
+// NewItem returns an Item for the envelope, scheduled for delivery straight away
+func NewItem(e *mail.Envelope) *Item {
+	now := time.Now()
+	return &Item{
+		QueuedId:       e.QueuedId,
+		RemoteIP:       e.RemoteIP,
+		Helo:           e.Helo,
+		TLS:            e.TLS,
+		ESMTP:          e.ESMTP,
+		MailFrom:       e.MailFrom,
+		RcptTo:         append([]mail.Address(nil), e.RcptTo...),
+		DeliveryHeader: e.DeliveryHeader,
+		Created:        now,
+		NextAttempt:    now,
+	}
+}
+
+// Envelope returns a new envelope for delivering the item, without the message data
+func (item *Item) Envelope() *mail.Envelope {
+	e := mail.NewEnvelope(item.RemoteIP, 0)
+	e.QueuedId = item.QueuedId
+	e.Helo = item.Helo
+	e.TLS = item.TLS
+	e.ESMTP = item.ESMTP
+	e.MailFrom = item.MailFrom
+	e.RcptTo = append(e.RcptTo, item.RcptTo...)
+	e.DeliveryHeader = item.DeliveryHeader
+	return e
+}
+
+// Spool stores queued items in a directory
+type Spool struct {
+	dir string
+	sync.Mutex
+}
+
+// Open opens the spool at dir, creating the directory if it does not exist
+func Open(dir string) (*Spool, error) {
+	s := &Spool{dir: dir}
+	if err := os.MkdirAll(filepath.Join(dir, failedDir), 0750); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Dir returns the directory of the spool
+func (s *Spool) Dir() string {
+	return s.dir
+}
+
+// Recover repairs the spool after the process was stopped half-way through writing to it.
+// Temporary files and stale locks are removed, items that were being moved between the queue and
+// the failed directory are completed, and metadata or messages without a counterpart are removed.
+// The locks of other running processes, such as the 'guerrillad queue' command, are kept, but
+// it must not be called while another process of this spool is writing a new item.
+func (s *Spool) Recover() error {
+	s.Lock()
+	defer s.Unlock()
+	dirs := []string{s.dir, filepath.Join(s.dir, failedDir)}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	for i, dir := range dirs {
+		other := dirs[1-i]
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			switch filepath.Ext(name) {
+			case tmpExt:
+				err = os.Remove(path)
+			case lockExt:
+				if staleLock(path) {
+					err = os.Remove(path)
+				}
+			case metaExt:
+				id := strings.TrimSuffix(name, metaExt)
+				if exists(s.path(dir, id, msgExt)) {
+					continue
+				}
+				if exists(s.path(other, id, msgExt)) && !exists(s.path(other, id, metaExt)) {
+					// the message was moved, but not the metadata
+					err = os.Rename(path, s.path(other, id, metaExt))
+				} else {
+					err = os.Remove(path)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || filepath.Ext(name) != msgExt {
+				continue
+			}
+			if !exists(s.path(dir, strings.TrimSuffix(name, msgExt), metaExt)) {
+				if err := os.Remove(filepath.Join(dir, name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// LockItem locks the queued or failed item with the id. It returns ErrLocked if the item is
+// already locked, by this or another process using the spool
+func (s *Spool) LockItem(id string) error {
+	if !validID.MatchString(id) {
+		return ErrInvalidID
+	}
+	f, err := os.OpenFile(s.path(s.dir, id, lockExt), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if os.IsExist(err) {
+		return ErrLocked
+	} else if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// staleLock returns true if the process that took the lock is no longer running. The locks of
+// this process are stale too, since the spool is only recovered before it is used
+func staleLock(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		// interrupted before the pid was written
+		return true
+	}
+	return pid == os.Getpid() || !processRunning(pid)
+}
+
+// UnlockItem releases a lock taken with LockItem
+func (s *Spool) UnlockItem(id string) error {
+	if !validID.MatchString(id) {
+		return ErrInvalidID
+	}
+	if err := os.Remove(s.path(s.dir, id, lockExt)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// IsLocked returns true if the item with the id is locked
+func (s *Spool) IsLocked(id string) bool {
+	_, err := os.Stat(s.path(s.dir, id, lockExt))
+	return err == nil
+}
+
+func (s *Spool) path(dir, id, ext string) string {
+	return filepath.Join(dir, id+ext)
+}
+
+// writeFile atomically writes the contents of r to path
+func writeFile(path string, r io.Reader) (int64, error) {
+	tmp := path + tmpExt
+	f, err := os.OpenFile(filepath.Clean(tmp), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return n, err
+}
+
+func (s *Spool) writeMeta(dir string, item *Item) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writeFile(s.path(dir, item.ID, metaExt), strings.NewReader(string(data)))
+	return err
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
+
+// Put adds the item to the spool, reading the message data from r.
+// A new item.ID is assigned.
+func (s *Spool) Put(item *Item, r io.Reader) (err error) {
+	if item.ID, err = newID(); err != nil {
+		return err
+	}
+	if item.Size, err = writeFile(s.path(s.dir, item.ID, msgExt), r); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if err = s.writeMeta(s.dir, item); err != nil {
+		_ = os.Remove(s.path(s.dir, item.ID, msgExt))
+	}
+	return err
+}
+
+// Update saves the delivery state of a queued item
+func (s *Spool) Update(item *Item) error {
+	if !validID.MatchString(item.ID) {
+		return ErrInvalidID
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, err := os.Stat(s.path(s.dir, item.ID, metaExt)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return s.writeMeta(s.dir, item)
+}
+
+func (s *Spool) read(dir, id string) (*Item, error) {
+	if !validID.MatchString(id) {
+		return nil, ErrInvalidID
+	}
+	data, err := os.ReadFile(s.path(dir, id, metaExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	item := &Item{}
+	if err = json.Unmarshal(data, item); err != nil {
+		return nil, fmt.Errorf("could not read queue item %s: %s", id, err)
+	}
+	return item, nil
+}
+
+// Get returns the queued item with the id
+func (s *Spool) Get(id string) (*Item, error) {
+	return s.read(s.dir, id)
+}
+
+// GetFailed returns the failed item with the id
+func (s *Spool) GetFailed(id string) (*Item, error) {
+	return s.read(filepath.Join(s.dir, failedDir), id)
+}
+
+// Message opens the message data of a queued or failed item
+func (s *Spool) Message(id string) (io.ReadCloser, error) {
+	if !validID.MatchString(id) {
+		return nil, ErrInvalidID
+	}
+	f, err := os.Open(s.path(s.dir, id, msgExt))
+	if os.IsNotExist(err) {
+		f, err = os.Open(s.path(filepath.Join(s.dir, failedDir), id, msgExt))
+	}
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *Spool) list(dir string) ([]*Item, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0, len(entries)/2)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != metaExt {
+			continue
+		}
+		item, err := s.read(dir, strings.TrimSuffix(entry.Name(), metaExt))
+		if err == ErrNotFound {
+			// removed since ReadDir
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].NextAttempt.Before(items[j].NextAttempt)
+	})
+	return items, nil
+}
+
+// List returns the queued items, sorted by the time of the next attempt
+func (s *Spool) List() ([]*Item, error) {
+	return s.list(s.dir)
+}
+
+// ListFailed returns the items that could not be delivered
+func (s *Spool) ListFailed() ([]*Item, error) {
+	return s.list(filepath.Join(s.dir, failedDir))
+}
+
+func (s *Spool) remove(dir, id string) error {
+	if !validID.MatchString(id) {
+		return ErrInvalidID
+	}
+	s.Lock()
+	defer s.Unlock()
+	// remove the metadata first, a message without metadata is cleaned up by recover
+	if err := os.Remove(s.path(dir, id, metaExt)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if err := os.Remove(s.path(dir, id, msgExt)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Remove deletes a queued item
+func (s *Spool) Remove(id string) error {
+	return s.remove(s.dir, id)
+}
+
+// RemoveFailed deletes a failed item
+func (s *Spool) RemoveFailed(id string) error {
+	return s.remove(filepath.Join(s.dir, failedDir), id)
+}
+
+// move moves an item between the queue and the failed directory, saving its state
+func (s *Spool) move(item *Item, from, to string) error {
+	if !validID.MatchString(item.ID) {
+		return ErrInvalidID
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, err := os.Stat(s.path(from, item.ID, metaExt)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if err := os.Rename(s.path(from, item.ID, msgExt), s.path(to, item.ID, msgExt)); err != nil {
+		return err
+	}
+	if err := s.writeMeta(to, item); err != nil {
+		return err
+	}
+	return os.Remove(s.path(from, item.ID, metaExt))
+}
+
+// Fail moves the item to the failed directory
+func (s *Spool) Fail(item *Item) error {
+	return s.move(item, s.dir, filepath.Join(s.dir, failedDir))
+}
+
+// Retry moves a failed item back to the queue, to be attempted straight away
+func (s *Spool) Retry(id string) (*Item, error) {
+	item, err := s.GetFailed(id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range item.Failed {
+		item.RcptTo = append(item.RcptTo, item.Failed[i].Rcpt)
+	}
+	item.Failed = nil
+	item.NextAttempt = time.Now()
+	return item, s.move(item, filepath.Join(s.dir, failedDir), s.dir)
+}
@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phires/go-guerrilla/mail"
+)
+
+func testItem() *Item {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "sender", Host: "example.com"}
+	e.RcptTo = []mail.Address{{User: "a", Host: "grr.la"}, {User: "b", Host: "grr.la"}}
+	e.DeliveryHeader = "Received: from test\r\n"
+	return NewItem(e)
+}
+
+func TestPutGetRemove(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := testItem()
+	if err = s.Put(item, strings.NewReader("Subject: test\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if item.ID == "" || item.Size != 24 {
+		t.Error("expecting an ID and size to be set, got", item.ID, item.Size)
+	}
+	got, err := s.Get(item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.RcptTo) != 2 || got.RcptTo[1].String() != "b@grr.la" || got.MailFrom.String() != "sender@example.com" {
+		t.Error("envelope not saved correctly, got", got)
+	}
+	e := got.Envelope()
+	if e.DeliveryHeader != item.DeliveryHeader || len(e.RcptTo) != 2 {
+		t.Error("envelope not restored correctly")
+	}
+	r, err := s.Message(item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	_ = r.Close()
+	if string(data) != "Subject: test\r\n\r\nhello\r\n" {
+		t.Error("unexpected message data:", string(data))
+	}
+	items, _ := s.List()
+	if len(items) != 1 {
+		t.Error("expecting 1 item, got", len(items))
+	}
+	if err = s.Remove(item.ID); err != nil {
+		t.Error(err)
+	}
+	if _, err = s.Get(item.ID); err != ErrNotFound {
+		t.Error("expecting ErrNotFound, got", err)
+	}
+	if _, err = s.Get("../../etc/passwd"); err != ErrInvalidID {
+		t.Error("expecting ErrInvalidID, got", err)
+	}
+}
+
+func TestFailRetry(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := testItem()
+	if err = s.Put(item, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	item.Failed = []Failure{{Rcpt: item.RcptTo[1], Code: 550, Msg: "5.1.1 No such user"}}
+	item.RcptTo = item.RcptTo[:1]
+	if err = s.Fail(item); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := s.List(); len(items) != 0 {
+		t.Error("expecting the queue to be empty")
+	}
+	failed, _ := s.ListFailed()
+	if len(failed) != 1 || len(failed[0].Failed) != 1 || failed[0].Failed[0].Code != 550 {
+		t.Fatal("expecting the item to be failed, got", failed)
+	}
+	if _, err = s.Message(item.ID); err != nil {
+		t.Error("expecting the message of a failed item to be readable, got", err)
+	}
+	retried, err := s.Retry(item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retried.RcptTo) != 2 || len(retried.Failed) != 0 {
+		t.Error("expecting all recipients to be queued again, got", retried.RcptTo)
+	}
+	if failed, _ = s.ListFailed(); len(failed) != 0 {
+		t.Error("expecting no failed items")
+	}
+	if _, err = s.Get(item.ID); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockItem(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := testItem()
+	if err = s.Put(item, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if s.IsLocked(item.ID) {
+		t.Error("expecting the item not to be locked")
+	}
+	if err = s.LockItem(item.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsLocked(item.ID) {
+		t.Error("expecting the item to be locked")
+	}
+	// another process using the spool
+	other, _ := Open(s.Dir())
+	if err = other.LockItem(item.ID); err != ErrLocked {
+		t.Error("expecting ErrLocked, got", err)
+	}
+	if err = s.UnlockItem(item.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = other.LockItem(item.ID); err != nil {
+		t.Error("expecting the item to be unlocked, got", err)
+	}
+	if err = s.LockItem("../x"); err != ErrInvalidID {
+		t.Error("expecting ErrInvalidID, got", err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := testItem()
+	if err = s.Put(complete, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	moved := testItem()
+	if err = s.Put(moved, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// interrupted while moving to failed, after the message was moved
+	if err = os.Rename(filepath.Join(dir, moved.ID+msgExt), filepath.Join(dir, failedDir, moved.ID+msgExt)); err != nil {
+		t.Fatal(err)
+	}
+	// interrupted while queuing
+	for _, name := range []string{"abc" + msgExt, "def" + msgExt + tmpExt, "ghi" + metaExt, "jkl" + lockExt} {
+		if err = os.WriteFile(filepath.Join(dir, name), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the locks of this process are stale, the lock of the parent process is kept
+	if err = os.WriteFile(filepath.Join(dir, "mno"+lockExt), []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+	running := filepath.Join(dir, complete.ID+lockExt)
+	if err = os.WriteFile(running, []byte(fmt.Sprintf("%d\n", os.Getppid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(running); err != nil {
+		t.Error("expecting the lock of a running process to be kept")
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), complete.ID) {
+			t.Error("expecting file to be removed:", entry.Name())
+		}
+	}
+	if items, _ := s.List(); len(items) != 1 || items[0].ID != complete.ID {
+		t.Error("expecting the complete item to be queued, got", items)
+	}
+	if failed, _ := s.ListFailed(); len(failed) != 1 || failed[0].ID != moved.ID {
+		t.Error("expecting the moved item to be failed, got", failed)
+	}
+}
@@ -133,6 +133,7 @@ type Responses struct {
 	FailReadErrorDataCmd         *Response
 	FailPathTooLong              *Response
 	FailInvalidAddress           *Response
+	FailInvalidDSNParam          *Response
 	FailLocalPartTooLong         *Response
 	FailDomainTooLong            *Response
 	FailBackendNotRunning        *Response
@@ -310,6 +311,13 @@ func init() {
 		Comment:      "Invalid address",
 	}
 
+	Canned.FailInvalidDSNParam = &Response{
+		EnhancedCode: InvalidCommandArguments,
+		BasicCode:    501,
+		Class:        ClassPermanentFailure,
+		Comment:      "Invalid DSN parameter:",
+	}
+
 	Canned.FailLocalPartTooLong = &Response{
 		EnhancedCode: InvalidCommandArguments,
 		BasicCode:    550,
@@ -2,6 +2,7 @@ package guerrilla
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
@@ -11,6 +12,8 @@ import (
 	"net/netip"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,8 +24,10 @@ import (
 	"github.com/phires/go-guerrilla/backends"
 	"github.com/phires/go-guerrilla/log"
 	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/mail/dsn"
 	"github.com/phires/go-guerrilla/mail/rfc5321"
 	"github.com/phires/go-guerrilla/response"
+	"github.com/phires/go-guerrilla/tracing"
 )
 
 const (
@@ -41,8 +46,27 @@ const (
 	ServerStateRunning
 	// Server could not start due to an error
 	ServerStateStartError
+	// Server stopped accepting clients, and will stop when the connected ones leave
+	ServerStateDraining
 )
 
+// serverStateName returns the name of a server state, eg. "running"
+func serverStateName(state int) string {
+	switch state {
+	case ServerStateNew:
+		return "new"
+	case ServerStateStopped:
+		return "stopped"
+	case ServerStateRunning:
+		return "running"
+	case ServerStateStartError:
+		return "start_error"
+	case ServerStateDraining:
+		return "draining"
+	}
+	return "unknown"
+}
+
 // Server listens for SMTP clients on the port specified in its config
 type server struct {
 	configStore     atomic.Value // stores guerrilla.ServerConfig
@@ -55,12 +79,16 @@ type server struct {
 	listener       net.Listener
 	closedListener chan bool
 	hosts          allowedHosts // stores map[string]bool for faster lookup
-	state          int
+	state          int32        // one of the ServerState constants, see getState
 	// If log changed after a config reload, newLogStore stores the value here until it's safe to change it
 	logStore     atomic.Value
 	mainlogStore atomic.Value
 	backendStore atomic.Value
 	envelopePool *mail.Pool
+	// events is the bus for the events of the clients, nil to not publish them
+	events *EventHandler
+	// shutdownGuard serializes Shutdown, so that only one waits for closedListener
+	shutdownGuard sync.Mutex
 }
 
 type allowedHosts struct {
@@ -203,6 +231,24 @@ func (s *server) backend() backends.Backend {
 	return nil
 }
 
+// process saves the envelope, with the context of the transaction if the backend takes it
+func (s *server) process(ctx context.Context, e *mail.Envelope) backends.Result {
+	b := s.backend()
+	if cb, ok := b.(backends.ContextBackend); ok {
+		return cb.ProcessContext(ctx, e, backends.TaskSaveMail)
+	}
+	return b.Process(e, backends.TaskSaveMail)
+}
+
+// validateRcpt validates the last recipient, with the context of the transaction if the backend takes it
+func (s *server) validateRcpt(ctx context.Context, e *mail.Envelope) backends.RcptError {
+	b := s.backend()
+	if cb, ok := b.(backends.ContextBackend); ok {
+		return cb.ValidateRcptContext(ctx, e)
+	}
+	return b.ValidateRcpt(e)
+}
+
 // Set the timeout for the server and all clients
 func (s *server) setTimeout(seconds int) {
 	duration := time.Duration(int64(seconds))
@@ -244,17 +290,22 @@ func (s *server) setAllowedHosts(allowedHosts []string) {
 // Begin accepting SMTP clients. Will block unless there is an error or server.Shutdown() is called
 func (s *server) Start(startWG *sync.WaitGroup) error {
 	var clientID uint64 = 0
+	select {
+	case <-s.closedListener:
+		// a server that was drained signalled that it stopped, without Shutdown waiting for it
+	default:
+	}
 
 	listener, err := net.Listen("tcp", s.listenInterface)
 	s.listener = listener
 	if err != nil {
+		s.setState(ServerStateStartError)
 		startWG.Done() // don't wait for me
-		s.state = ServerStateStartError
 		return fmt.Errorf("[%s] Cannot listen on port: %s ", s.listenInterface, err.Error())
 	}
 
 	s.log().Infof("Listening on TCP %s", s.listenInterface)
-	s.state = ServerStateRunning
+	s.setState(ServerStateRunning)
 	startWG.Done() // start successful, don't wait for me
 
 	for {
@@ -264,11 +315,17 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 		if err != nil {
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
 				s.log().Infof("Server [%s] has stopped accepting new clients", s.listenInterface)
-				// the listener has been closed, wait for clients to exit
-				s.log().Infof("shutting down pool [%s]", s.listenInterface)
-				s.clientPool.ShutdownState()
+				if s.getState() == ServerStateDraining {
+					// let the clients finish, Shutdown may still tell them to leave
+					s.log().Infof("draining pool [%s]", s.listenInterface)
+					s.clientPool.DrainWait()
+				} else {
+					// the listener has been closed, wait for clients to exit
+					s.log().Infof("shutting down pool [%s]", s.listenInterface)
+					s.clientPool.ShutdownState()
+				}
 				s.clientPool.ShutdownWait()
-				s.state = ServerStateStopped
+				s.setState(ServerStateStopped)
 				s.closedListener <- true
 				return nil
 			}
@@ -282,6 +339,7 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 				s.envelopePool.Return(c.Envelope)
 				s.clientPool.Return(c)
 			} else {
+				metricConnections.With(s.listenInterface, "rejected").Inc()
 				s.log().WithError(borrowErr).Info("couldn't borrow a new client")
 				// we could not get a client, so close the connection.
 				_ = conn.Close()
@@ -295,6 +353,16 @@ func (s *server) Start(startWG *sync.WaitGroup) error {
 }
 
 func (s *server) Shutdown() {
+	s.shutdownGuard.Lock()
+	defer s.shutdownGuard.Unlock()
+	if s.getState() == ServerStateStopped {
+		// eg. it was shut down while waiting for the guard
+		return
+	}
+	if s.getState() == ServerStateDraining {
+		// the clients being drained are told to leave
+		s.clientPool.ShutdownState()
+	}
 	if s.listener != nil {
 		// This will cause Start function to return, by causing an error on listener.Accept
 		_ = s.listener.Close()
@@ -305,14 +373,55 @@ func (s *server) Shutdown() {
 		s.clientPool.ShutdownState()
 		// listener already closed, wait for clients to exit
 		s.clientPool.ShutdownWait()
-		s.state = ServerStateStopped
+		s.setState(ServerStateStopped)
 	}
 }
 
+// Drain stops accepting clients, the server stops when the connected clients have left
+func (s *server) Drain() {
+	s.setState(ServerStateDraining)
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+}
+
+// getState returns the state of the server, goroutine safe
+func (s *server) getState() int {
+	return int(atomic.LoadInt32(&s.state))
+}
+
+func (s *server) setState(state int) {
+	atomic.StoreInt32(&s.state, int32(state))
+}
+
 func (s *server) GetActiveClientsCount() int {
 	return s.clientPool.GetActiveClientsCount()
 }
 
+// clients returns the connected clients, sorted by id
+func (s *server) clients() []ClientInfo {
+	clients := make([]ClientInfo, 0)
+	s.clientPool.activeClients.mapAll(func(p Poolable) {
+		if c, ok := p.(*client); ok {
+			clients = append(clients, c.getInfo())
+		}
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// killClient disconnects a client, it returns false if the client is not connected
+func (s *server) killClient(id uint64) bool {
+	found := false
+	s.clientPool.activeClients.mapAll(func(p Poolable) {
+		if c, ok := p.(*client); ok && c.getID() == id {
+			found = true
+			c.disconnect()
+		}
+	})
+	return found
+}
+
 // Verifies that the host is a valid recipient.
 // host checking turned off if there is a single entry and it's a dot.
 func (s *server) allowsHost(host string) bool {
@@ -390,6 +499,25 @@ func (s *server) isShuttingDown() bool {
 // Handles an entire client SMTP exchange
 func (s *server) handleClient(client *client) {
 	defer client.closeConn()
+	// ctx is cancelled when the client is done, the contexts of its transactions derive from it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the spans of the session, and of the transaction when there is one
+	ctx, sessionSpan := tracing.Start(ctx, "smtp.session",
+		tracing.String("server", s.listenInterface),
+		tracing.Int("client_id", int(client.ID)))
+	defer sessionSpan.End()
+	txCtx, txSpan := ctx, (*tracing.Span)(nil)
+	greeted := false
+	defer func() {
+		for _, h := range hooks() {
+			h.OnDisconnect(ctx, client.Envelope)
+		}
+		if greeted {
+			s.publish(EventClientDisconnect, s.connectionEvent(client))
+		}
+		txSpan.End()
+	}()
 	sc := s.configStore.Load().(ServerConfig)
 	s.log().Infof("Handle client [%s], id: %d", client.RemoteIP, client.ID)
 
@@ -398,36 +526,22 @@ func (s *server) handleClient(client *client) {
 		sc.Hostname, Version, client.ID,
 		s.clientPool.GetActiveClientsCount(), time.Now().Format(time.RFC3339))
 
-	helo := fmt.Sprintf("250 %s Hello", sc.Hostname)
-	// ehlo is a multi-line reply and need additional \r\n at the end
-	ehlo := fmt.Sprintf("250-%s Hello\r\n", sc.Hostname)
-
-	// Extended feature advertisements
-	messageSize := fmt.Sprintf("250-SIZE %d\r\n", sc.MaxSize)
-	pipelining := "250-PIPELINING\r\n"
-	advertiseTLS := "250-STARTTLS\r\n"
-	advertiseEnhancedStatusCodes := "250-ENHANCEDSTATUSCODES\r\n"
-	// The last line doesn't need \r\n since string will be printed as a new line.
-	// Also, Last line has no dash -
-	help := "250 HELP"
-
 	if sc.TLS.AlwaysOn {
 		tlsConfig, ok := s.tlsConfigStore.Load().(*tls.Config)
 		if !ok {
 			s.mainlog().Error("Failed to load *tls.Config")
 		} else if err := client.upgradeToTLS(tlsConfig); err == nil {
-			advertiseTLS = ""
+			metricTLS.With(s.listenInterface, "ok").Inc()
+			s.publish(EventClientTLS, s.connectionEvent(client))
 		} else {
+			metricTLS.With(s.listenInterface, "failed").Inc()
 			s.log().WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
 			// server requires TLS, but can't handshake
 			client.kill()
 		}
 	}
-	if !sc.TLS.StartTLSOn {
-		// STARTTLS turned off, don't advertise it
-		advertiseTLS = ""
-	}
 	r := response.Canned
+	ses := &session{c: client, s: s, sc: &sc}
 	for client.isAlive() {
 		switch client.state {
 		case ClientConnected:
@@ -516,6 +630,25 @@ func (s *server) handleClient(client *client) {
 			}
 
 		case ClientGreeting:
+			greeted = true
+			sessionSpan.SetAttributes(tracing.String("remote_ip", client.RemoteIP))
+			s.publish(EventClientConnect, s.connectionEvent(client))
+			var state *tls.ConnectionState
+			if conn, ok := client.conn.(*tls.Conn); ok {
+				cs := conn.ConnectionState()
+				state = &cs
+			}
+			if res := runHooks(func(h backends.SessionHooks) *response.Response {
+				return h.OnConnect(ctx, client.RemoteIP, state)
+			}); res != nil {
+				s.log().Infof("Client [%s] refused at connect: %s", client.RemoteIP, res)
+				metricConnections.With(s.listenInterface, "rejected").Inc()
+				sessionSpan.SetStatus(tracing.StatusError, res.String())
+				client.sendResponse(res)
+				client.kill()
+				break
+			}
+			metricConnections.With(s.listenInterface, "accepted").Inc()
 			client.sendResponse(greeting)
 			client.state = ClientCmd
 
@@ -542,141 +675,22 @@ func (s *server) handleClient(client *client) {
 				client.state = ClientShutdown
 				continue
 			}
-
-			cmdLen := len(input)
-			if cmdLen > CommandVerbMaxLength {
-				cmdLen = CommandVerbMaxLength
+			verb, args := commandVerb(input)
+			if verb == "MAIL" && txSpan == nil && !client.isInTransaction() {
+				txCtx, txSpan = tracing.Start(ctx, "smtp.transaction", tracing.String("remote_ip", client.RemoteIP))
 			}
-			cmd := bytes.ToUpper(input[:cmdLen])
-			switch {
-			case cmdHELO.match(cmd):
-				if h, err := client.parser.Helo(input[4:]); err == nil {
-					client.Helo = h
-				} else {
-					s.log().WithFields(logrus.Fields{"helo": h, "client": client.ID}).Warn("invalid helo")
-					client.sendResponse(r.FailSyntaxError)
-					break
-				}
-				client.resetTransaction()
-				client.sendResponse(helo)
-
-			case cmdEHLO.match(cmd):
-				if h, _, err := client.parser.Ehlo(input[4:]); err == nil {
-					client.Helo = h
-				} else {
-					client.sendResponse(r.FailSyntaxError)
-					s.log().WithFields(logrus.Fields{"ehlo": h, "client": client.ID}).Warn("invalid ehlo")
-					client.sendResponse(r.FailSyntaxError)
-					break
-				}
-				client.ESMTP = true
-				client.resetTransaction()
-				client.sendResponse(ehlo,
-					messageSize,
-					pipelining,
-					advertiseTLS,
-					advertiseEnhancedStatusCodes,
-					help)
-
-			case cmdHELP.match(cmd):
-				quote := response.GetQuote()
-				client.sendResponse("214-OK\r\n", quote)
-
-			case sc.XClientOn && cmdXCLIENT.match(cmd):
-				if toks := bytes.Split(input[8:], []byte{' '}); len(toks) > 0 {
-					for i := range toks {
-						if vals := bytes.Split(toks[i], []byte{'='}); len(vals) == 2 {
-							if bytes.Equal(vals[1], []byte("[UNAVAILABLE]")) {
-								// skip
-								continue
-							}
-							if bytes.Equal(vals[0], []byte("ADDR")) {
-								client.RemoteIP = string(vals[1])
-							}
-							if bytes.Equal(vals[0], []byte("HELO")) {
-								client.Helo = string(vals[1])
-							}
-						}
-					}
-				}
-				client.sendResponse(r.SuccessMailCmd)
-
-			case cmdMAIL.match(cmd):
-				if client.isInTransaction() {
-					client.sendResponse(r.FailNestedMailCmd)
-					break
-				}
-				client.MailFrom, err = client.parsePath(input[10:], client.parser.MailFrom)
-				if err != nil {
-					s.log().WithError(err).Error("MAIL parse error", "["+string(input[10:])+"]")
-					client.sendResponse(err)
-					break
-				} else if client.parser.NullPath {
-					// bounce has empty from address
-					client.MailFrom = mail.Address{}
-				}
-				client.sendResponse(r.SuccessMailCmd)
-
-			case cmdRCPT.match(cmd):
-				if len(client.RcptTo) > rfc5321.LimitRecipients {
-					client.sendResponse(r.ErrorTooManyRecipients)
-					break
-				}
-				to, err := client.parsePath(input[8:], client.parser.RcptTo)
-				if err != nil {
-					s.log().WithError(err).Error("RCPT parse error", "["+string(input[8:])+"]")
-					client.sendResponse(err.Error())
-					break
-				}
-				s.defaultHost(&to)
-				if (to.IP != nil && !s.allowsIp(to.IP)) || (to.IP == nil && !s.allowsHost(to.Host)) {
-					client.sendResponse(r.ErrorRelayDenied, " ", to.Host)
-				} else {
-					client.PushRcpt(to)
-					rcptError := s.backend().ValidateRcpt(client.Envelope)
-					if rcptError != nil {
-						client.PopRcpt()
-						client.sendResponse(r.FailRcptCmd, " ", rcptError.Error())
-					} else {
-						client.sendResponse(r.SuccessRcptCmd)
-					}
-				}
-
-			case cmdRSET.match(cmd):
-				client.resetTransaction()
-				client.sendResponse(r.SuccessResetCmd)
-
-			case cmdVRFY.match(cmd):
-				client.sendResponse(r.SuccessVerifyCmd)
-
-			case cmdNOOP.match(cmd):
-				client.sendResponse(r.SuccessNoopCmd)
-
-			case cmdQUIT.match(cmd):
-				client.sendResponse(r.SuccessQuitCmd)
-				client.kill()
-
-			case cmdDATA.match(cmd):
-				if len(client.RcptTo) == 0 {
-					client.sendResponse(r.FailNoRecipientsDataCmd)
-					break
-				}
-				client.sendResponse(r.SuccessDataCmd)
-				client.state = ClientData
-
-			case sc.TLS.StartTLSOn && cmdSTARTTLS.match(cmd):
+			cmdCtx, cmdSpan := tracing.Start(txCtx, "SMTP "+metricVerb(verb))
 
-				client.sendResponse(r.SuccessStartTLSCmd)
-				client.state = ClientStartTLS
-			default:
-				client.errors++
-				if client.errors >= MaxUnrecognizedCommands {
-					client.sendResponse(r.FailMaxUnrecognizedCmd)
-					client.kill()
-				} else {
-					client.sendResponse(r.FailUnrecognizedCmd)
-				}
+			metricCommands.With(s.listenInterface, metricVerb(verb)).Inc()
+			client.replyCode = ""
+			ses.ctx, ses.verb = cmdCtx, verb
+			if h := commandHandler(verb, s.builtInCommand); h != nil {
+				h(ses, args)
+			} else {
+				s.builtInCommand(ses, args)
 			}
+			traceReply(cmdSpan, client.replyCode)
+			cmdSpan.End()
 
 		case ClientData:
 
@@ -684,31 +698,52 @@ func (s *server) handleClient(client *client) {
 			// if the client goes a little over. Anything above will err
 			client.bufin.setLimit(sc.MaxSize + 1024000) // This a hard limit.
 
+			spillSize := sc.SpillSize
+			if spillSize == 0 {
+				spillSize = defaultSpillSize
+			}
+			client.Data.SetSpill(spillSize, sc.SpillDir)
 			n, err := client.Data.ReadFrom(client.smtpReader.DotReader())
 			if n > sc.MaxSize {
 				err = fmt.Errorf("maximum DATA size exceeded (%d)", sc.MaxSize)
 			}
 			if err != nil {
+				var res backends.Result
 				if err == ErrLineLimitExceeded {
-					client.sendResponse(r.FailReadLimitExceededDataCmd, " ", ErrLineLimitExceeded.Error())
-					client.kill()
+					res = backends.NewResult(r.FailReadLimitExceededDataCmd, " ", ErrLineLimitExceeded.Error())
 				} else if err == ErrMessageSizeExceeded {
-					client.sendResponse(r.FailMessageSizeExceeded, " ", ErrMessageSizeExceeded.Error())
-					client.kill()
+					res = backends.NewResult(r.FailMessageSizeExceeded, " ", ErrMessageSizeExceeded.Error())
 				} else {
-					client.sendResponse(r.FailReadErrorDataCmd, " ", err.Error())
-					client.kill()
+					res = backends.NewResult(r.FailReadErrorDataCmd, " ", err.Error())
 				}
+				s.messageResponse(client, n, res)
+				client.kill()
 				s.log().WithError(err).Warn("Error reading data")
 				client.resetTransaction()
 				break
 			}
 
-			res := s.backend().Process(client.Envelope, backends.TaskSaveMail)
+			if res := s.refused(txCtx, client, "end of DATA", backends.SessionHooks.OnDataEnd); res != nil {
+				s.messageResponse(client, n, backends.NewResult(res))
+				client.state = ClientCmd
+				client.resetTransaction()
+				break
+			}
+
+			processCtx, txCancel := context.WithCancel(txCtx)
+			stopWatching := client.watchConn(txCancel)
+			res := s.process(processCtx, client.Envelope)
+			stopWatching()
+			if processCtx.Err() != nil {
+				s.log().Warnf("Client [%s] disconnected while the backend processed %s", client.RemoteIP, client.QueuedId)
+				client.kill()
+			}
+			txCancel()
 			if res.Code() < 300 {
 				client.messagesSent++
 			}
-			client.sendResponse(res)
+			txSpan.SetAttributes(tracing.String("queued_id", client.QueuedId), tracing.Int("size", int(n)))
+			s.messageResponse(client, n, res)
 			client.state = ClientCmd
 			if s.isShuttingDown() {
 				client.state = ClientShutdown
@@ -721,9 +756,11 @@ func (s *server) handleClient(client *client) {
 				if !ok {
 					s.mainlog().Error("Failed to load *tls.Config")
 				} else if err := client.upgradeToTLS(tlsConfig); err == nil {
-					advertiseTLS = ""
 					client.resetTransaction()
+					metricTLS.With(s.listenInterface, "ok").Inc()
+					s.publish(EventClientTLS, s.connectionEvent(client))
 				} else {
+					metricTLS.With(s.listenInterface, "failed").Inc()
 					s.log().WithError(err).Warnf("[%s] Failed TLS handshake", client.RemoteIP)
 					// Don't disconnect, let the client decide if it wants to continue
 				}
@@ -736,12 +773,23 @@ func (s *server) handleClient(client *client) {
 			client.kill()
 		}
 
+		// the transaction ended, eg. the message was received, or MAIL was refused
+		if txSpan != nil && (!client.isInTransaction() || !client.isAlive()) {
+			traceReply(txSpan, client.replyCode)
+			txSpan.End()
+			txCtx, txSpan = ctx, nil
+		}
+		// before replying, the client waits in its new state
+		client.storeInfo()
 		if client.bufErr != nil {
 			s.log().WithError(client.bufErr).Debug("client could not buffer a response")
 			return
 		}
 		// flush the response buffer
 		if client.bufout.Buffered() > 0 {
+			if code, err := strconv.Atoi(client.replyCode); err == nil && code >= 200 && code < 600 {
+				metricResponses.With(s.listenInterface, client.replyCode).Inc()
+			}
 			if s.log().IsDebug() {
 				s.log().Debugf("Writing response to client: \n%s", client.response.String())
 			}
@@ -755,6 +803,299 @@ func (s *server) handleClient(client *client) {
 	}
 }
 
+// builtInCommand handles the commands of the server. It is the handler that AddCommand replaces
+// and WrapCommand wraps, so it uses the args it is passed rather than the line that was read.
+// ses must be the session given to the wrappers
+func (s *server) builtInCommand(ses Session, args string) {
+	ss := ses.(*session)
+	client, ctx, sc, r := ss.c, ss.ctx, ss.sc, response.Canned
+	// the command line, with the arguments that were passed
+	input := []byte(ss.verb)
+	if args != "" {
+		input = append(append(input, ' '), args...)
+	}
+	cmdLen := len(input)
+	if cmdLen > CommandVerbMaxLength {
+		cmdLen = CommandVerbMaxLength
+	}
+	cmd := bytes.ToUpper(input[:cmdLen])
+	switch {
+	case cmdHELO.match(cmd):
+		if h, err := client.parser.Helo(input[4:]); err == nil {
+			client.Helo = h
+		} else {
+			s.log().WithFields(logrus.Fields{"helo": h, "client": client.ID}).Warn("invalid helo")
+			client.sendResponse(r.FailSyntaxError)
+			break
+		}
+		client.resetTransaction()
+		if res := s.refused(ctx, client, "HELO", backends.SessionHooks.OnHelo); res != nil {
+			client.Helo = ""
+			client.sendResponse(res)
+			break
+		}
+		client.sendResponse(fmt.Sprintf("250 %s Hello", sc.Hostname))
+
+	case cmdEHLO.match(cmd):
+		if h, _, err := client.parser.Ehlo(input[4:]); err == nil {
+			client.Helo = h
+		} else {
+			client.sendResponse(r.FailSyntaxError)
+			s.log().WithFields(logrus.Fields{"ehlo": h, "client": client.ID}).Warn("invalid ehlo")
+			client.sendResponse(r.FailSyntaxError)
+			break
+		}
+		client.ESMTP = true
+		client.resetTransaction()
+		if res := s.refused(ctx, client, "EHLO", backends.SessionHooks.OnHelo); res != nil {
+			client.Helo = ""
+			client.sendResponse(res)
+			break
+		}
+		client.sendResponse(ehloResponse(client, sc))
+
+	case cmdHELP.match(cmd):
+		quote := response.GetQuote()
+		client.sendResponse("214-OK\r\n", quote)
+
+	case sc.XClientOn && cmdXCLIENT.match(cmd):
+		if toks := bytes.Split(input[8:], []byte{' '}); len(toks) > 0 {
+			for i := range toks {
+				if vals := bytes.Split(toks[i], []byte{'='}); len(vals) == 2 {
+					if bytes.Equal(vals[1], []byte("[UNAVAILABLE]")) {
+						// skip
+						continue
+					}
+					if bytes.Equal(vals[0], []byte("ADDR")) {
+						client.RemoteIP = string(vals[1])
+					}
+					if bytes.Equal(vals[0], []byte("HELO")) {
+						client.Helo = string(vals[1])
+					}
+				}
+			}
+		}
+		client.sendResponse(r.SuccessMailCmd)
+
+	case cmdMAIL.match(cmd):
+		if client.isInTransaction() {
+			client.sendResponse(r.FailNestedMailCmd)
+			break
+		}
+		from, err := client.parsePath(input[10:], client.parser.MailFrom)
+		if err != nil {
+			s.log().WithError(err).Error("MAIL parse error", "["+string(input[10:])+"]")
+			client.sendResponse(err)
+			break
+		}
+		client.MailFrom = from
+		if sc.DSN {
+			// the parameters are only checked when the extension is advertised
+			if err := dsn.CheckMailParams(client.MailFrom.PathParams); err != nil {
+				client.MailFrom = mail.Address{}
+				client.sendResponse(r.FailInvalidDSNParam, " ", err.Error())
+				break
+			}
+		}
+		if res := s.refused(ctx, client, "MAIL", backends.SessionHooks.OnMailFrom); res != nil {
+			client.MailFrom = mail.Address{}
+			client.sendResponse(res)
+			break
+		}
+		s.publish(EventTransactionStart, s.transactionEvent(client, nil))
+		client.sendResponse(r.SuccessMailCmd)
+
+	case cmdRCPT.match(cmd):
+		if len(client.RcptTo) > rfc5321.LimitRecipients {
+			client.sendResponse(r.ErrorTooManyRecipients)
+			break
+		}
+		to, err := client.parsePath(input[8:], client.parser.RcptTo)
+		if err != nil {
+			s.log().WithError(err).Error("RCPT parse error", "["+string(input[8:])+"]")
+			client.sendResponse(err.Error())
+			break
+		}
+		if sc.DSN {
+			if err := dsn.CheckRcptParams(to.PathParams); err != nil {
+				client.sendResponse(r.FailInvalidDSNParam, " ", err.Error())
+				break
+			}
+		}
+		s.defaultHost(&to)
+		if (to.IP != nil && !s.allowsIp(to.IP)) || (to.IP == nil && !s.allowsHost(to.Host)) {
+			s.rcptResponse(client, to, r.ErrorRelayDenied, " ", to.Host)
+		} else {
+			client.PushRcpt(to)
+			if res := s.refused(ctx, client, "RCPT", backends.SessionHooks.OnRcptTo); res != nil {
+				client.PopRcpt()
+				s.rcptResponse(client, to, res)
+				break
+			}
+			rcptError := s.validateRcpt(ctx, client.Envelope)
+			if rcptError != nil {
+				client.PopRcpt()
+				if msg := rcptError.Error(); len(msg) > 3 && msg[3] == ' ' && isReplyCode(msg[:3]) {
+					// the backend gave its own reply, eg. a temporary failure
+					s.rcptResponse(client, to, msg)
+				} else {
+					s.rcptResponse(client, to, r.FailRcptCmd, " ", msg)
+				}
+			} else {
+				s.rcptResponse(client, to, r.SuccessRcptCmd)
+			}
+		}
+
+	case cmdRSET.match(cmd):
+		client.resetTransaction()
+		client.sendResponse(r.SuccessResetCmd)
+
+	case cmdVRFY.match(cmd):
+		client.sendResponse(r.SuccessVerifyCmd)
+
+	case cmdNOOP.match(cmd):
+		client.sendResponse(r.SuccessNoopCmd)
+
+	case cmdQUIT.match(cmd):
+		client.sendResponse(r.SuccessQuitCmd)
+		client.kill()
+
+	case cmdDATA.match(cmd):
+		if len(client.RcptTo) == 0 {
+			client.sendResponse(r.FailNoRecipientsDataCmd)
+			break
+		}
+		if res := s.refused(ctx, client, "DATA", backends.SessionHooks.OnDataStart); res != nil {
+			client.sendResponse(res)
+			break
+		}
+		client.sendResponse(r.SuccessDataCmd)
+		client.state = ClientData
+
+	case sc.TLS.StartTLSOn && cmdSTARTTLS.match(cmd):
+
+		client.sendResponse(r.SuccessStartTLSCmd)
+		client.state = ClientStartTLS
+	default:
+		client.errors++
+		if client.errors >= MaxUnrecognizedCommands {
+			client.sendResponse(r.FailMaxUnrecognizedCmd)
+			client.kill()
+		} else {
+			client.sendResponse(r.FailUnrecognizedCmd)
+		}
+	}
+}
+
+// ehloResponse returns the reply to EHLO, with the extensions offered to the client
+func ehloResponse(client *client, sc *ServerConfig) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "250-%s Hello\r\n", sc.Hostname)
+	fmt.Fprintf(&b, "250-SIZE %d\r\n", sc.MaxSize)
+	b.WriteString("250-PIPELINING\r\n")
+	if sc.TLS.StartTLSOn && !client.TLS {
+		b.WriteString("250-STARTTLS\r\n")
+	}
+	b.WriteString("250-ENHANCEDSTATUSCODES\r\n")
+	if sc.DSN {
+		b.WriteString("250-DSN\r\n")
+	}
+	b.WriteString(ehloExtensions())
+	// the last line has no dash
+	b.WriteString("250 HELP")
+	return b.String()
+}
+
+// refused calls a session hook of a stage, eg. backends.SessionHooks.OnHelo,
+// and returns the reply if a hook refused the stage
+func (s *server) refused(
+	ctx context.Context,
+	client *client,
+	stage string,
+	hook func(backends.SessionHooks, context.Context, *mail.Envelope) *response.Response) *response.Response {
+	res := runHooks(func(h backends.SessionHooks) *response.Response {
+		return hook(h, ctx, client.Envelope)
+	})
+	if res != nil {
+		s.log().WithFields(logrus.Fields{"client": client.ID, "stage": stage}).Infof("Client [%s] refused: %s", client.RemoteIP, res)
+	}
+	return res
+}
+
+// traceReply tags a span with the code of the reply, an error if the code is 4xx or 5xx
+func traceReply(span *tracing.Span, replyCode string) {
+	code, err := strconv.Atoi(replyCode)
+	if err != nil {
+		return
+	}
+	span.SetAttributes(tracing.Int("smtp.code", code))
+	if code >= 400 {
+		span.SetStatus(tracing.StatusError, "reply "+replyCode)
+	}
+}
+
+// publish publishes an event of a client, if the server has an event bus
+func (s *server) publish(topic Event, arg interface{}) {
+	if s.events != nil {
+		s.events.Publish(topic, arg)
+	}
+}
+
+// connectionEvent returns the argument of the events of a client
+func (s *server) connectionEvent(client *client) *ConnectionEvent {
+	ev := &ConnectionEvent{
+		ClientID: client.ID,
+		Server:   s.listenInterface,
+		RemoteIP: client.RemoteIP,
+	}
+	if conn, ok := client.conn.(*tls.Conn); ok && client.TLS {
+		state := conn.ConnectionState()
+		ev.TLSVersion = tls.VersionName(state.Version)
+		ev.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	}
+	return ev
+}
+
+// transactionEvent returns the argument of the events of a transaction, with the reply if there is one
+func (s *server) transactionEvent(client *client, res backends.Result) *TransactionEvent {
+	ev := &TransactionEvent{
+		ConnectionEvent: *s.connectionEvent(client),
+		QueuedID:        client.QueuedId,
+		MailFrom:        client.MailFrom,
+	}
+	if res != nil {
+		ev.Code = res.Code()
+		ev.Reply = res.String()
+	}
+	return ev
+}
+
+// rcptResponse sends the reply to RCPT, and publishes whether the recipient was accepted
+func (s *server) rcptResponse(client *client, to mail.Address, r ...interface{}) {
+	res := backends.NewResult(r...)
+	ev := s.transactionEvent(client, res)
+	ev.Rcpt = to
+	if res.Code() < 300 {
+		s.publish(EventRcptAccepted, ev)
+	} else {
+		s.publish(EventRcptRejected, ev)
+	}
+	client.sendResponse(res)
+}
+
+// messageResponse sends the reply to the end of DATA, and publishes whether the message of size bytes was accepted
+func (s *server) messageResponse(client *client, size int64, res backends.Result) {
+	ev := s.transactionEvent(client, res)
+	ev.Size = size
+	metricMessageSize.With(s.listenInterface).Observe(float64(size))
+	if res.Code() < 300 {
+		s.publish(EventMessageAccepted, ev)
+	} else {
+		s.publish(EventMessageRejected, ev)
+	}
+	client.sendResponse(res)
+}
+
 func (s *server) log() log.Logger {
 	return s.loadLog(&s.logStore)
 }
@@ -795,3 +1136,10 @@ func (s *server) defaultHost(a *mail.Address) {
 		}
 	}
 }
+
+// isReplyCode returns true if s is a 4xx or 5xx SMTP reply code. A recipient validation
+// error that starts with one is sent to the client as it is
+func isReplyCode(s string) bool {
+	code, err := strconv.Atoi(s)
+	return err == nil && code >= 400 && code < 600
+}
@@ -1,8 +1,10 @@
 package guerrilla
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
 
 	"bufio"
 	"net/textproto"
@@ -906,6 +908,64 @@ func TestXClient(t *testing.T) {
 	wg.Wait() // wait for handleClient to exit
 }
 
+func TestDSNParams(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	sc := getMockServerConfig()
+	sc.DSN = true
+	mainlog, _ := log.GetLogger(sc.LogFile, "debug")
+	conn, server := getMockServerConn(sc, t)
+	server.setAllowedHosts([]string{"grr.la"})
+	if err := server.backend().Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.backend().Shutdown() }()
+	client := NewClient(conn.Server, 1, mainlog, mail.NewPool(5))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		server.handleClient(client)
+		wg.Done()
+	}()
+	r := textproto.NewReader(bufio.NewReader(conn.Client))
+	w := textproto.NewWriter(bufio.NewWriter(conn.Client))
+	_, _ = r.ReadLine()
+	if err := w.PrintfLine("EHLO test.test.com"); err != nil {
+		t.Error(err)
+	}
+	if _, ehlo, err := r.ReadResponse(250); err != nil {
+		t.Error(err)
+	} else if !strings.Contains(ehlo, "\nDSN\n") {
+		t.Error("expecting DSN to be advertised, got:", ehlo)
+	}
+
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"MAIL FROM:<test@grr.la> RET=BODY", "501 5.5.4 Invalid DSN parameter: RET must be"},
+		{"MAIL FROM:<test@grr.la> ENVID=a+2", "501 5.5.4 Invalid DSN parameter: ENVID must be"},
+		{"MAIL FROM:<test@grr.la> RET=HDRS RET=FULL", "501 5.5.4 Invalid DSN parameter: duplicate RET"},
+		{"MAIL FROM:<test@grr.la> RET=hdrs ENVID=QQ+2B314", "250 2.1.0 OK"},
+		{"RCPT TO:<test@grr.la> NOTIFY=NEVER,DELAY", "501 5.5.4 Invalid DSN parameter: NOTIFY=NEVER"},
+		{"RCPT TO:<test@grr.la> NOTIFY=SOMETIMES", "501 5.5.4 Invalid DSN parameter: NOTIFY must be"},
+		{"RCPT TO:<test@grr.la> ORCPT=test@test.com", "501 5.5.4 Invalid DSN parameter: ORCPT must be"},
+		{"RCPT TO:<test@grr.la> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;test+40grr.la", "250 2.1.5 OK"},
+	}
+	for _, tt := range tests {
+		if err := w.PrintfLine(tt.cmd); err != nil {
+			t.Error(err)
+		}
+		if line, _ := r.ReadLine(); !strings.HasPrefix(line, tt.expected) {
+			t.Error(tt.cmd, "expected", tt.expected, "but got:", line)
+		}
+	}
+	if err := w.PrintfLine("QUIT"); err != nil {
+		t.Error(err)
+	}
+	_, _ = r.ReadLine()
+	wg.Wait()
+}
+
 func TestProxy(t *testing.T) {
 	var mainlog log.Logger
 	var logOpenError error
@@ -1207,3 +1267,61 @@ func TestAllowsHosts(t *testing.T) {
 	s.setAllowedHosts([]string{"grr.la", "example.com"})
 
 }
+
+// The context of the transaction should be cancelled when the client disconnects
+// while the backend processes the message
+func TestClientDisconnect(t *testing.T) {
+	defer cleanTestArtifacts(t)
+	cancelled := make(chan error, 1)
+	cfg := &AppConfig{
+		LogFile:      log.OutputOff.String(),
+		AllowedHosts: []string{"grr.la"},
+		BackendConfig: backends.BackendConfig{
+			"save_workers_size": 1,
+			"save_process":      "HeadersParser|WaitCtx",
+			"gw_save_timeout":   "5s",
+		},
+	}
+	d := Daemon{Config: cfg}
+	d.AddProcessor("WaitCtx", func() backends.Decorator {
+		return func(p backends.Processor) backends.Processor {
+			return backends.ProcessWithContext(
+				func(ctx context.Context, e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+					<-ctx.Done()
+					cancelled <- ctx.Err()
+					return nil, ctx.Err()
+				})
+		}
+	})
+	if err := d.Start(); err != nil {
+		t.Fatal("server didn't start", err)
+	}
+	defer d.Shutdown()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := bufio.NewReader(conn)
+	for _, cmd := range []string{"", "HELO host\r\n", "MAIL FROM:<test@example.com>\r\n", "RCPT TO:<test@grr.la>\r\n", "DATA\r\n"} {
+		if _, err := fmt.Fprint(conn, cmd); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := in.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fmt.Fprint(conn, "Subject: Test subject\r\n\r\nA an email body\r\n.\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_ = conn.Close()
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Error("expecting the context to be cancelled, got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("the context was not cancelled after the client disconnected")
+	}
+}
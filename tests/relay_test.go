@@ -0,0 +1,238 @@
+package test
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phires/go-guerrilla"
+	"github.com/phires/go-guerrilla/backends"
+	"github.com/phires/go-guerrilla/log"
+	"github.com/phires/go-guerrilla/mail"
+	"github.com/phires/go-guerrilla/tests/testcert"
+)
+
+const relayTestHost = "relay.test"
+
+// relayCaptured receives the envelopes saved by the downstream server
+var relayCaptured = make(chan *mail.Envelope, 10)
+
+// relayCapture is a processor for the downstream server. It rejects recipients with
+// the user 'nobody' and sends a copy of each saved envelope to relayCaptured
+var relayCapture = func() backends.Decorator {
+	return func(p backends.Processor) backends.Processor {
+		return backends.ProcessWith(
+			func(e *mail.Envelope, task backends.SelectTask) (backends.Result, error) {
+				if task == backends.TaskValidateRcpt {
+					if rcpt := e.RcptTo[len(e.RcptTo)-1]; rcpt.User == "nobody" {
+						return backends.NewResult("550 5.1.1 No such user"), backends.NoSuchUser
+					}
+				}
+				if task == backends.TaskSaveMail {
+					c := mail.NewEnvelope(e.RemoteIP, 1)
+					c.MailFrom = e.MailFrom
+					c.RcptTo = append(c.RcptTo, e.RcptTo...)
+					c.TLS = e.TLS
+					c.Data.Write(e.Data.Bytes())
+					relayCaptured <- c
+				}
+				return p.Process(e, task)
+			})
+	}
+}
+
+func startRelayDownstream(t *testing.T) *guerrilla.Daemon {
+	if err := testcert.GenerateCert(relayTestHost, "", 365*24*time.Hour, false, 2048, "P256", "./"); err != nil {
+		t.Fatal(err)
+	}
+	d := &guerrilla.Daemon{Config: &guerrilla.AppConfig{
+		LogFile:      "./testlog",
+		AllowedHosts: []string{"grr.la"},
+		Servers: []guerrilla.ServerConfig{
+			{
+				Hostname:        relayTestHost,
+				ListenInterface: "127.0.0.1:2630",
+				IsEnabled:       true,
+				MaxSize:         100000,
+				Timeout:         30,
+				MaxClients:      10,
+				TLS: guerrilla.ServerTLSConfig{
+					StartTLSOn:     true,
+					PrivateKeyFile: relayTestHost + ".key.pem",
+					PublicKeyFile:  relayTestHost + ".cert.pem",
+				},
+			},
+		},
+		BackendConfig: backends.BackendConfig{
+			"save_process":      "RelayCapture",
+			"validate_process":  "RelayCapture",
+			"save_workers_size": 1,
+		},
+	}}
+	d.AddProcessor("RelayCapture", relayCapture)
+	if err := d.Start(); err != nil {
+		t.Fatal("could not start downstream server", err)
+	}
+	return d
+}
+
+func newRelayBackend(t *testing.T, cfg backends.BackendConfig) backends.Backend {
+	l, _ := log.GetLogger("./testlog", "debug")
+	// the DSN processor reports the recipients that failed, it sends nothing without a dsn_process
+	cfg["save_process"] = "DSN|Relay"
+	cfg["dsn_process"] = ""
+	cfg["save_workers_size"] = 1
+	cfg["primary_mail_host"] = "sender.test"
+	gw, err := backends.New(cfg, l)
+	if err != nil {
+		t.Fatal("could not create relay backend", err)
+	}
+	if err = gw.Start(); err != nil {
+		t.Fatal("could not start relay backend", err)
+	}
+	return gw
+}
+
+func newRelayEnvelope(rcpts ...string) *mail.Envelope {
+	e := mail.NewEnvelope("127.0.0.1", 1)
+	e.MailFrom = mail.Address{User: "sender", Host: "sender.test"}
+	for _, rcpt := range rcpts {
+		addr, _ := mail.NewAddress(rcpt)
+		e.RcptTo = append(e.RcptTo, *addr)
+	}
+	e.Data.WriteString("Subject: relay test\r\n\r\nHello from the relay\r\n")
+	return e
+}
+
+func TestRelay(t *testing.T) {
+	d := startRelayDownstream(t)
+	defer func() {
+		d.Shutdown()
+		_ = os.Remove(relayTestHost + ".key.pem")
+		_ = os.Remove(relayTestHost + ".cert.pem")
+	}()
+
+	gw := newRelayBackend(t, backends.BackendConfig{
+		"relay_smarthost":       "127.0.0.1:2630",
+		"relay_starttls":        "required",
+		"relay_tls_skip_verify": true,
+	})
+	defer func() { _ = gw.Shutdown() }()
+
+	// one recipient is accepted, the other rejected by the downstream server
+	e := newRelayEnvelope("test@grr.la", "nobody@grr.la")
+	result := gw.Process(e, backends.TaskSaveMail)
+	if result.Code() != 250 {
+		t.Error("expecting the message to be relayed, got:", result.String())
+	}
+	statuses, ok := e.Values["relay_status"].([]backends.DeliveryStatus)
+	if !ok || len(statuses) != 2 {
+		t.Fatal("expecting a relay_status for each recipient, got:", e.Values["relay_status"])
+	}
+	if !statuses[0].Delivered() || statuses[0].RemoteMTA != "127.0.0.1:2630" {
+		t.Error("expecting test@grr.la to be delivered, got:", statuses[0].String())
+	}
+	if statuses[1].Delivered() || statuses[1].Code != 550 || !strings.Contains(statuses[1].Msg, "5.1.1") {
+		t.Error("expecting nobody@grr.la to be rejected with 550 5.1.1, got:", statuses[1].String())
+	}
+
+	select {
+	case c := <-relayCaptured:
+		if !c.TLS {
+			t.Error("expecting the relay to use STARTTLS")
+		}
+		if len(c.RcptTo) != 1 || c.RcptTo[0].String() != "test@grr.la" {
+			t.Error("expecting only test@grr.la to be received downstream, got:", c.RcptTo)
+		}
+		if c.MailFrom.String() != "sender@sender.test" {
+			t.Error("unexpected MAIL FROM:", c.MailFrom.String())
+		}
+		if !strings.Contains(c.Data.String(), "Hello from the relay") {
+			t.Error("message data not relayed, got:", c.Data.String())
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("downstream server did not receive the message")
+	}
+
+	// all recipients rejected, the remote reply is returned
+	e = newRelayEnvelope("nobody@grr.la")
+	result = gw.Process(e, backends.TaskSaveMail)
+	if result.Code() != 550 || !strings.Contains(result.String(), "5.1.1") {
+		t.Error("expecting the remote rejection to be returned, got:", result.String())
+	}
+}
+
+func TestRelayRoutes(t *testing.T) {
+	d := startRelayDownstream(t)
+	defer func() {
+		d.Shutdown()
+		_ = os.Remove(relayTestHost + ".key.pem")
+		_ = os.Remove(relayTestHost + ".cert.pem")
+	}()
+
+	// grr.la is routed to the downstream server, everything else to an unreachable smarthost
+	gw := newRelayBackend(t, backends.BackendConfig{
+		"relay_smarthost": "127.0.0.1:1",
+		"relay_routes":    "grr.la=127.0.0.1:2630",
+		"relay_starttls":  "off",
+		"relay_timeout":   "5s",
+	})
+	defer func() { _ = gw.Shutdown() }()
+
+	e := newRelayEnvelope("test@grr.la", "test@example.com")
+	result := gw.Process(e, backends.TaskSaveMail)
+	if result.Code() != 250 {
+		t.Error("expecting the message to be relayed, got:", result.String())
+	}
+	statuses := e.Values["relay_status"].([]backends.DeliveryStatus)
+	if !statuses[0].Delivered() {
+		t.Error("expecting test@grr.la to be delivered via the route, got:", statuses[0].String())
+	}
+	if !statuses[1].Temporary() || statuses[1].RemoteMTA != "127.0.0.1:1" {
+		t.Error("expecting a temporary failure for test@example.com, got:", statuses[1].String())
+	}
+	select {
+	case c := <-relayCaptured:
+		if c.TLS {
+			t.Error("not expecting STARTTLS when relay_starttls is off")
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("downstream server did not receive the message")
+	}
+
+	// unreachable host only, the client should try again later
+	e = newRelayEnvelope("test@example.com")
+	result = gw.Process(e, backends.TaskSaveMail)
+	if result.Code() != 451 {
+		t.Error("expecting a temporary failure, got:", result.String())
+	}
+}
+
+func TestRelayNullMX(t *testing.T) {
+	lookupMX := backends.RelayLookupMX
+	backends.RelayLookupMX = func(name string) ([]*net.MX, error) {
+		return []*net.MX{{Host: ".", Pref: 0}}, nil
+	}
+	defer func() { backends.RelayLookupMX = lookupMX }()
+
+	gw := newRelayBackend(t, backends.BackendConfig{})
+	defer func() { _ = gw.Shutdown() }()
+	result := gw.Process(newRelayEnvelope("test@nullmx.test"), backends.TaskSaveMail)
+	if result.Code() != 556 || !strings.Contains(result.String(), "5.1.10") {
+		t.Error("expecting a permanent failure for a null MX, got:", result.String())
+	}
+}
+
+func TestRelayWithoutReports(t *testing.T) {
+	l, _ := log.GetLogger("./testlog", "debug")
+	gw, err := backends.New(backends.BackendConfig{
+		"save_process":      "Relay",
+		"save_workers_size": 1,
+	}, l)
+	if err == nil {
+		_ = gw.Shutdown()
+		t.Error("expecting Relay to need the DSN or Queue processor")
+	}
+}
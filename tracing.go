@@ -0,0 +1,36 @@
+package guerrilla
+
+import "github.com/phires/go-guerrilla/tracing"
+
+// startTracing sends the spans to the collector at endpoint, if endpoint is not empty
+func (g *guerrilla) startTracing(endpoint string) {
+	if endpoint == "" {
+		return
+	}
+	g.tracingGuard.Lock()
+	defer g.tracingGuard.Unlock()
+	if g.tracingExporter != nil {
+		return
+	}
+	e := tracing.NewOTLPExporter(endpoint, "go-guerrilla")
+	e.ErrorLog = func(err error) {
+		g.mainlog().WithError(err).Warn("could not send the spans")
+	}
+	g.tracingExporter = e
+	tracing.SetExporter(e)
+	g.mainlog().Infof("Sending spans to %s", endpoint)
+}
+
+// stopTracing sends the spans left and stops tracing, unless the exporter was not set by startTracing
+func (g *guerrilla) stopTracing() {
+	g.tracingGuard.Lock()
+	defer g.tracingGuard.Unlock()
+	if g.tracingExporter == nil {
+		return
+	}
+	tracing.SetExporter(nil)
+	if err := g.tracingExporter.Shutdown(); err != nil {
+		g.mainlog().WithError(err).Warn("tracing exporter failed to shutdown")
+	}
+	g.tracingExporter = nil
+}
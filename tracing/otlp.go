@@ -0,0 +1,241 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// otlpBatchSize is the most spans sent in a request
+	otlpBatchSize = 512
+	// otlpQueueSize is the most spans waiting to be sent, the others are dropped
+	otlpQueueSize = 4096
+	// otlpInterval is the longest a span waits to be sent
+	otlpInterval = 2 * time.Second
+)
+
+// OTLPExporter sends the spans in batches to an OpenTelemetry collector, with OTLP over HTTP in JSON
+type OTLPExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	queue   chan *SpanData
+	done    chan struct{}
+	// ErrorLog is called when a batch could not be sent, it may be nil
+	ErrorLog func(err error)
+	// closed is true after Shutdown, the spans that end later are dropped
+	closed bool
+	sync.RWMutex
+}
+
+// NewOTLPExporter returns an exporter to endpoint, eg. "http://127.0.0.1:4318".
+// The spans are posted to endpoint/v1/traces, unless the endpoint has a path.
+// service is the service.name of the spans
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if i := strings.Index(url, "://"); i == -1 || !strings.Contains(url[i+3:], "/") {
+		url += "/v1/traces"
+	}
+	o := &OTLPExporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan *SpanData, otlpQueueSize),
+		done:    make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+// Export queues the span, it is dropped if the queue is full
+func (o *OTLPExporter) Export(s *SpanData) {
+	o.RLock()
+	defer o.RUnlock()
+	if o.closed {
+		return
+	}
+	select {
+	case o.queue <- s:
+	default:
+	}
+}
+
+// Shutdown sends the spans left and stops
+func (o *OTLPExporter) Shutdown() error {
+	o.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.queue)
+	}
+	o.Unlock()
+	<-o.done
+	return nil
+}
+
+func (o *OTLPExporter) run() {
+	defer close(o.done)
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+	batch := make([]*SpanData, 0, otlpBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := o.send(batch); err != nil && o.ErrorLog != nil {
+			o.ErrorLog(err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s, ok := <-o.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) == otlpBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send posts a batch to the collector
+func (o *OTLPExporter) send(batch []*SpanData) error {
+	body, err := json.Marshal(o.request(batch))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not send %d spans: %w", len(batch), err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("could not send %d spans: %s", len(batch), resp.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    string   `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// spanKindServer is the kind of the spans, they are all parts of serving a client
+const spanKindServer = 2
+
+func (o *OTLPExporter) request(batch []*SpanData) otlpRequest {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              spanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+			Status:            otlpStatus{Code: s.Status, Message: s.StatusMessage},
+		}
+		if s.ParentSpanID != [8]byte{} {
+			spans[i].ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{String("service.name", o.service)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/phires/go-guerrilla"}, Spans: spans}},
+	}}}
+}
+
+func otlpAttributes(attrs []Attribute) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch val := a.Value.(type) {
+		case string:
+			v.StringValue = &val
+		case bool:
+			v.BoolValue = &val
+		case int:
+			v.IntValue = strconv.Itoa(val)
+		case int64:
+			v.IntValue = strconv.FormatInt(val, 10)
+		case float64:
+			v.DoubleValue = &val
+		default:
+			s := fmt.Sprint(val)
+			v.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: a.Key, Value: v})
+	}
+	return out
+}
@@ -0,0 +1,189 @@
+// Package tracing records spans of the SMTP sessions and the processors, and exports them
+// with an Exporter, eg. to an OpenTelemetry collector with the OTLPExporter.
+// Nothing is recorded until an exporter is set with SetExporter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status codes of a span, as in OpenTelemetry
+const (
+	StatusUnset = iota
+	StatusOK
+	StatusError
+)
+
+// Attribute is a key and a value of a span, the value is a string, bool, int, int64 or float64
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute
+func String(key, value string) Attribute {
+	return Attribute{key, value}
+}
+
+// Int returns an int attribute
+func Int(key string, value int) Attribute {
+	return Attribute{key, int64(value)}
+}
+
+// Bool returns a bool attribute
+func Bool(key string, value bool) Attribute {
+	return Attribute{key, value}
+}
+
+// SpanData is a span that ended, as given to the exporter
+type SpanData struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte
+	Name         string
+	Start, End   time.Time
+	Attributes   []Attribute
+	Status       int
+	// StatusMessage describes the error, if the status is StatusError
+	StatusMessage string
+}
+
+// Exporter exports the spans
+type Exporter interface {
+	// Export is called with each span when it ends, it should not block
+	Export(s *SpanData)
+	// Shutdown exports the spans left, and stops
+	Shutdown() error
+}
+
+type exporterHolder struct {
+	Exporter
+}
+
+var exporter atomic.Value
+
+// SetExporter sets the exporter of the spans, nil to stop recording them
+func SetExporter(e Exporter) {
+	exporter.Store(exporterHolder{e})
+}
+
+// current returns the exporter, or nil
+func current() Exporter {
+	if h, ok := exporter.Load().(exporterHolder); ok {
+		return h.Exporter
+	}
+	return nil
+}
+
+// Span is an operation, eg. an SMTP command. A nil span records nothing,
+// so that its methods can be called when there is no exporter
+type Span struct {
+	data     SpanData
+	exporter Exporter
+	ended    bool
+	sync.Mutex
+}
+
+type spanKey struct{}
+
+// FromContext returns the span of the context, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a span, child of the span of ctx if there is one, and returns a context with it.
+// It returns ctx and a nil span if there is no exporter
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	e := current()
+	if e == nil {
+		return ctx, nil
+	}
+	s := &Span{exporter: e}
+	s.data.Name = name
+	s.data.Start = time.Now()
+	s.data.Attributes = attrs
+	if parent := FromContext(ctx); parent != nil {
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentSpanID = parent.data.SpanID
+	} else {
+		_, _ = rand.Read(s.data.TraceID[:])
+	}
+	_, _ = rand.Read(s.data.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// SetStatus sets the status of the span, msg describes the error of StatusError
+func (s *Span) SetStatus(code int, msg string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.data.Status = code
+	s.data.StatusMessage = msg
+}
+
+// End ends the span and exports it, it does nothing if it already ended
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	data.Attributes = append([]Attribute(nil), s.data.Attributes...)
+	s.Unlock()
+	s.exporter.Export(&data)
+}
+
+// MemoryExporter keeps the spans in memory, eg. for tests
+type MemoryExporter struct {
+	spans []*SpanData
+	sync.Mutex
+}
+
+// Export keeps the span
+func (m *MemoryExporter) Export(s *SpanData) {
+	m.Lock()
+	defer m.Unlock()
+	m.spans = append(m.spans, s)
+}
+
+// Shutdown does nothing
+func (m *MemoryExporter) Shutdown() error {
+	return nil
+}
+
+// Spans returns the spans that ended, in the order they ended
+func (m *MemoryExporter) Spans() []*SpanData {
+	m.Lock()
+	defer m.Unlock()
+	return append([]*SpanData(nil), m.spans...)
+}
+
+// Reset drops the spans
+func (m *MemoryExporter) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.spans = nil
+}
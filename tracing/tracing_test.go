@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStart(t *testing.T) {
+	defer SetExporter(nil)
+	if _, s := Start(context.Background(), "off"); s != nil {
+		t.Error("expecting no span without an exporter")
+	}
+	m := &MemoryExporter{}
+	SetExporter(m)
+	ctx, parent := Start(context.Background(), "parent", String("a", "b"))
+	_, child := Start(ctx, "child")
+	child.SetStatus(StatusError, "failed")
+	child.End()
+	parent.SetAttributes(Int("code", 250))
+	parent.End()
+	parent.End()
+	spans := m.Spans()
+	if len(spans) != 2 || spans[0].Name != "child" || spans[1].Name != "parent" {
+		t.Fatal("expecting the child then the parent, got", spans)
+	}
+	if spans[0].TraceID != spans[1].TraceID || spans[0].ParentSpanID != spans[1].SpanID {
+		t.Error("expecting the child to be in the trace of the parent")
+	}
+	if spans[0].Status != StatusError || len(spans[1].Attributes) != 2 {
+		t.Error("unexpected status or attributes", spans[0].Status, spans[1].Attributes)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	defer SetExporter(nil)
+	requests := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Error("unexpected request", r.URL.Path, r.Header)
+		}
+		b, _ := io.ReadAll(r.Body)
+		requests <- b
+	}))
+	defer collector.Close()
+
+	o := NewOTLPExporter(collector.URL, "test")
+	SetExporter(o)
+	ctx, parent := Start(context.Background(), "session", String("remote_ip", "127.0.0.1"))
+	_, child := Start(ctx, "MAIL", Int("code", 250), Bool("tls", false))
+	child.End()
+	parent.End()
+	if err := o.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	var req otlpRequest
+	if err := json.Unmarshal(<-requests, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatal("unexpected request", req)
+	}
+	if v := req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; v == nil || *v != "test" {
+		t.Error("expecting the service name")
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Name != "MAIL" || spans[0].ParentSpanID != spans[1].SpanID || len(spans[0].TraceID) != 32 {
+		t.Fatal("unexpected spans", spans)
+	}
+	if spans[1].ParentSpanID != "" || spans[0].Attributes[0].Value.IntValue != "250" {
+		t.Error("unexpected spans", spans)
+	}
+}